@@ -0,0 +1,231 @@
+// Package anchor is a client for Stellar anchors, the services that exchange fiat for tokens
+// on Stellar. An anchor is found by its home domain: its stellar.toml (SEP-1) lists its
+// endpoints, users are authenticated against it with SEP-10 and deposits and withdrawals are
+// made either interactively in the anchor's web flow (SEP-24) or programmatically (SEP-6)
+// with the KYC information the anchor asks for sent over SEP-12
+package anchor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	toml "github.com/pelletier/go-toml"
+)
+
+// Timeout is the number of seconds after which requests to anchors are abandoned
+var Timeout = 30
+
+// Currency is an asset issued by an anchor
+type Currency struct {
+	Code   string `toml:"code" json:"code"`
+	Issuer string `toml:"issuer" json:"issuer"`
+}
+
+// Info is what an anchor publishes about itself in its stellar.toml
+type Info struct {
+	SigningKey          string     `toml:"SIGNING_KEY" json:"signing_key"`
+	WebAuthEndpoint     string     `toml:"WEB_AUTH_ENDPOINT" json:"web_auth_endpoint"`
+	TransferServer      string     `toml:"TRANSFER_SERVER" json:"transfer_server"`
+	TransferServerSep24 string     `toml:"TRANSFER_SERVER_SEP0024" json:"transfer_server_sep0024"`
+	KYCServer           string     `toml:"KYC_SERVER" json:"kyc_server"`
+	Currencies          []Currency `toml:"CURRENCIES" json:"currencies"`
+}
+
+// Client talks to the anchor at HomeDomain
+type Client struct {
+	HomeDomain string
+	// HTTP is the client requests are made with. It is only replaced in tests
+	HTTP *http.Client
+
+	mu   sync.Mutex
+	info *Info
+}
+
+// New returns a client for the anchor at the passed home domain
+func New(homeDomain string) *Client {
+	return &Client{
+		HomeDomain: homeDomain,
+		HTTP:       &http.Client{Timeout: time.Duration(Timeout) * time.Second},
+	}
+}
+
+var (
+	anchorsMu sync.RWMutex
+	anchors   = make(map[string]*Client)
+)
+
+// Register makes the anchor available to users under its home domain
+func Register(c *Client) {
+	anchorsMu.Lock()
+	defer anchorsMu.Unlock()
+	anchors[c.HomeDomain] = c
+}
+
+// Get returns the registered anchor with the passed home domain
+func Get(homeDomain string) (*Client, error) {
+	anchorsMu.RLock()
+	defer anchorsMu.RUnlock()
+	c, exists := anchors[homeDomain]
+	if !exists {
+		return nil, errors.New("unknown anchor " + homeDomain)
+	}
+	return c, nil
+}
+
+// List returns the home domains of the registered anchors
+func List() []string {
+	anchorsMu.RLock()
+	defer anchorsMu.RUnlock()
+	domains := make([]string, 0, len(anchors))
+	for domain := range anchors {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// Info returns the stellar.toml of the anchor. It is fetched once and cached afterwards
+func (c *Client) Info() (Info, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.info != nil {
+		return *c.info, nil
+	}
+
+	resp, err := c.HTTP.Get("https://" + c.HomeDomain + "/.well-known/stellar.toml")
+	if err != nil {
+		return Info{}, errors.Wrap(err, "could not fetch stellar.toml")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Info{}, errors.Errorf("could not fetch stellar.toml: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Info{}, errors.Wrap(err, "could not read stellar.toml")
+	}
+
+	var info Info
+	err = toml.Unmarshal(data, &info)
+	if err != nil {
+		return Info{}, errors.Wrap(err, "invalid stellar.toml")
+	}
+	c.info = &info
+	return info, nil
+}
+
+// Currency returns the asset the anchor issues with the passed code
+func (c *Client) Currency(code string) (Currency, error) {
+	info, err := c.Info()
+	if err != nil {
+		return Currency{}, err
+	}
+	for _, currency := range info.Currencies {
+		if currency.Code == code {
+			return currency, nil
+		}
+	}
+	return Currency{}, errors.New("anchor doesn't issue " + code)
+}
+
+// Error is an error response of an anchor
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "anchor responded with " + http.StatusText(e.Status) + ": " + e.Message
+}
+
+// request sends a request to the anchor and decodes the JSON response into x. Responses
+// with an error status are returned as *Error with the raw body available to the caller
+func (c *Client) request(method string, endpoint string, token string, contentType string,
+	body io.Reader, x interface{}) ([]byte, error) {
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not build request")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not reach anchor")
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &e)
+		if e.Error == "" {
+			e.Error = strings.TrimSpace(string(data))
+		}
+		return data, &Error{Status: resp.StatusCode, Message: e.Error}
+	}
+
+	if x != nil {
+		err = json.Unmarshal(data, x)
+		if err != nil {
+			return data, errors.Wrap(err, "could not decode response")
+		}
+	}
+	return data, nil
+}
+
+// get sends a GET request with the passed query params
+func (c *Client) get(endpoint string, token string, params url.Values, x interface{}) ([]byte, error) {
+	if len(params) != 0 {
+		endpoint += "?" + params.Encode()
+	}
+	return c.request("GET", endpoint, token, "", nil, x)
+}
+
+// send sends the passed fields as multipart/form-data, which all SEPs accept
+func (c *Client) send(method string, endpoint string, token string, fields map[string]string,
+	x interface{}) ([]byte, error) {
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if fields[key] == "" {
+			continue
+		}
+		err := form.WriteField(key, fields[key])
+		if err != nil {
+			return nil, errors.Wrap(err, "could not encode request")
+		}
+	}
+	err := form.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encode request")
+	}
+	return c.request(method, endpoint, token, form.FormDataContentType(), &body, x)
+}
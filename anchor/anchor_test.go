@@ -0,0 +1,165 @@
+// +build all travis
+
+package anchor_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	anchor "github.com/YaleOpenLab/openx/anchor"
+	anchortest "github.com/YaleOpenLab/openx/anchor/anchortest"
+	consts "github.com/YaleOpenLab/openx/consts"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// signWith returns a SignFunc signing with the passed key
+func signWith(kp *keypair.Full) anchor.SignFunc {
+	return func(txe string) (string, error) {
+		gtx, err := build.TransactionFromXDR(txe)
+		if err != nil {
+			return "", err
+		}
+		tx, _ := gtx.Transaction()
+		tx, err = tx.Sign(xlm.Passphrase, kp)
+		if err != nil {
+			return "", err
+		}
+		return tx.Base64()
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	consts.SetConsts(false)
+	s, err := anchortest.NewServer("USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	client := s.Client()
+
+	anchor.Register(client)
+	registered, err := anchor.Get(s.HomeDomain())
+	if err != nil || registered != client {
+		t.Fatalf("registered anchor not found: %v", err)
+	}
+	_, err = anchor.Get("unknown.example")
+	if err == nil {
+		t.Fatalf("unregistered anchor found")
+	}
+
+	currency, err := client.Currency("USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currency != s.Asset {
+		t.Fatalf("wrong currency read from stellar.toml: %v", currency)
+	}
+	_, err = client.Currency("EUR")
+	if err == nil {
+		t.Fatalf("currency the anchor doesn't issue found")
+	}
+
+	user, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Auth(user.Address(), signWith(other))
+	if err == nil {
+		t.Fatalf("challenge signed with another key accepted")
+	}
+	token, err := client.Auth(user.Address(), signWith(user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	if token.Expired(now) || token.Expiry < now {
+		t.Fatalf("token expiry not read: %v", token)
+	}
+
+	transfer := anchor.TransferRequest{AssetCode: "USD", Account: user.Address(), Amount: "100"}
+
+	// SEP-24
+	flow, err := client.DepositInteractive(token.Value, transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.ID == "" || flow.URL == "" {
+		t.Fatalf("interactive flow not returned: %v", flow)
+	}
+	tx, err := client.Transaction(token.Value, anchor.SEP24, flow.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Kind != anchor.Deposit || tx.Status != "incomplete" || tx.Final() {
+		t.Fatalf("unexpected transaction: %v", tx)
+	}
+	_, err = client.Transaction(token.Value, anchor.SEP6, flow.ID)
+	if e, ok := err.(*anchor.Error); !ok || e.Status != http.StatusNotFound {
+		t.Fatalf("transaction of another protocol found: %v", err)
+	}
+
+	_, err = client.WithdrawInteractive("badtoken", transfer)
+	if err == nil {
+		t.Fatalf("transfer started without a valid token")
+	}
+
+	// SEP-6 with the KYC information the anchor asks for sent over SEP-12
+	s.RequiredFields = []string{"first_name", "last_name"}
+	_, err = client.Deposit(token.Value, transfer)
+	needed, ok := err.(*anchor.CustomerInfoNeeded)
+	if !ok || len(needed.Fields) != 2 {
+		t.Fatalf("anchor didn't ask for customer info: %v", err)
+	}
+	err = client.PutCustomer(token.Value, user.Address(), map[string]string{"first_name": "John", "last_name": "Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Customer(user.Address())["last_name"] != "Doe" {
+		t.Fatalf("customer info not received: %v", s.Customer(user.Address()))
+	}
+	deposit, err := client.Deposit(token.Value, transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deposit.ID == "" || deposit.How == "" {
+		t.Fatalf("deposit instructions not returned: %v", deposit)
+	}
+
+	_, err = client.Withdraw(token.Value, transfer)
+	if e, ok := err.(*anchor.Error); !ok || e.Status != http.StatusBadRequest {
+		t.Fatalf("withdrawal without destination accepted: %v", err)
+	}
+	transfer.Type, transfer.Dest = "bank_account", "123456789"
+	withdrawal, err := client.Withdraw(token.Value, transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withdrawal.AccountID != s.Key.Address() || withdrawal.Memo == "" {
+		t.Fatalf("withdraw instructions not returned: %v", withdrawal)
+	}
+
+	// polling
+	_, err = client.Poll(token.Value, anchor.SEP6, deposit.ID, 10*time.Millisecond, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("pending transfer reported final")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.SetStatus(deposit.ID, "completed", "stellartxhash")
+	}()
+	tx, err = client.Poll(token.Value, anchor.SEP6, deposit.ID, 10*time.Millisecond, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tx.Completed() || tx.StellarTransactionID != "stellartxhash" {
+		t.Fatalf("completed transfer not seen: %v", tx)
+	}
+}
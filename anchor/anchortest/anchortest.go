@@ -0,0 +1,402 @@
+// Package anchortest runs a local stub anchor that implements the parts of SEP-1, SEP-6,
+// SEP-10, SEP-12 and SEP-24 openx uses, so that anchor transfers can be tested without
+// talking to a real anchor
+package anchortest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	anchor "github.com/YaleOpenLab/openx/anchor"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// Server is a stub anchor served over TLS on a local port
+type Server struct {
+	*httptest.Server
+	// Key is the SEP-10 signing key of the anchor
+	Key *keypair.Full
+	// Asset is the only asset the anchor issues
+	Asset anchor.Currency
+	// RequiredFields are the SEP-9 fields the anchor needs about a user before it accepts
+	// SEP-6 transfers of the user
+	RequiredFields []string
+
+	mu           sync.Mutex
+	tokens       map[string]string
+	customers    map[string]map[string]string
+	transactions map[string]*transaction
+	count        int
+}
+
+// transaction is a transfer made with the stub anchor
+type transaction struct {
+	anchor.Transaction
+	protocol string
+	account  string
+}
+
+// NewServer starts a stub anchor issuing an asset with the passed code
+func NewServer(assetCode string) (*Server, error) {
+	key, err := keypair.Random()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate signing key")
+	}
+	issuer, err := keypair.Random()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate issuer")
+	}
+
+	s := &Server{
+		Key:          key,
+		Asset:        anchor.Currency{Code: assetCode, Issuer: issuer.Address()},
+		tokens:       make(map[string]string),
+		customers:    make(map[string]map[string]string),
+		transactions: make(map[string]*transaction),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/stellar.toml", s.stellarToml)
+	mux.HandleFunc("/auth", s.auth)
+	mux.HandleFunc("/sep24/transactions/deposit/interactive", s.sep24(anchor.Deposit))
+	mux.HandleFunc("/sep24/transactions/withdraw/interactive", s.sep24(anchor.Withdrawal))
+	mux.HandleFunc("/sep24/transaction", s.transaction(anchor.SEP24))
+	mux.HandleFunc("/sep6/deposit", s.sep6(anchor.Deposit))
+	mux.HandleFunc("/sep6/withdraw", s.sep6(anchor.Withdrawal))
+	mux.HandleFunc("/sep6/transaction", s.transaction(anchor.SEP6))
+	mux.HandleFunc("/sep6/customer", s.customer)
+	s.Server = httptest.NewTLSServer(mux)
+	return s, nil
+}
+
+// HomeDomain returns the home domain of the stub anchor
+func (s *Server) HomeDomain() string {
+	return strings.TrimPrefix(s.URL, "https://")
+}
+
+// Client returns a client for the stub anchor that trusts its certificate
+func (s *Server) Client() *anchor.Client {
+	c := anchor.New(s.HomeDomain())
+	c.HTTP = s.Server.Client()
+	return c
+}
+
+// SetStatus moves the transfer with the passed id to status as the anchor would once funds
+// arrive. Completed transfers get the hash of the Stellar transaction that paid them out
+func (s *Server) SetStatus(id string, status string, stellarTxID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, exists := s.transactions[id]
+	if !exists {
+		return errors.New("unknown transaction " + id)
+	}
+	tx.Status = status
+	tx.StellarTransactionID = stellarTxID
+	if tx.Final() {
+		tx.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+// Customer returns the SEP-9 fields the stub anchor has received about the account
+func (s *Server) Customer(account string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fields := make(map[string]string)
+	for key, value := range s.customers[account] {
+		fields[key] = value
+	}
+	return fields
+}
+
+// respond writes x as JSON with the passed status
+func respond(w http.ResponseWriter, status int, x interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(x)
+}
+
+// fail responds with an error as the SEPs define it
+func fail(w http.ResponseWriter, status int, message string) {
+	respond(w, status, map[string]string{"error": message})
+}
+
+func (s *Server) stellarToml(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "NETWORK_PASSPHRASE = %q\n", xlm.Passphrase)
+	fmt.Fprintf(w, "SIGNING_KEY = %q\n", s.Key.Address())
+	fmt.Fprintf(w, "WEB_AUTH_ENDPOINT = %q\n", s.URL+"/auth")
+	fmt.Fprintf(w, "TRANSFER_SERVER = %q\n", s.URL+"/sep6")
+	fmt.Fprintf(w, "TRANSFER_SERVER_SEP0024 = %q\n", s.URL+"/sep24")
+	fmt.Fprintf(w, "\n[[CURRENCIES]]\ncode = %q\nissuer = %q\n", s.Asset.Code, s.Asset.Issuer)
+}
+
+// newToken issues a token for the account shaped like the JWTs of real anchors
+func (s *Server) newToken(account string) (string, error) {
+	jti := make([]byte, 16)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().Unix()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": s.URL + "/auth", "sub": account, "iat": now, "exp": now + 3600, "jti": hex.EncodeToString(jti),
+	})
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	token := header + "." + base64.RawURLEncoding.EncodeToString(claims) + "."
+
+	s.mu.Lock()
+	s.tokens[token] = account
+	s.mu.Unlock()
+	return token, nil
+}
+
+// account returns the account the request was authenticated for
+func (s *Server) account(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, exists := s.tokens[token]
+	return account, exists
+}
+
+func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		account := r.URL.Query().Get("account")
+		if _, err := keypair.ParseAddress(account); err != nil {
+			fail(w, http.StatusBadRequest, "invalid account")
+			return
+		}
+		tx, err := build.BuildChallengeTx(s.Key.Seed(), account, "anchortest", xlm.Passphrase, 5*time.Minute)
+		if err != nil {
+			fail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		txe, err := tx.Base64()
+		if err != nil {
+			fail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respond(w, http.StatusOK, map[string]string{"transaction": txe, "network_passphrase": xlm.Passphrase})
+	case "POST":
+		var x struct {
+			Transaction string `json:"transaction"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+			fail(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		_, account, err := build.ReadChallengeTx(x.Transaction, s.Key.Address(), xlm.Passphrase)
+		if err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		_, err = build.VerifyChallengeTxSigners(x.Transaction, s.Key.Address(), xlm.Passphrase, account)
+		if err != nil {
+			fail(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		token, err := s.newToken(account)
+		if err != nil {
+			fail(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		respond(w, http.StatusOK, map[string]string{"token": token})
+	default:
+		fail(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// newTransaction records a transfer the user has started
+func (s *Server) newTransaction(protocol string, kind string, account string, amount string,
+	status string) *transaction {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	tx := &transaction{
+		Transaction: anchor.Transaction{
+			ID:        strconv.Itoa(s.count),
+			Kind:      kind,
+			Status:    status,
+			AmountIn:  amount,
+			StartedAt: time.Now().UTC().Format(time.RFC3339),
+		},
+		protocol: protocol,
+		account:  account,
+	}
+	if kind == anchor.Withdrawal {
+		tx.WithdrawAnchorAccount = s.Key.Address()
+		tx.WithdrawMemoType = "id"
+		tx.WithdrawMemo = tx.ID
+	}
+	s.transactions[tx.ID] = tx
+	return tx
+}
+
+// checkTransfer checks that the request is authenticated for its account and asks for the
+// stub's asset
+func (s *Server) checkTransfer(w http.ResponseWriter, r *http.Request, asset string,
+	account string) (string, bool) {
+
+	authenticated, ok := s.account(r)
+	if !ok {
+		fail(w, http.StatusForbidden, "authentication required")
+		return "", false
+	}
+	if account != "" && account != authenticated {
+		fail(w, http.StatusForbidden, "token is for another account")
+		return "", false
+	}
+	if asset != s.Asset.Code {
+		fail(w, http.StatusBadRequest, "unsupported asset")
+		return "", false
+	}
+	return authenticated, true
+}
+
+func (s *Server) sep24(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fail(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			fail(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+		account, ok := s.checkTransfer(w, r, r.FormValue("asset_code"), r.FormValue("account"))
+		if !ok {
+			return
+		}
+
+		tx := s.newTransaction(anchor.SEP24, kind, account, r.FormValue("amount"), "incomplete")
+		respond(w, http.StatusOK, anchor.Interactive{
+			Type: "interactive_customer_info_needed",
+			URL:  s.URL + "/flow?id=" + tx.ID,
+			ID:   tx.ID,
+		})
+	}
+}
+
+func (s *Server) sep6(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		account, ok := s.checkTransfer(w, r, query.Get("asset_code"), query.Get("account"))
+		if !ok {
+			return
+		}
+
+		var missing []string
+		customer := s.Customer(account)
+		for _, field := range s.RequiredFields {
+			if customer[field] == "" {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) != 0 {
+			respond(w, http.StatusForbidden, anchor.CustomerInfoNeeded{
+				Type:   "non_interactive_customer_info_needed",
+				Fields: missing,
+			})
+			return
+		}
+
+		if kind == anchor.Deposit {
+			tx := s.newTransaction(anchor.SEP6, kind, account, query.Get("amount"), "pending_user_transfer_start")
+			respond(w, http.StatusOK, anchor.DepositInstructions{
+				How:  "wire " + s.Asset.Code + " to account 1234 referencing " + tx.ID,
+				ID:   tx.ID,
+				Fees: anchor.Fees{ETA: 3600},
+			})
+			return
+		}
+
+		if query.Get("type") == "" || query.Get("dest") == "" {
+			fail(w, http.StatusBadRequest, "type and dest are required")
+			return
+		}
+		tx := s.newTransaction(anchor.SEP6, kind, account, query.Get("amount"), "pending_user_transfer_start")
+		respond(w, http.StatusOK, anchor.WithdrawInstructions{
+			AccountID: tx.WithdrawAnchorAccount,
+			MemoType:  tx.WithdrawMemoType,
+			Memo:      tx.WithdrawMemo,
+			ID:        tx.ID,
+			Fees:      anchor.Fees{ETA: 3600},
+		})
+	}
+}
+
+func (s *Server) transaction(protocol string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, ok := s.account(r)
+		if !ok {
+			fail(w, http.StatusForbidden, "authentication required")
+			return
+		}
+
+		s.mu.Lock()
+		tx, exists := s.transactions[r.URL.Query().Get("id")]
+		var x anchor.Transaction
+		if exists {
+			x = tx.Transaction
+		}
+		s.mu.Unlock()
+		if !exists || tx.protocol != protocol || tx.account != account {
+			fail(w, http.StatusNotFound, "transaction not found")
+			return
+		}
+		respond(w, http.StatusOK, map[string]anchor.Transaction{"transaction": x})
+	}
+}
+
+func (s *Server) customer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		fail(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	authenticated, ok := s.account(r)
+	if !ok {
+		fail(w, http.StatusForbidden, "authentication required")
+		return
+	}
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+	if r.FormValue("account") != authenticated {
+		fail(w, http.StatusForbidden, "token is for another account")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.customers[authenticated] == nil {
+		s.customers[authenticated] = make(map[string]string)
+	}
+	for key, values := range r.MultipartForm.Value {
+		if key != "account" && len(values) != 0 {
+			s.customers[authenticated][key] = values[0]
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
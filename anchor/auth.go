@@ -0,0 +1,101 @@
+package anchor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// SignFunc signs a base64 encoded transaction envelope with the keys of the account that is
+// authenticating and returns the signed envelope
+type SignFunc func(txe string) (string, error)
+
+// Token is a SEP-10 token issued by an anchor
+type Token struct {
+	Value string `json:"token"`
+	// Expiry is the unix time after which the anchor doesn't accept the token anymore. It is
+	// zero if the token doesn't say when it expires
+	Expiry int64 `json:"expiry"`
+}
+
+// Expired returns true if the token can't be used anymore
+func (t Token) Expired(now int64) bool {
+	return t.Value == "" || (t.Expiry != 0 && now >= t.Expiry)
+}
+
+// tokenExpiry reads the expiry of a JWT without verifying it. The token is only ever sent
+// back to the anchor that issued it, so there is nothing to verify it against
+func tokenExpiry(token string) int64 {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return 0
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	json.Unmarshal(payload, &claims)
+	return claims.Exp
+}
+
+// Auth logs the account in with the anchor over SEP-10. The challenge is checked to have
+// been issued by the anchor's signing key for the account before it is signed
+func (c *Client) Auth(account string, sign SignFunc) (Token, error) {
+	info, err := c.Info()
+	if err != nil {
+		return Token{}, err
+	}
+	if info.WebAuthEndpoint == "" || info.SigningKey == "" {
+		return Token{}, errors.New("anchor doesn't support SEP-10")
+	}
+
+	var challenge struct {
+		Transaction       string `json:"transaction"`
+		NetworkPassphrase string `json:"network_passphrase"`
+	}
+	_, err = c.get(info.WebAuthEndpoint, "", url.Values{"account": {account}}, &challenge)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "could not fetch challenge")
+	}
+	if challenge.NetworkPassphrase != "" && challenge.NetworkPassphrase != xlm.Passphrase {
+		return Token{}, errors.New("challenge is for another network")
+	}
+
+	_, client, err := build.ReadChallengeTx(challenge.Transaction, info.SigningKey, xlm.Passphrase)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "invalid challenge")
+	}
+	if client != account {
+		return Token{}, errors.New("challenge was issued for another account")
+	}
+
+	txe, err := sign(challenge.Transaction)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "could not sign challenge")
+	}
+
+	var token Token
+	body, err := json.Marshal(map[string]string{"transaction": txe})
+	if err != nil {
+		return Token{}, errors.Wrap(err, "could not encode challenge")
+	}
+	_, err = c.request("POST", info.WebAuthEndpoint, "", "application/json",
+		strings.NewReader(string(body)), &token)
+	if err != nil {
+		return Token{}, errors.Wrap(err, "anchor rejected challenge")
+	}
+	if token.Value == "" {
+		return Token{}, errors.New("anchor didn't issue a token")
+	}
+	token.Expiry = tokenExpiry(token.Value)
+	return token, nil
+}
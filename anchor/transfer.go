@@ -0,0 +1,299 @@
+package anchor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SEP6 and SEP24 are the protocols deposits and withdrawals can be made with
+const (
+	// SEP6 transfers are made programmatically with the KYC information the anchor asks for
+	SEP6 = "sep6"
+	// SEP24 transfers are made by the user in a web flow hosted by the anchor
+	SEP24 = "sep24"
+)
+
+// Deposit and Withdrawal are the kinds of transfers
+const (
+	Deposit    = "deposit"
+	Withdrawal = "withdrawal"
+)
+
+// TransferRequest describes a deposit or withdrawal
+type TransferRequest struct {
+	AssetCode string
+	Account   string
+	// Amount is optional, users can choose it in the interactive flow
+	Amount string
+	Email  string
+	// Type, Dest and DestExtra say how and where SEP-6 withdrawals are paid out, eg. the
+	// bank_account type with the account number and routing number of the bank
+	Type      string
+	Dest      string
+	DestExtra string
+}
+
+// fields returns the request params of the transfer
+func (t TransferRequest) fields() map[string]string {
+	return map[string]string{
+		"asset_code":    t.AssetCode,
+		"account":       t.Account,
+		"amount":        t.Amount,
+		"email_address": t.Email,
+		"type":          t.Type,
+		"dest":          t.Dest,
+		"dest_extra":    t.DestExtra,
+	}
+}
+
+// query returns the request params of the transfer as a query
+func (t TransferRequest) query() url.Values {
+	query := make(url.Values)
+	for key, value := range t.fields() {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+// Interactive is the web flow of a SEP-24 transfer the user has to complete
+type Interactive struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	ID   string `json:"id"`
+}
+
+// sep24 starts an interactive transfer of the passed kind
+func (c *Client) sep24(token string, kind string, t TransferRequest) (Interactive, error) {
+	info, err := c.Info()
+	if err != nil {
+		return Interactive{}, err
+	}
+	if info.TransferServerSep24 == "" {
+		return Interactive{}, errors.New("anchor doesn't support SEP-24")
+	}
+
+	var x Interactive
+	_, err = c.send("POST", strings.TrimSuffix(info.TransferServerSep24, "/")+"/transactions/"+kind+"/interactive",
+		token, t.fields(), &x)
+	if err != nil {
+		return x, err
+	}
+	if x.URL == "" || x.ID == "" {
+		return x, errors.New("anchor didn't return an interactive flow")
+	}
+	return x, nil
+}
+
+// DepositInteractive starts a SEP-24 deposit. The user completes it at the returned url
+func (c *Client) DepositInteractive(token string, t TransferRequest) (Interactive, error) {
+	return c.sep24(token, "deposit", t)
+}
+
+// WithdrawInteractive starts a SEP-24 withdrawal. The user completes it at the returned url
+func (c *Client) WithdrawInteractive(token string, t TransferRequest) (Interactive, error) {
+	return c.sep24(token, "withdraw", t)
+}
+
+// CustomerInfoNeeded is returned by SEP-6 transfers the anchor needs more information about
+// the user for. Fields lists the SEP-9 fields to send over SEP-12 for non interactive
+// requests, Status says whether the information that was sent is still being reviewed or has
+// been denied and URL is where the user can provide the information for interactive requests
+type CustomerInfoNeeded struct {
+	Type        string   `json:"type"`
+	Fields      []string `json:"fields,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	MoreInfoURL string   `json:"more_info_url,omitempty"`
+	ID          string   `json:"id,omitempty"`
+}
+
+func (e *CustomerInfoNeeded) Error() string {
+	switch e.Type {
+	case "non_interactive_customer_info_needed":
+		return "anchor needs customer info: " + strings.Join(e.Fields, ", ")
+	case "customer_info_status":
+		return "customer info is " + e.Status
+	}
+	return "anchor needs customer info at " + e.URL
+}
+
+// Fees and limits of a SEP-6 transfer
+type Fees struct {
+	ETA        int     `json:"eta,omitempty"`
+	MinAmount  float64 `json:"min_amount,omitempty"`
+	MaxAmount  float64 `json:"max_amount,omitempty"`
+	FeeFixed   float64 `json:"fee_fixed,omitempty"`
+	FeePercent float64 `json:"fee_percent,omitempty"`
+}
+
+// DepositInstructions say how to send funds to the anchor for a SEP-6 deposit
+type DepositInstructions struct {
+	Fees
+	How       string `json:"how"`
+	ID        string `json:"id"`
+	ExtraInfo struct {
+		Message string `json:"message,omitempty"`
+	} `json:"extra_info"`
+}
+
+// WithdrawInstructions say where to send the asset for a SEP-6 withdrawal
+type WithdrawInstructions struct {
+	Fees
+	AccountID string `json:"account_id"`
+	MemoType  string `json:"memo_type"`
+	Memo      string `json:"memo"`
+	ID        string `json:"id"`
+}
+
+// sep6 requests a programmatic transfer of the passed kind
+func (c *Client) sep6(token string, kind string, t TransferRequest, x interface{}) error {
+	info, err := c.Info()
+	if err != nil {
+		return err
+	}
+	if info.TransferServer == "" {
+		return errors.New("anchor doesn't support SEP-6")
+	}
+
+	data, err := c.get(strings.TrimSuffix(info.TransferServer, "/")+"/"+kind, token, t.query(), x)
+	if e, ok := err.(*Error); ok && e.Status == http.StatusForbidden {
+		var needed CustomerInfoNeeded
+		if json.Unmarshal(data, &needed) == nil && needed.Type != "" {
+			return &needed
+		}
+	}
+	return err
+}
+
+// Deposit requests a SEP-6 deposit. If the anchor needs to know more about the user a
+// *CustomerInfoNeeded is returned
+func (c *Client) Deposit(token string, t TransferRequest) (DepositInstructions, error) {
+	var x DepositInstructions
+	err := c.sep6(token, "deposit", t, &x)
+	return x, err
+}
+
+// Withdraw requests a SEP-6 withdrawal. If the anchor needs to know more about the user a
+// *CustomerInfoNeeded is returned
+func (c *Client) Withdraw(token string, t TransferRequest) (WithdrawInstructions, error) {
+	var x WithdrawInstructions
+	err := c.sep6(token, "withdraw", t, &x)
+	return x, err
+}
+
+// PutCustomer sends SEP-9 fields about the account to the anchor over SEP-12
+func (c *Client) PutCustomer(token string, account string, fields map[string]string) error {
+	info, err := c.Info()
+	if err != nil {
+		return err
+	}
+	server := info.KYCServer
+	if server == "" {
+		server = info.TransferServer
+	}
+	if server == "" {
+		return errors.New("anchor doesn't support SEP-12")
+	}
+
+	params := map[string]string{"account": account}
+	for key, value := range fields {
+		params[key] = value
+	}
+	_, err = c.send("PUT", strings.TrimSuffix(server, "/")+"/customer", token, params, nil)
+	return err
+}
+
+// Transaction is the status of a transfer as reported by the anchor
+type Transaction struct {
+	ID                    string `json:"id"`
+	Kind                  string `json:"kind"`
+	Status                string `json:"status"`
+	StatusEta             int    `json:"status_eta,omitempty"`
+	MoreInfoURL           string `json:"more_info_url,omitempty"`
+	AmountIn              string `json:"amount_in,omitempty"`
+	AmountOut             string `json:"amount_out,omitempty"`
+	AmountFee             string `json:"amount_fee,omitempty"`
+	StartedAt             string `json:"started_at,omitempty"`
+	CompletedAt           string `json:"completed_at,omitempty"`
+	StellarTransactionID  string `json:"stellar_transaction_id,omitempty"`
+	ExternalTransactionID string `json:"external_transaction_id,omitempty"`
+	Message               string `json:"message,omitempty"`
+	WithdrawAnchorAccount string `json:"withdraw_anchor_account,omitempty"`
+	WithdrawMemo          string `json:"withdraw_memo,omitempty"`
+	WithdrawMemoType      string `json:"withdraw_memo_type,omitempty"`
+}
+
+// finalStatuses are the statuses transfers don't leave anymore
+var finalStatuses = map[string]bool{
+	"completed": true,
+	"refunded":  true,
+	"expired":   true,
+	"error":     true,
+	"no_market": true,
+	"too_small": true,
+	"too_large": true,
+}
+
+// Final returns true if the transfer has completed or failed
+func (t Transaction) Final() bool {
+	return finalStatuses[t.Status]
+}
+
+// Completed returns true if the transfer went through
+func (t Transaction) Completed() bool {
+	return t.Status == "completed"
+}
+
+// Transaction returns the status of the transfer with the passed id made over the passed
+// protocol
+func (c *Client) Transaction(token string, protocol string, id string) (Transaction, error) {
+	info, err := c.Info()
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	server := info.TransferServer
+	if protocol == SEP24 {
+		server = info.TransferServerSep24
+	}
+	if server == "" {
+		return Transaction{}, errors.New("anchor doesn't support " + protocol)
+	}
+
+	var x struct {
+		Transaction Transaction `json:"transaction"`
+	}
+	_, err = c.get(strings.TrimSuffix(server, "/")+"/transaction", token, url.Values{"id": {id}}, &x)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return x.Transaction, nil
+}
+
+// Poll checks the status of the transfer every interval until it completes or fails or
+// timeout has passed and returns the last status seen
+func (c *Client) Poll(token string, protocol string, id string, interval time.Duration,
+	timeout time.Duration) (Transaction, error) {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		tx, err := c.Transaction(token, protocol, id)
+		if err != nil {
+			return tx, err
+		}
+		if tx.Final() {
+			return tx, nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return tx, errors.New("transfer still " + tx.Status + " after timeout")
+		}
+		time.Sleep(interval)
+	}
+}
@@ -61,8 +61,9 @@ var AnchorUSDAddress string
 // AnchorUSDTrustLimit is the trust limit till which an account trusts AnchorUSD's stablecoin
 var AnchorUSDTrustLimit float64
 
-// AnchorAPI is the URL of AnchorUSD's API
-var AnchorAPI string
+// Anchors are the home domains of the SEP-6 / SEP-24 anchors users can deposit fiat with and
+// withdraw fiat from
+var Anchors []string
 
 // AlgodAddress is the address of the Algod Daemon
 var AlgodAddress string
@@ -88,6 +89,21 @@ var DbName = "openx.db"
 // PlatformSeedFile is the location where PlatformSeedFile is stored and decrypted each time the platform is started
 var PlatformSeedFile = HomeDir + "/platformseed.hex"
 
+// MasterKeyFile is the location of the master key that wraps the keys used to encrypt sensitive user
+// data in the database. It must not be stored alongside the database
+var MasterKeyFile = HomeDir + "/masterkey.hex"
+
+// HomeDomain is the domain openx is served at. It names openx in SEP-10 challenges
+var HomeDomain = "localhost"
+
+// KeystoreDir is the directory where the encrypted seeds transactions are signed with in process
+// are stored
+var KeystoreDir = HomeDir + "/keystore/"
+
+// SignerSocket is the unix socket of the signing daemon. If it isn't set, transactions are signed
+// in process with the seeds in KeystoreDir
+var SignerSocket string
+
 // Tlsport is the default SSL port on which openx starts
 var Tlsport = 443
 
@@ -104,6 +120,8 @@ func SetConsts(mainnet bool) {
 		HomeDir += "/testnet"
 		DbDir = HomeDir + "/database/"
 		PlatformSeedFile = HomeDir + "/platformseed.hex"
+		MasterKeyFile = HomeDir + "/masterkey.hex"
+		KeystoreDir = HomeDir + "/keystore/"
 
 		StablecoinCode = "STABLEUSD"                                                     // this is constant across different pubkeys
 		StablecoinPublicKey = "GBESYUIFJ2NKNSLXCDWJJ7YYXD7OTCPWDM57YK6R3U76YEVYS5F5HI37" // set this after running this the first time. replace for tests to run properly
@@ -114,7 +132,7 @@ func SetConsts(mainnet bool) {
 		AnchorUSDCode = "USD"
 		AnchorUSDAddress = "GCKFBEIYV2U22IO2BJ4KVJOIP7XPWQGQFKKWXR6DOSJBV7STMAQSMTGG"
 		AnchorUSDTrustLimit = 1000000
-		AnchorAPI = "https://sandbox-api.anchorusd.com/"
+		Anchors = []string{"testanchor.stellar.org"} // the SDF reference anchor issuing SRT on testnet
 
 		// algorand stuff is only enabled with stellar testnet and not mainnet
 		AlgodAddress = "http://localhost:50435"
@@ -129,6 +147,8 @@ func SetConsts(mainnet bool) {
 		HomeDir += "/mainnet"
 		DbDir = HomeDir + "/database/"
 		PlatformSeedFile = HomeDir + "/platformseed.hex"
+		MasterKeyFile = HomeDir + "/masterkey.hex"
+		KeystoreDir = HomeDir + "/keystore/"
 
 		// set in house stablecoin params to zero to not trade in it
 		StablecoinPublicKey = ""
@@ -140,7 +160,7 @@ func SetConsts(mainnet bool) {
 		AnchorUSDCode = "USD"
 		AnchorUSDAddress = "GDUKMGUGDZQK6YHYA5Z6AY2G4XDSZPSZ3SW5UN3ARVMO6QSRDWP5YLEX"
 		AnchorUSDTrustLimit = 10000 // conservative limit of USD 10000 set for investments on mainnet. Can be increased or decreased as necessary
-		AnchorAPI = "https://api.anchorusd.com/"
+		Anchors = []string{"www.anchorusd.com"}
 
 		RefillAmount = 0
 	}
@@ -0,0 +1,482 @@
+package database
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// approval contains the multi party approval workflow for dangerous admin operations. An
+// operation is proposed, stored in ApprovalBucket and executed once enough distinct users
+// with the permission required by the operation have approved it within the policy's window
+
+// ApprovalBucket stores proposals keyed by their index
+var ApprovalBucket = []byte("Approvals")
+
+// the states a proposal can be in
+const (
+	ProposalPending   = "pending"
+	ProposalExecuting = "executing"
+	ProposalExecuted  = "executed"
+	ProposalFailed    = "failed"
+	ProposalCancelled = "cancelled"
+	ProposalExpired   = "expired"
+)
+
+// the steps of the approval workflow recorded in the audit log
+const (
+	AuditPropose        = "propose"
+	AuditApprove        = "approve"
+	AuditCancelProposal = "cancelproposal"
+	AuditExecute        = "executeproposal"
+)
+
+// ExecutionTimeout is the number of seconds after which a proposal that is still executing is
+// considered abandoned, for example because the server crashed while running the action.
+// Abandoned proposals can be cancelled, which marks them as failed
+var ExecutionTimeout = int64(600)
+
+// ApprovalPolicy describes the approvals an action requires
+type ApprovalPolicy struct {
+	// Required is the number of distinct users that need to approve the action, including the
+	// user who proposed it
+	Required int
+	// Window is the number of seconds within which the approvals must be gathered
+	Window int64
+	// Permission is the permission approvers must hold
+	Permission string
+}
+
+// ApprovalPolicies are the policies of the actions that go through the approval workflow,
+// keyed by action. Actions requiring a single approval are executed as soon as they are
+// proposed
+var ApprovalPolicies = map[string]ApprovalPolicy{
+	AuditKillServer:   {Required: 2, Window: 3600, Permission: PermKillServer},
+	AuditFreezeServer: {Required: 2, Window: 3600, Permission: PermFreezeServer},
+	AuditBanUser:      {Required: 2, Window: 86400, Permission: PermBanUsers},
+	AuditVerifyUser:   {Required: 2, Window: 86400, Permission: PermVerifyUsers},
+	AuditUnverifyUser: {Required: 2, Window: 86400, Permission: PermVerifyUsers},
+}
+
+// Proposal is an action waiting for approval
+type Proposal struct {
+	Index int
+	// Action is the proposed action, one of the keys of ApprovalPolicies
+	Action string
+	// Target identifies what the action is to be performed on, for example a user index
+	Target string
+	// Proposer is the index of the user who proposed the action
+	Proposer int
+	// Approvals are the indices of the users who approved the action, starting with the proposer
+	Approvals []int
+	// Required is the number of approvals required at the time of the proposal
+	Required int
+	// Created is the unix time at which the action was proposed
+	Created int64
+	// Expiry is the unix time after which the proposal can't be approved anymore
+	Expiry int64
+	// Status is one of the Proposal* states
+	Status string
+	// Executing is the unix time at which the proposal reached quorum and started executing
+	Executing int64
+	// Result contains the error returned by the action if it failed
+	Result string
+}
+
+// ApprovalExecutor performs an approved action. approvers are the users who approved it
+type ApprovalExecutor func(p Proposal, approvers []User) error
+
+// executors holds the function that performs each action
+var executors = make(map[string]ApprovalExecutor)
+
+// RegisterApprovalExecutor sets the function that performs action once it has been approved
+func RegisterApprovalExecutor(action string, fn ApprovalExecutor) {
+	executors[action] = fn
+}
+
+// finalizers holds the functions that run once an action has been executed and saved
+var finalizers = make(map[string]func(p Proposal))
+
+// RegisterApprovalFinalizer sets a function that runs after action has been executed and its
+// proposal has been saved as executed. Actions that don't return, like shutting down the
+// server, go here so their execution is recorded first
+func RegisterApprovalFinalizer(action string, fn func(p Proposal)) {
+	finalizers[action] = fn
+}
+
+// retrieveProposalTx retrieves the proposal with the passed index within a transaction
+func retrieveProposalTx(b Bucket, iK []byte) (Proposal, error) {
+	var p Proposal
+	x, err := b.Get(iK)
+	if err != nil {
+		return p, err
+	}
+	if x == nil {
+		return p, errors.New("proposal does not exist")
+	}
+	err = json.Unmarshal(x, &p)
+	return p, err
+}
+
+// putProposal stores a proposal under its index
+func putProposal(b Bucket, p Proposal) error {
+	iK, err := utils.ToByte(p.Index)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return b.Put(iK, encoded)
+}
+
+// ProposeAction proposes an action on target. The proposer counts as the first approval and
+// the action is executed right away if the policy requires a single approval
+func ProposeAction(proposer User, action string, target string) (Proposal, error) {
+	var p Proposal
+	policy, exists := ApprovalPolicies[action]
+	if !exists {
+		return p, errors.New("action " + action + " does not go through approvals")
+	}
+	if executors[action] == nil {
+		return p, errors.New("no executor registered for action " + action)
+	}
+
+	allowed, err := proposer.HasPermission(policy.Permission)
+	if err != nil {
+		return p, errors.Wrap(err, "could not check permissions")
+	}
+	if !allowed {
+		return p, errors.New("user not authorized to propose " + action)
+	}
+
+	if policy.Required > 1 {
+		approvers, err := retrieveApprovers(policy.Permission)
+		if err != nil {
+			return p, err
+		}
+		if len(approvers) < policy.Required {
+			return p, errors.New("only " + strconv.Itoa(len(approvers)) + " users can approve " + action +
+				", " + strconv.Itoa(policy.Required) + " approvals required")
+		}
+	}
+
+	timeNow := utils.Unix()
+	p = Proposal{
+		Action:    action,
+		Target:    target,
+		Proposer:  proposer.Index,
+		Approvals: []int{proposer.Index},
+		Required:  policy.Required,
+		Created:   timeNow,
+		Expiry:    timeNow + policy.Window,
+		Status:    ProposalPending,
+	}
+	if p.Required <= 1 {
+		p.Status = ProposalExecuting
+		p.Executing = timeNow
+	}
+
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(ApprovalBucket)
+		if err != nil {
+			return err
+		}
+		p.Index, err = nextIndex(b)
+		if err != nil {
+			return err
+		}
+		return putProposal(b, p)
+	})
+	if err != nil {
+		return p, errors.Wrap(err, "could not save proposal")
+	}
+
+	err = AppendAudit(proposer.Index, proposer.Username, AuditPropose, strconv.Itoa(p.Index), action+" "+target, nil)
+	if err != nil {
+		log.Println("could not write audit entry for proposal: ", err)
+	}
+
+	if p.Status == ProposalExecuting {
+		return executeProposal(p)
+	}
+	return p, nil
+}
+
+// ApproveProposal records approver's approval of the proposal with the passed index and
+// executes the action if this brings the proposal to quorum
+func ApproveProposal(approver User, index int) (Proposal, error) {
+	p, err := RetrieveProposal(index)
+	if err != nil {
+		return p, err
+	}
+
+	// permissions are checked outside the transaction since they are read from the store
+	allowed, err := approver.HasPermission(ApprovalPolicies[p.Action].Permission)
+	if err != nil {
+		return p, errors.Wrap(err, "could not check permissions")
+	}
+	if !allowed {
+		return p, errors.New("user not authorized to approve " + p.Action)
+	}
+
+	iK, err := utils.ToByte(index)
+	if err != nil {
+		return p, err
+	}
+
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(ApprovalBucket)
+		if err != nil {
+			return err
+		}
+		p, err = retrieveProposalTx(b, iK)
+		if err != nil {
+			return err
+		}
+
+		if p.Status != ProposalPending {
+			return errors.New("proposal is " + p.Status)
+		}
+		if utils.Unix() > p.Expiry {
+			p.Status = ProposalExpired
+			return putProposal(b, p)
+		}
+
+		for _, x := range p.Approvals {
+			if x == approver.Index {
+				return errors.New("user already approved this proposal")
+			}
+		}
+
+		p.Approvals = append(p.Approvals, approver.Index)
+		if len(p.Approvals) >= p.Required {
+			// mark the proposal within the transaction so that it is executed only once
+			p.Status = ProposalExecuting
+			p.Executing = utils.Unix()
+		}
+		return putProposal(b, p)
+	})
+	if err != nil {
+		return p, err
+	}
+	if p.Status == ProposalExpired {
+		return p, errors.New("proposal expired")
+	}
+
+	err = AppendAudit(approver.Index, approver.Username, AuditApprove, strconv.Itoa(p.Index), p.Action+" "+p.Target, nil)
+	if err != nil {
+		log.Println("could not write audit entry for approval: ", err)
+	}
+
+	if p.Status == ProposalExecuting {
+		return executeProposal(p)
+	}
+	return p, nil
+}
+
+// abandoned checks whether the proposal has been executing for longer than ExecutionTimeout.
+// Proposals stored before the execution start was recorded are abandoned right away
+func (p Proposal) abandoned(timeNow int64) bool {
+	return p.Status == ProposalExecuting && timeNow-p.Executing > ExecutionTimeout
+}
+
+// CancelProposal cancels a pending proposal. Any user who could approve the proposal can
+// cancel it. Abandoned executing proposals are marked as failed instead since their action
+// might have run in part
+func CancelProposal(user User, index int) (Proposal, error) {
+	p, err := RetrieveProposal(index)
+	if err != nil {
+		return p, err
+	}
+
+	allowed, err := user.HasPermission(ApprovalPolicies[p.Action].Permission)
+	if err != nil {
+		return p, errors.Wrap(err, "could not check permissions")
+	}
+	if !allowed && user.Index != p.Proposer {
+		return p, errors.New("user not authorized to cancel proposal")
+	}
+
+	iK, err := utils.ToByte(index)
+	if err != nil {
+		return p, err
+	}
+
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(ApprovalBucket)
+		if err != nil {
+			return err
+		}
+		p, err = retrieveProposalTx(b, iK)
+		if err != nil {
+			return err
+		}
+		if p.abandoned(utils.Unix()) {
+			p.Status = ProposalFailed
+			p.Result = "execution did not finish, cancelled by " + strconv.Itoa(user.Index)
+			return putProposal(b, p)
+		}
+		if p.Status != ProposalPending {
+			return errors.New("proposal is " + p.Status)
+		}
+
+		p.Status = ProposalCancelled
+		return putProposal(b, p)
+	})
+	if err != nil {
+		return p, err
+	}
+
+	err = AppendAudit(user.Index, user.Username, AuditCancelProposal, strconv.Itoa(p.Index), p.Action+" "+p.Target, nil)
+	if err != nil {
+		log.Println("could not write audit entry for cancelled proposal: ", err)
+	}
+	return p, nil
+}
+
+// saveProposal stores the proposal
+func saveProposal(p Proposal) error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(ApprovalBucket)
+		if err != nil {
+			return err
+		}
+		return putProposal(b, p)
+	})
+}
+
+// failProposal saves the proposal as failed with err as its result and returns err
+func failProposal(p Proposal, err error) (Proposal, error) {
+	p.Status = ProposalFailed
+	p.Result = err.Error()
+	saveErr := saveProposal(p)
+	if saveErr != nil {
+		log.Println("could not save failed proposal: ", saveErr)
+	}
+	return p, err
+}
+
+// executeProposal runs the executor of a proposal that reached quorum and records the result
+func executeProposal(p Proposal) (Proposal, error) {
+	var approvers []User
+	for _, index := range p.Approvals {
+		user, err := RetrieveUser(index)
+		if err != nil {
+			return failProposal(p, errors.Wrap(err, "could not retrieve approver"))
+		}
+		approvers = append(approvers, user)
+	}
+
+	details := "approved by"
+	for _, index := range p.Approvals {
+		details += " " + strconv.Itoa(index)
+	}
+	// record the execution before running the action
+	err := AppendAudit(0, "approvals", AuditExecute, strconv.Itoa(p.Index), p.Action+" "+p.Target+", "+details, nil)
+	if err != nil {
+		log.Println("could not write audit entry for executed proposal: ", err)
+	}
+
+	execErr := executors[p.Action](p, approvers)
+	p.Status = ProposalExecuted
+	if execErr != nil {
+		p.Status = ProposalFailed
+		p.Result = execErr.Error()
+	}
+
+	err = saveProposal(p)
+	if err != nil {
+		return p, errors.Wrap(err, "could not save proposal")
+	}
+
+	if execErr != nil {
+		return p, errors.Wrap(execErr, "could not execute "+p.Action)
+	}
+	if fn, exists := finalizers[p.Action]; exists {
+		fn(p)
+	}
+	return p, nil
+}
+
+// retrieveApprovers retrieves the users that hold perm
+func retrieveApprovers(perm string) ([]User, error) {
+	var arr []User
+	users, err := RetrieveAllUsers()
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all users from database")
+	}
+	for _, user := range users {
+		allowed, err := user.HasPermission(perm)
+		if err != nil {
+			return arr, err
+		}
+		if allowed {
+			arr = append(arr, user)
+		}
+	}
+	return arr, nil
+}
+
+// RetrieveProposal retrieves the proposal with the passed index
+func RetrieveProposal(index int) (Proposal, error) {
+	var p Proposal
+	iK, err := utils.ToByte(index)
+	if err != nil {
+		return p, err
+	}
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket(ApprovalBucket)
+		if err != nil {
+			return err
+		}
+		p, err = retrieveProposalTx(b, iK)
+		return err
+	})
+	return p, err
+}
+
+// RetrieveProposals retrieves the proposals with the passed status, or all proposals if status
+// is empty, latest first. Pending proposals past their expiry are reported as expired
+func RetrieveProposals(status string) ([]Proposal, error) {
+	var arr []Proposal
+	timeNow := utils.Unix()
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(ApprovalBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var p Proposal
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return errors.Wrap(err, "could not decode proposal "+string(k))
+			}
+			if p.Status == ProposalPending && timeNow > p.Expiry {
+				p.Status = ProposalExpired
+			}
+			if status == "" || p.Status == status {
+				arr = append(arr, p)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve proposals")
+	}
+
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].Index > arr[j].Index
+	})
+	return arr, nil
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// audit contains an append only log of security relevant actions. Every entry contains the
+// hash of the entry before it, so modifying or deleting an entry breaks the chain from that
+// point on, which VerifyAudit detects.
+
+// AuditBucket stores the audit log, keyed by the index of the entry
+var AuditBucket = []byte("Audit")
+
+// auditHeadKey is the key in MetaBucket holding the hash of the latest audit entry
+var auditHeadKey = []byte("AuditHead")
+
+// the actions recorded in the audit log
+const (
+	AuditVerifyUser        = "verifyuser"
+	AuditUnverifyUser      = "unverifyuser"
+	AuditBanUser           = "banuser"
+	AuditAuthorizeKyc      = "authorizekyc"
+	AuditSendMessage       = "sendmessage"
+	AuditFreezeServer      = "freezeserver"
+	AuditKillServer        = "killserver"
+	AuditGenKillCode       = "genkillcode"
+	AuditNewPlatform       = "newplatform"
+	AuditBackup            = "backup"
+	AuditRestore           = "restore"
+	AuditRotateKey         = "rotatekey"
+	AuditPwdResetRequest   = "pwdresetrequest"
+	AuditPwdReset          = "pwdreset"
+	AuditPwdChange         = "pwdchange"
+	AuditEmailChange       = "emailchange"
+	AuditSeedChange        = "seedchange"
+	AuditSeedImport        = "seedimport"
+	AuditSweepFunds        = "sweepfunds"
+	AuditSweepAsset        = "sweepasset"
+	AuditGrantRole         = "grantrole"
+	AuditRevokeRole        = "revokerole"
+	AuditLockout           = "lockout"
+	AuditUnlock            = "unlock"
+	AuditRotatePlatformKey = "rotateplatformkey"
+	AuditRevokePlatformKey = "revokeplatformkey"
+	AuditPlatformScopes    = "platformscopes"
+	AuditPlatformRedirects = "platformredirects"
+	AuditOAuthConsent      = "oauthconsent"
+	AuditOAuthRevoke       = "oauthrevoke"
+	AuditRotateOIDCKey     = "rotateoidckey"
+)
+
+// AuditEntry is a single entry in the audit log
+type AuditEntry struct {
+	// Index is the position of the entry in the log, starting from 1
+	Index int
+	// Timestamp is the unix time at which the entry was recorded
+	Timestamp int64
+	// Actor is the index of the user who performed the action, 0 for the platform itself
+	Actor int
+	// ActorName is the username of the actor at the time of the action
+	ActorName string
+	// Action is the action performed, one of the Audit* consts
+	Action string
+	// Target identifies what the action was performed on, for example a user index
+	Target string
+	// Details contains additional information on the action
+	Details string
+	// Metadata contains information on the request that triggered the action (ip, user agent, etc)
+	Metadata map[string]string
+	// PrevHash is the hash of the previous entry in the log
+	PrevHash string
+	// Hash is the hash of this entry including PrevHash
+	Hash string
+}
+
+// AuditFilter selects entries from the audit log. Zero values match everything
+type AuditFilter struct {
+	Actor  int
+	Action string
+	Target string
+	Since  int64
+	Until  int64
+	// Limit is the maximum number of entries returned, starting from the latest
+	Limit int
+}
+
+// hash computes the hash of the entry
+func (e AuditEntry) hash() (string, error) {
+	e.Hash = ""
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return utils.SHA3hash(string(encoded)), nil
+}
+
+// AppendAudit appends an entry to the audit log
+func AppendAudit(actor int, actorName string, action string, target string, details string, metadata map[string]string) error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(AuditBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(MetaBucket)
+		if err != nil {
+			return err
+		}
+
+		index, err := nextIndex(b)
+		if err != nil {
+			return err
+		}
+
+		head, err := meta.Get(auditHeadKey)
+		if err != nil {
+			return err
+		}
+
+		entry := AuditEntry{
+			Index:     index,
+			Timestamp: utils.Unix(),
+			Actor:     actor,
+			ActorName: actorName,
+			Action:    action,
+			Target:    target,
+			Details:   details,
+			Metadata:  metadata,
+			PrevHash:  string(head),
+		}
+
+		entry.Hash, err = entry.hash()
+		if err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		iK, err := utils.ToByte(index)
+		if err != nil {
+			return err
+		}
+
+		err = b.Put(iK, encoded)
+		if err != nil {
+			return err
+		}
+
+		return meta.Put(auditHeadKey, []byte(entry.Hash))
+	})
+}
+
+// retrieveAudit retrieves all audit entries ordered by index along with the stored head hash
+func retrieveAudit() ([]AuditEntry, string, error) {
+	var entries []AuditEntry
+	var head string
+	err := store.View(func(tx Tx) error {
+		meta, err := tx.Bucket(MetaBucket)
+		if err == nil {
+			x, err := meta.Get(auditHeadKey)
+			if err != nil {
+				return err
+			}
+			head = string(x)
+		}
+
+		b, err := tx.Bucket(AuditBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var entry AuditEntry
+			err := json.Unmarshal(v, &entry)
+			if err != nil {
+				return errors.Wrap(err, "could not decode audit entry "+string(k))
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	// keys are decimal strings and don't sort numerically
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Index < entries[j].Index
+	})
+	return entries, head, err
+}
+
+// QueryAudit returns the audit entries matching filter, latest first
+func QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	entries, _, err := retrieveAudit()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve audit log")
+	}
+
+	var arr []AuditEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if filter.Actor != 0 && entry.Actor != filter.Actor {
+			continue
+		}
+		if filter.Action != "" && entry.Action != filter.Action {
+			continue
+		}
+		if filter.Target != "" && entry.Target != filter.Target {
+			continue
+		}
+		if filter.Since != 0 && entry.Timestamp < filter.Since {
+			continue
+		}
+		if filter.Until != 0 && entry.Timestamp > filter.Until {
+			continue
+		}
+		arr = append(arr, entry)
+		if filter.Limit > 0 && len(arr) == filter.Limit {
+			break
+		}
+	}
+
+	return arr, nil
+}
+
+// VerifyAudit walks the audit log and checks that no entry has been modified, removed or
+// inserted. Returns the number of entries verified
+func VerifyAudit() (int, error) {
+	entries, head, err := retrieveAudit()
+	if err != nil {
+		return 0, errors.Wrap(err, "could not retrieve audit log")
+	}
+
+	prev := ""
+	for i, entry := range entries {
+		if entry.Index != i+1 {
+			return i, errors.New("audit entry " + strconv.Itoa(i+1) + " missing")
+		}
+		if entry.PrevHash != prev {
+			return i, errors.New("audit entry " + strconv.Itoa(entry.Index) + " does not follow the previous entry")
+		}
+		hash, err := entry.hash()
+		if err != nil {
+			return i, err
+		}
+		if hash != entry.Hash {
+			return i, errors.New("audit entry " + strconv.Itoa(entry.Index) + " has been modified")
+		}
+		prev = entry.Hash
+	}
+
+	if prev != head {
+		return len(entries), errors.New("latest audit entry does not match the recorded head, entries have been removed")
+	}
+
+	return len(entries), nil
+}
@@ -0,0 +1,424 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	"github.com/boltdb/bolt"
+)
+
+// backup contains functions to take consistent snapshots of the database while openx is
+// running and to restore them. A snapshot is a boltdb file containing every bucket in the
+// store irrespective of the backend in use, optionally encrypted with a passphrase.
+
+// encryptedSnapshotHeader prefixes snapshots that have been encrypted with a passphrase
+var encryptedSnapshotHeader = []byte("OPENXENC")
+
+// snapshotPrefix and snapshotExt make up the names of scheduled snapshots
+const (
+	snapshotPrefix = "openx-"
+	snapshotExt    = ".snap"
+)
+
+// WriteSnapshot writes a consistent snapshot of the database to w. The snapshot is encrypted
+// with passphrase if one is passed. The snapshot is taken into a temporary file first so the
+// database is only locked while it is copied on disk and not while w consumes it
+func WriteSnapshot(w io.Writer, passphrase string) error {
+	path, err := snapshotFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if passphrase == "" {
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	e, err := newSnapshotEncrypter(w, passphrase)
+	if err != nil {
+		return errors.Wrap(err, "could not encrypt snapshot")
+	}
+	_, err = io.Copy(e, f)
+	if err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+// snapshotFile writes an unencrypted snapshot of the database to a temporary file and returns
+// its path
+func snapshotFile() (string, error) {
+	tmp, err := ioutil.TempFile("", "openx-snapshot")
+	if err != nil {
+		return "", err
+	}
+
+	if s, ok := store.(*boltStore); ok {
+		// bolt can write a consistent copy of the file from within a read transaction
+		err = func() error {
+			defer tmp.Close()
+			db, err := edb.OpenDB(s.dbPath())
+			if err != nil {
+				return errors.Wrap(err, "could not open database")
+			}
+			defer db.Close()
+
+			return db.View(func(tx *bolt.Tx) error {
+				_, err := tx.WriteTo(tmp)
+				return err
+			})
+		}()
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", err
+		}
+		return tmp.Name(), nil
+	}
+
+	// other backends are copied into a temporary bolt file
+	tmp.Close()
+	db, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "could not create snapshot")
+	}
+
+	err = store.View(func(src Tx) error {
+		return db.Update(func(dst *bolt.Tx) error {
+			return copyBuckets(src, boltTx{dst})
+		})
+	})
+	if err != nil {
+		db.Close()
+		os.Remove(tmp.Name())
+		return "", errors.Wrap(err, "could not copy database into snapshot")
+	}
+
+	err = db.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// copyBuckets copies every bucket along with its sequence from src to dst
+func copyBuckets(src Tx, dst Tx) error {
+	return src.ForEachBucket(func(name []byte) error {
+		sb, err := src.Bucket(name)
+		if err != nil {
+			return err
+		}
+		db, err := dst.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		seq, err := sb.Sequence()
+		if err != nil {
+			return err
+		}
+		err = db.SetSequence(seq)
+		if err != nil {
+			return err
+		}
+		return sb.ForEach(func(k, v []byte) error {
+			return db.Put(k, v)
+		})
+	})
+}
+
+// SaveSnapshot writes a snapshot of the database to the file at path
+func SaveSnapshot(path string, passphrase string) error {
+	// write to a temporary file first so that a failed snapshot doesn't leave a partial file
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not create snapshot file")
+	}
+
+	err = WriteSnapshot(f, passphrase)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// openSnapshot decrypts the snapshot read from r if needed and opens it as a read only bolt
+// database. The returned function closes the database and removes the temporary file
+func openSnapshot(r io.Reader, passphrase string) (*bolt.DB, func(), error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(encryptedSnapshotHeader))
+	if err != nil && err != io.EOF {
+		return nil, nil, errors.Wrap(err, "could not read snapshot")
+	}
+	encrypted := bytes.Equal(header, encryptedSnapshotHeader)
+	if encrypted && passphrase == "" {
+		return nil, nil, errors.New("snapshot is encrypted, passphrase required")
+	}
+
+	tmp, err := ioutil.TempFile("", "openx-restore")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if encrypted {
+		_, err = br.Discard(len(encryptedSnapshotHeader))
+		if err == nil {
+			err = decryptSnapshot(tmp, br, passphrase)
+		}
+	} else {
+		_, err = io.Copy(tmp, br)
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, errors.Wrap(err, "could not read snapshot")
+	}
+
+	db, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, errors.Wrap(err, "snapshot is not a valid database")
+	}
+
+	cleanup := func() {
+		db.Close()
+		os.Remove(tmp.Name())
+	}
+	return db, cleanup, nil
+}
+
+// validateSnapshot checks the consistency of the snapshot and that the users and platforms
+// stored in it can be decoded
+func validateSnapshot(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		// drain the channel so that the checking goroutine can exit
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return errors.Wrap(checkErr, "snapshot failed consistency check")
+		}
+
+		for _, bucket := range [][]byte{UserBucket, PlatformBucket} {
+			b := tx.Bucket(bucket)
+			if b == nil {
+				return errors.New("snapshot is missing bucket " + string(bucket))
+			}
+		}
+
+		keys, err := snapshotKeys(boltTx{tx})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(UserBucket).ForEach(func(k, v []byte) error {
+			var user User
+			err := json.Unmarshal(v, &user)
+			if err != nil {
+				return errors.Wrap(err, "could not decode user "+string(k))
+			}
+
+			var probe struct {
+				Sealed *sealedFields
+			}
+			err = json.Unmarshal(v, &probe)
+			if err != nil || probe.Sealed == nil {
+				return err
+			}
+			key, exists := keys[probe.Sealed.KeyID]
+			if !exists {
+				return errors.New("user " + string(k) + " is encrypted with a data key missing from the snapshot")
+			}
+			_, err = unseal(key, probe.Sealed.Data)
+			if err != nil {
+				return errors.Wrap(err, "could not decrypt user "+string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(PlatformBucket).ForEach(func(k, v []byte) error {
+			var platform Platform
+			err := json.Unmarshal(v, &platform)
+			if err != nil {
+				return errors.Wrap(err, "could not decode platform "+string(k))
+			}
+			return nil
+		})
+	})
+}
+
+// snapshotKeys unwraps the data keys stored in the snapshot with the loaded master key. A
+// snapshot whose keys were wrapped with another master key, for example one taken before the
+// master key was rotated, is refused since none of its encrypted users could be read
+func snapshotKeys(tx Tx) (map[int][]byte, error) {
+	b, err := tx.Bucket(KeysBucket)
+	if err == edb.ErrBucketMissing {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ring.RLock()
+	master := ring.master
+	ring.RUnlock()
+	if master == nil {
+		return nil, errors.New("snapshot contains encrypted data but no master key is loaded")
+	}
+
+	keys, _, err := unwrapKeys(b, master)
+	if err != nil {
+		return nil, errors.Wrap(err, "snapshot was encrypted with another master key")
+	}
+	return keys, nil
+}
+
+// ValidateSnapshot checks whether the snapshot read from r can be restored
+func ValidateSnapshot(r io.Reader, passphrase string) error {
+	db, cleanup, err := openSnapshot(r, passphrase)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	return validateSnapshot(db)
+}
+
+// RestoreSnapshot validates the snapshot read from r and replaces the contents of the database
+// with it. The database is left untouched if the snapshot is invalid
+func RestoreSnapshot(r io.Reader, passphrase string) error {
+	db, cleanup, err := openSnapshot(r, passphrase)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	err = validateSnapshot(db)
+	if err != nil {
+		return err
+	}
+
+	err = db.View(func(src *bolt.Tx) error {
+		// swap in the snapshot within a single transaction so that readers either see the old
+		// or the restored database
+		return store.Update(func(dst Tx) error {
+			var names [][]byte
+			err := dst.ForEachBucket(func(name []byte) error {
+				temp := make([]byte, len(name))
+				copy(temp, name)
+				names = append(names, temp)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				err = dst.DeleteBucket(name)
+				if err != nil {
+					return err
+				}
+			}
+
+			return copyBuckets(boltTx{src}, dst)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// the snapshot might have been taken before or after a data key rotation
+	return reloadKeys()
+}
+
+// RestoreSnapshotFile restores the snapshot stored in the file at path
+func RestoreSnapshotFile(path string, passphrase string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "could not open snapshot file")
+	}
+	defer f.Close()
+
+	return RestoreSnapshot(f, passphrase)
+}
+
+// ScheduleSnapshots saves a snapshot of the database in dir every interval and keeps the latest
+// retain snapshots around. This blocks, so it should be run in a goroutine
+func ScheduleSnapshots(dir string, interval time.Duration, retain int, passphrase string) {
+	edb.CreateDirs(dir)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		path := filepath.Join(dir, snapshotPrefix+time.Now().UTC().Format("20060102T150405Z")+snapshotExt)
+		err := SaveSnapshot(path, passphrase)
+		if err != nil {
+			log.Println("could not save scheduled snapshot: ", err)
+			continue
+		}
+		log.Println("saved database snapshot: ", path)
+
+		err = pruneSnapshots(dir, retain)
+		if err != nil {
+			log.Println("could not prune old snapshots: ", err)
+		}
+	}
+}
+
+// pruneSnapshots deletes all but the latest retain snapshots in dir
+func pruneSnapshots(dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"+snapshotExt))
+	if err != nil {
+		return err
+	}
+
+	// snapshot names sort in the order they were taken
+	sort.Strings(paths)
+	for len(paths) > retain {
+		err = os.Remove(paths[0])
+		if err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	consts "github.com/YaleOpenLab/openx/consts"
+	"github.com/boltdb/bolt"
+)
+
+// boltStore is a Store backed by a boltdb file. The file is opened for the duration of each
+// transaction so that other processes (platforms built on openx) can access it in between
+type boltStore struct {
+	path string
+}
+
+// NewBoltStore returns a store backed by the boltdb file at path. If path is empty, the
+// store uses the file at consts.DbDir + consts.DbName
+func NewBoltStore(path string) Store {
+	return &boltStore{path: path}
+}
+
+// dbPath returns the path of the boltdb file
+func (s *boltStore) dbPath() string {
+	if s.path == "" {
+		return consts.DbDir + consts.DbName
+	}
+	return s.path
+}
+
+// Update runs fn within a read-write bolt transaction
+func (s *boltStore) Update(fn func(Tx) error) (err error) {
+	db, err := edb.OpenDB(s.dbPath())
+	if err != nil {
+		return errors.Wrap(err, "could not open database")
+	}
+
+	defer func() {
+		if ferr := db.Close(); ferr != nil {
+			err = ferr
+		}
+	}()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+	return err
+}
+
+// View runs fn within a read-only bolt transaction
+func (s *boltStore) View(fn func(Tx) error) (err error) {
+	db, err := edb.OpenDB(s.dbPath())
+	if err != nil {
+		return errors.Wrap(err, "could not open database")
+	}
+
+	defer func() {
+		if ferr := db.Close(); ferr != nil {
+			err = ferr
+		}
+	}()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+	return err
+}
+
+// Close is a no-op since the bolt file is only held open during transactions
+func (s *boltStore) Close() error {
+	return nil
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) (Bucket, error) {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil, edb.ErrBucketMissing
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	err := t.tx.DeleteBucket(name)
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+func (t boltTx) ForEachBucket(fn func(name []byte) error) error {
+	return t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name)
+	})
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltBucket) Get(key []byte) ([]byte, error) {
+	return b.b.Get(key), nil
+}
+
+func (b boltBucket) Put(key []byte, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	c := b.b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b boltBucket) Sequence() (uint64, error) {
+	return b.b.Sequence(), nil
+}
+
+func (b boltBucket) SetSequence(seq uint64) error {
+	return b.b.SetSequence(seq)
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
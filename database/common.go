@@ -1,29 +1,28 @@
 package database
 
 import (
-	"encoding/json"
-
 	"github.com/pkg/errors"
 
-	edb "github.com/Varunram/essentials/database"
-	utils "github.com/Varunram/essentials/utils"
 	consts "github.com/YaleOpenLab/openx/consts"
 )
 
-// Save inserts a User object into the database
+// Save inserts a User object into the database and updates the username, email and
+// public key indexes in the same transaction
 func (a *User) Save() error {
-	return edb.Save(consts.DbDir+consts.DbName, UserBucket, a, a.Index)
+	return store.Update(func(tx Tx) error {
+		return saveUserTx(tx, a)
+	})
 }
 
 // RetrieveUser retrieves a User from the database
 func RetrieveUser(key int) (User, error) {
 	var user User
-	x, err := edb.Retrieve(consts.DbDir+consts.DbName, UserBucket, key)
+	x, err := retrieve(UserBucket, key)
 	if err != nil {
 		return user, errors.Wrap(err, "error while retrieving key from bucket")
 	}
 
-	err = json.Unmarshal(x, &user)
+	err = decodeUser(x, &user)
 	if user.Index == 0 {
 		return user, errors.New("Error while retrieving user")
 	}
@@ -33,15 +32,15 @@ func RetrieveUser(key int) (User, error) {
 // RetrieveAllUsers gets a list of all Users in the database
 func RetrieveAllUsers() ([]User, error) {
 	var arr []User
-	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, UserBucket)
+	x, err := retrieveAll(UserBucket)
 	if err != nil {
 		return arr, errors.Wrap(err, "error while retrieving all users")
 	}
 	for _, value := range x {
 		var temp User
-		err := json.Unmarshal(value, &temp)
+		err := decodeUser(value, &temp)
 		if err != nil {
-			return arr, errors.New("error while unmarshalling json, quitting")
+			return arr, errors.Wrap(err, "error while decoding user, quitting")
 		}
 		arr = append(arr, temp)
 	}
@@ -51,7 +50,7 @@ func RetrieveAllUsers() ([]User, error) {
 
 // RetrieveAllUsersLim gets the number of users in the bucket
 func RetrieveAllUsersLim() (int, error) {
-	return edb.RetrieveAllKeysLim(consts.DbDir+consts.DbName, UserBucket)
+	return countKeys(UserBucket)
 }
 
 // TopReputationUsers gets a list of users sorted by descending reputation
@@ -74,7 +73,7 @@ func TopReputationUsers() ([]User, error) {
 	return arr, nil
 }
 
-// RetrieveAllAdmins retrieves a list of all admisn from the database
+// RetrieveAllAdmins retrieves a list of all users holding the admin or superadmin role
 func RetrieveAllAdmins() ([]User, error) {
 	var arr []User
 	users, err := RetrieveAllUsers()
@@ -83,10 +82,10 @@ func RetrieveAllAdmins() ([]User, error) {
 	}
 
 	for _, user := range users {
-		if user.Admin {
+		if user.HasRole(RoleAdmin) || user.HasRole(RoleSuperAdmin) {
 			var x User
 			x.Index = user.Index
-			x.Admin = user.Admin
+			x.Roles = user.Roles
 			x.Image = user.Image
 			x.Name = user.Name
 			x.Username = user.Username
@@ -102,36 +101,35 @@ func RetrieveAllAdmins() ([]User, error) {
 // ValidatePwhash validates a username / pwhash combination
 func ValidatePwhash(name string, pwhash string) (User, error) {
 	var dummy User
-	users, err := RetrieveAllUsers()
+	user, err := RetrieveUserByUsername(name)
 	if err != nil {
-		return dummy, errors.Wrap(err, "error while retrieving all users from database")
+		return dummy, errors.Wrap(err, "could not find user with requested credentials")
 	}
 
-	for _, user := range users {
-		if !user.Conf {
-			continue
-		}
-		if user.Username == name && user.Pwhash == pwhash {
-			return user, nil
-		}
+	if !user.Conf {
+		return dummy, errors.New("could not find user with requested credentials")
 	}
-	return dummy, errors.New("could not find user with requested credentials")
+
+	err = user.checkPassword(pwhash)
+	if err != nil {
+		return dummy, err
+	}
+	return user, nil
 }
 
 // ValidatePwhashReg validates a username / pwhash combination during registration
 func ValidatePwhashReg(name string, pwhash string) (User, error) {
 	var dummy User
-	users, err := RetrieveAllUsers()
+	user, err := RetrieveUserByUsername(name)
 	if err != nil {
-		return dummy, errors.Wrap(err, "error while retrieving all users from database")
+		return dummy, errors.Wrap(err, "could not find user with requested credentials")
 	}
 
-	for _, user := range users {
-		if user.Username == name && user.Pwhash == pwhash {
-			return user, nil
-		}
+	err = user.checkPassword(pwhash)
+	if err != nil {
+		return dummy, err
 	}
-	return dummy, errors.New("could not find user with requested credentials")
+	return user, nil
 }
 
 // ValidateAccessToken validates a username / accessToken combination
@@ -142,27 +140,19 @@ func ValidateAccessToken(name string, accessToken string) (User, error) {
 		return dummy, errors.New("incorrect token length")
 	}
 
-	users, err := RetrieveAllUsers()
+	user, err := RetrieveUserByUsername(name)
 	if err != nil {
-		return dummy, errors.Wrap(err, "error while retrieving all users from database")
+		return dummy, errors.Wrap(err, "could not find user with requested credentials")
 	}
 
-	for _, user := range users {
-		if !user.Conf {
-			continue
-		}
-		if user.Username == name {
-			dummy = user
-			break
-		}
+	if !user.Conf {
+		return dummy, errors.New("could not find user with requested credentials")
 	}
 
-	timeNow := utils.Unix()
-	for storedToken, timeout := range dummy.AccessToken {
-		if storedToken == accessToken && timeNow-timeout < consts.AccessTokenLife {
-			return dummy, nil
-		}
+	err = validateSession(user.Index, accessToken)
+	if err != nil {
+		return dummy, errors.Wrap(err, "could not find user with requested credentials")
 	}
 
-	return dummy, errors.New("could not find user with requested credentials")
+	return user, nil
 }
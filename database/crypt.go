@@ -0,0 +1,642 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// crypt contains the envelope encryption of sensitive user fields. The fields listed in
+// sensitiveUserFields are encrypted with a data key before a user is written to the database
+// and decrypted transparently when the user is read back. Data keys are stored in KeysBucket
+// wrapped by a master key that is loaded from a file outside the database directory when openx
+// starts, so a copy of the database alone doesn't reveal anything about the user's identity.
+//
+// Email lookups go through a blind index (an HMAC of the email) instead of the plaintext
+// email so that the index doesn't leak what the encrypted records hide.
+
+// KeysBucket stores the wrapped data keys used to encrypt sensitive user fields
+var KeysBucket = []byte("DataKeys")
+
+// sensitiveUserFields are the fields of User that are encrypted at rest
+var sensitiveUserFields = []string{"Address", "RecoveryPhone", "Email", "AnchorKYC", "KYC"}
+
+// sealedKey is the field of a stored user that holds the encrypted fields
+const sealedKey = "Sealed"
+
+// indexKeyID is the id of the key used for blind indexes. Data keys start from 1
+const indexKeyID = 0
+
+// masterKeyLength is the length of the master key and data keys in bytes (AES-256)
+const masterKeyLength = 32
+
+// sealedFields are the encrypted sensitive fields of a record
+type sealedFields struct {
+	// KeyID is the id of the data key the fields were encrypted with
+	KeyID int
+	// Data is the nonce followed by the encrypted JSON object of the sensitive fields
+	Data []byte
+}
+
+// storedKey is a data key as stored in KeysBucket
+type storedKey struct {
+	ID      int
+	Wrapped []byte
+	Created int64
+}
+
+// keyring holds the master key and the unwrapped data keys
+type keyring struct {
+	sync.RWMutex
+	master []byte
+	keys   map[int][]byte
+	active int
+}
+
+var ring keyring
+
+// encryptionEnabled returns true if a master key has been loaded
+func encryptionEnabled() bool {
+	ring.RLock()
+	defer ring.RUnlock()
+	return ring.master != nil
+}
+
+// disableEncryption forgets the master key and data keys. Sensitive fields of users saved
+// afterwards are stored in plaintext
+func disableEncryption() {
+	ring.Lock()
+	defer ring.Unlock()
+	ring.master = nil
+	ring.keys = nil
+	ring.active = 0
+}
+
+// seal encrypts plaintext with AES-GCM under key. The random nonce is prepended to the result
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal decrypts data produced by seal
+func unseal(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// newKey returns a random key suitable for AES-256
+func newKey() ([]byte, error) {
+	key := make([]byte, masterKeyLength)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
+
+// putKey wraps key with master and stores it under id
+func putKey(b Bucket, master []byte, id int, key []byte) error {
+	wrapped, err := seal(master, key)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(storedKey{ID: id, Wrapped: wrapped, Created: utils.Unix()})
+	if err != nil {
+		return err
+	}
+	iK, err := utils.ToByte(id)
+	if err != nil {
+		return err
+	}
+	return b.Put(iK, encoded)
+}
+
+// unwrapKeys unwraps all keys stored in b with master
+func unwrapKeys(b Bucket, master []byte) (map[int][]byte, int, error) {
+	keys := make(map[int][]byte)
+	active := 0
+	err := b.ForEach(func(k, v []byte) error {
+		var x storedKey
+		err := json.Unmarshal(v, &x)
+		if err != nil {
+			return errors.Wrap(err, "could not decode data key "+string(k))
+		}
+		key, err := unseal(master, x.Wrapped)
+		if err != nil {
+			return errors.Wrap(err, "could not unwrap data key "+string(k)+", wrong master key?")
+		}
+		keys[x.ID] = key
+		if x.ID > active {
+			active = x.ID
+		}
+		return nil
+	})
+	return keys, active, err
+}
+
+// SetMasterKey loads the data keys with the passed master key and enables encryption of
+// sensitive user fields. The index and first data key are created if they don't exist yet
+func SetMasterKey(master []byte) error {
+	if len(master) != masterKeyLength {
+		return errors.New("master key must be 32 bytes long")
+	}
+
+	var keys map[int][]byte
+	var active int
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(KeysBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range []int{indexKeyID, 1} {
+			iK, err := utils.ToByte(id)
+			if err != nil {
+				return err
+			}
+			x, err := b.Get(iK)
+			if err != nil {
+				return err
+			}
+			if x != nil {
+				continue
+			}
+			key, err := newKey()
+			if err != nil {
+				return err
+			}
+			err = putKey(b, master, id, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		keys, active, err = unwrapKeys(b, master)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ring.Lock()
+	defer ring.Unlock()
+	ring.master = master
+	ring.keys = keys
+	ring.active = active
+	return nil
+}
+
+// reloadKeys reloads the data keys from the database, for example after a snapshot restore
+func reloadKeys() error {
+	ring.RLock()
+	master := ring.master
+	ring.RUnlock()
+	if master == nil {
+		return nil
+	}
+	return SetMasterKey(master)
+}
+
+// readMasterKey reads a hex encoded master key from path
+func readMasterKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// writeMasterKey writes a hex encoded master key to path, readable only by the current user
+func writeMasterKey(path string, master []byte) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(master)), 0600)
+}
+
+// LoadMasterKeyFile loads the master key from the file at path and enables encryption of
+// sensitive user fields. A new master key is generated if the file doesn't exist. The file
+// must be kept outside the database directory and backed up separately, users can't be read
+// without it.
+func LoadMasterKeyFile(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Println("master key file not found, generating new master key at: ", path)
+		master, err := newKey()
+		if err != nil {
+			return err
+		}
+		err = writeMasterKey(path, master)
+		if err != nil {
+			return errors.Wrap(err, "could not write master key file")
+		}
+	}
+
+	master, err := readMasterKey(path)
+	if err != nil {
+		return errors.Wrap(err, "could not read master key file")
+	}
+
+	err = SetMasterKey(master)
+	if err == nil {
+		return nil
+	}
+
+	// a master key rotation might have been interrupted after the data keys were rewrapped
+	newPath := path + ".new"
+	if _, serr := os.Stat(newPath); serr != nil {
+		return err
+	}
+	log.Println("could not unwrap data keys with master key, trying interrupted rotation key: ", newPath)
+	master, nerr := readMasterKey(newPath)
+	if nerr != nil {
+		return err
+	}
+	nerr = SetMasterKey(master)
+	if nerr != nil {
+		return err
+	}
+	return os.Rename(newPath, path)
+}
+
+// RotateMasterKeyFile generates a new master key, rewraps all data keys with it and replaces
+// the master key file at path
+func RotateMasterKeyFile(path string) error {
+	if !encryptionEnabled() {
+		return errors.New("master key not loaded")
+	}
+
+	master, err := newKey()
+	if err != nil {
+		return err
+	}
+
+	// keep the new key around until the data keys have been rewrapped so that we can recover
+	// if we crash in between
+	newPath := path + ".new"
+	err = writeMasterKey(newPath, master)
+	if err != nil {
+		return errors.Wrap(err, "could not write new master key file")
+	}
+
+	err = rotateMasterKey(master)
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+
+	return os.Rename(newPath, path)
+}
+
+// rotateMasterKey rewraps all data keys with master
+func rotateMasterKey(master []byte) error {
+	ring.RLock()
+	old := ring.master
+	ring.RUnlock()
+
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(KeysBucket)
+		if err != nil {
+			return err
+		}
+		keys, _, err := unwrapKeys(b, old)
+		if err != nil {
+			return err
+		}
+		for id, key := range keys {
+			err = putKey(b, master, id, key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not rewrap data keys")
+	}
+
+	ring.Lock()
+	ring.master = master
+	ring.Unlock()
+	return nil
+}
+
+// RotateDataKey creates a new data key which is used to encrypt users from now on. Existing
+// users are moved over to the new key by ReencryptUsers. Returns the id of the new key
+func RotateDataKey() (int, error) {
+	ring.RLock()
+	master := ring.master
+	ring.RUnlock()
+
+	if master == nil {
+		return 0, errors.New("master key not loaded")
+	}
+
+	var id int
+	var key []byte
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(KeysBucket)
+		if err != nil {
+			return err
+		}
+		id, err = nextIndex(b)
+		if err != nil {
+			return err
+		}
+		key, err = newKey()
+		if err != nil {
+			return err
+		}
+		return putKey(b, master, id, key)
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create data key")
+	}
+
+	ring.Lock()
+	ring.keys[id] = key
+	ring.active = id
+	ring.Unlock()
+
+	log.Println("rotated data key, new key id: ", id)
+	return id, nil
+}
+
+// ReencryptUsers encrypts users that were saved in plaintext or with an older data key with
+// the active data key. Each user is rewritten in its own transaction so that this can run in
+// the background while openx serves requests. Returns the number of users rewritten
+func ReencryptUsers() (int, error) {
+	if !encryptionEnabled() {
+		return 0, nil
+	}
+
+	var keys [][]byte
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(UserBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			temp := make([]byte, len(k))
+			copy(temp, k)
+			keys = append(keys, temp)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	plaintext := false
+	for _, iK := range keys {
+		err = store.Update(func(tx Tx) error {
+			b, err := tx.Bucket(UserBucket)
+			if err != nil {
+				return err
+			}
+			x, err := b.Get(iK)
+			if err != nil || x == nil {
+				return err
+			}
+
+			var probe struct {
+				Sealed *sealedFields
+			}
+			err = json.Unmarshal(x, &probe)
+			if err != nil {
+				return err
+			}
+
+			ring.RLock()
+			active := ring.active
+			ring.RUnlock()
+			if probe.Sealed != nil && probe.Sealed.KeyID == active {
+				return nil
+			}
+			if probe.Sealed == nil {
+				plaintext = true
+			}
+
+			var user User
+			err = decodeUser(x, &user)
+			if err != nil {
+				return err
+			}
+			count++
+			return saveUserTx(tx, &user)
+		})
+		if err != nil {
+			return count, errors.Wrap(err, "could not reencrypt user "+string(iK))
+		}
+	}
+
+	if plaintext {
+		// index entries of users stored in plaintext aren't blinded, regenerate them
+		_, err = RebuildUserIndexes()
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// sealRecord moves the sensitive fields of a user record into its encrypted Sealed field
+func sealRecord(record Record) error {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	if ring.master == nil {
+		return nil
+	}
+
+	fields := make(Record)
+	for _, field := range sensitiveUserFields {
+		if value, exists := record[field]; exists {
+			fields[field] = value
+			delete(record, field)
+		}
+	}
+
+	plaintext, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	data, err := seal(ring.keys[ring.active], plaintext)
+	if err != nil {
+		return errors.Wrap(err, "could not encrypt user fields")
+	}
+
+	record[sealedKey] = sealedFields{KeyID: ring.active, Data: data}
+	return nil
+}
+
+// openSealed decrypts sealed fields
+func openSealed(sealed sealedFields) ([]byte, error) {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	if ring.master == nil {
+		return nil, errors.New("user fields are encrypted but no master key is loaded")
+	}
+
+	key, exists := ring.keys[sealed.KeyID]
+	if !exists {
+		return nil, errors.New("unknown data key: " + strconv.Itoa(sealed.KeyID))
+	}
+
+	plaintext, err := unseal(key, sealed.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt user fields")
+	}
+	return plaintext, nil
+}
+
+// sealValue encrypts a single value with the active data key. It returns nil if no master
+// key is loaded, in which case the caller stores the value in plaintext
+func sealValue(plaintext []byte) (*sealedFields, error) {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	if ring.master == nil {
+		return nil, nil
+	}
+
+	data, err := seal(ring.keys[ring.active], plaintext)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encrypt value")
+	}
+	return &sealedFields{KeyID: ring.active, Data: data}, nil
+}
+
+// openRecord moves the sensitive fields of a user record out of its Sealed field
+func openRecord(record Record) error {
+	x, exists := record[sealedKey]
+	if !exists {
+		return nil
+	}
+
+	encoded, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	var sealed sealedFields
+	err = json.Unmarshal(encoded, &sealed)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := openSealed(sealed)
+	if err != nil {
+		return err
+	}
+
+	fields, err := decodeRecord(plaintext)
+	if err != nil {
+		return err
+	}
+
+	delete(record, sealedKey)
+	for field, value := range fields {
+		record[field] = value
+	}
+	return nil
+}
+
+// encodeUser returns the JSON of a user as stored in the database, with its sensitive fields
+// encrypted if a master key is loaded
+func encodeUser(a *User) ([]byte, error) {
+	encoded, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	if !encryptionEnabled() {
+		return encoded, nil
+	}
+
+	record, err := decodeRecord(encoded)
+	if err != nil {
+		return nil, err
+	}
+	err = sealRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
+
+// decodeUser decodes a user as stored in the database, decrypting its sensitive fields
+func decodeUser(v []byte, user *User) error {
+	err := json.Unmarshal(v, user)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Contains(v, []byte(`"`+sealedKey+`"`)) {
+		return nil
+	}
+
+	var probe struct {
+		Sealed *sealedFields
+	}
+	err = json.Unmarshal(v, &probe)
+	if err != nil || probe.Sealed == nil {
+		return err
+	}
+
+	plaintext, err := openSealed(*probe.Sealed)
+	if err != nil {
+		return err
+	}
+
+	// the decrypted object only contains the sensitive fields, decode it over the user
+	return json.Unmarshal(plaintext, user)
+}
+
+// blindIndex returns the key under which value is stored in an index bucket. If a master
+// key is loaded this is an HMAC of the value so that the index doesn't contain the value
+func blindIndex(value string) string {
+	ring.RLock()
+	defer ring.RUnlock()
+
+	if ring.master == nil || value == "" {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, ring.keys[indexKeyID])
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
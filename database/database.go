@@ -1,13 +1,18 @@
 package database
 
 import (
+	"bytes"
+	"log"
+
 	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
 	consts "github.com/YaleOpenLab/openx/consts"
 	"github.com/boltdb/bolt"
 )
 
 // the database package contains the handlers necesssary for openx to interact with the
-// underlying boltdb database
+// underlying database. boltdb is used by default, other backends can be plugged in through
+// the Store interface
 
 // UserBucket is the bucket in which we'll store openx users
 var UserBucket = []byte("Users")
@@ -15,19 +20,89 @@ var UserBucket = []byte("Users")
 // PlatformBucket is the bucket where we'll store platforms that are under openx1
 var PlatformBucket = []byte("Platforms")
 
-// CreateHomeDir creates the home and database directories
+// UsernameIndexBucket maps usernames to the key of the user in UserBucket
+var UsernameIndexBucket = []byte("UsernameIndex")
+
+// EmailIndexBucket maps email addresses to the key of the user in UserBucket
+var EmailIndexBucket = []byte("EmailIndex")
+
+// PubkeyIndexBucket maps Stellar public keys to the key of the user in UserBucket
+var PubkeyIndexBucket = []byte("PubkeyIndex")
+
+// CreateHomeDir creates the home and database directories along with the buckets in the
+// configured store
 func CreateHomeDir() {
 	edb.CreateDirs(consts.HomeDir, consts.DbDir)
-	db, _ := edb.CreateDB(consts.DbDir+consts.DbName, UserBucket, PlatformBucket)
-	db.Close()
+	err := createBuckets(UserBucket, PlatformBucket, UsernameIndexBucket, EmailIndexBucket, PubkeyIndexBucket, MetaBucket, AuditBucket, SessionBucket, SessionIndexBucket, RoleBucket, ApprovalBucket, LockoutBucket, WebAuthnBucket, PlatformNonceBucket, OAuthBucket, OIDCKeyBucket, LoginBucket, KnownDeviceBucket, ChallengeBucket, TransferBucket)
+	if err != nil {
+		log.Println("could not create buckets: ", err)
+	}
+	err = SeedRoles()
+	if err != nil {
+		log.Println("could not create default roles: ", err)
+	}
 }
 
-// OpenDB opens the db and returns a pointer to the database
+// OpenDB opens the bolt db file and returns a pointer to the database. This bypasses the
+// configured store and should only be used by tools that work with the bolt file directly
 func OpenDB() (*bolt.DB, error) {
 	return edb.OpenDB(consts.DbDir + consts.DbName)
 }
 
 // DeleteKeyFromBucket deletes an object from the passed bucket
 func DeleteKeyFromBucket(key int, bucketName []byte) error {
-	return edb.DeleteKeyFromBucket(consts.DbDir+consts.DbName, key, bucketName)
+	if bytes.Equal(bucketName, UserBucket) {
+		// users are referenced from the index buckets, clean those up as well
+		return deleteUser(key)
+	}
+	return deleteKey(bucketName, key)
+}
+
+// nextIndex allocates the next unused integer key in the passed bucket. This must be called
+// within the write transaction that inserts the new element so that concurrent inserts can't
+// be handed the same key. Keys are never reused, even if the element holding them is deleted.
+func nextIndex(b Bucket) (int, error) {
+	seq, err := b.Sequence()
+	if err != nil {
+		return 0, err
+	}
+
+	if seq == 0 {
+		// buckets created before we allocated keys with sequences have their keys allocated by
+		// counting elements, start the sequence after the largest of those
+		max := 0
+		err := b.ForEach(func(k, v []byte) error {
+			index, err := utils.ToInt(k)
+			if err == nil && index > max {
+				max = index
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		err = b.SetSequence(uint64(max))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return 0, err
+		}
+		iK, err := utils.ToByte(int(seq))
+		if err != nil {
+			return 0, err
+		}
+		// elements can be saved under an explicit index, skip past those
+		x, err := b.Get(iK)
+		if err != nil {
+			return 0, err
+		}
+		if x == nil {
+			return int(seq), nil
+		}
+	}
 }
@@ -3,19 +3,70 @@
 package database
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	googauth "github.com/Varunram/essentials/googauth"
 	"github.com/Varunram/essentials/utils"
 	xlm "github.com/Varunram/essentials/xlm"
 	assets "github.com/Varunram/essentials/xlm/assets"
 	consts "github.com/YaleOpenLab/openx/consts"
+	signer "github.com/YaleOpenLab/openx/signer"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
 	build "github.com/stellar/go/txnbuild"
 )
 
 // go test --tags="all" -coverprofile=test.txt .
+
+// setupTestStore points the package at a fresh memory store. The returned func puts the
+// default bolt store back
+func setupTestStore(t *testing.T) func() {
+	t.Helper()
+	consts.SetConsts(false)
+	SetStore(NewMemoryStore())
+	CreateHomeDir()
+	return func() { SetStore(NewBoltStore("")) }
+}
+
+// withMasterKey turns encryption on with a master key stored in a temporary key file. It
+// returns the path of the key file and a func that turns encryption off and removes the file
+func withMasterKey(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := dir + "/masterkey.hex"
+	err = LoadMasterKeyFile(keyFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return keyFile, func() {
+		disableEncryption()
+		os.RemoveAll(dir)
+	}
+}
 func TestDb(t *testing.T) {
 	var err error
 	consts.SetConsts(false)
@@ -29,7 +80,7 @@ func TestDb(t *testing.T) {
 
 	PlatformBucket = []byte("FakePlatforms")
 	UserBucket = []byte("FakeUsers")
-	err = NewPlatform("platform", "CODE", false)
+	_, _, err = NewPlatform("platform", false)
 	if err == nil {
 		t.Fatalf("unable to catch wrong platform bucket name")
 	}
@@ -202,8 +253,13 @@ func TestDb(t *testing.T) {
 		t.Fatalf("didn't fail on fake username and token")
 	}
 
-	user.AccessToken[accessToken] = 0
-	err = user.Save()
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		return putSession(b, hashToken(accessToken), Session{User: user.Index})
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -249,7 +305,7 @@ func TestDb(t *testing.T) {
 		t.Fatalf("can't catch fake username")
 	}
 
-	_, err = ValidateSeedpwd(user.Username, user.Pwhash, "fakeseedpwd")
+	_, err = ValidateSeedpwd(user.Username, userpwhash, "fakeseedpwd")
 	if err == nil {
 		t.Fatalf("can't catch fake seedpwd")
 	}
@@ -360,7 +416,7 @@ func TestDb(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unable to save user for banning, quitting")
 	}
-	user.Admin = true
+	user.Roles = append(user.Roles, RoleAdmin)
 	err = user.Save()
 	if err != nil {
 		t.Fatal(err)
@@ -430,7 +486,7 @@ func TestDb(t *testing.T) {
 
 	// end of user related tests
 
-	err = NewPlatform("platform", "CODE", false)
+	_, _, err = NewPlatform("platform", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -564,3 +620,2755 @@ func TestDb(t *testing.T) {
 
 	os.Remove(consts.DbDir + "/openx.db")
 }
+
+func TestUserIndexes(t *testing.T) {
+	defer setupTestStore(t)()
+
+	user, err := NewUser("indexuser", utils.SHA3hash("pass"), "x", "index@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewUser("otherindexuser", utils.SHA3hash("pass"), "x", "otherindex@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.StellarWallet.PublicKey = "GINDEXUSER"
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := RetrieveUserByUsername("indexuser")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("user not found by username: %v", err)
+	}
+	x, err = RetrieveUserByEmail("index@openx")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("user not found by email: %v", err)
+	}
+	x, err = RetrieveUserByPubkey("GINDEXUSER")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("user not found by pubkey: %v", err)
+	}
+	_, err = RetrieveUserByUsername("nouser")
+	if err == nil {
+		t.Fatalf("unknown username found")
+	}
+
+	// renames move the index references along with the user
+	user.Username = "renameduser"
+	user.Email = "renamed@openx"
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RetrieveUserByUsername("indexuser")
+	if err == nil {
+		t.Fatalf("old username still indexed")
+	}
+	_, err = RetrieveUserByEmail("index@openx")
+	if err == nil {
+		t.Fatalf("old email still indexed")
+	}
+	x, err = RetrieveUserByUsername("renameduser")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("user not found by new username: %v", err)
+	}
+	x, err = RetrieveUserByEmail("renamed@openx")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("user not found by new email: %v", err)
+	}
+
+	// values held by another user can't be taken over
+	other.Email = "renamed@openx"
+	err = other.Save()
+	if errors.Cause(err) != ErrIndexCollision {
+		t.Fatalf("email of another user taken over: %v", err)
+	}
+	other.Email = "otherindex@openx"
+	other.Username = "renameduser"
+	err = other.Save()
+	if errors.Cause(err) != ErrIndexCollision {
+		t.Fatalf("username of another user taken over: %v", err)
+	}
+	x, err = RetrieveUserByEmail("renamed@openx")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("email index changed by rejected save: %v", err)
+	}
+	x, err = RetrieveUser(other.Index)
+	if err != nil || x.Username != "otherindexuser" {
+		t.Fatalf("rejected save stored: %v", err)
+	}
+
+	// databases created before the indexes existed have their indexes rebuilt
+	err = store.Update(func(tx Tx) error {
+		for _, bucket := range [][]byte{UsernameIndexBucket, EmailIndexBucket, PubkeyIndexBucket} {
+			err := tx.DeleteBucket(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RetrieveUserByUsername("renameduser")
+	if err == nil {
+		t.Fatalf("user found without indexes")
+	}
+	count, err := RebuildUserIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 users to be indexed, got %d", count)
+	}
+	x, err = RetrieveUserByPubkey("GINDEXUSER")
+	if err != nil || x.Index != user.Index {
+		t.Fatalf("user not found by pubkey after rebuild: %v", err)
+	}
+	x, err = RetrieveUserByEmail("otherindex@openx")
+	if err != nil || x.Index != other.Index {
+		t.Fatalf("user not found by email after rebuild: %v", err)
+	}
+}
+
+func TestSeeds(t *testing.T) {
+	defer setupTestStore(t)()
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer.Default = signer.NewLocal(signer.NewKeystore(dir + "/keys"))
+	defer func() { signer.Default = nil }()
+
+	// new keys are imported into the signer which checks seedpwds from then on
+	user, err := NewUser("seeduser", utils.SHA3hash("pass"), "seedpwd", "seed@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.VerifySeedpwd("wrongpwd")
+	if err == nil {
+		t.Fatalf("wrong seedpwd verified")
+	}
+	err = user.VerifySeedpwd("seedpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// failed signups don't leave seeds behind in the signer
+	_, err = NewUser("otherseeduser", utils.SHA3hash("pass"), "seedpwd", "seed@openx")
+	if err == nil {
+		t.Fatalf("signup with a taken email succeeded")
+	}
+	files, err := ioutil.ReadDir(dir + "/keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the seeds of one user in the signer, found %d", len(files))
+	}
+
+	shares, err := user.NewRecoveryShares("seedpwd")
+	if err != nil || len(shares) != 3 {
+		t.Fatalf("no recovery shares created: %v", err)
+	}
+
+	err = user.ChangeSeedpwd("wrongpwd", "newpwd")
+	if err == nil {
+		t.Fatalf("seedpwd changed with the wrong old seedpwd")
+	}
+	oldSeed := user.StellarWallet.EncryptedSeed
+	err = user.ChangeSeedpwd("seedpwd", "newpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldSeed, user.StellarWallet.EncryptedSeed) {
+		t.Fatalf("new encrypted seed not stored with user")
+	}
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.VerifySeedpwd("newpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ImportSeed(oldSeed, user.StellarWallet.PublicKey, "seedpwd")
+	if err == nil {
+		t.Fatalf("seed with the old seedpwd imported over the current one")
+	}
+
+	// seeds that only live in the database are imported on start
+	signer.Default = signer.NewLocal(signer.NewKeystore(dir + "/newkeys"))
+	err = user.VerifySeedpwd("newpwd")
+	if err == nil {
+		t.Fatalf("seedpwd verified without a seed")
+	}
+	err = ImportSeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.VerifySeedpwd("newpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentSignup(t *testing.T) {
+	consts.SetConsts(false)
+	defer SetStore(NewBoltStore(""))
+
+	for _, backend := range []string{"bolt", "sqlite", "memory"} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "openx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			consts.HomeDir = dir
+			consts.DbDir = dir + "/database/"
+
+			store, err := NewStore(backend, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			SetStore(store)
+			CreateHomeDir()
+			testConcurrentSignup(t)
+		})
+	}
+}
+
+func testConcurrentSignup(t *testing.T) {
+	// leave a hole so that the allocator has to skip explicitly saved users
+	var existing User
+	existing.Index = 2
+	existing.Username = "existing"
+	err := existing.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 10
+	var wg sync.WaitGroup
+	indices := make(chan int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := NewUser("user"+strconv.Itoa(i), utils.SHA3hash("pass"), "x", "user"+strconv.Itoa(i)+"@openx")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			indices <- user.Index
+		}(i)
+	}
+	wg.Wait()
+	close(indices)
+
+	seen := make(map[int]bool)
+	for index := range indices {
+		if seen[index] || index == existing.Index {
+			t.Fatalf("index %d allocated twice", index)
+		}
+		seen[index] = true
+	}
+
+	users, err := RetrieveAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != n+1 {
+		t.Fatalf("expected %d users, found %d", n+1, len(users))
+	}
+
+	// only one of the signups racing for the same username should go through
+	var successes int
+	var mutex sync.Mutex
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := NewUser("samename", utils.SHA3hash("pass"), "x", "same"+strconv.Itoa(i)+"@openx")
+			if err == nil {
+				mutex.Lock()
+				successes++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if successes != 1 {
+		t.Fatalf("expected one signup with a shared username to succeed, %d did", successes)
+	}
+
+	// deleted indices must not be handed out again
+	err = DeleteKeyFromBucket(n+2, UserBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := NewUser("afterdelete", utils.SHA3hash("pass"), "x", "afterdelete@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Index <= n+2 {
+		t.Fatalf("index %d reused after delete", user.Index)
+	}
+
+	_, err = NewUser("otheruser", utils.SHA3hash("pass"), "x", "afterdelete@openx")
+	if err == nil {
+		t.Fatalf("able to sign up with an email that's already in use")
+	}
+}
+
+func TestForEachPrefix(t *testing.T) {
+	consts.SetConsts(false)
+	defer SetStore(NewBoltStore(""))
+
+	for _, backend := range []string{"bolt", "sqlite", "memory"} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "openx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			consts.HomeDir = dir
+			consts.DbDir = dir + "/database/"
+
+			store, err := NewStore(backend, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			SetStore(store)
+			CreateHomeDir()
+
+			bucket := []byte("Prefixes")
+			keys := []string{"a", "abc", "ab|1", "ab|2", "ab\xff", "ab\xff\xff", "b"}
+			err = store.Update(func(tx Tx) error {
+				b, err := tx.CreateBucketIfNotExists(bucket)
+				if err != nil {
+					return err
+				}
+				for _, k := range keys {
+					err = b.Put([]byte(k), []byte(k))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for prefix, expected := range map[string][]string{
+				"ab|":    {"ab|1", "ab|2"},
+				"ab":     {"abc", "ab|1", "ab|2", "ab\xff", "ab\xff\xff"},
+				"ab\xff": {"ab\xff", "ab\xff\xff"},
+				"c":      nil,
+				"":       keys,
+			} {
+				var found []string
+				err = store.View(func(tx Tx) error {
+					b, err := tx.Bucket(bucket)
+					if err != nil {
+						return err
+					}
+					return b.ForEachPrefix([]byte(prefix), func(k, v []byte) error {
+						found = append(found, string(k))
+						return nil
+					})
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(found, expected) {
+					t.Fatalf("prefix %q: expected %q, got %q", prefix, expected, found)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	defer setupTestStore(t)()
+
+	registered := migrations
+	defer func() { migrations = registered }()
+
+	// a user written before records were versioned, with its name in a field that has since been
+	// renamed, a plaintext access token and the admin flag
+	base := SchemaVersion(UserBucket)
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(UserBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("1"), []byte(`{"Index":1,"Username":"legacy","FullName":"Legacy User","AccessToken":{"token":1},"Admin":true}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RegisterMigration(Migration{
+		Version:     base,
+		Bucket:      UserBucket,
+		Description: "duplicate version",
+		Migrate:     func(record Record) error { return nil },
+	})
+	if err == nil {
+		t.Fatalf("able to register a migration with an existing version")
+	}
+
+	err = RegisterMigration(Migration{
+		Version:     base + 1,
+		Bucket:      UserBucket,
+		Description: "rename FullName to Name",
+		Migrate: func(record Record) error {
+			if name, exists := record["FullName"]; exists {
+				record["Name"] = name
+				delete(record, "FullName")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := RunMigrations(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != base+1 || len(reports[base].Changed) != 1 || reports[base].Stamped != 1 {
+		t.Fatalf("unexpected dry run reports: %v", reports)
+	}
+
+	user, err := RetrieveUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "" || user.SchemaVersion != 0 {
+		t.Fatalf("dry run modified the database")
+	}
+
+	_, err = RunMigrations(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err = RetrieveUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Legacy User" || user.SchemaVersion != base+1 {
+		t.Fatalf("user not migrated: %v %d", user.Name, user.SchemaVersion)
+	}
+	if len(user.Roles) != 1 || user.Roles[0] != RoleAdmin {
+		t.Fatalf("admin flag not migrated to roles: %v", user.Roles)
+	}
+
+	version, err := StoredSchemaVersion(UserBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != base+1 {
+		t.Fatalf("expected schema version %d, got %d", base+1, version)
+	}
+
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket(UserBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get([]byte("1"))
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(x, []byte("AccessToken")) {
+			t.Fatalf("plaintext access token not dropped by migration")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = RetrieveUserByUsername("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err = RunMigrations(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Fatalf("migrations ran twice")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	consts.SetConsts(false)
+	defer SetStore(NewBoltStore(""))
+
+	for _, backend := range []string{"bolt", "memory"} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "openx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			consts.HomeDir = dir
+			consts.DbDir = dir + "/database/"
+
+			store, err := NewStore(backend, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetStore(store)
+			CreateHomeDir()
+
+			user, err := NewUser("snapshot", utils.SHA3hash("pass"), "x", "snapshot@openx")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, passphrase := range []string{"", "secret"} {
+				path := dir + "/snapshot" + passphrase + ".snap"
+				err = SaveSnapshot(path, passphrase)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = NewUser("aftersnapshot"+passphrase, utils.SHA3hash("pass"), "x", "after"+passphrase+"@openx")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if passphrase != "" {
+					err = RestoreSnapshotFile(path, "wrongpass")
+					if err == nil {
+						t.Fatalf("able to restore encrypted snapshot with wrong passphrase")
+					}
+					err = RestoreSnapshotFile(path, "")
+					if err == nil {
+						t.Fatalf("able to restore encrypted snapshot without passphrase")
+					}
+				}
+
+				err = RestoreSnapshotFile(path, passphrase)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				users, err := RetrieveAllUsers()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(users) != 1 || users[0].Index != user.Index {
+					t.Fatalf("database not restored to snapshot, found %d users", len(users))
+				}
+
+				_, err = RetrieveUserByUsername("aftersnapshot" + passphrase)
+				if err == nil {
+					t.Fatalf("index not restored to snapshot")
+				}
+			}
+
+			err = ioutil.WriteFile(dir+"/corrupt.snap", []byte("not a database"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = RestoreSnapshotFile(dir+"/corrupt.snap", "")
+			if err == nil {
+				t.Fatalf("able to restore corrupt snapshot")
+			}
+
+			// encrypted snapshots are streamed in chunks and a missing chunk fails the restore
+			chunkSize := snapshotChunkSize
+			snapshotChunkSize = 1024
+			var chunked bytes.Buffer
+			err = WriteSnapshot(&chunked, "secret")
+			snapshotChunkSize = chunkSize
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = RestoreSnapshot(bytes.NewReader(chunked.Bytes()[:chunked.Len()-1024]), "secret")
+			if err == nil {
+				t.Fatalf("able to restore truncated snapshot")
+			}
+			err = RestoreSnapshot(&chunked, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 5; i++ {
+				err = ioutil.WriteFile(dir+"/"+snapshotPrefix+strconv.Itoa(i)+snapshotExt, []byte{}, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = pruneSnapshots(dir, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				_, err = os.Stat(dir + "/" + snapshotPrefix + strconv.Itoa(i) + snapshotExt)
+				if (i < 3) != os.IsNotExist(err) {
+					t.Fatalf("snapshot %d not pruned correctly", i)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	defer setupTestStore(t)()
+
+	// a user saved before encryption was turned on
+	plain, err := NewUser("plainuser", utils.SHA3hash("pass"), "x", "plain@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, unload := withMasterKey(t)
+	defer unload()
+
+	count, err := ReencryptUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected one user to be encrypted, got %d", count)
+	}
+
+	user, err := NewUser("secretuser", utils.SHA3hash("pass"), "x", "secret@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Address = "221B Baker Street"
+	user.AnchorKYC.Name = "Sherlock Holmes"
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := func() []byte {
+		var dump []byte
+		err := store.View(func(tx Tx) error {
+			return tx.ForEachBucket(func(name []byte) error {
+				b, err := tx.Bucket(name)
+				if err != nil {
+					return err
+				}
+				return b.ForEach(func(k, v []byte) error {
+					dump = append(dump, k...)
+					dump = append(dump, v...)
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dump
+	}
+
+	for _, secret := range []string{"secret@openx", "plain@openx", "Baker Street", "Sherlock"} {
+		if bytes.Contains(raw(), []byte(secret)) {
+			t.Fatalf("%s stored in plaintext", secret)
+		}
+	}
+
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "secret@openx" || user.Address != "221B Baker Street" || user.AnchorKYC.Name != "Sherlock Holmes" {
+		t.Fatalf("sensitive fields not decrypted: %v %v %v", user.Email, user.Address, user.AnchorKYC.Name)
+	}
+
+	for _, email := range []string{"plain@openx", "secret@openx"} {
+		_, err = RetrieveUserByEmail(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = NewUser("otheruser", utils.SHA3hash("pass"), "x", "plain@openx")
+	if err == nil {
+		t.Fatalf("able to sign up with an email that's already in use")
+	}
+
+	id, err := RotateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Fatalf("expected data key 2, got %d", id)
+	}
+
+	count, err = ReencryptUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected two users to be reencrypted, got %d", count)
+	}
+
+	var old bytes.Buffer
+	err = WriteSnapshot(&old, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RotateMasterKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshots taken before the master key was rotated can't be read with the new one
+	err = RestoreSnapshot(bytes.NewReader(old.Bytes()), "")
+	if err == nil {
+		t.Fatalf("able to restore snapshot encrypted with the old master key")
+	}
+	var current bytes.Buffer
+	err = WriteSnapshot(&current, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreSnapshot(&current, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start over with the rotated key file as openx would on restart
+	disableEncryption()
+	_, err = RetrieveUser(plain.Index)
+	if err == nil {
+		t.Fatalf("able to read encrypted user without master key")
+	}
+
+	err = LoadMasterKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err = RetrieveUser(plain.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Email != "plain@openx" {
+		t.Fatalf("could not decrypt user after key rotation")
+	}
+
+	err = SetMasterKey(bytes.Repeat([]byte{1}, 32))
+	if err == nil {
+		t.Fatalf("able to load data keys with the wrong master key")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	defer setupTestStore(t)()
+
+	for i := 1; i <= 12; i++ {
+		err := AppendAudit(i%3, "admin", AuditVerifyUser, strconv.Itoa(i), "", map[string]string{"ip": "127.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 12 {
+		t.Fatalf("expected 12 audit entries, verified %d", count)
+	}
+
+	entries, err := QueryAudit(AuditFilter{Actor: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Target != "10" || entries[1].Target != "7" {
+		t.Fatalf("unexpected audit query result: %v", entries)
+	}
+
+	entries, err = QueryAudit(AuditFilter{Target: "11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry for target 11, got %d", len(entries))
+	}
+
+	tamper := func(fn func(b Bucket) error) {
+		err := store.Update(func(tx Tx) error {
+			b, err := tx.Bucket(AuditBucket)
+			if err != nil {
+				return err
+			}
+			return fn(b)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// modify an entry in the middle of the chain
+	original, err := retrieve(AuditBucket, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper(func(b Bucket) error {
+		return b.Put([]byte("5"), bytes.Replace(original, []byte(`"Target":"5"`), []byte(`"Target":"6"`), 1))
+	})
+	_, err = VerifyAudit()
+	if err == nil {
+		t.Fatalf("unable to detect a modified audit entry")
+	}
+
+	// restore it and drop the latest entry instead
+	tamper(func(b Bucket) error {
+		return b.Put([]byte("5"), original)
+	})
+	_, err = VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper(func(b Bucket) error {
+		return b.Delete([]byte("12"))
+	})
+	_, err = VerifyAudit()
+	if err == nil {
+		t.Fatalf("unable to detect a removed audit entry")
+	}
+}
+
+func TestQueryUsers(t *testing.T) {
+	defer setupTestStore(t)()
+
+	for i := 1; i <= 7; i++ {
+		user, err := NewUser("user"+strconv.Itoa(i), "pwhash", "seedpwd", "user"+strconv.Itoa(i)+"@test.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Name = "Name " + strconv.Itoa(8-i)
+		user.Kyc = i%2 == 0
+		user.Country = "US"
+		if i > 5 {
+			user.Country = "IN"
+		}
+		user.Reputation = float64(i % 3)
+		err = user.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kyc := true
+	page, err := QueryUsers(UserQuery{Kyc: &kyc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Users) != 3 || page.Next != "" {
+		t.Fatalf("expected 3 kyc users in a single page, got %d of %d", len(page.Users), page.Total)
+	}
+
+	page, err = QueryUsers(UserQuery{Country: "in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("expected 2 users from IN, got %d", page.Total)
+	}
+
+	page, err = QueryUsers(UserQuery{Search: "USER3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Users[0].Username != "user3" {
+		t.Fatalf("search for user3 failed: %v", page.Users)
+	}
+
+	page, err = QueryUsers(UserQuery{SignedUpAfter: utils.Unix() + 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 0 {
+		t.Fatalf("expected no users signed up in the future, got %d", page.Total)
+	}
+
+	// walk through all users three at a time sorted by name
+	var names []string
+	q := UserQuery{SortBy: SortByName, Limit: 3}
+	for {
+		page, err = QueryUsers(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range page.Users {
+			names = append(names, user.Name)
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	if len(names) != 7 || names[0] != "Name 1" || names[6] != "Name 7" {
+		t.Fatalf("unexpected pagination result: %v", names)
+	}
+
+	var reputations []float64
+	q = UserQuery{SortBy: SortByReputation, Descending: true, Limit: 2}
+	for {
+		page, err = QueryUsers(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range page.Users {
+			reputations = append(reputations, user.Reputation)
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	if len(reputations) != 7 || reputations[0] != 2 || reputations[6] != 0 {
+		t.Fatalf("unexpected descending pagination result: %v", reputations)
+	}
+
+	_, err = QueryUsers(UserQuery{SortBy: "pwhash"})
+	if err == nil {
+		t.Fatalf("able to sort by an unsupported field")
+	}
+
+	_, err = QueryUsers(UserQuery{Cursor: "invalid"})
+	if err == nil {
+		t.Fatalf("able to query with an invalid cursor")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	defer setupTestStore(t)()
+
+	user, err := NewUser("sessions", utils.SHA3hash("pass"), "x", "sessions@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Conf = true
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := user.NewSession("laptop", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens must not be stored in plaintext
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if bytes.Contains(k, []byte(first)) || bytes.Contains(v, []byte(first)) {
+				t.Fatalf("access token stored in plaintext")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make the first session the oldest one
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(hashToken(first))
+		if err != nil {
+			return err
+		}
+		var session Session
+		err = json.Unmarshal(x, &session)
+		if err != nil {
+			return err
+		}
+		session.Created -= 100
+		session.LastUsed -= 100
+		return putSession(b, hashToken(first), session)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ValidateAccessToken(user.Username, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := RetrieveSessions(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Device != "laptop" || sessions[0].LastUsed != sessions[0].Created+100 {
+		t.Fatalf("unexpected sessions: %v", sessions)
+	}
+
+	var tokens []string
+	for i := 0; i < MaxSessions; i++ {
+		token, err := user.NewSession("phone", "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	_, err = ValidateAccessToken(user.Username, first)
+	if err == nil {
+		t.Fatalf("oldest session not revoked when exceeding MaxSessions")
+	}
+
+	sessions, err = RetrieveSessions(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != MaxSessions {
+		t.Fatalf("expected %d sessions, got %d", MaxSessions, len(sessions))
+	}
+
+	other, err := NewUser("othersessions", utils.SHA3hash("pass"), "x", "othersessions@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sessions created within the same second can't be told apart by their order, look up the id
+	var last Session
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(hashToken(tokens[len(tokens)-1]))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(x, &last)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RevokeSession(other.Index, last.ID)
+	if err == nil {
+		t.Fatalf("able to revoke the session of another user")
+	}
+
+	err = RevokeSession(user.Index, last.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateAccessToken(user.Username, tokens[len(tokens)-1])
+	if err == nil {
+		t.Fatalf("revoked session still valid")
+	}
+	_, err = ValidateAccessToken(user.Username, tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = user.AllLogout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = RetrieveSessions(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("sessions left after logging out everywhere")
+	}
+
+	// sessions of users who never come back are removed by the sweep
+	expired, err := other.NewSession("tablet", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := other.NewSession("tablet", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(hashToken(expired))
+		if err != nil {
+			return err
+		}
+		var session Session
+		err = json.Unmarshal(x, &session)
+		if err != nil {
+			return err
+		}
+		session.Expiry = utils.Unix() - 1
+		return putSession(b, hashToken(expired), session)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := SweepSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 expired session to be swept, got %d", count)
+	}
+	err = store.View(func(tx Tx) error {
+		keys, err := userSessionKeys(tx, other.Index)
+		if err != nil {
+			return err
+		}
+		if len(keys) != 1 || keys[0] != string(hashToken(live)) {
+			t.Fatalf("session index not rebuilt by the sweep: %v", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = RetrieveSessions(other.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 live session after the sweep, got %d", len(sessions))
+	}
+}
+
+func TestPasswords(t *testing.T) {
+	defer setupTestStore(t)()
+
+	pwhash := utils.SHA3hash("pass")
+	user, err := NewUser("passwords", pwhash, "x", "passwords@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Pwhash == pwhash || !strings.HasPrefix(user.Pwhash, argon2Prefix) {
+		t.Fatalf("password not hashed with argon2id: %s", user.Pwhash)
+	}
+
+	other, err := NewUser("passwords2", pwhash, "x", "passwords2@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Pwhash == user.Pwhash {
+		t.Fatalf("same password hashed to the same value for two users")
+	}
+
+	_, err = ValidatePwhashReg(user.Username, pwhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidatePwhashReg(user.Username, utils.SHA3hash("wrong"))
+	if err == nil {
+		t.Fatalf("able to validate with the wrong password")
+	}
+
+	// a user stored before passwords were hashed on the server
+	user.Pwhash = pwhash
+	user.Conf = true
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ValidatePwhash(user.Username, utils.SHA3hash("wrong"))
+	if err == nil {
+		t.Fatalf("able to validate a legacy user with the wrong password")
+	}
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Pwhash != pwhash {
+		t.Fatalf("legacy password rehashed on a failed login")
+	}
+
+	_, err = ValidatePwhash(user.Username, pwhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.Pwhash, argon2Prefix) {
+		t.Fatalf("legacy password not rehashed on login")
+	}
+
+	// hashes created with outdated params are upgraded as well
+	params := Argon2Params
+	defer func() { Argon2Params = params }()
+	Argon2Params.Time++
+	old := user.Pwhash
+
+	_, err = ValidatePwhash(user.Username, pwhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Pwhash == old || !strings.Contains(user.Pwhash, "t="+strconv.Itoa(int(Argon2Params.Time))) {
+		t.Fatalf("password hash not upgraded to the new params: %s", user.Pwhash)
+	}
+
+	_, err = ValidatePwhash(user.Username, pwhash)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	defer setupTestStore(t)()
+
+	roles, err := RetrieveRoles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != len(DefaultRoles) {
+		t.Fatalf("expected %d default roles, got %d", len(DefaultRoles), len(roles))
+	}
+
+	super, err := NewUser("super", utils.SHA3hash("pass"), "x", "super@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector, err := NewUser("inspector", utils.SHA3hash("pass"), "x", "inspector@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = GrantRole(super.Index, RoleSuperAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GrantRole(super.Index, RoleSuperAdmin)
+	if err == nil {
+		t.Fatalf("able to grant the same role twice")
+	}
+	err = GrantRole(inspector.Index, "doesnotexist")
+	if err == nil {
+		t.Fatalf("able to grant a role that doesn't exist")
+	}
+	err = AddInspector(inspector.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	super, err = RetrieveUser(super.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector, err = RetrieveUser(inspector.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, err := super.HasPermission(PermKillServer)
+	if err != nil || !allowed {
+		t.Fatalf("superadmin can't kill the server: %v", err)
+	}
+	allowed, err = inspector.HasPermission(PermKyc)
+	if err != nil || !allowed {
+		t.Fatalf("inspector can't authorize kyc: %v", err)
+	}
+	allowed, err = inspector.HasPermission(PermBanUsers)
+	if err != nil || allowed {
+		t.Fatalf("inspector able to ban users")
+	}
+
+	err = inspector.SetBan(super.Index)
+	if err == nil {
+		t.Fatalf("inspector able to ban a user")
+	}
+	err = inspector.Authorize(super.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// role definitions are read from the database
+	err = SaveRole(Role{Name: RoleKycInspector, Permissions: []string{PermViewUsers}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, err = inspector.HasPermission(PermKyc)
+	if err != nil || allowed {
+		t.Fatalf("permission removed from role still granted")
+	}
+
+	admins, err := RetrieveAllAdmins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admins) != 1 || admins[0].Index != super.Index {
+		t.Fatalf("unexpected admins: %v", admins)
+	}
+
+	err = RevokeRole(super.Index, RoleSuperAdmin)
+	if err == nil {
+		t.Fatalf("able to revoke the last superadmin")
+	}
+	err = RevokeRole(inspector.Index, RoleKycInspector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspector, err = RetrieveUser(inspector.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inspector.Roles) != 0 {
+		t.Fatalf("role not revoked: %v", inspector.Roles)
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	defer setupTestStore(t)()
+
+	registered, finalized := executors, finalizers
+	defer func() { executors, finalizers = registered, finalized }()
+	executors = make(map[string]ApprovalExecutor)
+	finalizers = make(map[string]func(Proposal))
+
+	var executed []Proposal
+	RegisterApprovalExecutor(AuditVerifyUser, func(p Proposal, approvers []User) error {
+		executed = append(executed, p)
+		return nil
+	})
+	// finalizers run once the proposal has been saved as executed
+	var saved []Proposal
+	RegisterApprovalFinalizer(AuditVerifyUser, func(p Proposal) {
+		stored, err := RetrieveProposal(p.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, stored)
+	})
+
+	var admins []User
+	for i := 0; i < 3; i++ {
+		user, err := NewUser("approver"+strconv.Itoa(i), utils.SHA3hash("pass"), "x", "approver"+strconv.Itoa(i)+"@openx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = GrantRole(user.Index, RoleAdmin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err = RetrieveUser(user.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		admins = append(admins, user)
+	}
+	outsider, err := NewUser("outsider", utils.SHA3hash("pass"), "x", "outsider@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ProposeAction(outsider, AuditVerifyUser, "1")
+	if err == nil {
+		t.Fatalf("user without permission able to propose an action")
+	}
+	_, err = ProposeAction(admins[0], AuditFreezeServer, "")
+	if err == nil {
+		t.Fatalf("able to propose an action without an executor")
+	}
+
+	policies := ApprovalPolicies
+	defer func() { ApprovalPolicies = policies }()
+	ApprovalPolicies = map[string]ApprovalPolicy{
+		AuditVerifyUser: {Required: 3, Window: 3600, Permission: PermVerifyUsers},
+	}
+
+	p, err := ProposeAction(admins[0], AuditVerifyUser, strconv.Itoa(outsider.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != ProposalPending || len(executed) != 0 {
+		t.Fatalf("action executed before quorum")
+	}
+
+	_, err = ApproveProposal(admins[0], p.Index)
+	if err == nil {
+		t.Fatalf("proposer able to approve twice")
+	}
+	_, err = ApproveProposal(outsider, p.Index)
+	if err == nil {
+		t.Fatalf("user without permission able to approve")
+	}
+
+	p, err = ApproveProposal(admins[1], p.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != ProposalPending || len(executed) != 0 {
+		t.Fatalf("action executed before quorum")
+	}
+
+	p, err = ApproveProposal(admins[2], p.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != ProposalExecuted || len(executed) != 1 {
+		t.Fatalf("action not executed on quorum: %s", p.Status)
+	}
+	if len(saved) != 1 || saved[0].Status != ProposalExecuted {
+		t.Fatalf("finalizer ran before the proposal was saved as executed: %v", saved)
+	}
+
+	// cancelled and expired proposals can't be approved
+	p, err = ProposeAction(admins[0], AuditVerifyUser, strconv.Itoa(outsider.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CancelProposal(outsider, p.Index)
+	if err == nil {
+		t.Fatalf("user without permission able to cancel a proposal")
+	}
+	_, err = CancelProposal(admins[1], p.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ApproveProposal(admins[2], p.Index)
+	if err == nil {
+		t.Fatalf("able to approve a cancelled proposal")
+	}
+
+	ApprovalPolicies[AuditVerifyUser] = ApprovalPolicy{Required: 2, Window: -1, Permission: PermVerifyUsers}
+	p, err = ProposeAction(admins[0], AuditVerifyUser, strconv.Itoa(outsider.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ApproveProposal(admins[1], p.Index)
+	if err == nil {
+		t.Fatalf("able to approve an expired proposal")
+	}
+
+	// actions requiring a single approval run right away
+	ApprovalPolicies[AuditVerifyUser] = ApprovalPolicy{Required: 1, Window: 3600, Permission: PermVerifyUsers}
+	p, err = ProposeAction(admins[0], AuditVerifyUser, strconv.Itoa(outsider.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != ProposalExecuted || len(executed) != 2 {
+		t.Fatalf("single approval action not executed")
+	}
+
+	proposals, err := RetrieveProposals(ProposalExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proposals) != 1 {
+		t.Fatalf("expected one expired proposal, got %d", len(proposals))
+	}
+
+	_, err = VerifyAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := QueryAudit(AuditFilter{Action: AuditApprove})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 approvals in the audit log, got %d", len(entries))
+	}
+
+	// executing proposals can only be cancelled once they have been abandoned
+	ApprovalPolicies[AuditVerifyUser] = ApprovalPolicy{Required: 2, Window: 3600, Permission: PermVerifyUsers}
+	p, err = ProposeAction(admins[1], AuditVerifyUser, strconv.Itoa(outsider.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Status = ProposalExecuting
+	p.Executing = utils.Unix()
+	err = saveProposal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CancelProposal(admins[2], p.Index)
+	if err == nil {
+		t.Fatalf("able to cancel a proposal while it is executing")
+	}
+	p.Executing -= ExecutionTimeout + 1
+	err = saveProposal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = CancelProposal(admins[2], p.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != ProposalFailed || p.Result == "" {
+		t.Fatalf("abandoned proposal not marked as failed: %v", p)
+	}
+
+	// proposals whose approvers can't be retrieved fail instead of executing forever
+	p, err = ProposeAction(admins[0], AuditVerifyUser, strconv.Itoa(outsider.Index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deleteUser(admins[0].Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ApproveProposal(admins[1], p.Index)
+	if err == nil {
+		t.Fatalf("proposal with a deleted approver executed")
+	}
+	p, err = RetrieveProposal(p.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != ProposalFailed || p.Result == "" || len(executed) != 2 {
+		t.Fatalf("proposal with a deleted approver not marked as failed: %v", p)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	defer setupTestStore(t)()
+
+	user, err := NewUser("locked", utils.SHA3hash("pass"), "x", "locked@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var code string
+	for i := 0; i < MaxAuthFailures; i++ {
+		lockout, c, err := RecordAuthFailure(user.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < MaxAuthFailures-1 && (c != "" || lockout.RetryAfter() != 0) {
+			t.Fatalf("account locked after %d failures", i+1)
+		}
+		code = c
+	}
+	if code == "" {
+		t.Fatalf("account not locked after %d failures", MaxAuthFailures)
+	}
+
+	lockout, err := RetrieveLockout(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout.RetryAfter() == 0 || lockout.RetryAfter() > LockoutBase {
+		t.Fatalf("unexpected first lockout duration: %d", lockout.RetryAfter())
+	}
+
+	// further lockouts last longer
+	for i := 0; i < MaxAuthFailures; i++ {
+		lockout, code, err = RecordAuthFailure(user.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lockout.Lockouts != 2 || lockout.RetryAfter() <= LockoutBase {
+		t.Fatalf("lockout not progressive: %d lockouts, %d seconds", lockout.Lockouts, lockout.RetryAfter())
+	}
+	if lockoutDuration(100) != MaxLockout {
+		t.Fatalf("lockout duration not capped")
+	}
+
+	_, err = UnlockUser("locked", "wrongcode")
+	if err == nil {
+		t.Fatalf("unlocked account with wrong code")
+	}
+
+	_, err = UnlockUser("locked", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockout, err = RetrieveLockout(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout.RetryAfter() != 0 || lockout.Lockouts != 0 {
+		t.Fatalf("account still locked after unlocking")
+	}
+
+	// unlock codes can't be reused
+	_, err = UnlockUser("locked", code)
+	if err == nil {
+		t.Fatalf("unlock code reused")
+	}
+
+	_, _, err = RecordAuthFailure(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ClearAuthFailures(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockout, err = RetrieveLockout(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout.Failures != 0 {
+		t.Fatalf("failures not cleared")
+	}
+}
+
+// currentOtp returns the otp for secret in the current time step, waiting for the next step
+// if the current one is about to end
+func currentOtp(secret string) string {
+	if time.Now().Unix()%30 > 27 {
+		time.Sleep(3 * time.Second)
+	}
+	code := googauth.ComputeCode(base32.StdEncoding.EncodeToString([]byte(secret)), time.Now().Unix()/30)
+	return fmt.Sprintf("%06d", code)
+}
+
+func TestTwoFA(t *testing.T) {
+	defer setupTestStore(t)()
+
+	user, err := NewUser("twofa", utils.SHA3hash("pass"), "x", "twofa@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = user.Verify2FA("123456")
+	if err == nil {
+		t.Fatalf("verified otp of user without 2FA")
+	}
+
+	_, err = user.Generate2FA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TwoFAEnabled || user.TwoFASecret != "" {
+		t.Fatalf("2FA enabled before confirmation")
+	}
+
+	_, err = user.Confirm2FA("000000")
+	if err == nil && currentOtp(user.TwoFAPendingSecret) != "000000" {
+		t.Fatalf("2FA confirmed with wrong otp")
+	}
+
+	codes, err := user.Confirm2FA(currentOtp(user.TwoFAPendingSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.TwoFAEnabled || len(codes) != BackupCodeCount {
+		t.Fatalf("2FA not enabled after confirmation")
+	}
+
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otp := currentOtp(user.TwoFASecret)
+	result, err := user.Verify2FA(otp)
+	if err != nil || !result {
+		t.Fatalf("could not verify otp: %v", err)
+	}
+	result, err = user.Verify2FA(otp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result {
+		t.Fatalf("otp reused")
+	}
+
+	// backup codes are single use
+	result, err = user.Verify2FA(codes[0])
+	if err != nil || !result {
+		t.Fatalf("could not verify backup code: %v", err)
+	}
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.TwoFABackupCodes) != BackupCodeCount-1 {
+		t.Fatalf("backup code not used up")
+	}
+	result, err = user.Verify2FA(codes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result {
+		t.Fatalf("backup code reused")
+	}
+
+	err = user.Disable2FA("wrongcode")
+	if err == nil {
+		t.Fatalf("2FA disabled with wrong otp")
+	}
+	err = user.Disable2FA(codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TwoFAEnabled || user.TwoFASecret != "" || len(user.TwoFABackupCodes) != 0 {
+		t.Fatalf("2FA not disabled")
+	}
+}
+
+// softAuthenticator is a software WebAuthn authenticator holding a single P-256 credential
+type softAuthenticator struct {
+	id     []byte
+	key    *ecdsa.PrivateKey
+	count  uint32
+	origin string
+}
+
+func newSoftAuthenticator() (*softAuthenticator, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	return &softAuthenticator{id: id, key: key, origin: WebAuthnRP.Origins[0]}, nil
+}
+
+// padTo32 left pads a big endian coordinate to 32 bytes
+func padTo32(x *big.Int) []byte {
+	b := x.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// authData returns the authenticator data with the credential attached if attested is set
+func (a *softAuthenticator) authData(attested bool) ([]byte, error) {
+	rpIDHash := sha256.Sum256([]byte(WebAuthnRP.RPID))
+	data := append([]byte{}, rpIDHash[:]...)
+	flags := byte(flagUserPresent)
+	if attested {
+		flags |= flagAttested
+	}
+	data = append(data, flags)
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, a.count)
+	data = append(data, counter...)
+	if !attested {
+		return data, nil
+	}
+
+	data = append(data, make([]byte, 16)...) // aaguid
+	idLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(idLen, uint16(len(a.id)))
+	data = append(data, idLen...)
+	data = append(data, a.id...)
+	key, err := cbor.Marshal(map[int]interface{}{
+		1: 2, 3: coseES256, -1: 1, -2: padTo32(a.key.X), -3: padTo32(a.key.Y),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, key...), nil
+}
+
+// clientDataJSON returns the base64url encoded client data of a ceremony
+func (a *softAuthenticator) clientDataJSON(ceremony string, challenge string) ([]byte, string) {
+	raw, _ := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: a.origin})
+	return raw, base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// create performs the authenticator side of a registration ceremony
+func (a *softAuthenticator) create(opts CredentialCreationOptions) (CredentialResponse, error) {
+	var response CredentialResponse
+	authData, err := a.authData(true)
+	if err != nil {
+		return response, err
+	}
+	att, err := cbor.Marshal(map[string]interface{}{
+		"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData,
+	})
+	if err != nil {
+		return response, err
+	}
+
+	response.ID = base64.RawURLEncoding.EncodeToString(a.id)
+	response.Type = "public-key"
+	_, response.Response.ClientDataJSON = a.clientDataJSON("webauthn.create", opts.Challenge)
+	response.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(att)
+	return response, nil
+}
+
+// get performs the authenticator side of an assertion ceremony
+func (a *softAuthenticator) get(opts CredentialRequestOptions) (CredentialResponse, error) {
+	var response CredentialResponse
+	a.count++
+	authData, err := a.authData(false)
+	if err != nil {
+		return response, err
+	}
+	rawClientData, clientDataJSON := a.clientDataJSON("webauthn.get", opts.Challenge)
+	clientDataHash := sha256.Sum256(rawClientData)
+	hash := sha256.Sum256(append(authData, clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, hash[:])
+	if err != nil {
+		return response, err
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		return response, err
+	}
+
+	response.ID = base64.RawURLEncoding.EncodeToString(a.id)
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = clientDataJSON
+	response.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	response.Response.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	return response, nil
+}
+
+func TestWebAuthn(t *testing.T) {
+	defer setupTestStore(t)()
+
+	user, err := NewUser("webauthn", utils.SHA3hash("pass"), "x", "webauthn@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newSoftAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creationOpts, err := user.BeginWebAuthnRegistration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := auth.create(creationOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := user.FinishWebAuthnRegistration("yubikey", created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.ID != created.ID || len(user.WebAuthnCredentials) != 1 {
+		t.Fatalf("credential not stored")
+	}
+
+	// challenges are single use
+	_, err = user.FinishWebAuthnRegistration("yubikey", created)
+	if err == nil {
+		t.Fatalf("registration challenge reused")
+	}
+
+	user, err = RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestOpts, err := user.BeginWebAuthnAssertion("/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := auth.get(requestOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.FinishWebAuthnAssertion("/token", assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.WebAuthnCredentials[0].SignCount != auth.count {
+		t.Fatalf("signature counter not updated")
+	}
+
+	err = user.FinishWebAuthnAssertion("/token", assertion)
+	if err == nil {
+		t.Fatalf("assertion replayed")
+	}
+
+	// assertions only authorize the route they were requested for
+	requestOpts, err = user.BeginWebAuthnAssertion("/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err = auth.get(requestOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.FinishWebAuthnAssertion("/user/sweep", assertion)
+	if err == nil {
+		t.Fatalf("assertion for one route authorized another")
+	}
+
+	// a cloned authenticator reports a counter that didn't increase
+	auth.count = user.WebAuthnCredentials[0].SignCount - 1
+	requestOpts, err = user.BeginWebAuthnAssertion("/user/sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err = auth.get(requestOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.FinishWebAuthnAssertion("/user/sweep", assertion)
+	if err == nil {
+		t.Fatalf("assertion with stale signature counter accepted")
+	}
+
+	auth.origin = "https://evil.com"
+	requestOpts, err = user.BeginWebAuthnAssertion("/user/sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err = auth.get(requestOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.FinishWebAuthnAssertion("/user/sweep", assertion)
+	if err == nil {
+		t.Fatalf("assertion from foreign origin accepted")
+	}
+
+	// a different key can't sign for the credential
+	other, err := newSoftAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.id = auth.id
+	other.count = 100
+	requestOpts, err = user.BeginWebAuthnAssertion("/user/sweep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err = other.get(requestOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.FinishWebAuthnAssertion("/user/sweep", assertion)
+	if err == nil {
+		t.Fatalf("assertion signed with a different key accepted")
+	}
+
+	err = user.RemoveWebAuthnCredential(cred.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = user.BeginWebAuthnAssertion("/token")
+	if err == nil {
+		t.Fatalf("assertion started without credentials")
+	}
+}
+
+func TestPlatformKeys(t *testing.T) {
+	defer setupTestStore(t)()
+	_, unload := withMasterKey(t)
+	defer unload()
+
+	pf, secret, err := NewPlatform("signed", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.Expired() || pf.Timeout == 0 {
+		t.Fatalf("new platform should expire in the future")
+	}
+	first := pf.Keys[0].ID
+
+	// secrets are stored sealed if a master key is loaded
+	pf, err = RetrievePlatformByKey(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.Keys[0].Secret != "" || pf.Keys[0].SealedSecret == nil {
+		t.Fatalf("platform key secret stored in plaintext")
+	}
+	x, err := pf.KeySecret(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(x) != secret {
+		t.Fatalf("platform key secret does not match")
+	}
+	if pf.Redacted().Keys[0].SealedSecret != nil {
+		t.Fatalf("redacted platform contains key secrets")
+	}
+
+	// old keys stay valid for the overlap after a rotation
+	key, _, err := pf.RotateKey(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pf.KeySecret(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pf.RotateKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pf.KeySecret(first)
+	if err == nil {
+		t.Fatalf("rotated key valid after its overlap")
+	}
+
+	err = pf.RevokeKey(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RetrievePlatformByKey(key.ID)
+	if err == nil {
+		t.Fatalf("revoked key still belongs to platform")
+	}
+
+	pf.Timeout = utils.Unix() - 1
+	if !pf.Expired() {
+		t.Fatalf("platform past its timeout not expired")
+	}
+	pf, _, err = NewPlatform("notimeout", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.Expired() {
+		t.Fatalf("platform without timeout expired")
+	}
+
+	// nonces can't be reused
+	err = UsePlatformNonce(first, "nonce", utils.Unix()+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UsePlatformNonce(first, "nonce", utils.Unix()+60)
+	if err == nil {
+		t.Fatalf("reused nonce accepted")
+	}
+
+	// expired nonces are swept at most once every NonceSweepInterval
+	nonceStored := func(nonce string) bool {
+		var x []byte
+		err := store.View(func(tx Tx) error {
+			b, err := tx.Bucket(PlatformNonceBucket)
+			if err != nil {
+				return err
+			}
+			x, err = b.Get([]byte(first + "|" + nonce))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return x != nil
+	}
+	err = UsePlatformNonce(first, "expired", utils.Unix()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = UsePlatformNonce(first, "nonce2", utils.Unix()+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nonceStored("expired") {
+		t.Fatalf("nonces swept before NonceSweepInterval passed")
+	}
+	nonceSweeps.Lock()
+	nonceSweeps.last[string(PlatformNonceBucket)] = 0
+	nonceSweeps.Unlock()
+	err = UsePlatformNonce(first, "nonce3", utils.Unix()+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonceStored("expired") || !nonceStored("nonce2") {
+		t.Fatalf("expired nonces not swept")
+	}
+}
+
+func TestPlatformScopes(t *testing.T) {
+	defer setupTestStore(t)()
+
+	pf, _, err := NewPlatform("scoped", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.HasScope(ScopeReadConsts) {
+		t.Fatalf("new platform has scopes it wasn't granted")
+	}
+
+	err = pf.SetScopes([]string{ScopeReadConsts, "admin"})
+	if err == nil {
+		t.Fatalf("unknown scope granted to platform")
+	}
+	err = pf.SetScopes([]string{ScopeReadConsts, ScopeReadUser, ScopeReadConsts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err = RetrievePlatform(pf.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pf.Scopes) != 2 || !pf.HasScope(ScopeReadUser) || pf.HasScope(ScopeReadSecrets) {
+		t.Fatalf("unexpected platform scopes: %v", pf.Scopes)
+	}
+
+	user, err := NewUser("scopeduser", utils.SHA3hash("pass"), "x", "scoped@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := user.WithoutSecrets()
+	if stripped.Pwhash != "" || stripped.StellarWallet.EncryptedSeed != nil || stripped.ConfToken != "" {
+		t.Fatalf("user secrets not stripped")
+	}
+	if stripped.Username != user.Username || stripped.StellarWallet.PublicKey != user.StellarWallet.PublicKey {
+		t.Fatalf("public user fields stripped")
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	defer setupTestStore(t)()
+
+	pf, secret, err := NewPlatform("client", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pf.CheckSecret(secret) || pf.CheckSecret("wrong") {
+		t.Fatalf("client secret check failed")
+	}
+
+	err = pf.SetRedirectURIs([]string{"http://example.com/cb"})
+	if err == nil {
+		t.Fatalf("plain http redirect uri accepted")
+	}
+	redirect := "https://example.com/cb"
+	err = pf.SetRedirectURIs([]string{redirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pf.ValidRedirect(redirect) || pf.ValidRedirect(redirect+"/evil") {
+		t.Fatalf("redirect uri check failed")
+	}
+
+	user, err := NewUser("oauthuser", utils.SHA3hash("pass"), "x", "oauth@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseOAuthScopes("profile admin")
+	if err == nil {
+		t.Fatalf("unknown scope parsed")
+	}
+	scopes, err := ParseOAuthScopes("profile email profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 2 {
+		t.Fatalf("duplicate scopes not removed: %v", scopes)
+	}
+
+	consent, err := GrantConsent(user.Index, pf.Index, scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !consent.Covers([]string{OAuthEmail}) || consent.Covers([]string{OAuthWallet}) {
+		t.Fatalf("unexpected consent scopes: %v", consent.Scopes)
+	}
+
+	verifier := strings.Repeat("v", 50)
+	hash := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	code, err := NewAuthorizationCode(user.Index, pf.Index, redirect, scopes, challenge, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExchangeAuthorizationCode(code, pf.Index, redirect, strings.Repeat("w", 50))
+	if err == nil {
+		t.Fatalf("code exchanged with wrong verifier")
+	}
+	_, err = ExchangeAuthorizationCode(code, pf.Index+1, redirect, verifier)
+	if err == nil {
+		t.Fatalf("code exchanged by a different client")
+	}
+	tokens, err := ExchangeAuthorizationCode(code, pf.Index, redirect, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExchangeAuthorizationCode(code, pf.Index, redirect, verifier)
+	if err == nil {
+		t.Fatalf("code exchanged twice")
+	}
+
+	grant, err := IntrospectOAuthToken(tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.User != user.Index || grant.Client != pf.Index || grant.TokenType() != "Bearer" {
+		t.Fatalf("unexpected grant: %v", grant)
+	}
+
+	// refresh tokens rotate and can only narrow down scopes
+	_, err = RefreshOAuthTokens(tokens.RefreshToken, pf.Index, []string{OAuthWallet})
+	if err == nil {
+		t.Fatalf("refresh widened scopes")
+	}
+	refreshed, err := RefreshOAuthTokens(tokens.RefreshToken, pf.Index, []string{OAuthProfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Scope != OAuthProfile {
+		t.Fatalf("unexpected refreshed scope: %s", refreshed.Scope)
+	}
+	_, err = RefreshOAuthTokens(tokens.RefreshToken, pf.Index, nil)
+	if err == nil {
+		t.Fatalf("refresh token used twice")
+	}
+
+	err = RevokeOAuthToken(refreshed.AccessToken, pf.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = IntrospectOAuthToken(refreshed.AccessToken)
+	if err == nil {
+		t.Fatalf("revoked token still active")
+	}
+
+	// revoking consent revokes every token issued to the client
+	consents, err := RetrieveConsents(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consents) != 1 {
+		t.Fatalf("expected one consent, got %d", len(consents))
+	}
+	err = RevokeConsent(user.Index, pf.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = IntrospectOAuthToken(tokens.AccessToken)
+	if err == nil {
+		t.Fatalf("token active after consent was revoked")
+	}
+	_, err = IntrospectOAuthToken(refreshed.RefreshToken)
+	if err == nil {
+		t.Fatalf("refresh token active after consent was revoked")
+	}
+	consent, err = RetrieveConsent(user.Index, pf.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consent.Scopes) != 0 {
+		t.Fatalf("consent not revoked")
+	}
+}
+
+// verifyJWT verifies the signature of a JWT signed by openx against the JWKS and decodes its
+// claims into claims. The expiry of the token isn't checked
+func verifyJWT(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.Wrap(err, "malformed token header")
+	}
+	err = json.Unmarshal(raw, &header)
+	if err != nil || header.Alg != "ES256" {
+		return errors.New("unsupported token header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return errors.New("malformed token signature")
+	}
+
+	jwks, err := RetrieveJWKS()
+	if err != nil {
+		return err
+	}
+	for _, k := range jwks.Keys {
+		if k.Kid != header.Kid {
+			continue
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return err
+		}
+		pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if !ecdsa.Verify(&pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return errors.New("token signature does not match")
+		}
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return errors.Wrap(err, "malformed token payload")
+		}
+		return json.Unmarshal(payload, claims)
+	}
+	return errors.New("token signed with unknown key")
+}
+
+func TestOIDC(t *testing.T) {
+	defer setupTestStore(t)()
+
+	pf, _, err := NewPlatform("rp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pf.SetLogoutURI("http://example.com/logout")
+	if err == nil {
+		t.Fatalf("plain http logout uri accepted")
+	}
+
+	user, err := NewUser("oidcuser", utils.SHA3hash("pass"), "x", "oidc@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scopes := []string{OAuthOpenID, OAuthProfile}
+	_, err = GrantConsent(user.Index, pf.Index, scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := strings.Repeat("v", 50)
+	hash := sha256.Sum256([]byte(verifier))
+	code, err := NewAuthorizationCode(user.Index, pf.Index, "https://example.com/cb", scopes,
+		base64.RawURLEncoding.EncodeToString(hash[:]), "n-0S6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ExchangeAuthorizationCode(code, pf.Index, "https://example.com/cb", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.IDToken == "" {
+		t.Fatalf("no id token issued for the openid scope")
+	}
+
+	var claims IDTokenClaims
+	err = verifyJWT(tokens.IDToken, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != strconv.Itoa(user.Index) || claims.Audience != strconv.Itoa(pf.Index) ||
+		claims.Nonce != "n-0S6" || claims.Issuer != OIDCIssuer {
+		t.Fatalf("unexpected id token claims: %v", claims)
+	}
+
+	// tampered tokens don't verify
+	parts := strings.Split(tokens.IDToken, ".")
+	forged, _ := json.Marshal(IDTokenClaims{Subject: "0"})
+	err = verifyJWT(parts[0]+"."+base64.RawURLEncoding.EncodeToString(forged)+"."+parts[2], &claims)
+	if err == nil {
+		t.Fatalf("tampered id token verified")
+	}
+
+	// tokens signed with a rotated key still verify until the key is dropped
+	_, err = RotateOIDCKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := RetrieveJWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected 2 keys in the jwks, got %d", len(jwks.Keys))
+	}
+
+	// the jwks is served from the public keys stored with the signing keys, without reading
+	// the private keys
+	var signingKeys []OIDCKey
+	putKeys := func(strip bool) {
+		err := store.Update(func(tx Tx) error {
+			b, err := tx.Bucket(OIDCKeyBucket)
+			if err != nil {
+				return err
+			}
+			if signingKeys == nil {
+				signingKeys, err = retrieveOIDCKeys(b)
+				if err != nil {
+					return err
+				}
+			}
+			for _, x := range signingKeys {
+				if strip {
+					x.Private, x.SealedPrivate = nil, nil
+				}
+				err = putJSON(b, []byte(x.ID), x)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	putKeys(true)
+	stored, err := RetrieveJWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Keys) != 2 || stored.Keys[0] != jwks.Keys[0] || stored.Keys[1] != jwks.Keys[1] {
+		t.Fatalf("jwks not served from the stored public keys: %v", stored)
+	}
+	putKeys(false)
+	err = verifyJWT(tokens.IDToken, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := RefreshOAuthTokens(tokens.RefreshToken, pf.Index, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refreshedClaims IDTokenClaims
+	err = verifyJWT(refreshed.IDToken, &refreshedClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshedClaims.Nonce != "" {
+		t.Fatalf("nonce passed on to refreshed id token")
+	}
+
+	logoutToken, err := NewLogoutToken(user.Index, pf.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logout LogoutTokenClaims
+	err = verifyJWT(logoutToken, &logout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := logout.Events[backchannelLogoutEvent]; !exists {
+		t.Fatalf("logout token without logout event")
+	}
+
+	clients, err := LogoutOAuth(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0] != pf.Index {
+		t.Fatalf("unexpected clients to notify: %v", clients)
+	}
+	_, err = IntrospectOAuthToken(refreshed.AccessToken)
+	if err == nil {
+		t.Fatalf("token active after logout")
+	}
+}
+
+func TestLogins(t *testing.T) {
+	defer setupTestStore(t)()
+
+	user, err := NewUser("loginuser", utils.SHA3hash("pass"), "x", "login@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewUser("otheruser", utils.SHA3hash("pass"), "x", "other@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login, err := RecordLogin(user.Index, "1.1.1.1", "curl", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.NewDevice {
+		t.Fatalf("first login marked as a new device")
+	}
+	login, err = RecordLogin(user.Index, "1.1.1.1", "curl", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.NewDevice {
+		t.Fatalf("login from a known device marked as a new device")
+	}
+	login, err = RecordLogin(user.Index, "2.2.2.2", "curl", "/token", LoginBadPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.NewDevice {
+		t.Fatalf("failed login marked as a new device")
+	}
+	login, err = RecordLogin(user.Index, "2.2.2.2", "curl", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !login.NewDevice {
+		t.Fatalf("login from a new ip not marked as a new device")
+	}
+	_, err = RecordLogin(other.Index, "2.2.2.2", "firefox", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logins, err := QueryLogins(LoginQuery{User: user.Index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 4 {
+		t.Fatalf("expected 4 logins, got %d", len(logins))
+	}
+	logins, err = QueryLogins(LoginQuery{IP: "2.2.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 3 {
+		t.Fatalf("expected 3 logins from ip, got %d", len(logins))
+	}
+	logins, err = QueryLogins(LoginQuery{User: user.Index, Outcome: LoginBadPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 || logins[0].IP != "2.2.2.2" {
+		t.Fatalf("outcome filter didn't work")
+	}
+	logins, err = QueryLogins(LoginQuery{User: user.Index, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 {
+		t.Fatalf("limit didn't work")
+	}
+
+	// attempts for usernames no user has are recorded under user 0
+	err = RecordUnknownLogin("nosuchuser", "3.3.3.3", "curl", "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logins, err = QueryLogins(LoginQuery{Outcome: LoginUnknownUser})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 1 || logins[0].User != 0 || logins[0].Username != "nosuchuser" || logins[0].IP != "3.3.3.3" {
+		t.Fatalf("attempt for unknown user not recorded: %v", logins)
+	}
+
+	oldMax := MaxLoginHistory
+	MaxLoginHistory = 3
+	defer func() { MaxLoginHistory = oldMax }()
+	_, err = RecordLogin(user.Index, "1.1.1.1", "curl", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logins, err = QueryLogins(LoginQuery{User: user.Index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 3 {
+		t.Fatalf("history not pruned, got %d logins", len(logins))
+	}
+
+	// failed attempts push successful logins out of the history but not out of the known devices
+	for i := 0; i < 2*MaxLoginHistory; i++ {
+		_, err = RecordLogin(user.Index, "4.4.4.4", "curl", "/token", LoginLocked)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	login, err = RecordLogin(user.Index, "1.1.1.1", "curl", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.NewDevice {
+		t.Fatalf("login from a known device marked as a new device after failed attempts")
+	}
+	for i := 0; i < 2*MaxLoginHistory; i++ {
+		_, err = RecordLogin(user.Index, "4.4.4.4", "curl", "/token", LoginBad2FA)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	login, err = RecordLogin(user.Index, "4.4.4.4", "curl", "/token", LoginSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !login.NewDevice {
+		t.Fatalf("login from a new ip not marked as a new device after failed attempts")
+	}
+
+	err = store.Update(func(tx Tx) error {
+		return deleteLogins(tx, user.Index)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logins, err = QueryLogins(LoginQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 2 || logins[0].User == user.Index || logins[1].User == user.Index {
+		t.Fatalf("logins of deleted user not removed")
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	defer setupTestStore(t)()
+	_, unload := withMasterKey(t)
+	defer unload()
+
+	user, err := NewUser("transferuser", utils.SHA3hash("pass"), "x", "transfer@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewUser("otheruser", utils.SHA3hash("pass"), "x", "other@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x := Transfer{User: user.Index, Anchor: "anchor.example", Protocol: "sep6", ID: "1",
+		Kind: "deposit", Asset: "USD", Amount: "100", Status: "pending_user_transfer_start"}
+	err = x.SetToken("secrettoken", utils.Unix()+3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Token != "" || x.SealedToken == nil {
+		t.Fatalf("token not sealed with a master key loaded")
+	}
+	_, err = NewTransfer(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewTransfer(x)
+	if err == nil {
+		t.Fatalf("transfer recorded twice")
+	}
+	_, err = NewTransfer(Transfer{User: other.Index, Anchor: "anchor.example", ID: "2", Status: "incomplete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err = RetrieveTransfer(user.Index, "anchor.example", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := x.PollToken()
+	if err != nil || token != "secrettoken" {
+		t.Fatalf("token not recovered: %v", err)
+	}
+	if redacted := x.Redacted(); redacted.Token != "" || redacted.SealedToken != nil {
+		t.Fatalf("token not redacted")
+	}
+
+	if x.SetStatus("pending_user_transfer_start", "", "", false) {
+		t.Fatalf("unchanged status recorded")
+	}
+	if !x.SetStatus("pending_anchor", "funds received", "", false) {
+		t.Fatalf("new status not recorded")
+	}
+	if !x.SetStatus("completed", "", "txhash", true) {
+		t.Fatalf("completion not recorded")
+	}
+	err = x.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err = RetrieveTransfer(user.Index, "anchor.example", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.History) != 3 || x.History[1].Message != "funds received" || x.StellarTxHash != "txhash" || !x.Done {
+		t.Fatalf("transfer history not stored: %v", x)
+	}
+
+	pending, err := RetrievePendingTransfers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].User != other.Index {
+		t.Fatalf("expected the transfer of the other user to be pending, got %v", pending)
+	}
+
+	// concurrent updates see each other, so only one of them finishes the transfer
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	finished := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			old, updated, err := UpdateTransfer(other.Index, pending[0].Anchor, pending[0].ID, func(x *Transfer) bool {
+				return x.SetStatus("completed", "", "txhash", true)
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if updated.Done && !old.Done {
+				mu.Lock()
+				finished++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if finished != 1 {
+		t.Fatalf("expected one update to finish the transfer, got %d", finished)
+	}
+	x, err = RetrieveTransfer(other.Index, pending[0].Anchor, pending[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.History) != 2 || !x.Done {
+		t.Fatalf("concurrent updates not merged: %v", x)
+	}
+	_, _, err = UpdateTransfer(other.Index, "anchor.example", "unknown", func(*Transfer) bool { return true })
+	if err == nil {
+		t.Fatalf("unknown transfer updated")
+	}
+
+	err = DeleteKeyFromBucket(user.Index, UserBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers, err := RetrieveUserTransfers(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 0 {
+		t.Fatalf("transfers of deleted user not removed")
+	}
+	transfers, err = RetrieveUserTransfers(other.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 1 {
+		t.Fatalf("transfers of other user removed")
+	}
+}
@@ -0,0 +1,331 @@
+package database
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// index contains the secondary indexes that we maintain on users so that lookups by username,
+// email or Stellar public key don't have to decode every user in the database. The index
+// buckets map the looked up value to the key of the user in UserBucket and are updated in the
+// same transaction that writes the user.
+
+// ErrIndexCollision is returned when a user is saved with a username, email or public key
+// that belongs to another user
+var ErrIndexCollision = errors.New("username, email or public key already in use by another user")
+
+// indexEntry is a single reference to a user from one of the index buckets
+type indexEntry struct {
+	bucket []byte
+	key    string
+}
+
+// userIndexEntries returns the index references that must exist for the passed user
+func userIndexEntries(a *User) []indexEntry {
+	return []indexEntry{
+		{UsernameIndexBucket, a.Username},
+		{EmailIndexBucket, blindIndex(a.Email)},
+		{PubkeyIndexBucket, a.StellarWallet.PublicKey},
+	}
+}
+
+// putUserIndexes adds index references for the user stored under iK. References that already
+// point to another user are never overwritten, ErrIndexCollision is returned instead
+func putUserIndexes(tx Tx, a *User, iK []byte) error {
+	for _, entry := range userIndexEntries(a) {
+		if entry.key == "" {
+			continue
+		}
+		b, err := tx.CreateBucketIfNotExists(entry.bucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get([]byte(entry.key))
+		if err != nil {
+			return err
+		}
+		if x != nil && !bytes.Equal(x, iK) {
+			return ErrIndexCollision
+		}
+		err = b.Put([]byte(entry.key), iK)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUserIndexes removes index references held by the user stored under iK. References
+// which have since been taken over by another user are left untouched
+func deleteUserIndexes(tx Tx, a *User, iK []byte) error {
+	for _, entry := range userIndexEntries(a) {
+		if entry.key == "" {
+			continue
+		}
+		b, err := tx.Bucket(entry.bucket)
+		if err == edb.ErrBucketMissing {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		x, err := b.Get([]byte(entry.key))
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(x, iK) {
+			err := b.Delete([]byte(entry.key))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clearUserIndexes removes the index references held by the user currently stored under iK
+func clearUserIndexes(tx Tx, b Bucket, iK []byte) error {
+	old, err := b.Get(iK)
+	if err != nil || old == nil {
+		return err
+	}
+	var prev User
+	if err := decodeUser(old, &prev); err != nil {
+		// nothing we can clean up if we can't read the old record
+		return nil
+	}
+	return deleteUserIndexes(tx, &prev, iK)
+}
+
+// indexTaken checks whether key is already referenced from the passed index bucket
+func indexTaken(tx Tx, bucket []byte, key string) (bool, error) {
+	ib, err := tx.Bucket(bucket)
+	if err == edb.ErrBucketMissing {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	x, err := ib.Get([]byte(key))
+	return x != nil, err
+}
+
+// saveUserTx writes a user to the user bucket and updates the index buckets within the passed transaction
+func saveUserTx(tx Tx, a *User) error {
+	b, err := tx.CreateBucketIfNotExists(UserBucket)
+	if err != nil {
+		return err
+	}
+
+	iK, err := utils.ToByte(a.Index)
+	if err != nil {
+		return err
+	}
+
+	// drop references to values the user no longer holds (changed email, imported seed, etc)
+	err = clearUserIndexes(tx, b, iK)
+	if err != nil {
+		return err
+	}
+
+	a.SchemaVersion = SchemaVersion(UserBucket)
+	encoded, err := encodeUser(a)
+	if err != nil {
+		return errors.Wrap(err, "error while encoding user")
+	}
+
+	err = b.Put(iK, encoded)
+	if err != nil {
+		return err
+	}
+
+	return putUserIndexes(tx, a, iK)
+}
+
+// insertUser allocates an index for a new user and stores it. The username and email are
+// checked against the indexes in the same transaction so concurrent signups can't end up
+// with the same index or credentials
+func insertUser(a *User) error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(UserBucket)
+		if err != nil {
+			return err
+		}
+
+		taken, err := indexTaken(tx, UsernameIndexBucket, a.Username)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return errors.New("username collision observed, quitting")
+		}
+
+		if a.Email != "" {
+			taken, err = indexTaken(tx, EmailIndexBucket, blindIndex(a.Email))
+			if err != nil {
+				return err
+			}
+			if taken {
+				return errors.New("email already in use by another user, quitting")
+			}
+		}
+
+		index, err := nextIndex(b)
+		if err != nil {
+			return errors.Wrap(err, "could not allocate user index")
+		}
+
+		a.Index = index
+		return saveUserTx(tx, a)
+	})
+}
+
+// deleteUser deletes a user along with its index references
+func deleteUser(key int) error {
+	iK, err := utils.ToByte(key)
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(UserBucket)
+		if err != nil {
+			return err
+		}
+		err = clearUserIndexes(tx, b, iK)
+		if err != nil {
+			return err
+		}
+		_, err = deleteSessions(tx, key, func(Session) bool { return true })
+		if err != nil {
+			return err
+		}
+		err = deleteLockout(tx, iK)
+		if err != nil {
+			return err
+		}
+		err = deleteUserOAuth(tx, key)
+		if err != nil {
+			return err
+		}
+		err = deleteLogins(tx, key)
+		if err != nil {
+			return err
+		}
+		err = deleteTransfers(tx, key)
+		if err != nil {
+			return err
+		}
+		return b.Delete(iK)
+	})
+}
+
+// retrieveUserWithIndex retrieves the user referenced by key in the passed index bucket
+func retrieveUserWithIndex(bucket []byte, key string) (User, error) {
+	var user User
+	err := store.View(func(tx Tx) error {
+		ib, err := tx.Bucket(bucket)
+		if err != nil {
+			return err
+		}
+		iK, err := ib.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if iK == nil {
+			return edb.ErrElementNotFound
+		}
+		b, err := tx.Bucket(UserBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(iK)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			return edb.ErrElementNotFound
+		}
+		return decodeUser(x, &user)
+	})
+
+	return user, err
+}
+
+// RetrieveUserByUsername retrieves a user from the database using the username index
+func RetrieveUserByUsername(username string) (User, error) {
+	return retrieveUserWithIndex(UsernameIndexBucket, username)
+}
+
+// RetrieveUserByEmail retrieves a user from the database using the email index
+func RetrieveUserByEmail(email string) (User, error) {
+	return retrieveUserWithIndex(EmailIndexBucket, blindIndex(email))
+}
+
+// RetrieveUserByPubkey retrieves a user from the database using the Stellar public key index
+func RetrieveUserByPubkey(pubkey string) (User, error) {
+	return retrieveUserWithIndex(PubkeyIndexBucket, pubkey)
+}
+
+// RebuildUserIndexes drops and regenerates the username, email and public key indexes from
+// the users stored in the database. This should be run once on databases created before the
+// indexes were introduced. Returns the number of users indexed
+func RebuildUserIndexes() (int, error) {
+	var count int
+	err := store.Update(func(tx Tx) error {
+		var err error
+		count, err = rebuildUserIndexes(tx)
+		return err
+	})
+
+	return count, err
+}
+
+// rebuildUserIndexes regenerates the user indexes within the passed transaction
+func rebuildUserIndexes(tx Tx) (int, error) {
+	for _, bucket := range [][]byte{UsernameIndexBucket, EmailIndexBucket, PubkeyIndexBucket} {
+		err := tx.DeleteBucket(bucket)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	b, err := tx.Bucket(UserBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = b.ForEach(func(k, v []byte) error {
+		var user User
+		err := decodeUser(v, &user)
+		if err != nil {
+			log.Println("could not unmarshal user with key: ", string(k), err)
+			return nil
+		}
+		iK := make([]byte, len(k))
+		copy(iK, k)
+		err = putUserIndexes(tx, &user, iK)
+		if err == ErrIndexCollision {
+			// users stored before the indexes existed may share an email, the first one keeps it
+			log.Println("could not index all values of user with key: ", string(k), err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	return count, err
+}
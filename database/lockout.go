@@ -0,0 +1,184 @@
+package database
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// lockout contains the progressive lockout of accounts after repeated failed authentication
+// attempts. Every lockout of an account lasts twice as long as the one before it until the
+// user authenticates successfully or unlocks the account with the code emailed to them
+
+// LockoutBucket stores the failed authentication attempts of users keyed by user index
+var LockoutBucket = []byte("Lockouts")
+
+// MaxAuthFailures is the number of consecutive failed attempts after which an account is locked
+var MaxAuthFailures = 5
+
+// LockoutBase is the number of seconds the first lockout of an account lasts
+var LockoutBase = int64(60)
+
+// MaxLockout is the maximum number of seconds a single lockout can last
+var MaxLockout = int64(24 * 60 * 60)
+
+// Lockout tracks the failed authentication attempts of a user
+type Lockout struct {
+	// User is the index of the user the lockout belongs to
+	User int
+	// Failures is the number of failed attempts since the last lockout or success
+	Failures int
+	// Lockouts is the number of times the account has been locked since the last success
+	Lockouts int
+	// LockedUntil is the unix time until which the account is locked
+	LockedUntil int64
+	// UnlockCode is the hash of the code that unlocks the account
+	UnlockCode string
+}
+
+// RetryAfter returns the number of seconds until the account is unlocked, zero if it isn't locked
+func (l Lockout) RetryAfter() int64 {
+	left := l.LockedUntil - utils.Unix()
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// lockoutDuration returns the number of seconds the nth lockout of an account lasts
+func lockoutDuration(n int) int64 {
+	duration := LockoutBase
+	for i := 1; i < n && duration < MaxLockout; i++ {
+		duration *= 2
+	}
+	if duration > MaxLockout {
+		duration = MaxLockout
+	}
+	return duration
+}
+
+// getLockout retrieves the lockout of the user from b, returning an empty lockout if the
+// user has no failed attempts
+func getLockout(b Bucket, userIndex int) (Lockout, error) {
+	lockout := Lockout{User: userIndex}
+	iK, err := utils.ToByte(userIndex)
+	if err != nil {
+		return lockout, err
+	}
+	x, err := b.Get(iK)
+	if err != nil || x == nil {
+		return lockout, err
+	}
+	err = json.Unmarshal(x, &lockout)
+	return lockout, err
+}
+
+// RetrieveLockout retrieves the failed authentication attempts of the user
+func RetrieveLockout(userIndex int) (Lockout, error) {
+	lockout := Lockout{User: userIndex}
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(LockoutBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lockout, err = getLockout(b, userIndex)
+		return err
+	})
+	if err != nil {
+		return lockout, errors.Wrap(err, "could not retrieve lockout")
+	}
+	return lockout, nil
+}
+
+// RecordAuthFailure records a failed authentication attempt of the user and locks the account
+// once MaxAuthFailures consecutive attempts have failed. If this attempt locked the account,
+// the code that unlocks it is returned so that it can be sent to the user
+func RecordAuthFailure(userIndex int) (Lockout, string, error) {
+	var lockout Lockout
+	var code string
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(LockoutBucket)
+		if err != nil {
+			return err
+		}
+		lockout, err = getLockout(b, userIndex)
+		if err != nil {
+			return err
+		}
+
+		lockout.Failures++
+		if lockout.Failures >= MaxAuthFailures {
+			lockout.Failures = 0
+			lockout.Lockouts++
+			lockout.LockedUntil = utils.Unix() + lockoutDuration(lockout.Lockouts)
+			code = utils.GetRandomString(16)
+			lockout.UnlockCode = string(hashToken(code))
+		}
+
+		encoded, err := json.Marshal(lockout)
+		if err != nil {
+			return err
+		}
+		iK, err := utils.ToByte(userIndex)
+		if err != nil {
+			return err
+		}
+		return b.Put(iK, encoded)
+	})
+	if err != nil {
+		return lockout, "", errors.Wrap(err, "could not record failed attempt")
+	}
+	return lockout, code, nil
+}
+
+// ClearAuthFailures forgets the failed attempts and lockouts of the user. This should be
+// called after the user authenticates successfully
+func ClearAuthFailures(userIndex int) error {
+	iK, err := utils.ToByte(userIndex)
+	if err != nil {
+		return err
+	}
+	return store.Update(func(tx Tx) error {
+		return deleteLockout(tx, iK)
+	})
+}
+
+// deleteLockout deletes the lockout stored under the user key iK
+func deleteLockout(tx Tx, iK []byte) error {
+	b, err := tx.Bucket(LockoutBucket)
+	if err == edb.ErrBucketMissing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.Delete(iK)
+}
+
+// UnlockUser unlocks the account of the user with the passed username using the code sent
+// to them when the account was locked
+func UnlockUser(username string, code string) (User, error) {
+	user, err := RetrieveUserByUsername(username)
+	if err != nil {
+		return user, errors.Wrap(err, "could not find user")
+	}
+
+	lockout, err := RetrieveLockout(user.Index)
+	if err != nil {
+		return user, err
+	}
+
+	if lockout.UnlockCode == "" ||
+		subtle.ConstantTimeCompare([]byte(lockout.UnlockCode), hashToken(code)) != 1 {
+		return user, errors.New("invalid unlock code")
+	}
+
+	return user, ClearAuthFailures(user.Index)
+}
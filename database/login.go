@@ -0,0 +1,326 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// login contains the login history of users. Every attempt to get an access token for an
+// account is recorded along with where it came from so that users can spot logins they don't
+// recognize and admins can investigate compromised accounts
+
+// LoginBucket stores login attempts keyed by user index and time
+var LoginBucket = []byte("Logins")
+
+// KnownDeviceBucket stores the ips and user agents users have logged in successfully from,
+// keyed by user index. They are kept apart from the login history so that failed attempts
+// can't push them out
+var KnownDeviceBucket = []byte("KnownDevices")
+
+// MaxLoginHistory is the number of login attempts kept per user. Older attempts are dropped
+var MaxLoginHistory = 100
+
+// MaxKnownDevices is the number of ips and of user agents remembered per user. The ones that
+// haven't been logged in from for the longest are dropped
+var MaxKnownDevices = 50
+
+// outcomes of login attempts
+const (
+	LoginSuccess      = "success"
+	LoginBadPassword  = "badpassword"
+	LoginBad2FA       = "bad2fa"
+	LoginLocked       = "locked"
+	LoginBadSignature = "badsignature"
+	LoginUnknownUser  = "unknownuser"
+)
+
+// Login is an attempt to log in to an account
+type Login struct {
+	// User is the index of the user the attempt was made for, zero if there is no user with
+	// the username the attempt was made for
+	User int
+	// Username is the username attempts for unknown users were made for
+	Username string `json:",omitempty"`
+	// Time is the unix time of the attempt
+	Time int64
+	// IP is the ip address the attempt was made from
+	IP string
+	// UserAgent is the user agent of the client that made the attempt
+	UserAgent string
+	// Route is the route the attempt was made at
+	Route string
+	// Outcome is the outcome of the attempt
+	Outcome string
+	// NewDevice is set on successful logins from an ip or user agent the user hadn't logged
+	// in from before
+	NewDevice bool
+}
+
+// LoginQuery filters login attempts
+type LoginQuery struct {
+	// User restricts the attempts to the user with this index if non zero
+	User int
+	// IP restricts the attempts to the ones made from this ip if set
+	IP string
+	// Outcome restricts the attempts to the ones with this outcome if set
+	Outcome string
+	// Since restricts the attempts to the ones made at or after this unix time
+	Since int64
+	// Limit is the maximum number of attempts returned, all of them if zero
+	Limit int
+}
+
+// knownDevices are the ips and user agents a user has logged in successfully from, least
+// recently used first
+type knownDevices struct {
+	IPs        []string
+	UserAgents []string
+}
+
+// remember moves value to the end of list, dropping the oldest values beyond MaxKnownDevices
+func remember(list []string, value string) []string {
+	for i, x := range list {
+		if x == value {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	list = append(list, value)
+	if len(list) > MaxKnownDevices {
+		list = list[len(list)-MaxKnownDevices:]
+	}
+	return list
+}
+
+// contains checks whether value is in list
+func contains(list []string, value string) bool {
+	for _, x := range list {
+		if x == value {
+			return true
+		}
+	}
+	return false
+}
+
+// retrieveKnownDevices returns the known devices of the user. Users without a record have
+// their known devices collected from the successful logins in their history, which is where
+// they were kept before they had a record of their own
+func retrieveKnownDevices(tx Tx, b Bucket, user int) (knownDevices, error) {
+	var devices knownDevices
+	db, err := tx.CreateBucketIfNotExists(KnownDeviceBucket)
+	if err != nil {
+		return devices, err
+	}
+	iK, err := utils.ToByte(user)
+	if err != nil {
+		return devices, err
+	}
+	x, err := db.Get(iK)
+	if err != nil {
+		return devices, err
+	}
+	if x != nil {
+		return devices, json.Unmarshal(x, &devices)
+	}
+
+	err = forEachLogin(b, loginPrefix(user), func(k []byte, login Login) error {
+		if login.Outcome == LoginSuccess {
+			devices.IPs = remember(devices.IPs, login.IP)
+			devices.UserAgents = remember(devices.UserAgents, login.UserAgent)
+		}
+		return nil
+	})
+	return devices, err
+}
+
+// loginPrefix returns the prefix of the keys of the login attempts of a user
+func loginPrefix(user int) string {
+	return fmt.Sprintf("%010d|", user)
+}
+
+// forEachLogin calls fn with the key and login of every attempt in b whose key starts with prefix
+func forEachLogin(b Bucket, prefix string, fn func(k []byte, login Login) error) error {
+	return b.ForEachPrefix([]byte(prefix), func(k, v []byte) error {
+		var login Login
+		err := json.Unmarshal(v, &login)
+		if err != nil {
+			return errors.Wrap(err, "could not decode login")
+		}
+		key := make([]byte, len(k))
+		copy(key, k)
+		return fn(key, login)
+	})
+}
+
+// RecordLogin records a login attempt of the user. Successful logins are marked as coming
+// from a new device if the user has logged in successfully before but never from the ip or
+// user agent of this attempt
+func RecordLogin(user int, ip string, userAgent string, route string, outcome string) (Login, error) {
+	return recordLogin(Login{
+		User:      user,
+		Time:      utils.Unix(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Route:     route,
+		Outcome:   outcome,
+	})
+}
+
+// RecordUnknownLogin records a login attempt for a username no user has. These attempts are
+// stored under user 0 so that admins can spot credential stuffing, only the latest
+// MaxLoginHistory of them are kept
+func RecordUnknownLogin(username string, ip string, userAgent string, route string) error {
+	_, err := recordLogin(Login{
+		Username:  username,
+		Time:      utils.Unix(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Route:     route,
+		Outcome:   LoginUnknownUser,
+	})
+	return err
+}
+
+// recordLogin stores the login attempt and drops the oldest attempts of the user beyond
+// MaxLoginHistory. Successful logins are added to the known devices of the user
+func recordLogin(login Login) (Login, error) {
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(LoginBucket)
+		if err != nil {
+			return err
+		}
+
+		if login.Outcome == LoginSuccess {
+			devices, err := retrieveKnownDevices(tx, b, login.User)
+			if err != nil {
+				return err
+			}
+			seen := len(devices.IPs) != 0
+			login.NewDevice = seen && !(contains(devices.IPs, login.IP) && contains(devices.UserAgents, login.UserAgent))
+
+			devices.IPs = remember(devices.IPs, login.IP)
+			devices.UserAgents = remember(devices.UserAgents, login.UserAgent)
+			db, err := tx.Bucket(KnownDeviceBucket)
+			if err != nil {
+				return err
+			}
+			iK, err := utils.ToByte(login.User)
+			if err != nil {
+				return err
+			}
+			err = putJSON(db, iK, devices)
+			if err != nil {
+				return err
+			}
+		}
+
+		var keys [][]byte
+		err = forEachLogin(b, loginPrefix(login.User), func(k []byte, x Login) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// keys sort by time, so the first ones are the oldest
+		sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+		for len(keys) >= MaxLoginHistory {
+			err = b.Delete(keys[0])
+			if err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+
+		key := fmt.Sprintf("%s%020d|%s", loginPrefix(login.User), login.Time, utils.GetRandomString(8))
+		return putJSON(b, []byte(key), login)
+	})
+	if err != nil {
+		return login, errors.Wrap(err, "could not record login")
+	}
+	return login, nil
+}
+
+// QueryLogins returns the login attempts that match the query, latest first
+func QueryLogins(q LoginQuery) ([]Login, error) {
+	var arr []Login
+	prefix := ""
+	if q.User != 0 {
+		prefix = loginPrefix(q.User)
+	}
+
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(LoginBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return forEachLogin(b, prefix, func(k []byte, x Login) error {
+			if (q.IP != "" && x.IP != q.IP) || (q.Outcome != "" && x.Outcome != q.Outcome) ||
+				x.Time < q.Since {
+				return nil
+			}
+			arr = append(arr, x)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query logins")
+	}
+
+	sort.SliceStable(arr, func(i, j int) bool { return arr[i].Time > arr[j].Time })
+	if q.Limit > 0 && len(arr) > q.Limit {
+		arr = arr[:q.Limit]
+	}
+	return arr, nil
+}
+
+// deleteLogins deletes the login history and known devices of the user with the passed index
+func deleteLogins(tx Tx, user int) error {
+	db, err := tx.Bucket(KnownDeviceBucket)
+	if err == nil {
+		iK, err := utils.ToByte(user)
+		if err != nil {
+			return err
+		}
+		err = db.Delete(iK)
+		if err != nil {
+			return err
+		}
+	} else if err != edb.ErrBucketMissing {
+		return err
+	}
+
+	b, err := tx.Bucket(LoginBucket)
+	if err == edb.ErrBucketMissing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	err = forEachLogin(b, loginPrefix(user), func(k []byte, x Login) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	edb "github.com/Varunram/essentials/database"
+)
+
+// memoryStore is a Store that holds everything in memory. It is meant for tests and for
+// trying out openx without touching the disk. Write transactions operate on a copy of the
+// data which replaces the live data only if the transaction succeeds
+type memoryStore struct {
+	sync.RWMutex
+	buckets map[string]*memoryBucketData
+}
+
+type memoryBucketData struct {
+	seq  uint64
+	data map[string][]byte
+}
+
+// NewMemoryStore returns an empty in memory store
+func NewMemoryStore() Store {
+	return &memoryStore{buckets: make(map[string]*memoryBucketData)}
+}
+
+// Update runs fn within a read-write transaction
+func (s *memoryStore) Update(fn func(Tx) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// values are never modified in place, so copying the maps is enough to isolate the
+	// transaction from the live data
+	clone := make(map[string]*memoryBucketData, len(s.buckets))
+	for name, bucket := range s.buckets {
+		data := make(map[string][]byte, len(bucket.data))
+		for k, v := range bucket.data {
+			data[k] = v
+		}
+		clone[name] = &memoryBucketData{seq: bucket.seq, data: data}
+	}
+
+	err := fn(&memoryTx{buckets: clone, writable: true})
+	if err != nil {
+		return err
+	}
+
+	s.buckets = clone
+	return nil
+}
+
+// View runs fn within a read-only transaction
+func (s *memoryStore) View(fn func(Tx) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	return fn(&memoryTx{buckets: s.buckets})
+}
+
+// Close is a no-op for the memory store
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	buckets  map[string]*memoryBucketData
+	writable bool
+}
+
+func (t *memoryTx) Bucket(name []byte) (Bucket, error) {
+	b, exists := t.buckets[string(name)]
+	if !exists {
+		return nil, edb.ErrBucketMissing
+	}
+	return &memoryBucket{b: b, writable: t.writable}, nil
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if b, exists := t.buckets[string(name)]; exists {
+		return &memoryBucket{b: b, writable: t.writable}, nil
+	}
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+	b := &memoryBucketData{data: make(map[string][]byte)}
+	t.buckets[string(name)] = b
+	return &memoryBucket{b: b, writable: true}, nil
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+	delete(t.buckets, string(name))
+	return nil
+}
+
+func (t *memoryTx) ForEachBucket(fn func(name []byte) error) error {
+	names := make([]string, 0, len(t.buckets))
+	for name := range t.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := fn([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type memoryBucket struct {
+	b        *memoryBucketData
+	writable bool
+}
+
+func (b *memoryBucket) Get(key []byte) ([]byte, error) {
+	return b.b.data[string(key)], nil
+}
+
+func (b *memoryBucket) Put(key []byte, value []byte) error {
+	if !b.writable {
+		return errTxNotWritable
+	}
+	temp := make([]byte, len(value))
+	copy(temp, value)
+	b.b.data[string(key)] = temp
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.writable {
+		return errTxNotWritable
+	}
+	delete(b.b.data, string(key))
+	return nil
+}
+
+func (b *memoryBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.ForEachPrefix(nil, fn)
+}
+
+func (b *memoryBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	keys := make([]string, 0, len(b.b.data))
+	for k := range b.b.data {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		err := fn([]byte(k), b.b.data[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) Sequence() (uint64, error) {
+	return b.b.seq, nil
+}
+
+func (b *memoryBucket) SetSequence(seq uint64) error {
+	if !b.writable {
+		return errTxNotWritable
+	}
+	b.b.seq = seq
+	return nil
+}
+
+func (b *memoryBucket) NextSequence() (uint64, error) {
+	if !b.writable {
+		return 0, errTxNotWritable
+	}
+	b.b.seq++
+	return b.b.seq, nil
+}
@@ -0,0 +1,373 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// migrate contains the schema versioning for records stored in the database. Every bucket
+// that has migrations registered has its schema version stored in MetaBucket and every record
+// in it carries the version it was last written with in its SchemaVersion field. Migrations
+// operate on the raw JSON of a record so that renamed fields or changed types can be carried
+// over instead of being silently zeroed when unmarshalled into the current structs.
+
+// MetaBucket stores the schema version of the other buckets, keyed by bucket name
+var MetaBucket = []byte("Meta")
+
+// schemaVersionKey is the field in which a record's schema version is stored
+const schemaVersionKey = "SchemaVersion"
+
+// Record is the decoded JSON of a stored record. Numbers are decoded as json.Number so that
+// they survive a migration without losing precision
+type Record map[string]interface{}
+
+// Migration upgrades the records in Bucket to Version
+type Migration struct {
+	// Version is the schema version that records are at after this migration has run
+	Version int
+	// Bucket is the bucket whose records this migration applies to
+	Bucket []byte
+	// Description is a short human readable description of what the migration does
+	Description string
+	// Migrate modifies record in place. Returning an error aborts all pending migrations
+	Migrate func(record Record) error
+}
+
+// MigrationReport describes the effect of a migration on the database
+type MigrationReport struct {
+	Version     int
+	Bucket      string
+	Description string
+	// Changed contains the keys of records whose content was modified by the migration
+	Changed []string
+	// Stamped is the number of records that were brought to the migration's schema version
+	Stamped int
+}
+
+// migrations is the ordered list of registered migrations
+var migrations []Migration
+
+// errDryRun is returned from within the migration transaction to roll back a dry run
+var errDryRun = errors.New("dry run, rolling back")
+
+// RegisterMigration adds a migration to the registry. Migrations must be registered in
+// increasing version order for each bucket
+func RegisterMigration(m Migration) error {
+	if m.Migrate == nil {
+		return errors.New("migration has no migrate function")
+	}
+	latest := SchemaVersion(m.Bucket)
+	if m.Version <= latest {
+		return errors.New("migration version must be greater than " + string(m.Bucket) + " schema version")
+	}
+	migrations = append(migrations, m)
+	return nil
+}
+
+// SchemaVersion returns the latest registered schema version of the passed bucket
+func SchemaVersion(bucket []byte) int {
+	version := 0
+	for _, m := range migrations {
+		if bytes.Equal(m.Bucket, bucket) && m.Version > version {
+			version = m.Version
+		}
+	}
+	return version
+}
+
+// storedSchemaVersion returns the schema version of the passed bucket recorded in MetaBucket
+func storedSchemaVersion(tx Tx, bucket []byte) (int, error) {
+	meta, err := tx.CreateBucketIfNotExists(MetaBucket)
+	if err != nil {
+		return 0, err
+	}
+	x, err := meta.Get(bucket)
+	if err != nil || x == nil {
+		return 0, err
+	}
+	return utils.ToInt(x)
+}
+
+// StoredSchemaVersion returns the schema version of the passed bucket as recorded in the database
+func StoredSchemaVersion(bucket []byte) (int, error) {
+	var version int
+	err := store.View(func(tx Tx) error {
+		meta, err := tx.Bucket(MetaBucket)
+		if err != nil {
+			return err
+		}
+		x, err := meta.Get(bucket)
+		if err != nil || x == nil {
+			return err
+		}
+		version, err = utils.ToInt(x)
+		return err
+	})
+	return version, err
+}
+
+// RunMigrations runs pending migrations on all buckets. If dryRun is set, the migrations are
+// run and reported on but their changes are rolled back
+func RunMigrations(dryRun bool) ([]MigrationReport, error) {
+	var reports []MigrationReport
+
+	err := store.Update(func(tx Tx) error {
+		reports = nil
+		usersChanged := false
+
+		for _, m := range migrations {
+			current, err := storedSchemaVersion(tx, m.Bucket)
+			if err != nil {
+				return errors.Wrap(err, "could not read schema version")
+			}
+			if m.Version <= current {
+				continue
+			}
+
+			report, err := runMigration(tx, m)
+			if err != nil {
+				return errors.Wrap(err, "migration to version "+strconv.Itoa(m.Version)+" of "+string(m.Bucket)+" failed")
+			}
+			reports = append(reports, report)
+
+			if bytes.Equal(m.Bucket, UserBucket) && len(report.Changed) != 0 {
+				usersChanged = true
+			}
+
+			meta, err := tx.Bucket(MetaBucket)
+			if err != nil {
+				return err
+			}
+			err = meta.Put(m.Bucket, []byte(strconv.Itoa(m.Version)))
+			if err != nil {
+				return err
+			}
+		}
+
+		if usersChanged {
+			// migrations might have changed indexed fields, regenerate the indexes
+			_, err := rebuildUserIndexes(tx)
+			if err != nil {
+				return errors.Wrap(err, "could not rebuild user indexes")
+			}
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+
+	if err == errDryRun {
+		err = nil
+	}
+	return reports, err
+}
+
+// runMigration applies m to every record in its bucket that is behind m.Version
+func runMigration(tx Tx, m Migration) (MigrationReport, error) {
+	report := MigrationReport{
+		Version:     m.Version,
+		Bucket:      string(m.Bucket),
+		Description: m.Description,
+	}
+
+	b, err := tx.CreateBucketIfNotExists(m.Bucket)
+	if err != nil {
+		return report, err
+	}
+
+	type update struct {
+		key   []byte
+		value []byte
+	}
+	var updates []update
+
+	err = b.ForEach(func(k, v []byte) error {
+		record, err := decodeRecord(v)
+		if err != nil {
+			return errors.Wrap(err, "could not decode record "+string(k))
+		}
+
+		version, err := recordVersion(record)
+		if err != nil {
+			return errors.Wrap(err, "could not read schema version of record "+string(k))
+		}
+		if version >= m.Version {
+			return nil
+		}
+
+		// migrations see the decrypted fields of users
+		sealed := bytes.Equal(m.Bucket, UserBucket)
+		if sealed {
+			err = openRecord(record)
+			if err != nil {
+				return errors.Wrap(err, "could not decrypt record "+string(k))
+			}
+		}
+
+		before, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		err = m.Migrate(record)
+		if err != nil {
+			return errors.Wrap(err, "could not migrate record "+string(k))
+		}
+
+		after, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(before, after) {
+			report.Changed = append(report.Changed, string(k))
+		}
+
+		record[schemaVersionKey] = m.Version
+		if sealed {
+			err = sealRecord(record)
+			if err != nil {
+				return errors.Wrap(err, "could not encrypt record "+string(k))
+			}
+		}
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, len(k))
+		copy(key, k)
+		updates = append(updates, update{key, encoded})
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// write outside ForEach since not every backend allows modifying a bucket while iterating
+	for _, u := range updates {
+		err = b.Put(u.key, u.value)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	report.Stamped = len(updates)
+	return report, nil
+}
+
+// decodeRecord decodes the JSON of a stored record
+func decodeRecord(v []byte) (Record, error) {
+	var record Record
+	decoder := json.NewDecoder(bytes.NewReader(v))
+	decoder.UseNumber()
+	err := decoder.Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		record = make(Record)
+	}
+	return record, nil
+}
+
+// recordVersion returns the schema version of a decoded record. Records written before
+// versioning was introduced have no version and are treated as version 0
+func recordVersion(record Record) (int, error) {
+	x, exists := record[schemaVersionKey]
+	if !exists {
+		return 0, nil
+	}
+	switch version := x.(type) {
+	case json.Number:
+		v, err := version.Int64()
+		return int(v), err
+	case int:
+		return version, nil
+	}
+	return 0, errors.New("schema version is not a number")
+}
+
+// LogMigrationReports prints migration reports to the log
+func LogMigrationReports(reports []MigrationReport, dryRun bool) {
+	if len(reports) == 0 {
+		log.Println("database schema is up to date")
+		return
+	}
+	prefix := "applied"
+	if dryRun {
+		prefix = "would apply"
+	}
+	for _, report := range reports {
+		log.Printf("%s migration %s v%d (%s): %d records stamped, %d records changed %v",
+			prefix, report.Bucket, report.Version, report.Description, report.Stamped, len(report.Changed), report.Changed)
+	}
+}
+
+func init() {
+	// the first version of the user schema is the set of fields that existed before records
+	// were versioned, there is nothing to convert apart from stamping the version
+	err := RegisterMigration(Migration{
+		Version:     1,
+		Bucket:      UserBucket,
+		Description: "add schema version to existing users",
+		Migrate:     func(record Record) error { return nil },
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// access tokens moved to SessionBucket and are stored hashed there. Tokens stored in
+	// plaintext on users are dropped, which logs out everyone once
+	err = RegisterMigration(Migration{
+		Version:     2,
+		Bucket:      UserBucket,
+		Description: "drop plaintext access tokens",
+		Migrate: func(record Record) error {
+			delete(record, "AccessToken")
+			return nil
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the Admin and Inspector flags are replaced by roles. The kill switch used to be limited to
+	// the admin named martin, who keeps it as the superadmin
+	err = RegisterMigration(Migration{
+		Version:     3,
+		Bucket:      UserBucket,
+		Description: "replace admin and inspector flags with roles",
+		Migrate: func(record Record) error {
+			var roles []interface{}
+			if x, ok := record["Roles"].([]interface{}); ok {
+				roles = x
+			}
+			if admin, _ := record["Admin"].(bool); admin {
+				roles = append(roles, RoleAdmin)
+				if username, _ := record["Username"].(string); username == "martin" {
+					roles = append(roles, RoleSuperAdmin)
+				}
+			}
+			if inspector, _ := record["Inspector"].(bool); inspector {
+				roles = append(roles, RoleKycInspector)
+			}
+			if len(roles) != 0 {
+				record["Roles"] = roles
+			}
+			delete(record, "Admin")
+			delete(record, "Inspector")
+			return nil
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
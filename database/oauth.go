@@ -0,0 +1,623 @@
+package database
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// oauth contains the OAuth2 provider of openx. Platforms are registered as clients and users
+// grant them access through the authorization code flow with PKCE. The authorization codes,
+// access tokens and refresh tokens handed out are stored hashed along with the consents users
+// gave, so that platforms never see the credentials of users
+
+// OAuthBucket stores authorization codes, tokens and consents
+var OAuthBucket = []byte("OAuth")
+
+// scopes users can grant to platforms
+const (
+	OAuthProfile = "profile"
+	OAuthEmail   = "email"
+	OAuthWallet  = "wallet"
+)
+
+// OAuthScopes are the scopes platforms can request from users
+var OAuthScopes = []string{OAuthOpenID, OAuthProfile, OAuthEmail, OAuthWallet}
+
+// OAuthCodeLife is the number of seconds an authorization code can be exchanged for tokens
+var OAuthCodeLife = int64(60)
+
+// OAuthAccessLife is the number of seconds an access token is valid for
+var OAuthAccessLife = int64(60 * 60)
+
+// OAuthRefreshLife is the number of seconds a refresh token is valid for
+var OAuthRefreshLife = int64(30 * 24 * 60 * 60)
+
+// kinds of grants stored in OAuthBucket
+const (
+	oauthCode    = "code"
+	oauthAccess  = "access"
+	oauthRefresh = "refresh"
+	oauthConsent = "consent"
+)
+
+// oauthTokenLength is the length of authorization codes and tokens
+var oauthTokenLength = 40
+
+// OAuthGrant is an authorization code, access token or refresh token issued to a platform
+type OAuthGrant struct {
+	// Kind is the kind of the grant
+	Kind string
+	// Client is the index of the platform the grant was issued to
+	Client int
+	// User is the index of the user who authorized the platform
+	User int
+	// Scopes are the scopes the grant is valid for
+	Scopes []string
+	// Created is the unix time at which the grant was issued
+	Created int64
+	// Expiry is the unix time after which the grant can't be used
+	Expiry int64
+	// RedirectURI is the redirect uri an authorization code was requested with
+	RedirectURI string `json:",omitempty"`
+	// Challenge is the PKCE code challenge an authorization code was requested with
+	Challenge string `json:",omitempty"`
+	// Nonce is the OpenID Connect nonce an authorization code was requested with
+	Nonce string `json:",omitempty"`
+	// AuthTime is the unix time at which the user authorized the platform
+	AuthTime int64
+}
+
+// TokenType returns the type of a token as reported by the introspection endpoint
+func (g OAuthGrant) TokenType() string {
+	if g.Kind == oauthRefresh {
+		return "refresh_token"
+	}
+	return "Bearer"
+}
+
+// Consent records the scopes a user has allowed a platform to access
+type Consent struct {
+	User    int
+	Client  int
+	Scopes  []string
+	Created int64
+}
+
+// OAuthTokens is the response of the token endpoint
+type OAuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// ParseOAuthScopes parses a space separated list of scopes
+func ParseOAuthScopes(scope string) ([]string, error) {
+	var scopes []string
+	for _, x := range strings.Fields(scope) {
+		if !containsScope(OAuthScopes, x) {
+			return nil, errors.New("unknown scope: " + x)
+		}
+		if !containsScope(scopes, x) {
+			scopes = append(scopes, x)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("no scopes requested")
+	}
+	return scopes, nil
+}
+
+// containsScope returns true if scope is in scopes
+func containsScope(scopes []string, scope string) bool {
+	for _, x := range scopes {
+		if x == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// coversScopes returns true if every scope in requested is in granted
+func coversScopes(granted []string, requested []string) bool {
+	for _, x := range requested {
+		if !containsScope(granted, x) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetRedirectURIs replaces the redirect uris users can be sent back to after authorizing
+// the platform. Redirect uris must be absolute and use https unless they point to localhost
+func (a *Platform) SetRedirectURIs(uris []string) error {
+	for _, x := range uris {
+		err := checkPlatformURI(x)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.RedirectURIs = uris
+	return a.Save()
+}
+
+// checkPlatformURI checks that a uri registered by a platform is absolute and uses https
+// unless it points to localhost
+func checkPlatformURI(x string) error {
+	u, err := url.Parse(x)
+	if err != nil {
+		return errors.Wrap(err, "invalid uri")
+	}
+	if u.Host == "" || u.Fragment != "" {
+		return errors.New("uri must be absolute and can't contain a fragment: " + x)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && u.Hostname() == "localhost") {
+		return errors.New("uri must use https: " + x)
+	}
+	return nil
+}
+
+// ValidRedirect returns true if uri has been registered by the platform
+func (a Platform) ValidRedirect(uri string) bool {
+	for _, x := range a.RedirectURIs {
+		if x == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSecret returns true if secret is the secret of one of the live keys of the platform.
+// Platforms authenticate to the token endpoint with it
+func (a Platform) CheckSecret(secret string) bool {
+	for _, x := range a.Keys {
+		s, err := a.KeySecret(x.ID)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(s, []byte(secret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// oauthKey returns the key under which a code or token is stored
+func oauthKey(kind string, token string) []byte {
+	return []byte(kind + "|" + string(hashToken(token)))
+}
+
+// consentKey returns the key under which the consent of user to client is stored
+func consentKey(user int, client int) []byte {
+	return []byte(oauthConsent + "|" + strconv.Itoa(user) + "|" + strconv.Itoa(client))
+}
+
+// putJSON stores x under key in b
+func putJSON(b Bucket, key []byte, x interface{}) error {
+	encoded, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, encoded)
+}
+
+// RetrieveConsent retrieves the consent the user gave to the platform. The consent has no
+// scopes if the user hasn't authorized the platform
+func RetrieveConsent(user int, client int) (Consent, error) {
+	consent := Consent{User: user, Client: client}
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(OAuthBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(consentKey(user, client))
+		if err != nil || x == nil {
+			return err
+		}
+		return json.Unmarshal(x, &consent)
+	})
+	if err != nil {
+		return consent, errors.Wrap(err, "could not retrieve consent")
+	}
+	return consent, nil
+}
+
+// Covers returns true if the consent includes every scope in scopes
+func (c Consent) Covers(scopes []string) bool {
+	return coversScopes(c.Scopes, scopes)
+}
+
+// GrantConsent records that the user allows the platform to access scopes in addition to
+// the scopes allowed before
+func GrantConsent(user int, client int, scopes []string) (Consent, error) {
+	consent, err := RetrieveConsent(user, client)
+	if err != nil {
+		return consent, err
+	}
+
+	for _, x := range scopes {
+		if !containsScope(consent.Scopes, x) {
+			consent.Scopes = append(consent.Scopes, x)
+		}
+	}
+	consent.Created = utils.Unix()
+
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(OAuthBucket)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, consentKey(user, client), consent)
+	})
+	if err != nil {
+		return consent, errors.Wrap(err, "could not save consent")
+	}
+	return consent, nil
+}
+
+// RetrieveConsents retrieves the consents the user has given, sorted by platform
+func RetrieveConsents(user int) ([]Consent, error) {
+	var arr []Consent
+	prefix := []byte(oauthConsent + "|" + strconv.Itoa(user) + "|")
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(OAuthBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if !strings.HasPrefix(string(k), string(prefix)) {
+				return nil
+			}
+			var x Consent
+			err := json.Unmarshal(v, &x)
+			if err != nil {
+				return err
+			}
+			arr = append(arr, x)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve consents")
+	}
+	sort.Slice(arr, func(i, j int) bool { return arr[i].Client < arr[j].Client })
+	return arr, nil
+}
+
+// RevokeConsent revokes the consent the user gave to the platform along with every code and
+// token issued to the platform on behalf of the user
+func RevokeConsent(user int, client int) error {
+	return store.Update(func(tx Tx) error {
+		return deleteOAuthGrants(tx, func(x OAuthGrant) bool {
+			return x.User == user && x.Client == client
+		}, consentKey(user, client))
+	})
+}
+
+// deleteOAuthGrants deletes the codes and tokens that match along with the passed keys
+func deleteOAuthGrants(tx Tx, match func(OAuthGrant) bool, keys ...[]byte) error {
+	b, err := tx.Bucket(OAuthBucket)
+	if err == edb.ErrBucketMissing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.ForEach(func(k, v []byte) error {
+		if strings.HasPrefix(string(k), oauthConsent+"|") {
+			return nil
+		}
+		var x OAuthGrant
+		if json.Unmarshal(v, &x) != nil || match(x) {
+			key := make([]byte, len(k))
+			copy(key, k)
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = b.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUserOAuth deletes the consents, codes and tokens of the user with the passed index
+func deleteUserOAuth(tx Tx, user int) error {
+	var consents [][]byte
+	prefix := oauthConsent + "|" + strconv.Itoa(user) + "|"
+	b, err := tx.Bucket(OAuthBucket)
+	if err == edb.ErrBucketMissing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = b.ForEach(func(k, v []byte) error {
+		if strings.HasPrefix(string(k), prefix) {
+			key := make([]byte, len(k))
+			copy(key, k)
+			consents = append(consents, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteOAuthGrants(tx, func(x OAuthGrant) bool { return x.User == user }, consents...)
+}
+
+// NewAuthorizationCode issues an authorization code to the platform on behalf of the user.
+// challenge is the S256 PKCE code challenge sent by the platform and nonce the optional
+// OpenID Connect nonce that is passed on to the ID token
+func NewAuthorizationCode(user int, client int, redirectURI string, scopes []string,
+	challenge string, nonce string) (string, error) {
+	if challenge == "" {
+		return "", errors.New("code challenge required")
+	}
+
+	code := utils.GetRandomString(oauthTokenLength)
+	now := utils.Unix()
+	grant := OAuthGrant{
+		Kind:        oauthCode,
+		Client:      client,
+		User:        user,
+		Scopes:      scopes,
+		Created:     now,
+		Expiry:      now + OAuthCodeLife,
+		RedirectURI: redirectURI,
+		Challenge:   challenge,
+		Nonce:       nonce,
+		AuthTime:    now,
+	}
+
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(OAuthBucket)
+		if err != nil {
+			return err
+		}
+		// drop the codes and tokens that can't be used anymore
+		err = deleteOAuthGrants(tx, func(x OAuthGrant) bool { return x.Expiry <= now })
+		if err != nil {
+			return err
+		}
+		return putJSON(b, oauthKey(oauthCode, code), grant)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "could not save authorization code")
+	}
+	return code, nil
+}
+
+// consumeGrant deletes the grant stored under key and returns it
+func consumeGrant(b Bucket, key []byte) (OAuthGrant, error) {
+	var grant OAuthGrant
+	x, err := b.Get(key)
+	if err != nil {
+		return grant, err
+	}
+	if x == nil {
+		return grant, errors.New("grant not found")
+	}
+	err = json.Unmarshal(x, &grant)
+	if err != nil {
+		return grant, err
+	}
+	return grant, b.Delete(key)
+}
+
+// issueTokens stores a new access token and refresh token for the passed grant
+func issueTokens(b Bucket, client int, user int, scopes []string, authTime int64) (OAuthTokens, error) {
+	now := utils.Unix()
+	tokens := OAuthTokens{
+		AccessToken:  utils.GetRandomString(oauthTokenLength),
+		TokenType:    "Bearer",
+		ExpiresIn:    OAuthAccessLife,
+		RefreshToken: utils.GetRandomString(oauthTokenLength),
+		Scope:        strings.Join(scopes, " "),
+	}
+
+	access := OAuthGrant{Kind: oauthAccess, Client: client, User: user, Scopes: scopes,
+		Created: now, Expiry: now + OAuthAccessLife, AuthTime: authTime}
+	err := putJSON(b, oauthKey(oauthAccess, tokens.AccessToken), access)
+	if err != nil {
+		return tokens, err
+	}
+
+	refresh := access
+	refresh.Kind = oauthRefresh
+	refresh.Expiry = now + OAuthRefreshLife
+	return tokens, putJSON(b, oauthKey(oauthRefresh, tokens.RefreshToken), refresh)
+}
+
+// ExchangeAuthorizationCode exchanges an authorization code issued to the platform for an
+// access token and a refresh token. verifier is the PKCE code verifier of the code challenge
+// the code was requested with. Codes can only be exchanged once
+func ExchangeAuthorizationCode(code string, client int, redirectURI string,
+	verifier string) (OAuthTokens, error) {
+	var tokens OAuthTokens
+	var grant OAuthGrant
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(OAuthBucket)
+		if err != nil {
+			return err
+		}
+
+		grant, err = consumeGrant(b, oauthKey(oauthCode, code))
+		if err != nil {
+			return err
+		}
+		if grant.Client != client {
+			return errors.New("code was issued to a different client")
+		}
+		if grant.Expiry <= utils.Unix() {
+			return errors.New("code expired")
+		}
+		if grant.RedirectURI != redirectURI {
+			return errors.New("redirect uri does not match")
+		}
+		if !verifyPKCE(verifier, grant.Challenge) {
+			return errors.New("code verifier does not match")
+		}
+
+		tokens, err = issueTokens(b, grant.Client, grant.User, grant.Scopes, grant.AuthTime)
+		return err
+	})
+	if err != nil {
+		return tokens, errors.Wrap(err, "could not exchange authorization code")
+	}
+	return tokens, addIDToken(&tokens, grant, grant.Scopes)
+}
+
+// addIDToken adds an ID token to tokens issued for grant if the openid scope was granted.
+// Signing happens outside the transaction that stored the tokens since it reads the keys
+func addIDToken(tokens *OAuthTokens, grant OAuthGrant, scopes []string) error {
+	if !containsScope(scopes, OAuthOpenID) {
+		return nil
+	}
+	var err error
+	tokens.IDToken, err = newIDToken(grant.User, grant.Client, grant.AuthTime, grant.Nonce)
+	if err != nil {
+		return errors.Wrap(err, "could not issue id token")
+	}
+	return nil
+}
+
+// verifyPKCE checks a PKCE code verifier against an S256 code challenge
+func verifyPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// RefreshOAuthTokens exchanges a refresh token issued to the platform for a new access token
+// and refresh token. The old refresh token can't be used again. scopes can narrow down the
+// scopes of the new tokens and the scopes of the refresh token are kept if it is empty
+func RefreshOAuthTokens(refreshToken string, client int, scopes []string) (OAuthTokens, error) {
+	var tokens OAuthTokens
+	var grant OAuthGrant
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(OAuthBucket)
+		if err != nil {
+			return err
+		}
+
+		grant, err = consumeGrant(b, oauthKey(oauthRefresh, refreshToken))
+		if err != nil {
+			return err
+		}
+		if grant.Client != client {
+			return errors.New("refresh token was issued to a different client")
+		}
+		if grant.Expiry <= utils.Unix() {
+			return errors.New("refresh token expired")
+		}
+		if len(scopes) == 0 {
+			scopes = grant.Scopes
+		}
+		if !coversScopes(grant.Scopes, scopes) {
+			return errors.New("requested scopes exceed the scopes of the refresh token")
+		}
+
+		tokens, err = issueTokens(b, grant.Client, grant.User, scopes, grant.AuthTime)
+		return err
+	})
+	if err != nil {
+		return tokens, errors.Wrap(err, "could not refresh tokens")
+	}
+	// nonces are only passed on to the first ID token
+	grant.Nonce = ""
+	return tokens, addIDToken(&tokens, grant, scopes)
+}
+
+// IntrospectOAuthToken returns the grant of a live access token or refresh token
+func IntrospectOAuthToken(token string) (OAuthGrant, error) {
+	var grant OAuthGrant
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(OAuthBucket)
+		if err != nil {
+			return err
+		}
+		for _, kind := range []string{oauthAccess, oauthRefresh} {
+			x, err := b.Get(oauthKey(kind, token))
+			if err != nil {
+				return err
+			}
+			if x != nil {
+				return json.Unmarshal(x, &grant)
+			}
+		}
+		return errors.New("token not found")
+	})
+	if err != nil {
+		return grant, err
+	}
+	if grant.Expiry <= utils.Unix() {
+		return grant, errors.New("token expired")
+	}
+	return grant, nil
+}
+
+// RevokeOAuthToken revokes an access token or refresh token issued to the platform. Revoking
+// a token that doesn't exist isn't an error
+func RevokeOAuthToken(token string, client int) error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(OAuthBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, kind := range []string{oauthAccess, oauthRefresh} {
+			key := oauthKey(kind, token)
+			x, err := b.Get(key)
+			if err != nil {
+				return err
+			}
+			if x == nil {
+				continue
+			}
+			var grant OAuthGrant
+			err = json.Unmarshal(x, &grant)
+			if err != nil {
+				return err
+			}
+			if grant.Client != client {
+				return errors.New("token was issued to a different client")
+			}
+			return b.Delete(key)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,395 @@
+package database
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// oidc contains the OpenID Connect layer on top of the OAuth2 provider. Platforms that are
+// granted the openid scope receive ID tokens signed with ES256 keys that are rotated
+// periodically and published as a JWKS so that users can sign in to any platform with their
+// openx account. When a user logs out, platforms are sent back-channel logout tokens
+
+// OIDCKeyBucket stores the keys ID tokens are signed with
+var OIDCKeyBucket = []byte("OIDCKeys")
+
+// OAuthOpenID is the scope platforms request to receive ID tokens
+const OAuthOpenID = "openid"
+
+// OIDCIssuer is the issuer of ID tokens, the url openx is reachable at
+var OIDCIssuer = "https://localhost"
+
+// OIDCTokenLife is the number of seconds an ID token is valid for
+var OIDCTokenLife = int64(60 * 60)
+
+// OIDCKeyLife is the number of seconds a signing key is used before it is rotated
+var OIDCKeyLife = int64(30 * 24 * 60 * 60)
+
+// OIDCKeyOverlap is the number of seconds a rotated key stays in the JWKS so that tokens
+// signed with it can still be verified
+var OIDCKeyOverlap = int64(7 * 24 * 60 * 60)
+
+// backchannelLogoutEvent is the event a logout token carries
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// OIDCKey is a key ID tokens are signed with
+type OIDCKey struct {
+	// ID is the key id of the key in the JWKS
+	ID string
+	// Private is the DER encoded private key. It is only stored in plaintext if no master key is loaded
+	Private []byte `json:",omitempty"`
+	// SealedPrivate is the private key encrypted with a data key
+	SealedPrivate *sealedFields `json:",omitempty"`
+	// Created is the unix time at which the key was generated
+	Created int64
+	// Retired is the unix time at which the key stopped signing tokens, zero if it is active
+	Retired int64
+	// Public is the public key as published in the JWKS
+	Public JWK
+}
+
+// JWK is a public key as published in a JWKS
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// JWKS is the set of keys ID tokens can be verified with
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// IDTokenClaims are the claims of an ID token
+type IDTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	Expiry   int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+}
+
+// LogoutTokenClaims are the claims of a back-channel logout token
+type LogoutTokenClaims struct {
+	Issuer   string                 `json:"iss"`
+	Subject  string                 `json:"sub"`
+	Audience string                 `json:"aud"`
+	IssuedAt int64                  `json:"iat"`
+	JTI      string                 `json:"jti"`
+	Events   map[string]interface{} `json:"events"`
+}
+
+// privateKey decodes the private key of the key
+func (k OIDCKey) privateKey() (*ecdsa.PrivateKey, error) {
+	der := k.Private
+	if k.SealedPrivate != nil {
+		var err error
+		der, err = openSealed(*k.SealedPrivate)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// newOIDCKey generates a new signing key
+func newOIDCKey() (OIDCKey, error) {
+	var key OIDCKey
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return key, errors.Wrap(err, "could not generate signing key")
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return key, err
+	}
+
+	raw := make([]byte, 8)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return key, err
+	}
+	key.ID = hex.EncodeToString(raw)
+	key.Created = utils.Unix()
+	key.Public = publicJWK(key.ID, &priv.PublicKey)
+
+	key.SealedPrivate, err = sealValue(der)
+	if err != nil {
+		return key, err
+	}
+	if key.SealedPrivate == nil {
+		key.Private = der
+	}
+	return key, nil
+}
+
+// retrieveOIDCKeys retrieves the signing keys, newest first
+func retrieveOIDCKeys(b Bucket) ([]OIDCKey, error) {
+	var keys []OIDCKey
+	err := b.ForEach(func(k, v []byte) error {
+		var x OIDCKey
+		err := json.Unmarshal(v, &x)
+		if err != nil {
+			return errors.Wrap(err, "could not decode signing key")
+		}
+		keys = append(keys, x)
+		return nil
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created > keys[j].Created })
+	return keys, err
+}
+
+// RotateOIDCKey retires the active signing key and generates a new one. Retired keys are
+// dropped once they have been retired for OIDCKeyOverlap seconds
+func RotateOIDCKey() (OIDCKey, error) {
+	key, err := newOIDCKey()
+	if err != nil {
+		return key, err
+	}
+
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(OIDCKeyBucket)
+		if err != nil {
+			return err
+		}
+		keys, err := retrieveOIDCKeys(b)
+		if err != nil {
+			return err
+		}
+
+		now := utils.Unix()
+		for _, x := range keys {
+			if x.Retired == 0 {
+				x.Retired = now
+				err = putJSON(b, []byte(x.ID), x)
+			} else if x.Retired+OIDCKeyOverlap < now {
+				err = b.Delete([]byte(x.ID))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return putJSON(b, []byte(key.ID), key)
+	})
+	if err != nil {
+		return key, errors.Wrap(err, "could not rotate signing key")
+	}
+	return key, nil
+}
+
+// activeOIDCKey returns the key tokens are signed with, rotating it if it is older than
+// OIDCKeyLife
+func activeOIDCKey() (OIDCKey, error) {
+	var active OIDCKey
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(OIDCKeyBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		keys, err := retrieveOIDCKeys(b)
+		if err != nil {
+			return err
+		}
+		for _, x := range keys {
+			if x.Retired == 0 {
+				active = x
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return active, err
+	}
+
+	if active.ID == "" || active.Created+OIDCKeyLife < utils.Unix() {
+		return RotateOIDCKey()
+	}
+	return active, nil
+}
+
+// RetrieveJWKS returns the public keys of the signing keys that tokens may have been
+// signed with
+func RetrieveJWKS() (JWKS, error) {
+	jwks := JWKS{Keys: []JWK{}}
+	_, err := activeOIDCKey()
+	if err != nil {
+		return jwks, err
+	}
+
+	var keys []OIDCKey
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket(OIDCKeyBucket)
+		if err != nil {
+			return err
+		}
+		keys, err = retrieveOIDCKeys(b)
+		return err
+	})
+	if err != nil {
+		return jwks, errors.Wrap(err, "could not retrieve signing keys")
+	}
+
+	now := utils.Unix()
+	for _, x := range keys {
+		if x.Retired != 0 && x.Retired+OIDCKeyOverlap < now {
+			continue
+		}
+		jwk, err := x.jwk()
+		if err != nil {
+			return jwks, err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks, nil
+}
+
+// publicJWK returns the JWK of the public key with the passed key id
+func publicJWK(id string, pub *ecdsa.PublicKey) JWK {
+	return JWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(pad32(pub.X.Bytes())),
+		Y:   base64.RawURLEncoding.EncodeToString(pad32(pub.Y.Bytes())),
+		Kid: id,
+		Use: "sig",
+		Alg: "ES256",
+	}
+}
+
+// jwk returns the public key of the key. Keys generated before the public key was stored
+// along with them have it derived from their private key
+func (k OIDCKey) jwk() (JWK, error) {
+	if k.Public.Kid != "" {
+		return k.Public, nil
+	}
+	priv, err := k.privateKey()
+	if err != nil {
+		return JWK{}, err
+	}
+	return publicJWK(k.ID, &priv.PublicKey), nil
+}
+
+// pad32 left pads b with zeroes to 32 bytes
+func pad32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// SignJWT signs claims with the active signing key and returns the compact JWT
+func SignJWT(claims interface{}, typ string) (string, error) {
+	key, err := activeOIDCKey()
+	if err != nil {
+		return "", err
+	}
+	priv, err := key.privateKey()
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "typ": typ, "kid": key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign token")
+	}
+
+	sig := append(pad32(r.Bytes()), pad32(s.Bytes())...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// newIDToken returns an ID token for the user issued to client
+func newIDToken(user int, client int, authTime int64, nonce string) (string, error) {
+	now := utils.Unix()
+	return SignJWT(IDTokenClaims{
+		Issuer:   OIDCIssuer,
+		Subject:  strconv.Itoa(user),
+		Audience: strconv.Itoa(client),
+		Expiry:   now + OIDCTokenLife,
+		IssuedAt: now,
+		AuthTime: authTime,
+		Nonce:    nonce,
+	}, "JWT")
+}
+
+// NewLogoutToken returns a back-channel logout token telling client that user logged out
+func NewLogoutToken(user int, client int) (string, error) {
+	return SignJWT(LogoutTokenClaims{
+		Issuer:   OIDCIssuer,
+		Subject:  strconv.Itoa(user),
+		Audience: strconv.Itoa(client),
+		IssuedAt: utils.Unix(),
+		JTI:      utils.GetRandomString(24),
+		Events:   map[string]interface{}{backchannelLogoutEvent: struct{}{}},
+	}, "logout+jwt")
+}
+
+// SetLogoutURI sets the uri the platform is sent back-channel logout tokens at. An empty uri
+// stops logouts from being propagated to the platform
+func (a *Platform) SetLogoutURI(uri string) error {
+	if uri != "" {
+		err := checkPlatformURI(uri)
+		if err != nil {
+			return err
+		}
+	}
+	a.LogoutURI = uri
+	return a.Save()
+}
+
+// LogoutOAuth revokes every token issued on behalf of the user and returns the platforms the
+// user has authorized so that they can be told about the logout. Consents are kept so that
+// the user isn't asked again the next time they sign in
+func LogoutOAuth(user int) ([]int, error) {
+	consents, err := RetrieveConsents(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Update(func(tx Tx) error {
+		return deleteOAuthGrants(tx, func(x OAuthGrant) bool { return x.User == user })
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not revoke tokens")
+	}
+
+	clients := make([]int, len(consents))
+	for i, x := range consents {
+		clients[i] = x.Client
+	}
+	return clients, nil
+}
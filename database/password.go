@@ -0,0 +1,152 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// password contains the server side hashing of user passwords. Clients send a hash of the
+// password which is treated as the password itself and stored as an Argon2id hash with a
+// per user salt. Users stored before this have the client hash stored as is and are rehashed
+// the next time they log in
+
+// Argon2Config holds the Argon2id parameters used to hash passwords
+type Argon2Config struct {
+	// Time is the number of passes over memory
+	Time uint32
+	// Memory is the amount of memory used in KiB
+	Memory uint32
+	// Threads is the number of threads used
+	Threads uint8
+	// KeyLen is the length of the derived key in bytes
+	KeyLen uint32
+	// SaltLen is the length of the random salt in bytes
+	SaltLen uint32
+}
+
+// Argon2Params are the parameters new password hashes are created with. Existing hashes
+// created with different parameters are rehashed on the next successful login
+var Argon2Params = Argon2Config{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+	KeyLen:  32,
+	SaltLen: 16,
+}
+
+// argon2Prefix prefixes password hashes in the PHC string format
+const argon2Prefix = "$argon2id$"
+
+// HashPassword hashes pwhash with Argon2id and a random salt using Argon2Params
+func HashPassword(pwhash string) (string, error) {
+	params := Argon2Params
+	salt := make([]byte, params.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate salt")
+	}
+
+	key := argon2.IDKey([]byte(pwhash), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, params.Memory, params.Time,
+		params.Threads, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// decodePasswordHash parses a password hash created by HashPassword
+func decodePasswordHash(encoded string) (Argon2Config, []byte, []byte, error) {
+	var params Argon2Config
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid password hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid password hash version")
+	}
+	if version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid password hash parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid password hash salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "invalid password hash")
+	}
+
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// verifyPassword checks pwhash against the stored hash. needsRehash is set if the stored hash
+// is a legacy plain hash or was created with parameters other than Argon2Params
+func verifyPassword(stored string, pwhash string) (match bool, needsRehash bool) {
+	if !strings.HasPrefix(stored, argon2Prefix) {
+		// legacy users have the client hash stored as is
+		if stored == "" {
+			return false, false
+		}
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(pwhash)) == 1, true
+	}
+
+	params, salt, key, err := decodePasswordHash(stored)
+	if err != nil {
+		log.Println(err)
+		return false, false
+	}
+
+	computed := argon2.IDKey([]byte(pwhash), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false
+	}
+
+	return true, params != Argon2Params
+}
+
+// SetPassword sets the password of the user to pwhash. The user must be saved afterwards
+func (a *User) SetPassword(pwhash string) error {
+	hash, err := HashPassword(pwhash)
+	if err != nil {
+		return err
+	}
+	a.Pwhash = hash
+	return nil
+}
+
+// checkPassword checks pwhash against the password of the user and upgrades the stored hash
+// if it is outdated
+func (a *User) checkPassword(pwhash string) error {
+	match, needsRehash := verifyPassword(a.Pwhash, pwhash)
+	if !match {
+		return errors.New("could not find user with requested credentials")
+	}
+
+	if needsRehash {
+		err := a.SetPassword(pwhash)
+		if err == nil {
+			err = a.Save()
+		}
+		if err != nil {
+			// the user has been authenticated, retry on the next login
+			log.Println("could not upgrade password hash of user: ", a.Index, err)
+		}
+	}
+	return nil
+}
@@ -1,47 +1,277 @@
 package database
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"strconv"
+	"sync"
+
 	"github.com/pkg/errors"
 
-	edb "github.com/Varunram/essentials/database"
 	utils "github.com/Varunram/essentials/utils"
-	consts "github.com/YaleOpenLab/openx/consts"
 )
 
+// PlatformNonceBucket stores the nonces of signed platform requests until they expire
+var PlatformNonceBucket = []byte("PlatformNonces")
+
+// NonceSweepInterval is the minimum number of seconds between two sweeps of the expired
+// nonces in a bucket. Nonces are swept while recording a new one, at most once per interval
+var NonceSweepInterval = int64(60)
+
+// nonceSweeps holds the unix time at which each nonce bucket was last swept
+var nonceSweeps = struct {
+	sync.Mutex
+	last map[string]int64
+}{last: make(map[string]int64)}
+
+// PlatformTimeout is the number of seconds a platform is valid for if it was created with a timeout
+var PlatformTimeout = int64(2600000)
+
+// KeyOverlap is the default number of seconds the keys of a platform stay valid after a new
+// key has been issued so that the platform can switch over without downtime
+var KeyOverlap = int64(24 * 60 * 60)
+
+// scopes limit the platform routes a platform can call. Secret material is only handed out
+// to platforms that have been granted the matching secrets scope
+const (
+	ScopeReadConsts      = "read-consts"
+	ScopeReadSecrets     = "read-secrets"
+	ScopeReadUser        = "read-user"
+	ScopeReadUserSecrets = "read-user-secrets"
+	ScopeValidateUser    = "validate-user"
+	ScopeCreateUser      = "create-user"
+	ScopeSendEmail       = "send-email"
+)
+
+// PlatformScopes are the scopes that can be granted to platforms
+var PlatformScopes = []string{ScopeReadConsts, ScopeReadSecrets, ScopeReadUser, ScopeReadUserSecrets,
+	ScopeValidateUser, ScopeCreateUser, ScopeSendEmail}
+
 // Platform is a struct which holds all platform related info
 type Platform struct {
-	Index   int
-	Name    string
-	Code    string
+	Index int
+	Name  string
+	// Code is the static code platforms used to authenticate with before they signed requests
+	Code string `json:",omitempty"`
+	// Timeout is the unix time after which the platform can't authenticate, zero if it doesn't expire
 	Timeout int64
+	// Keys are the API keys the platform signs its requests with
+	Keys []PlatformKey
+	// Scopes are the scopes granted to the platform
+	Scopes []string
+	// RedirectURIs are the uris users are sent back to after authorizing the platform
+	RedirectURIs []string
+	// LogoutURI is the uri the platform is sent back-channel logout tokens at
+	LogoutURI string `json:",omitempty"`
 }
 
-// NewPlatform creates a new platform and stores it in the database
-func NewPlatform(name string, code string, timeout bool) error {
-	index, err := RetrieveAllPfLim()
-	if err != nil {
-		return errors.Wrap(err, "could not retrieve all keys from the database")
-	}
+// PlatformKey is an API key pair of a platform. The ID is sent along with every request and
+// the secret is used to sign it
+type PlatformKey struct {
+	// ID identifies the key in signed requests
+	ID string
+	// Secret is the signing secret of the key. It is only stored in plaintext if no master key is loaded
+	Secret string `json:",omitempty"`
+	// SealedSecret is the signing secret encrypted with a data key
+	SealedSecret *sealedFields `json:",omitempty"`
+	// Created is the unix time at which the key was issued
+	Created int64
+	// Expiry is the unix time after which the key isn't accepted, zero if it doesn't expire
+	Expiry int64
+}
 
+// NewPlatform creates a new platform and stores it in the database. The platform is issued
+// its first key, whose id and secret are returned. The secret can't be retrieved later on
+func NewPlatform(name string, timeout bool) (Platform, string, error) {
 	var x Platform
-	x.Index = index + 1
 	x.Name = name
-	x.Code = code
-	x.Timeout = utils.Unix() + 2600000 // 10 months
-	// timeout is set to true by default
-	return x.Save()
+	if timeout {
+		x.Timeout = utils.Unix() + PlatformTimeout
+	}
+
+	key, secret, err := newPlatformKey()
+	if err != nil {
+		return x, "", err
+	}
+	x.Keys = []PlatformKey{key}
+
+	err = x.insert()
+	if err != nil {
+		return x, "", err
+	}
+	return x, secret, nil
+}
+
+// newPlatformKey generates a new key and returns it along with its secret
+func newPlatformKey() (PlatformKey, string, error) {
+	var key PlatformKey
+	raw := make([]byte, 40)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return key, "", errors.Wrap(err, "could not generate platform key")
+	}
+
+	key.ID = "pk_" + hex.EncodeToString(raw[:8])
+	secret := hex.EncodeToString(raw[8:])
+	key.Created = utils.Unix()
+
+	key.SealedSecret, err = sealValue([]byte(secret))
+	if err != nil {
+		return key, "", err
+	}
+	if key.SealedSecret == nil {
+		key.Secret = secret
+	}
+	return key, secret, nil
+}
+
+// Expired returns true if the platform was created with a timeout that has passed
+func (a Platform) Expired() bool {
+	return a.Timeout != 0 && utils.Unix() >= a.Timeout
+}
+
+// HasScope returns true if the platform has been granted scope
+func (a Platform) HasScope(scope string) bool {
+	for _, x := range a.Scopes {
+		if x == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// SetScopes replaces the scopes of the platform
+func (a *Platform) SetScopes(scopes []string) error {
+	var arr []string
+	for _, scope := range scopes {
+		valid := false
+		for _, x := range PlatformScopes {
+			if scope == x {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return errors.New("unknown scope: " + scope)
+		}
+		if !(Platform{Scopes: arr}).HasScope(scope) {
+			arr = append(arr, scope)
+		}
+	}
+
+	a.Scopes = arr
+	return a.Save()
+}
+
+// expired returns true if the key can't be used to sign requests anymore
+func (k PlatformKey) expired(now int64) bool {
+	return k.Expiry != 0 && now >= k.Expiry
+}
+
+// RotateKey issues a new key to the platform. Existing keys stay valid for overlap seconds
+// so requests signed with them are accepted while the platform switches over. Keys that have
+// already expired are dropped
+func (a *Platform) RotateKey(overlap int64) (PlatformKey, string, error) {
+	key, secret, err := newPlatformKey()
+	if err != nil {
+		return key, "", err
+	}
+
+	now := utils.Unix()
+	var keys []PlatformKey
+	for _, x := range a.Keys {
+		if x.expired(now) {
+			continue
+		}
+		if x.Expiry == 0 || x.Expiry > now+overlap {
+			x.Expiry = now + overlap
+		}
+		keys = append(keys, x)
+	}
+	a.Keys = append(keys, key)
+
+	return key, secret, a.Save()
+}
+
+// RevokeKey revokes the key with the passed id immediately
+func (a *Platform) RevokeKey(id string) error {
+	for i, x := range a.Keys {
+		if x.ID == id {
+			a.Keys = append(a.Keys[:i], a.Keys[i+1:]...)
+			return a.Save()
+		}
+	}
+	return errors.New("platform has no key with id: " + id)
+}
+
+// KeySecret returns the signing secret of the key with the passed id if it hasn't expired
+func (a Platform) KeySecret(id string) ([]byte, error) {
+	for _, x := range a.Keys {
+		if x.ID != id {
+			continue
+		}
+		if x.expired(utils.Unix()) {
+			return nil, errors.New("platform key expired")
+		}
+		if x.SealedSecret == nil {
+			return []byte(x.Secret), nil
+		}
+		return openSealed(*x.SealedSecret)
+	}
+	return nil, errors.New("platform has no key with id: " + id)
+}
+
+// Redacted returns a copy of the platform without the secrets of its keys so that it can be
+// sent to admins
+func (a Platform) Redacted() Platform {
+	a.Code = ""
+	keys := make([]PlatformKey, len(a.Keys))
+	for i, x := range a.Keys {
+		x.Secret = ""
+		x.SealedSecret = nil
+		keys[i] = x
+	}
+	a.Keys = keys
+	return a
+}
+
+// insert allocates an index for a new platform and stores it in a single transaction
+func (a *Platform) insert() error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(PlatformBucket)
+		if err != nil {
+			return err
+		}
+
+		index, err := nextIndex(b)
+		if err != nil {
+			return errors.Wrap(err, "could not allocate platform index")
+		}
+		a.Index = index
+
+		encoded, err := json.Marshal(a)
+		if err != nil {
+			return errors.Wrap(err, "error while marshaling json struct")
+		}
+
+		iK, err := utils.ToByte(a.Index)
+		if err != nil {
+			return err
+		}
+		return b.Put(iK, encoded)
+	})
 }
 
 // Save inserts a Platform object into the database
 func (a *Platform) Save() error {
-	return edb.Save(consts.DbDir+consts.DbName, PlatformBucket, a, a.Index)
+	return save(PlatformBucket, a, a.Index)
 }
 
 // RetrievePlatform retrieves a Platform from the database
 func RetrievePlatform(key int) (Platform, error) {
 	var pf Platform
-	x, err := edb.Retrieve(consts.DbDir+consts.DbName, PlatformBucket, key)
+	x, err := retrieve(PlatformBucket, key)
 	if err != nil {
 		return pf, errors.Wrap(err, "error while retrieving key from bucket")
 	}
@@ -53,7 +283,7 @@ func RetrievePlatform(key int) (Platform, error) {
 // RetrieveAllPlatforms retrieves all platforms from the database
 func RetrieveAllPlatforms() ([]Platform, error) {
 	var arr []Platform
-	x, err := edb.RetrieveAllKeys(consts.DbDir+consts.DbName, PlatformBucket)
+	x, err := retrieveAll(PlatformBucket)
 	if err != nil {
 		return arr, errors.Wrap(err, "error while retrieving all platforms")
 	}
@@ -71,5 +301,96 @@ func RetrieveAllPlatforms() ([]Platform, error) {
 
 // RetrieveAllPfLim gets the number of platforms in the platform bucket
 func RetrieveAllPfLim() (int, error) {
-	return edb.RetrieveAllKeysLim(consts.DbDir+consts.DbName, PlatformBucket)
+	return countKeys(PlatformBucket)
+}
+
+// RetrievePlatformByKey retrieves the platform that owns the key with the passed id
+func RetrievePlatformByKey(id string) (Platform, error) {
+	var pf Platform
+	platforms, err := RetrieveAllPlatforms()
+	if err != nil {
+		return pf, err
+	}
+	for _, x := range platforms {
+		for _, key := range x.Keys {
+			if key.ID == id {
+				return x, nil
+			}
+		}
+	}
+	return pf, errors.New("no platform with key: " + id)
+}
+
+// UsePlatformNonce records that a request signed with the key id used nonce and fails if
+// the nonce has been used before. Nonces are remembered until expiry, after which the
+// timestamp of the request they were sent with is rejected anyway
+func UsePlatformNonce(id string, nonce string, expiry int64) error {
+	return useNonce(PlatformNonceBucket, []byte(id+"|"+nonce), expiry)
+}
+
+// nonceSweepDue checks whether the expired nonces in the bucket should be swept and if so
+// records that they are being swept now
+func nonceSweepDue(bucket []byte, now int64) bool {
+	nonceSweeps.Lock()
+	defer nonceSweeps.Unlock()
+
+	if now-nonceSweeps.last[string(bucket)] < NonceSweepInterval {
+		return false
+	}
+	nonceSweeps.last[string(bucket)] = now
+	return true
+}
+
+// sweepNonces deletes the nonces in b that can't be replayed anymore
+func sweepNonces(b Bucket, now int64) error {
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		exp, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil || exp < now {
+			k2 := make([]byte, len(k))
+			copy(k2, k)
+			expired = append(expired, k2)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// useNonce records that the nonce at key in the bucket has been used and fails if it has
+// been used before. The nonce is remembered until expiry
+func useNonce(bucket []byte, key []byte, expiry int64) error {
+	now := utils.Unix()
+	sweep := nonceSweepDue(bucket, now)
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+
+		x, err := b.Get(key)
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			return errors.New("nonce has already been used")
+		}
+
+		if sweep {
+			err = sweepNonces(b, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.Put(key, []byte(strconv.FormatInt(expiry, 10)))
+	})
 }
@@ -0,0 +1,310 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// query contains paginated and filtered retrieval of users for admin and support tooling
+
+// DefaultQueryLimit is the number of users returned by a query if no limit is passed
+var DefaultQueryLimit = 50
+
+// MaxQueryLimit is the maximum number of users that a single query can return
+var MaxQueryLimit = 500
+
+// the fields that users can be sorted by
+const (
+	SortByIndex      = "index"
+	SortByName       = "name"
+	SortByUsername   = "username"
+	SortBySignup     = "signup"
+	SortByReputation = "reputation"
+)
+
+// UserQuery selects, sorts and paginates users. Nil or zero valued filters match all users
+type UserQuery struct {
+	Kyc      *bool
+	Verified *bool
+	Banned   *bool
+	// Role matches users holding the passed role
+	Role string
+	// Country matches the country of the user, ignoring case
+	Country string
+	// SignedUpAfter and SignedUpBefore are unix timestamps bounding the signup date
+	SignedUpAfter  int64
+	SignedUpBefore int64
+	// Search matches users whose name or username contain the passed text, ignoring case
+	Search string
+	// SortBy is one of the SortBy consts, defaults to SortByIndex
+	SortBy     string
+	Descending bool
+	// Cursor is the cursor returned with the previous page, empty for the first page
+	Cursor string
+	// Limit is the page size, defaults to DefaultQueryLimit
+	Limit int
+}
+
+// UserPage is a page of users returned by QueryUsers
+type UserPage struct {
+	Users []User
+	// Next is the cursor to pass to retrieve the next page, empty if this is the last page
+	Next string
+	// Total is the number of users matching the query across all pages
+	Total int
+}
+
+// UserSummary is a projection of User without credentials, keys and KYC documents that can
+// be handed out to admins and inspectors
+type UserSummary struct {
+	Index           int
+	Name            string
+	Username        string
+	Email           string
+	City            string
+	Country         string
+	FirstSignedUp   string
+	PublicKey       string
+	Kyc             bool
+	Verified        bool
+	VerifyReq       bool
+	Banned          bool
+	Roles           []string
+	Conf            bool
+	Legal           bool
+	Reputation      float64
+	ProfileProgress float64
+}
+
+// Summary returns the sanitized projection of the user
+func (a User) Summary() UserSummary {
+	return UserSummary{
+		Index:           a.Index,
+		Name:            a.Name,
+		Username:        a.Username,
+		Email:           a.Email,
+		City:            a.City,
+		Country:         a.Country,
+		FirstSignedUp:   a.FirstSignedUp,
+		PublicKey:       a.StellarWallet.PublicKey,
+		Kyc:             a.Kyc,
+		Verified:        a.Verified,
+		VerifyReq:       a.VerifyReq,
+		Banned:          a.Banned,
+		Roles:           a.Roles,
+		Conf:            a.Conf,
+		Legal:           a.Legal,
+		Reputation:      a.Reputation,
+		ProfileProgress: a.ProfileProgress,
+	}
+}
+
+// WithoutSecrets returns a copy of the user without its credentials, encrypted seeds and
+// pending codes
+func (a User) WithoutSecrets() User {
+	a.Pwhash = ""
+	a.StellarWallet.EncryptedSeed = nil
+	a.StellarWallet.SeedPwhash = ""
+	a.SecondaryWallet.EncryptedSeed = nil
+	a.SecondaryWallet.SeedPwhash = ""
+	a.RecoveryShares = nil
+	a.PwdResetCode = ""
+	a.TwoFASecret = ""
+	a.TwoFAPendingSecret = ""
+	a.TwoFABackupCodes = nil
+	a.TwoFAUsed = nil
+	a.ConfToken = ""
+	return a
+}
+
+// Summaries returns the sanitized projections of the passed users
+func Summaries(users []User) []UserSummary {
+	arr := make([]UserSummary, len(users))
+	for i, user := range users {
+		arr[i] = user.Summary()
+	}
+	return arr
+}
+
+// sortKey is the position of a user in a sorted query. It doubles as the pagination cursor
+type sortKey struct {
+	S     string  `json:",omitempty"`
+	N     float64 `json:",omitempty"`
+	Index int
+}
+
+// less orders keys by S, then N and finally the user index so that the order is total
+func (k sortKey) less(o sortKey) bool {
+	if k.S != o.S {
+		return k.S < o.S
+	}
+	if k.N != o.N {
+		return k.N < o.N
+	}
+	return k.Index < o.Index
+}
+
+// userSortKey returns the sort key of a user for the passed sort field
+func userSortKey(user User, sortBy string) sortKey {
+	key := sortKey{Index: user.Index}
+	switch sortBy {
+	case SortByName:
+		key.S = strings.ToLower(user.Name)
+	case SortByUsername:
+		key.S = strings.ToLower(user.Username)
+	case SortBySignup:
+		key.N = float64(utils.StringToIntTime(user.FirstSignedUp))
+	case SortByReputation:
+		key.N = user.Reputation
+	}
+	return key
+}
+
+// encodeCursor encodes a sort key as an opaque cursor
+func encodeCursor(key sortKey) (string, error) {
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+// decodeCursor decodes a cursor returned by encodeCursor
+func decodeCursor(cursor string) (sortKey, error) {
+	var key sortKey
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return key, errors.Wrap(err, "invalid cursor")
+	}
+	err = json.Unmarshal(decoded, &key)
+	if err != nil {
+		return key, errors.Wrap(err, "invalid cursor")
+	}
+	return key, nil
+}
+
+// matches checks whether a user passes the filters of the query
+func (q UserQuery) matches(user User) bool {
+	if q.Kyc != nil && user.Kyc != *q.Kyc {
+		return false
+	}
+	if q.Verified != nil && user.Verified != *q.Verified {
+		return false
+	}
+	if q.Banned != nil && user.Banned != *q.Banned {
+		return false
+	}
+	if q.Role != "" && !user.HasRole(q.Role) {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(user.Country, q.Country) {
+		return false
+	}
+	if q.SignedUpAfter != 0 || q.SignedUpBefore != 0 {
+		signup := utils.StringToIntTime(user.FirstSignedUp)
+		if q.SignedUpAfter != 0 && signup < q.SignedUpAfter {
+			return false
+		}
+		if q.SignedUpBefore != 0 && signup > q.SignedUpBefore {
+			return false
+		}
+	}
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(user.Name), search) &&
+			!strings.Contains(strings.ToLower(user.Username), search) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryUsers returns a page of the users matching the query
+func QueryUsers(q UserQuery) (UserPage, error) {
+	var page UserPage
+
+	switch q.SortBy {
+	case "":
+		q.SortBy = SortByIndex
+	case SortByIndex, SortByName, SortByUsername, SortBySignup, SortByReputation:
+	default:
+		return page, errors.New("can't sort users by " + q.SortBy)
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = DefaultQueryLimit
+	}
+	if q.Limit > MaxQueryLimit {
+		q.Limit = MaxQueryLimit
+	}
+
+	var cursor sortKey
+	var err error
+	if q.Cursor != "" {
+		cursor, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	users, err := RetrieveAllUsers()
+	if err != nil {
+		return page, errors.Wrap(err, "error while retrieving all users from database")
+	}
+
+	type keyedUser struct {
+		key  sortKey
+		user User
+	}
+
+	var matched []keyedUser
+	for _, user := range users {
+		if q.matches(user) {
+			matched = append(matched, keyedUser{userSortKey(user, q.SortBy), user})
+		}
+	}
+	page.Total = len(matched)
+
+	sort.Slice(matched, func(i, j int) bool {
+		if q.Descending {
+			return matched[j].key.less(matched[i].key)
+		}
+		return matched[i].key.less(matched[j].key)
+	})
+
+	// skip past the last user of the previous page. Comparing against the key instead of
+	// looking the user up keeps pagination stable if that user has been deleted since
+	start := 0
+	if q.Cursor != "" {
+		start = sort.Search(len(matched), func(i int) bool {
+			if q.Descending {
+				return matched[i].key.less(cursor)
+			}
+			return cursor.less(matched[i].key)
+		})
+	}
+
+	end := start + q.Limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	for _, x := range matched[start:end] {
+		page.Users = append(page.Users, x.user)
+	}
+
+	if end < len(matched) {
+		page.Next, err = encodeCursor(matched[end-1].key)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	return page, nil
+}
@@ -0,0 +1,279 @@
+package database
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+)
+
+// role contains the roles and permissions model used to authorize privileged actions. Users
+// hold a list of roles and every role grants a set of permissions. Role definitions are
+// stored in the database so that they can be changed without a release
+
+// RoleBucket stores role definitions keyed by role name
+var RoleBucket = []byte("Roles")
+
+// the permissions that can be granted through roles
+const (
+	// PermAll grants every permission
+	PermAll             = "*"
+	PermKillServer      = "server.kill"
+	PermFreezeServer    = "server.freeze"
+	PermGenKillCode     = "server.genkillcode"
+	PermViewPlatforms   = "platforms.view"
+	PermManagePlatforms = "platforms.manage"
+	PermViewUsers       = "users.view"
+	PermMessageUsers    = "users.message"
+	PermVerifyUsers     = "users.verify"
+	PermBanUsers        = "users.ban"
+	PermKyc             = "kyc.authorize"
+	PermScreenKyc       = "kyc.screen"
+	PermBackup          = "db.backup"
+	PermRotateKeys      = "db.rotatekey"
+	PermViewAudit       = "audit.view"
+	PermManageRoles     = "roles.manage"
+)
+
+// the roles that are created by default
+const (
+	RoleSuperAdmin   = "superadmin"
+	RoleAdmin        = "admin"
+	RoleKycInspector = "kyc-inspector"
+	RoleSupport      = "support"
+	RoleAuditor      = "auditor"
+)
+
+// Role is a named set of permissions
+type Role struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// DefaultRoles are the roles created in a new database
+var DefaultRoles = []Role{
+	{
+		Name:        RoleSuperAdmin,
+		Description: "full access including killing the server and managing roles",
+		Permissions: []string{PermAll},
+	},
+	{
+		Name:        RoleAdmin,
+		Description: "day to day administration of users and platforms",
+		Permissions: []string{PermFreezeServer, PermViewPlatforms, PermManagePlatforms, PermViewUsers, PermMessageUsers,
+			PermVerifyUsers, PermBanUsers, PermKyc, PermScreenKyc, PermBackup, PermViewAudit},
+	},
+	{
+		Name:        RoleKycInspector,
+		Description: "reviews and authorizes KYC requests",
+		Permissions: []string{PermViewUsers, PermKyc, PermScreenKyc},
+	},
+	{
+		Name:        RoleSupport,
+		Description: "works through user lists and contacts users",
+		Permissions: []string{PermViewUsers, PermMessageUsers, PermVerifyUsers},
+	},
+	{
+		Name:        RoleAuditor,
+		Description: "read only access to the audit log, users and platforms",
+		Permissions: []string{PermViewAudit, PermViewUsers, PermViewPlatforms},
+	},
+}
+
+// SeedRoles stores the default roles that don't exist in the database yet. Existing roles are
+// left untouched so that changes made to them persist
+func SeedRoles() error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(RoleBucket)
+		if err != nil {
+			return err
+		}
+		for _, role := range DefaultRoles {
+			x, err := b.Get([]byte(role.Name))
+			if err != nil {
+				return err
+			}
+			if x != nil {
+				continue
+			}
+			err = putRole(b, role)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// putRole stores a role definition
+func putRole(b Bucket, role Role) error {
+	encoded, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(role.Name), encoded)
+}
+
+// SaveRole creates or replaces a role definition
+func SaveRole(role Role) error {
+	if role.Name == "" {
+		return errors.New("role name can't be empty")
+	}
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(RoleBucket)
+		if err != nil {
+			return err
+		}
+		return putRole(b, role)
+	})
+}
+
+// RetrieveRoles retrieves all role definitions sorted by name
+func RetrieveRoles() ([]Role, error) {
+	var arr []Role
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(RoleBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var role Role
+			err := json.Unmarshal(v, &role)
+			if err != nil {
+				return errors.Wrap(err, "could not decode role "+string(k))
+			}
+			arr = append(arr, role)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve roles")
+	}
+
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].Name < arr[j].Name
+	})
+	return arr, nil
+}
+
+// RetrieveRole retrieves the definition of the role with the passed name
+func RetrieveRole(name string) (Role, error) {
+	var role Role
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(RoleBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get([]byte(name))
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			return errors.New("role " + name + " does not exist")
+		}
+		return json.Unmarshal(x, &role)
+	})
+	return role, err
+}
+
+// HasRole checks whether the user holds the passed role
+func (a User) HasRole(role string) bool {
+	for _, x := range a.Roles {
+		if x == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission checks whether any of the user's roles grants perm. Banned users have no
+// permissions
+func (a User) HasPermission(perm string) (bool, error) {
+	if a.Banned {
+		return false, nil
+	}
+	for _, name := range a.Roles {
+		role, err := RetrieveRole(name)
+		if err != nil {
+			return false, err
+		}
+		for _, x := range role.Permissions {
+			if x == perm || x == PermAll {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// GrantRole adds role to the user with the passed index
+func GrantRole(userIndex int, role string) error {
+	_, err := RetrieveRole(role)
+	if err != nil {
+		return err
+	}
+
+	user, err := RetrieveUser(userIndex)
+	if err != nil {
+		return errors.Wrap(err, "error while retrieving user from database")
+	}
+	if user.HasRole(role) {
+		return errors.New("user already has role " + role)
+	}
+
+	user.Roles = append(user.Roles, role)
+	return user.Save()
+}
+
+// RevokeRole removes role from the user with the passed index. The last superadmin can't be
+// revoked so that roles can always be managed
+func RevokeRole(userIndex int, role string) error {
+	user, err := RetrieveUser(userIndex)
+	if err != nil {
+		return errors.Wrap(err, "error while retrieving user from database")
+	}
+	if !user.HasRole(role) {
+		return errors.New("user does not have role " + role)
+	}
+
+	if role == RoleSuperAdmin {
+		holders, err := RetrieveUsersWithRole(RoleSuperAdmin)
+		if err != nil {
+			return err
+		}
+		if len(holders) <= 1 {
+			return errors.New("can't revoke the last superadmin")
+		}
+	}
+
+	var roles []string
+	for _, x := range user.Roles {
+		if x != role {
+			roles = append(roles, x)
+		}
+	}
+	user.Roles = roles
+	return user.Save()
+}
+
+// RetrieveUsersWithRole retrieves all users that hold the passed role
+func RetrieveUsersWithRole(role string) ([]User, error) {
+	var arr []User
+	users, err := RetrieveAllUsers()
+	if err != nil {
+		return arr, errors.Wrap(err, "error while retrieving all users from database")
+	}
+
+	for _, user := range users {
+		if user.HasRole(role) {
+			arr = append(arr, user)
+		}
+	}
+	return arr, nil
+}
@@ -0,0 +1,11 @@
+package database
+
+// ChallengeBucket stores the hashes of the SEP-10 challenges that have been used to log in
+// until the challenges expire
+var ChallengeBucket = []byte("Sep10Challenges")
+
+// UseChallenge records that the SEP-10 challenge with the passed hash has been used to log in
+// and fails if it has been used before, so a signed challenge can't be replayed before expiry
+func UseChallenge(hash string, expiry int64) error {
+	return useNonce(ChallengeBucket, []byte(hash), expiry)
+}
@@ -0,0 +1,469 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	consts "github.com/YaleOpenLab/openx/consts"
+)
+
+// session contains the access tokens handed out to users. Tokens are stored hashed in their
+// own bucket so that issuing or using a token doesn't rewrite the user and a leaked database
+// doesn't leak live tokens. The keys of a user's sessions are indexed by user so that logins
+// and session listings only visit the sessions of that user
+
+// SessionBucket stores sessions keyed by the hash of their access token
+var SessionBucket = []byte("Sessions")
+
+// SessionIndexBucket stores the keys of the sessions of each user keyed by user index
+var SessionIndexBucket = []byte("SessionIndex")
+
+// MaxSessions is the maximum number of live sessions a user can have. The oldest session is
+// revoked when a new one is created beyond this
+var MaxSessions = 5
+
+// sessionTouchInterval is the minimum number of seconds between two updates of LastUsed so
+// that every authenticated request doesn't result in a write
+var sessionTouchInterval = int64(60)
+
+// Session is an access token issued to a user
+type Session struct {
+	// ID identifies the session when listing or revoking it. It can't be used to authenticate
+	ID string
+	// User is the index of the user the session belongs to
+	User int
+	// Device is a label for the device the session was created from
+	Device string
+	// IP is the ip address the session was created from
+	IP string
+	// Created is the unix time at which the session was created
+	Created int64
+	// LastUsed is the unix time at which the session was last used to authenticate
+	LastUsed int64
+	// Expiry is the unix time after which the session can't be used anymore
+	Expiry int64
+}
+
+// SessionSweepInterval is the number of seconds between two sweeps of expired sessions
+var SessionSweepInterval = 3600
+
+// hashToken returns the key under which the session for token is stored
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return []byte(hex.EncodeToString(hash[:]))
+}
+
+// forEachSession calls fn with the key and session of every session in b
+func forEachSession(b Bucket, fn func(k []byte, session Session) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		var session Session
+		err := json.Unmarshal(v, &session)
+		if err != nil {
+			return errors.Wrap(err, "could not decode session")
+		}
+		key := make([]byte, len(k))
+		copy(key, k)
+		return fn(key, session)
+	})
+}
+
+// userSessionKeys returns the keys of the sessions of the user with the passed index
+func userSessionKeys(tx Tx, userIndex int) ([]string, error) {
+	ib, err := tx.Bucket(SessionIndexBucket)
+	if err == edb.ErrBucketMissing {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	iK, err := utils.ToByte(userIndex)
+	if err != nil {
+		return nil, err
+	}
+	x, err := ib.Get(iK)
+	if err != nil || x == nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = json.Unmarshal(x, &keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode session index")
+	}
+	return keys, nil
+}
+
+// putUserSessionKeys replaces the keys of the sessions of the user with the passed index
+func putUserSessionKeys(tx Tx, userIndex int, keys []string) error {
+	ib, err := tx.CreateBucketIfNotExists(SessionIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	iK, err := utils.ToByte(userIndex)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ib.Delete(iK)
+	}
+
+	encoded, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return ib.Put(iK, encoded)
+}
+
+// forEachUserSession calls fn with the key and session of every session of the user with the
+// passed index. Index entries whose session has been removed are skipped
+func forEachUserSession(tx Tx, userIndex int, fn func(k []byte, session Session) error) error {
+	keys, err := userSessionKeys(tx, userIndex)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	b, err := tx.Bucket(SessionBucket)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		x, err := b.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			continue
+		}
+		var session Session
+		err = json.Unmarshal(x, &session)
+		if err != nil {
+			return errors.Wrap(err, "could not decode session")
+		}
+		if session.User != userIndex {
+			continue
+		}
+		err = fn([]byte(key), session)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putSession stores session under key
+func putSession(b Bucket, key []byte, session Session) error {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, encoded)
+}
+
+// NewSession creates a session with a new access token for the user and returns the token.
+// Expired sessions of the user are removed and the oldest session is revoked if the user
+// already has MaxSessions live sessions
+func (a *User) NewSession(device string, ip string) (string, error) {
+	token := utils.GetRandomString(consts.AccessTokenLength)
+	err := saveNewSession(a.Index, token, device, ip, consts.AccessTokenLife)
+	if err != nil {
+		return "", errors.Wrap(err, "could not save session to database")
+	}
+	return token, nil
+}
+
+// GenAccessToken generates a new access token for the user
+func (a *User) GenAccessToken() (string, error) {
+	return a.NewSession("", "")
+}
+
+// ImportSession creates a session for the user with a token chosen by the caller that is
+// valid for life seconds. Meant for test setups that need a fixed token
+func (a *User) ImportSession(token string, device string, life int64) error {
+	if len(token) != consts.AccessTokenLength {
+		return errors.New("incorrect token length")
+	}
+	return saveNewSession(a.Index, token, device, "", life)
+}
+
+// saveNewSession stores a new session for the user with the passed index
+func saveNewSession(userIndex int, token string, device string, ip string, life int64) error {
+	timeNow := utils.Unix()
+	session := Session{
+		ID:       utils.GetRandomString(16),
+		User:     userIndex,
+		Device:   device,
+		IP:       ip,
+		Created:  timeNow,
+		LastUsed: timeNow,
+		Expiry:   timeNow + life,
+	}
+
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(SessionBucket)
+		if err != nil {
+			return err
+		}
+
+		type keyedSession struct {
+			key     []byte
+			session Session
+		}
+
+		var live []keyedSession
+		var expired [][]byte
+		err = forEachUserSession(tx, userIndex, func(k []byte, x Session) error {
+			if x.Expiry <= timeNow {
+				expired = append(expired, k)
+			} else {
+				live = append(live, keyedSession{k, x})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// revoke the oldest sessions to make room for the new one
+		sort.Slice(live, func(i, j int) bool {
+			return live[i].session.Created < live[j].session.Created
+		})
+		for len(live) >= MaxSessions {
+			expired = append(expired, live[0].key)
+			live = live[1:]
+		}
+
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		key := hashToken(token)
+		keys := []string{string(key)}
+		for _, x := range live {
+			keys = append(keys, string(x.key))
+		}
+		err = putUserSessionKeys(tx, userIndex, keys)
+		if err != nil {
+			return err
+		}
+
+		return putSession(b, key, session)
+	})
+}
+
+// validateSession checks that token is a live session of the user with the passed index and
+// records its use
+func validateSession(userIndex int, token string) error {
+	key := hashToken(token)
+	timeNow := utils.Unix()
+
+	var session Session
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(key)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			return errors.New("session not found")
+		}
+		return json.Unmarshal(x, &session)
+	})
+	if err != nil {
+		return err
+	}
+
+	if session.User != userIndex {
+		return errors.New("session belongs to a different user")
+	}
+	if session.Expiry <= timeNow {
+		return errors.New("session expired")
+	}
+
+	if timeNow-session.LastUsed < sessionTouchInterval {
+		return nil
+	}
+
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(SessionBucket)
+		if err != nil {
+			return err
+		}
+		// the session might have been revoked since it was read
+		x, err := b.Get(key)
+		if err != nil || x == nil {
+			return err
+		}
+		session.LastUsed = timeNow
+		return putSession(b, key, session)
+	})
+}
+
+// RetrieveSessions retrieves the live sessions of the user with the passed index, latest first
+func RetrieveSessions(userIndex int) ([]Session, error) {
+	var arr []Session
+	timeNow := utils.Unix()
+	err := store.View(func(tx Tx) error {
+		return forEachUserSession(tx, userIndex, func(k []byte, session Session) error {
+			if session.Expiry > timeNow {
+				arr = append(arr, session)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not retrieve sessions")
+	}
+
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].Created > arr[j].Created
+	})
+	return arr, nil
+}
+
+// RevokeSession revokes the session with the passed id if it belongs to the user
+func RevokeSession(userIndex int, id string) error {
+	return revokeSessions(userIndex, func(session Session) bool {
+		return session.ID == id
+	}, true)
+}
+
+// RevokeAllSessions revokes every session of the user with the passed index
+func RevokeAllSessions(userIndex int) error {
+	return revokeSessions(userIndex, func(session Session) bool {
+		return true
+	}, false)
+}
+
+// revokeSessions deletes the sessions of the user for which match returns true. If mustMatch
+// is set, an error is returned if no session matched
+func revokeSessions(userIndex int, match func(Session) bool, mustMatch bool) error {
+	return store.Update(func(tx Tx) error {
+		count, err := deleteSessions(tx, userIndex, match)
+		if err != nil {
+			return err
+		}
+		if mustMatch && count == 0 {
+			return errors.New("session not found")
+		}
+		return nil
+	})
+}
+
+// deleteSessions deletes the sessions of the user for which match returns true and returns
+// the number of sessions deleted
+func deleteSessions(tx Tx, userIndex int, match func(Session) bool) (int, error) {
+	b, err := tx.CreateBucketIfNotExists(SessionBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys [][]byte
+	var remaining []string
+	err = forEachUserSession(tx, userIndex, func(k []byte, session Session) error {
+		if match(session) {
+			keys = append(keys, k)
+		} else {
+			remaining = append(remaining, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), putUserSessionKeys(tx, userIndex, remaining)
+}
+
+// SweepSessions deletes the expired sessions of all users and rebuilds the session index from
+// the sessions that are left. Returns the number of sessions deleted
+func SweepSessions() (int, error) {
+	timeNow := utils.Unix()
+	count := 0
+	err := store.Update(func(tx Tx) error {
+		count = 0
+		b, err := tx.CreateBucketIfNotExists(SessionBucket)
+		if err != nil {
+			return err
+		}
+
+		var expired [][]byte
+		live := make(map[int][]string)
+		err = forEachSession(b, func(k []byte, session Session) error {
+			if session.Expiry <= timeNow {
+				expired = append(expired, k)
+			} else {
+				live[session.User] = append(live[session.User], string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+
+		err = tx.DeleteBucket(SessionIndexBucket)
+		if err != nil {
+			return err
+		}
+		for userIndex, keys := range live {
+			err = putUserSessionKeys(tx, userIndex, keys)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// ScheduleSessionSweeps sweeps expired sessions right away and then every
+// SessionSweepInterval seconds. This blocks, so it should be run in a goroutine
+func ScheduleSessionSweeps() {
+	ticker := time.NewTicker(time.Duration(SessionSweepInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		count, err := SweepSessions()
+		if err != nil {
+			log.Println("could not sweep expired sessions: ", err)
+		} else if count != 0 {
+			log.Println("deleted expired sessions: ", count)
+		}
+		<-ticker.C
+	}
+}
+
+// AllLogout revokes all the sessions of the user
+func (a *User) AllLogout() error {
+	return RevokeAllSessions(a.Index)
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// snapcrypt encrypts snapshots with a passphrase while they are streamed so a snapshot never
+// has to be held in memory. After the header and a random salt, a snapshot is a sequence of
+// AES-GCM sealed chunks, each prefixed by its length. Chunks are sealed with their position
+// as nonce and the last chunk with a separate nonce so that chunks can't be reordered and a
+// truncated snapshot doesn't decrypt
+
+// snapshotChunkSize is the size of the plaintext sealed in each chunk
+var snapshotChunkSize = 64 * 1024
+
+// maxSnapshotChunk bounds the chunks read from a snapshot so a corrupt length can't allocate
+// arbitrary amounts of memory
+const maxSnapshotChunk = 1024 * 1024
+
+// snapshotSaltLen is the length of the salt the snapshot key is derived with
+const snapshotSaltLen = 16
+
+// snapshotCipher derives the key of a snapshot from the passphrase with Argon2id
+func snapshotCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	params := Argon2Params
+	key := argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// snapshotNonce returns the nonce of the chunk at position count
+func snapshotNonce(count uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	if final {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], count)
+	return nonce
+}
+
+// snapshotEncrypter encrypts everything written to it in chunks. Close has to be called to
+// write the last chunk
+type snapshotEncrypter struct {
+	w     io.Writer
+	gcm   cipher.AEAD
+	buf   []byte
+	count uint64
+}
+
+// newSnapshotEncrypter writes the header of an encrypted snapshot to w and returns a writer
+// that encrypts the snapshot written to it with passphrase
+func newSnapshotEncrypter(w io.Writer, passphrase string) (*snapshotEncrypter, error) {
+	salt := make([]byte, snapshotSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate salt")
+	}
+	gcm, err := snapshotCipher(passphrase, salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+
+	_, err = w.Write(encryptedSnapshotHeader)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotEncrypter{w: w, gcm: gcm, buf: make([]byte, 0, snapshotChunkSize)}, nil
+}
+
+// Write buffers p and writes every chunk that has been filled
+func (e *snapshotEncrypter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		m := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+m]
+		p = p[m:]
+		n += m
+		if len(e.buf) == cap(e.buf) {
+			err := e.flush(false)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk
+func (e *snapshotEncrypter) Close() error {
+	return e.flush(true)
+}
+
+// flush seals the buffered plaintext and writes it as the next chunk
+func (e *snapshotEncrypter) flush(final bool) error {
+	sealed := e.gcm.Seal(nil, snapshotNonce(e.count, final), e.buf, nil)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	_, err := e.w.Write(size[:])
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(sealed)
+	if err != nil {
+		return err
+	}
+	e.count++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptSnapshot decrypts the encrypted snapshot read from r, whose header has already been
+// read, and writes it to w
+func decryptSnapshot(w io.Writer, r io.Reader, passphrase string) error {
+	salt := make([]byte, snapshotSaltLen)
+	_, err := io.ReadFull(r, salt)
+	if err != nil {
+		return errors.Wrap(err, "snapshot is truncated")
+	}
+	gcm, err := snapshotCipher(passphrase, salt)
+	if err != nil {
+		return errors.Wrap(err, "could not create cipher")
+	}
+
+	var size [4]byte
+	for count := uint64(0); ; count++ {
+		_, err = io.ReadFull(r, size[:])
+		if err != nil {
+			return errors.Wrap(err, "snapshot is truncated")
+		}
+		length := binary.BigEndian.Uint32(size[:])
+		if length > uint32(maxSnapshotChunk+gcm.Overhead()) {
+			return errors.New("snapshot chunk is too large")
+		}
+		sealed := make([]byte, length)
+		_, err = io.ReadFull(r, sealed)
+		if err != nil {
+			return errors.Wrap(err, "snapshot is truncated")
+		}
+
+		final := false
+		chunk, err := gcm.Open(nil, snapshotNonce(count, false), sealed, nil)
+		if err != nil {
+			chunk, err = gcm.Open(nil, snapshotNonce(count, true), sealed, nil)
+			if err != nil {
+				return errors.New("could not decrypt snapshot, wrong passphrase?")
+			}
+			final = true
+		}
+
+		_, err = w.Write(chunk)
+		if err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
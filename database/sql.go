@@ -0,0 +1,288 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	// register the sqlite3 driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore is a Store backed by a SQL database. Buckets are stored as rows in a bucket table
+// and key value pairs in a second table keyed by (bucket, key). Statements use ? placeholders,
+// so the driver must accept those (sqlite3 and mysql do)
+type sqlStore struct {
+	db *sql.DB
+}
+
+const sqlCreateBuckets = `CREATE TABLE IF NOT EXISTS openx_buckets (
+	name BLOB NOT NULL PRIMARY KEY,
+	seq INTEGER NOT NULL DEFAULT 0
+)`
+
+const sqlCreateKV = `CREATE TABLE IF NOT EXISTS openx_kv (
+	bucket BLOB NOT NULL,
+	k BLOB NOT NULL,
+	v BLOB NOT NULL,
+	PRIMARY KEY (bucket, k)
+)`
+
+// NewSQLStore opens a SQL database with the given driver and data source and creates the
+// tables openx needs if they don't exist yet
+func NewSQLStore(driver string, source string) (Store, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open sql database")
+	}
+
+	// sqlite only supports a single writer, serialize access through a single connection
+	// instead of erroring out with database locked errors
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{sqlCreateBuckets, sqlCreateKV} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "could not create tables")
+		}
+	}
+
+	return &sqlStore{db: db}, nil
+}
+
+// Update runs fn within a read-write SQL transaction
+func (s *sqlStore) Update(fn func(Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+
+	err = fn(&sqlTx{tx: tx, writable: true})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// View runs fn within a SQL transaction that is always rolled back
+func (s *sqlStore) View(fn func(Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+
+	defer tx.Rollback()
+	return fn(&sqlTx{tx: tx})
+}
+
+// Close closes the underlying database
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+type sqlTx struct {
+	tx       *sql.Tx
+	writable bool
+}
+
+func (t *sqlTx) Bucket(name []byte) (Bucket, error) {
+	var seq uint64
+	err := t.tx.QueryRow("SELECT seq FROM openx_buckets WHERE name = ?", name).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return nil, edb.ErrBucketMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sqlBucket{tx: t, name: name}, nil
+}
+
+func (t *sqlTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.Bucket(name)
+	if err != edb.ErrBucketMissing {
+		return b, err
+	}
+	if !t.writable {
+		return nil, errTxNotWritable
+	}
+	_, err = t.tx.Exec("INSERT INTO openx_buckets (name, seq) VALUES (?, 0)", name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlBucket{tx: t, name: name}, nil
+}
+
+func (t *sqlTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return errTxNotWritable
+	}
+	_, err := t.tx.Exec("DELETE FROM openx_kv WHERE bucket = ?", name)
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.Exec("DELETE FROM openx_buckets WHERE name = ?", name)
+	return err
+}
+
+func (t *sqlTx) ForEachBucket(fn func(name []byte) error) error {
+	rows, err := t.tx.Query("SELECT name FROM openx_buckets ORDER BY name")
+	if err != nil {
+		return err
+	}
+
+	var names [][]byte
+	for rows.Next() {
+		var name []byte
+		err = rows.Scan(&name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = fn(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sqlBucket struct {
+	tx   *sqlTx
+	name []byte
+}
+
+func (b *sqlBucket) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.tx.tx.QueryRow("SELECT v FROM openx_kv WHERE bucket = ? AND k = ?", b.name, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (b *sqlBucket) Put(key []byte, value []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+	res, err := b.tx.tx.Exec("UPDATE openx_kv SET v = ? WHERE bucket = ? AND k = ?", value, b.name, key)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 0 {
+		return nil
+	}
+	_, err = b.tx.tx.Exec("INSERT INTO openx_kv (bucket, k, v) VALUES (?, ?, ?)", b.name, key, value)
+	return err
+}
+
+func (b *sqlBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+	_, err := b.tx.tx.Exec("DELETE FROM openx_kv WHERE bucket = ? AND k = ?", b.name, key)
+	return err
+}
+
+func (b *sqlBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.forEachRow(fn, "SELECT k, v FROM openx_kv WHERE bucket = ? ORDER BY k", b.name)
+}
+
+func (b *sqlBucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	if len(prefix) == 0 {
+		return b.ForEach(fn)
+	}
+	end := prefixEnd(prefix)
+	if end == nil {
+		return b.forEachRow(fn, "SELECT k, v FROM openx_kv WHERE bucket = ? AND k >= ? ORDER BY k", b.name, prefix)
+	}
+	return b.forEachRow(fn, "SELECT k, v FROM openx_kv WHERE bucket = ? AND k >= ? AND k < ? ORDER BY k", b.name, prefix, end)
+}
+
+// prefixEnd returns the smallest key that is greater than every key starting with prefix or
+// nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// forEachRow calls fn with the key and value of every row returned by query
+func (b *sqlBucket) forEachRow(fn func(k, v []byte) error, query string, args ...interface{}) error {
+	rows, err := b.tx.tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	// read everything before calling fn since fn might issue statements on the same
+	// transaction while we still hold the rows open
+	var keys, values [][]byte
+	for rows.Next() {
+		var k, v []byte
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for i := range keys {
+		err = fn(keys[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *sqlBucket) Sequence() (uint64, error) {
+	var seq uint64
+	err := b.tx.tx.QueryRow("SELECT seq FROM openx_buckets WHERE name = ?", b.name).Scan(&seq)
+	return seq, err
+}
+
+func (b *sqlBucket) SetSequence(seq uint64) error {
+	if !b.tx.writable {
+		return errTxNotWritable
+	}
+	_, err := b.tx.tx.Exec("UPDATE openx_buckets SET seq = ? WHERE name = ?", seq, b.name)
+	return err
+}
+
+func (b *sqlBucket) NextSequence() (uint64, error) {
+	seq, err := b.Sequence()
+	if err != nil {
+		return 0, err
+	}
+	seq++
+	return seq, b.SetSequence(seq)
+}
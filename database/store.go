@@ -0,0 +1,216 @@
+package database
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+	consts "github.com/YaleOpenLab/openx/consts"
+)
+
+// Store is the interface implemented by the storage backends that openx can persist data in.
+// Data is organised in buckets of key value pairs similar to boltdb and all access happens
+// within a transaction so that related writes (a user and its indexes, for example) either
+// all go through or none of them do.
+type Store interface {
+	// Update runs fn within a read-write transaction. The transaction is committed if fn
+	// returns nil and rolled back otherwise
+	Update(fn func(Tx) error) error
+	// View runs fn within a read-only transaction
+	View(fn func(Tx) error) error
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// Tx is a transaction on a Store
+type Tx interface {
+	// Bucket returns the bucket with the given name or edb.ErrBucketMissing if it doesn't exist
+	Bucket(name []byte) (Bucket, error)
+	// CreateBucketIfNotExists returns the bucket with the given name, creating it if needed
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	// DeleteBucket deletes the bucket with the given name along with all its keys
+	DeleteBucket(name []byte) error
+	// ForEachBucket calls fn with the name of every bucket in ascending order
+	ForEachBucket(fn func(name []byte) error) error
+}
+
+// Bucket is a collection of key value pairs within a transaction. Slices returned by a bucket
+// are only valid for the life of the transaction and must be copied if retained
+type Bucket interface {
+	// Get returns the value stored under key or nil if the key doesn't exist
+	Get(key []byte) ([]byte, error)
+	// Put stores value under key, replacing any existing value
+	Put(key []byte, value []byte) error
+	// Delete removes key from the bucket
+	Delete(key []byte) error
+	// ForEach calls fn for every key value pair in the bucket in ascending key order
+	ForEach(fn func(k, v []byte) error) error
+	// ForEachPrefix calls fn for every key value pair whose key starts with prefix in
+	// ascending key order without visiting the other keys in the bucket
+	ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error
+	// Sequence returns the current value of the bucket's sequence
+	Sequence() (uint64, error)
+	// SetSequence sets the value of the bucket's sequence
+	SetSequence(seq uint64) error
+	// NextSequence increments and returns the bucket's sequence
+	NextSequence() (uint64, error)
+}
+
+// errTxNotWritable is returned when a write is attempted within a read-only transaction
+var errTxNotWritable = errors.New("transaction not writable")
+
+// store is the backend that the database package persists data in. The default bolt store
+// resolves its path from consts at the time of each transaction
+var store Store = NewBoltStore("")
+
+// SetStore sets the backend that the database package persists data in
+func SetStore(s Store) {
+	store = s
+}
+
+// GetStore returns the backend that the database package persists data in
+func GetStore() Store {
+	return store
+}
+
+// NewStore returns a store for the given backend name. Supported backends are bolt (the
+// default), sqlite and memory. path is the location of the database file and defaults
+// to a file in consts.DbDir if empty.
+func NewStore(backend string, path string) (Store, error) {
+	switch strings.ToLower(backend) {
+	case "", "bolt", "boltdb":
+		return NewBoltStore(path), nil
+	case "sqlite", "sqlite3":
+		if path == "" {
+			path = consts.DbDir + "openx.sqlite"
+		}
+		edb.CreateDirs(filepath.Dir(path))
+		return NewSQLStore("sqlite3", path)
+	case "memory":
+		log.Println("using in memory store, data will not persist across restarts")
+		return NewMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown database backend: " + backend)
+	}
+}
+
+// createBuckets creates the passed buckets if they don't exist yet
+func createBuckets(buckets ...[]byte) error {
+	return store.Update(func(tx Tx) error {
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return errors.Wrap(err, "could not create bucket")
+			}
+		}
+		return nil
+	})
+}
+
+// save stores the json encoding of x under key in the passed bucket
+func save(bucketName []byte, x interface{}, key int) error {
+	encoded, err := json.Marshal(x)
+	if err != nil {
+		log.Println("error while marshaling json struct: ", err)
+		return errors.Wrap(err, "error while marshaling json struct")
+	}
+
+	iK, err := utils.ToByte(key)
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketName)
+		if err != nil {
+			return err
+		}
+		return b.Put(iK, encoded)
+	})
+}
+
+// retrieve retrieves the value stored under key in the passed bucket
+func retrieve(bucketName []byte, key int) ([]byte, error) {
+	var returnBytes []byte
+	iK, err := utils.ToByte(key)
+	if err != nil {
+		return returnBytes, err
+	}
+
+	err = store.View(func(tx Tx) error {
+		b, err := tx.Bucket(bucketName)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(iK)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			return edb.ErrElementNotFound
+		}
+		returnBytes = make([]byte, len(x))
+		copy(returnBytes, x)
+		return nil
+	})
+
+	return returnBytes, err
+}
+
+// retrieveAll retrieves all values stored in the passed bucket
+func retrieveAll(bucketName []byte) ([][]byte, error) {
+	var arr [][]byte
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(bucketName)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, x []byte) error {
+			temp := make([]byte, len(x))
+			copy(temp, x)
+			arr = append(arr, temp)
+			return nil
+		})
+	})
+	return arr, err
+}
+
+// countKeys returns the number of keys in the passed bucket
+func countKeys(bucketName []byte) (int, error) {
+	lim := 0
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(bucketName)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, x []byte) error {
+			lim++
+			return nil
+		})
+	})
+	if err != nil {
+		log.Println("could not open db for reading: ", err)
+	}
+	return lim, err
+}
+
+// deleteKey deletes key from the passed bucket
+func deleteKey(bucketName []byte, key int) error {
+	iK, err := utils.ToByte(key)
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(bucketName)
+		if err != nil {
+			return err
+		}
+		return b.Delete(iK)
+	})
+}
@@ -0,0 +1,301 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// transfer contains the deposits and withdrawals users make with anchors. Fiat transfers
+// take days to go through, so every transfer is recorded along with the statuses the anchor
+// reported for it and the SEP-10 token openx polls the anchor with until the transfer is done
+
+// TransferBucket stores anchor transfers keyed by user index, anchor and the id the anchor
+// gave the transfer
+var TransferBucket = []byte("Transfers")
+
+// TransferStatus is a status an anchor reported for a transfer
+type TransferStatus struct {
+	Status  string
+	Message string
+	Time    int64
+}
+
+// Transfer is a deposit or withdrawal a user made with an anchor
+type Transfer struct {
+	// User is the index of the user who made the transfer
+	User int
+	// Anchor is the home domain of the anchor
+	Anchor string
+	// Protocol is the SEP the transfer was made with, sep6 or sep24
+	Protocol string
+	// ID is the id the anchor gave the transfer
+	ID string
+	// Kind is deposit or withdrawal
+	Kind   string
+	Asset  string
+	Amount string
+	// Status is the latest status the anchor reported
+	Status string
+	// History contains every status the anchor reported, oldest first
+	History []TransferStatus
+	// StellarTxHash is the hash of the Stellar transaction that moved the asset
+	StellarTxHash string
+	// Done is set once the transfer has completed or failed and isn't polled anymore
+	Done    bool
+	Created int64
+	Updated int64
+	// Token is the SEP-10 token the anchor is polled with. It is stored in SealedToken
+	// instead if a master key is loaded
+	Token       string        `json:",omitempty"`
+	SealedToken *sealedFields `json:",omitempty"`
+	// TokenExpiry is the unix time after which the anchor doesn't accept the token anymore
+	TokenExpiry int64
+}
+
+// transferPrefix returns the prefix of the keys of the transfers of a user
+func transferPrefix(user int) string {
+	return fmt.Sprintf("%010d|", user)
+}
+
+// transferKey returns the key of the transfer
+func transferKey(user int, anchor string, id string) []byte {
+	return []byte(transferPrefix(user) + anchor + "|" + id)
+}
+
+// SetToken stores the token the anchor is polled with, encrypted if a master key is loaded
+func (t *Transfer) SetToken(token string, expiry int64) error {
+	sealed, err := sealValue([]byte(token))
+	if err != nil {
+		return err
+	}
+	t.Token, t.SealedToken, t.TokenExpiry = "", sealed, expiry
+	if sealed == nil {
+		t.Token = token
+	}
+	return nil
+}
+
+// PollToken returns the token the anchor is polled with
+func (t Transfer) PollToken() (string, error) {
+	if t.SealedToken == nil {
+		return t.Token, nil
+	}
+	token, err := openSealed(*t.SealedToken)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// Redacted returns a copy of the transfer without its token so that it can be sent to users
+func (t Transfer) Redacted() Transfer {
+	t.Token = ""
+	t.SealedToken = nil
+	return t
+}
+
+// SetStatus records the status the anchor reported for the transfer. It returns false if
+// neither the status nor the Stellar transaction changed
+func (t *Transfer) SetStatus(status string, message string, stellarTxHash string, done bool) bool {
+	if status == t.Status && (stellarTxHash == "" || stellarTxHash == t.StellarTxHash) && done == t.Done {
+		return false
+	}
+
+	now := utils.Unix()
+	if status != t.Status {
+		t.History = append(t.History, TransferStatus{Status: status, Message: message, Time: now})
+	}
+	t.Status = status
+	if stellarTxHash != "" {
+		t.StellarTxHash = stellarTxHash
+	}
+	t.Done = done
+	t.Updated = now
+	return true
+}
+
+// NewTransfer records a transfer the user has started with an anchor
+func NewTransfer(t Transfer) (Transfer, error) {
+	if t.User == 0 || t.Anchor == "" || t.ID == "" {
+		return t, errors.New("transfer needs a user, anchor and id")
+	}
+
+	now := utils.Unix()
+	t.Created, t.Updated = now, now
+	t.History = []TransferStatus{{Status: t.Status, Time: now}}
+
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(TransferBucket)
+		if err != nil {
+			return err
+		}
+		key := transferKey(t.User, t.Anchor, t.ID)
+		x, err := b.Get(key)
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			return errors.New("transfer already recorded")
+		}
+		return putJSON(b, key, t)
+	})
+	if err != nil {
+		return t, errors.Wrap(err, "could not record transfer")
+	}
+	return t, nil
+}
+
+// Save stores the transfer as is. Transfers that pollers may be updating at the same time
+// should be changed with UpdateTransfer instead
+func (t *Transfer) Save() error {
+	return store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(TransferBucket)
+		if err != nil {
+			return err
+		}
+		return putJSON(b, transferKey(t.User, t.Anchor, t.ID), t)
+	})
+}
+
+// UpdateTransfer reads the stored transfer and applies fn to it within a single transaction so
+// that concurrent updates don't overwrite each other. The transfer is only written if fn
+// returns true. It returns the transfer as stored before and after the update
+func UpdateTransfer(user int, anchor string, id string, fn func(*Transfer) bool) (Transfer, Transfer, error) {
+	var old, t Transfer
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(TransferBucket)
+		if err != nil {
+			return err
+		}
+		key := transferKey(user, anchor, id)
+		x, err := b.Get(key)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			return edb.ErrElementNotFound
+		}
+		err = json.Unmarshal(x, &old)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(x, &t)
+		if err != nil {
+			return err
+		}
+		if !fn(&t) {
+			return nil
+		}
+		return putJSON(b, key, t)
+	})
+	if err != nil {
+		return old, t, errors.Wrap(err, "could not update transfer")
+	}
+	return old, t, nil
+}
+
+// RetrieveTransfer retrieves the transfer the user made with the anchor
+func RetrieveTransfer(user int, anchor string, id string) (Transfer, error) {
+	var t Transfer
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(TransferBucket)
+		if err != nil {
+			return err
+		}
+		x, err := b.Get(transferKey(user, anchor, id))
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			return edb.ErrElementNotFound
+		}
+		return json.Unmarshal(x, &t)
+	})
+	if err != nil {
+		return t, errors.Wrap(err, "could not retrieve transfer")
+	}
+	return t, nil
+}
+
+// forEachTransfer calls fn with every transfer in b whose key starts with prefix
+func forEachTransfer(b Bucket, prefix string, fn func(k []byte, t Transfer) error) error {
+	return b.ForEachPrefix([]byte(prefix), func(k, v []byte) error {
+		var t Transfer
+		err := json.Unmarshal(v, &t)
+		if err != nil {
+			return errors.Wrap(err, "could not decode transfer")
+		}
+		key := make([]byte, len(k))
+		copy(key, k)
+		return fn(key, t)
+	})
+}
+
+// queryTransfers returns the transfers with keys starting with prefix that match, latest first
+func queryTransfers(prefix string, match func(Transfer) bool) ([]Transfer, error) {
+	var arr []Transfer
+	err := store.View(func(tx Tx) error {
+		b, err := tx.Bucket(TransferBucket)
+		if err == edb.ErrBucketMissing {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return forEachTransfer(b, prefix, func(k []byte, t Transfer) error {
+			if match(t) {
+				arr = append(arr, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not query transfers")
+	}
+
+	sort.SliceStable(arr, func(i, j int) bool { return arr[i].Created > arr[j].Created })
+	return arr, nil
+}
+
+// RetrieveUserTransfers returns the transfers of the user, latest first
+func RetrieveUserTransfers(user int) ([]Transfer, error) {
+	return queryTransfers(transferPrefix(user), func(Transfer) bool { return true })
+}
+
+// RetrievePendingTransfers returns the transfers of all users that aren't done yet
+func RetrievePendingTransfers() ([]Transfer, error) {
+	return queryTransfers("", func(t Transfer) bool { return !t.Done })
+}
+
+// deleteTransfers deletes the transfers of the user with the passed index
+func deleteTransfers(tx Tx, user int) error {
+	b, err := tx.Bucket(TransferBucket)
+	if err == edb.ErrBucketMissing {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys [][]byte
+	err = forEachTransfer(b, transferPrefix(user), func(k []byte, t Transfer) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	googauth "github.com/Varunram/essentials/googauth"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// twofa contains the TOTP based 2FA of users. A generated secret has to be confirmed with an
+// otp before it is enforced, at which point the user receives single use backup codes that
+// can be used in place of an otp if they lose their device
+
+// BackupCodeCount is the number of backup codes handed out when enrolling in 2FA
+var BackupCodeCount = 10
+
+// backupCodeLength is the length of a single backup code
+var backupCodeLength = 10
+
+// otpConfig returns the TOTP config for secret. used holds the recently used time steps of
+// the secret which are rejected to prevent replays
+func otpConfig(secret string, used []int) *googauth.OTPConfig {
+	if used == nil {
+		used = make([]int, 0)
+	}
+	return &googauth.OTPConfig{
+		Secret:        base32.StdEncoding.EncodeToString([]byte(secret)),
+		WindowSize:    1,
+		DisallowReuse: used,
+		UTC:           true,
+	}
+}
+
+// Generate2FA generates a new 2FA secret for the given user. The secret only replaces the
+// current one once it has been confirmed with Confirm2FA
+func (a *User) Generate2FA() (string, error) {
+	secret := utils.GetRandomString(35)
+	otpString, err := otpConfig(secret, nil).GenerateURI(a.Name)
+	if err != nil {
+		return otpString, err
+	}
+	a.TwoFAPendingSecret = secret
+	err = a.Save()
+	if err != nil {
+		return otpString, err
+	}
+	return otpString, nil
+}
+
+// Confirm2FA confirms the pending 2FA secret of the user with an otp generated from it and
+// enables 2FA. The backup codes of the user are replaced and returned
+func (a *User) Confirm2FA(otp string) ([]string, error) {
+	secret := a.TwoFAPendingSecret
+	if secret == "" && !a.TwoFAEnabled {
+		// secrets generated before enrollment needed confirmation are confirmed in place
+		secret = a.TwoFASecret
+	}
+	if secret == "" {
+		return nil, errors.New("no 2FA secret to confirm")
+	}
+
+	result, err := otpConfig(secret, nil).Authenticate(otp)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid otp")
+	}
+	if !result {
+		return nil, errors.New("otp does not match")
+	}
+
+	a.TwoFASecret = secret
+	a.TwoFAPendingSecret = ""
+	a.TwoFAEnabled = true
+	a.TwoFAUsed = nil
+	return a.GenerateBackupCodes()
+}
+
+// GenerateBackupCodes replaces the backup codes of the user with new ones and returns them.
+// Only the hashes of the codes are stored
+func (a *User) GenerateBackupCodes() ([]string, error) {
+	codes := make([]string, BackupCodeCount)
+	hashes := make([]string, BackupCodeCount)
+	for i := range codes {
+		codes[i] = strings.ToLower(utils.GetRandomString(backupCodeLength))
+		hashes[i] = string(hashToken(codes[i]))
+	}
+
+	a.TwoFABackupCodes = hashes
+	err := a.Save()
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Authenticate2FA authenticates the given password against the user's stored 2fA secret.
+// An otp can't be used twice
+func (a *User) Authenticate2FA(password string) (bool, error) {
+	if a.TwoFASecret == "" {
+		return false, errors.New("user has not set up 2FA")
+	}
+
+	otpc := otpConfig(a.TwoFASecret, a.TwoFAUsed)
+	result, err := otpc.Authenticate(password)
+	if err != nil || !result {
+		return result, err
+	}
+
+	a.TwoFAUsed = otpc.DisallowReuse
+	return true, a.Save()
+}
+
+// useBackupCode checks code against the unused backup codes of the user and removes it if
+// it matches
+func (a *User) useBackupCode(code string) (bool, error) {
+	hash := hashToken(strings.ToLower(strings.TrimSpace(code)))
+	for i, x := range a.TwoFABackupCodes {
+		if subtle.ConstantTimeCompare([]byte(x), hash) == 1 {
+			a.TwoFABackupCodes = append(a.TwoFABackupCodes[:i], a.TwoFABackupCodes[i+1:]...)
+			return true, a.Save()
+		}
+	}
+	return false, nil
+}
+
+// Verify2FA checks an otp or backup code of a user who has enabled 2FA
+func (a *User) Verify2FA(otp string) (bool, error) {
+	if !a.TwoFAEnabled {
+		return false, errors.New("user has not enabled 2FA")
+	}
+
+	result, err := a.Authenticate2FA(otp)
+	if result {
+		return true, err
+	}
+
+	// otps are numeric, so anything else could be a backup code
+	return a.useBackupCode(otp)
+}
+
+// Disable2FA disables 2FA for the user after verifying an otp or backup code
+func (a *User) Disable2FA(otp string) error {
+	result, err := a.Verify2FA(otp)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return errors.New("otp does not match")
+	}
+
+	a.TwoFAEnabled = false
+	a.TwoFASecret = ""
+	a.TwoFAPendingSecret = ""
+	a.TwoFABackupCodes = nil
+	a.TwoFAUsed = nil
+	return a.Save()
+}
@@ -1,21 +1,21 @@
 package database
 
 import (
-	"encoding/base32"
 	"log"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
 
 	aes "github.com/Varunram/essentials/aes"
 	algorand "github.com/Varunram/essentials/algorand"
-	googauth "github.com/Varunram/essentials/googauth"
+	edb "github.com/Varunram/essentials/database"
 	utils "github.com/Varunram/essentials/utils"
 	xlm "github.com/Varunram/essentials/xlm"
-	assets "github.com/Varunram/essentials/xlm/assets"
-	wallet "github.com/Varunram/essentials/xlm/wallet"
 	consts "github.com/YaleOpenLab/openx/consts"
+	signer "github.com/YaleOpenLab/openx/signer"
 	recovery "github.com/bithyve/research/sss"
+	build "github.com/stellar/go/txnbuild"
 )
 
 // User defines a base layer structure that can be used by entities on platforms built on openx
@@ -50,14 +50,12 @@ type User struct {
 	AlgorandWallet algorand.Wallet
 	// Username denoteds the username of the user to log on to openx
 	Username string
-	// Pwhash is the 512 byte SHA-3 hash of the user's password
+	// Pwhash is the Argon2id hash of the SHA-3 hash of the user's password sent by clients
 	Pwhash string
 	// Kyc denotes whether the user has passed KYC
 	Kyc bool
-	// Admin denotes whether the user has passed kyc or not
-	Admin bool
-	// Inspector denotes whether the user is a KYC inspector ie whether they're authorized to approve other's KYC requests
-	Inspector bool
+	// Roles are the roles held by the user which grant permissions for privileged actions
+	Roles []string
 	// Banned is true if the user is banned on openx
 	Banned bool
 	// Reputation is a float which denotes the reputation of a user on the openx platform
@@ -80,10 +78,19 @@ type User struct {
 	GivenStarRating map[int]int
 	// TwoFASecret is the secret associated with Google 2FA that users can enable while logging on openx
 	TwoFASecret string
-	// AnchorKYC contains KYC information required by AnchorUSD
+	// TwoFAEnabled is set once the user confirms their 2FA enrollment. Sensitive operations
+	// require an otp from then on
+	TwoFAEnabled bool
+	// TwoFAPendingSecret is a newly generated 2FA secret that hasn't been confirmed yet
+	TwoFAPendingSecret string
+	// TwoFABackupCodes are the hashes of the unused single use 2FA backup codes
+	TwoFABackupCodes []string
+	// TwoFAUsed are the time steps of recently used otps which can't be used again
+	TwoFAUsed []int
+	// WebAuthnCredentials are the hardware keys and passkeys the user registered as a second factor
+	WebAuthnCredentials []WebAuthnCredential
+	// AnchorKYC contains KYC information sent to anchors that ask for it
 	AnchorKYC AnchorKYCHelper
-	// AccessToken is the access token that will be used for authenticating RPC requests made to the server
-	AccessToken map[string]int64
 	// Mailbox is a mailbox where admins can send you messages or updated on your invested / interested projects
 	Mailbox []MailboxHelper
 	// Legal is a bool which is set when the user accepts the terms and conditions
@@ -102,6 +109,8 @@ type User struct {
 	ConfToken string
 	// Conf is a bool that is set to true when users confirm their tokens
 	Conf bool
+	// SchemaVersion is the version of the user schema that this record was last written with
+	SchemaVersion int
 }
 
 // MailboxHelper is a helper struct that can be used to send admin notifications to users
@@ -118,7 +127,7 @@ type KycStruct struct {
 	PersonalPhoto  string
 }
 
-// AnchorKYCHelper contains the KYC parameters required by Anchor
+// AnchorKYCHelper contains the KYC parameters anchors ask for before accepting transfers
 type AnchorKYCHelper struct {
 	Name     string
 	Birthday struct {
@@ -138,12 +147,8 @@ type AnchorKYCHelper struct {
 		Country string
 		Phone   string
 	}
-	PrimaryPhone       string
-	Gender             string
-	DepositIdentifier  string
-	WithdrawIdentifier string
-	URL                string
-	AccountID          string
+	PrimaryPhone string
+	Gender       string
 }
 
 // StellWallet hold the Stellar Publickey and Encrypted Seed
@@ -162,27 +167,41 @@ func NewUser(uname string, pwhash string, seedpwd string, email string) (User, e
 		return a, errors.Wrap(err, "username collision: "+uname+", quitting")
 	}
 
-	lim, err := RetrieveAllUsersLim()
+	err = a.genKeys(seedpwd)
 	if err != nil {
-		return a, errors.Wrap(err, "Error while retrieving all users from database")
+		return a, errors.Wrap(err, "Error while generating public and private keys")
 	}
-	a.Index = lim + 1
 
-	err = a.GenKeys(seedpwd)
+	err = a.SetPassword(pwhash)
 	if err != nil {
-		return a, errors.Wrap(err, "Error while generating public and private keys")
+		return a, errors.Wrap(err, "could not hash password")
 	}
 
 	a.Email = email
 	a.Username = uname
-	a.Pwhash = pwhash
 	a.FirstSignedUp = utils.Timestamp()
 	a.Kyc = false
 	a.Notification = false
 	a.ConfToken = strings.ToUpper(utils.GetRandomString(8))
-	log.Println("saving: ", uname, pwhash, seedpwd, email)
-	err = a.Save()
-	return a, err
+	log.Println("saving: ", uname, email)
+	// the index is allocated and the username / email re-checked in the same transaction
+	// that stores the user
+	err = insertUser(&a)
+	if err != nil {
+		return a, err
+	}
+
+	// seeds are only handed to the signer once the user exists so that failed signups don't
+	// leave seeds nobody can use behind
+	err = a.importKeys(seedpwd)
+	if err != nil {
+		derr := deleteUser(a.Index)
+		if derr != nil {
+			log.Println("could not delete user whose seeds couldn't be imported: ", a.Index, derr)
+		}
+		return a, err
+	}
+	return a, nil
 }
 
 // RetrieveAllUsersWithoutKyc retrieves all users without kyc
@@ -227,16 +246,9 @@ func ValidateSeedpwd(name string, pwhash string, seedpwd string) (User, error) {
 	if err != nil {
 		return user, errors.Wrap(err, "could not validate user")
 	}
-	seed, err := wallet.DecryptSeed(user.StellarWallet.EncryptedSeed, seedpwd)
+	err = user.VerifySeedpwd(seedpwd)
 	if err != nil {
-		return user, errors.Wrap(err, "failed to decrypt user's seed")
-	}
-	pubkey, err := wallet.ReturnPubkey(seed)
-	if err != nil {
-		return user, errors.Wrap(err, "could not decrypt seed")
-	}
-	if pubkey != user.StellarWallet.PublicKey {
-		return user, errors.New("pubkeys don't match, quitting")
+		return user, err
 	}
 	return user, nil
 }
@@ -247,22 +259,83 @@ func ValidateSeedpwdAuthToken(name string, token string, seedpwd string) (User,
 	if err != nil {
 		return user, errors.Wrap(err, "could not validate user")
 	}
-	seed, err := wallet.DecryptSeed(user.StellarWallet.EncryptedSeed, seedpwd)
+	err = user.VerifySeedpwd(seedpwd)
 	if err != nil {
-		return user, errors.Wrap(err, "failed to decrypt user's seed")
+		return user, err
 	}
-	pubkey, err := wallet.ReturnPubkey(seed)
+	return user, nil
+}
+
+// VerifySeedpwd has the signer check that seedpwd unlocks the seed of the user's primary wallet
+func (a *User) VerifySeedpwd(seedpwd string) error {
+	return signer.Verify(a.StellarWallet.PublicKey, seedpwd)
+}
+
+// ChangeSeedpwd has the signer encrypt the seed of the user's primary wallet with a new seedpwd
+// without saving the user
+func (a *User) ChangeSeedpwd(oldSeedpwd string, seedpwd string) error {
+	encryptedSeed, err := signer.Rekey(a.StellarWallet.PublicKey, oldSeedpwd, seedpwd)
 	if err != nil {
-		return user, errors.Wrap(err, "could not decrypt seed")
+		return err
 	}
-	if pubkey != user.StellarWallet.PublicKey {
-		return user, errors.New("pubkeys don't match, quitting")
+	a.StellarWallet.EncryptedSeed = encryptedSeed
+	return nil
+}
+
+// NewRecoveryShares has the signer split the seed of the user's primary wallet into a new set
+// of recovery shares
+func (a *User) NewRecoveryShares(seedpwd string) ([]string, error) {
+	return signer.Shares(a.StellarWallet.PublicKey, seedpwd)
+}
+
+// ImportSeeds imports the seeds of all users into the signer. Users created before openx signed
+// with a signer only have their seeds in the database. The signer doesn't replace seeds it
+// already holds, so importing on every start is safe
+func ImportSeeds() error {
+	users, err := RetrieveAllUsers()
+	if err != nil {
+		return errors.Wrap(err, "error while retrieving all users from database")
 	}
-	return user, nil
+
+	for _, user := range users {
+		for _, wallet := range []StellWallet{user.StellarWallet, user.SecondaryWallet} {
+			if wallet.PublicKey == "" || len(wallet.EncryptedSeed) == 0 {
+				continue
+			}
+			err = signer.Import(wallet.PublicKey, wallet.EncryptedSeed, "")
+			if err != nil {
+				log.Println("could not import seed of user: ", user.Index, err)
+			}
+		}
+	}
+	return nil
 }
 
 // GenKeys generates a keypair for the user and takes in options on which blockchain to generate keys for
 func (a *User) GenKeys(seedpwd string, options ...string) error {
+	err := a.genKeys(seedpwd, options...)
+	if err != nil {
+		return err
+	}
+	err = a.importKeys(seedpwd)
+	if err != nil {
+		return err
+	}
+	return a.Save()
+}
+
+// importKeys imports the seeds of the user's wallets into the signer
+func (a *User) importKeys(seedpwd string) error {
+	err := signer.Import(a.StellarWallet.PublicKey, a.StellarWallet.EncryptedSeed, seedpwd)
+	if err != nil {
+		return err
+	}
+	return signer.Import(a.SecondaryWallet.PublicKey, a.SecondaryWallet.EncryptedSeed, seedpwd)
+}
+
+// genKeys generates keypairs for the user without saving them to the database or importing
+// them into the signer
+func (a *User) genKeys(seedpwd string, options ...string) error {
 	if len(options) == 1 {
 		if consts.Mainnet {
 			return errors.New("only stellar supported in mainnet mode, quitting")
@@ -335,32 +408,32 @@ func (a *User) GenKeys(seedpwd string, options ...string) error {
 		return errors.Wrap(err, "error while encrypting seed")
 	}
 
-	err = a.Save()
-	return err
+	return nil
 }
 
 // CheckUsernameCollision checks if a passed username collides with someone who's already
 // on the platform. If a collision does exist, return the existing user in the database
 func CheckUsernameCollision(uname string) (User, error) {
 	var dummy User
-	users, err := RetrieveAllUsers()
-	if err != nil {
-		return dummy, errors.Wrap(err, "error while retrieving all users from database")
+	user, err := RetrieveUserByUsername(uname)
+	if err == edb.ErrElementNotFound {
+		return dummy, nil
 	}
-
-	for _, user := range users {
-		if user.Username == uname {
-			return user, errors.New("username collision observed, quitting")
-		}
+	if err != nil {
+		return dummy, errors.Wrap(err, "error while retrieving user from database")
 	}
 
-	return dummy, nil
+	return user, errors.New("username collision observed, quitting")
 }
 
-// Authorize sets the Kyc flag on a user. Can only be called by Inspectors
+// Authorize sets the Kyc flag on a user. Can only be called by users with the PermKyc permission
 func (a *User) Authorize(userIndex int) error {
 	// we don't really mind who this user is since all we need to verify is his identity
-	if !a.Inspector && !a.Admin {
+	allowed, err := a.HasPermission(PermKyc)
+	if err != nil {
+		return errors.Wrap(err, "could not check permissions")
+	}
+	if !allowed {
 		return errors.New("You don't have the required permissions to kyc a person")
 	}
 	user, err := RetrieveUser(userIndex)
@@ -372,18 +445,17 @@ func (a *User) Authorize(userIndex int) error {
 		return errors.New("user already KYC'd")
 	}
 	user.Kyc = true
-	return user.Save()
+	err = user.Save()
+	if err != nil {
+		return err
+	}
+	return AppendAudit(a.Index, a.Username, AuditAuthorizeKyc, strconv.Itoa(userIndex), "", nil)
 }
 
-// AddInspector sets the Inspector flag on a user
+// AddInspector grants the kyc inspector role to a user
 func AddInspector(userIndex int) error {
 	// this should only be called by the platform itself and not open to others
-	user, err := RetrieveUser(userIndex)
-	if err != nil {
-		return errors.Wrap(err, "error while retrieving user from database")
-	}
-	user.Inspector = true
-	return user.Save()
+	return GrantRole(userIndex, RoleKycInspector)
 }
 
 // ChangeReputation changes the reputation associated with a user
@@ -392,24 +464,35 @@ func (a *User) ChangeReputation(reputation float64) error {
 	return a.Save()
 }
 
+// SubmitTx builds a transaction from the user's primary wallet with the passed ops, has the
+// signer sign it with the user's seed and broadcasts it
+func (a *User) SubmitTx(seedpwd string, memo string, ops ...build.Operation) (string, error) {
+	return signer.SubmitTx(a.StellarWallet.PublicKey, seedpwd, memo, ops...)
+}
+
+// SignTx has the signer sign the transaction envelope with the seed of the user's primary wallet
+func (a *User) SignTx(seedpwd string, txe string) (string, error) {
+	return signer.SignTx(a.StellarWallet.PublicKey, seedpwd, txe)
+}
+
 // IncreaseTrustLimit increases the trust limit of a user towards the in house stablecoin
 func (a *User) IncreaseTrustLimit(seedpwd string, trust float64) error {
+	code, issuer, limit := consts.StablecoinCode, consts.StablecoinPublicKey, consts.StablecoinTrustLimit
+	if consts.Mainnet {
+		code, issuer, limit = consts.AnchorUSDCode, consts.AnchorUSDAddress, consts.AnchorUSDTrustLimit
+	}
 
-	seed, err := wallet.DecryptSeed(a.StellarWallet.EncryptedSeed, seedpwd)
+	limitString, err := utils.ToString(trust + limit)
 	if err != nil {
-		return errors.Wrap(err, "couldn't decrypt seed, quitting!")
+		return errors.Wrap(err, "could not convert limit to string")
 	}
 
-	if !consts.Mainnet {
-		_, err = assets.TrustAsset(consts.StablecoinCode, consts.StablecoinPublicKey, trust+consts.StablecoinTrustLimit, seed)
-		if err != nil {
-			return errors.Wrap(err, "couldn't trust asset, quitting!")
-		}
-	} else {
-		_, err = assets.TrustAsset(consts.AnchorUSDCode, consts.AnchorUSDAddress, trust+consts.AnchorUSDTrustLimit, seed)
-		if err != nil {
-			return errors.Wrap(err, "couldn't trust asset, quitting!")
-		}
+	_, err = a.SubmitTx(seedpwd, "trust asset", &build.ChangeTrust{
+		Line:  build.CreditAsset{Code: code, Issuer: issuer},
+		Limit: limitString,
+	})
+	if err != nil {
+		return errors.Wrap(err, "couldn't trust asset, quitting!")
 	}
 
 	return nil
@@ -418,34 +501,36 @@ func (a *User) IncreaseTrustLimit(seedpwd string, trust float64) error {
 // SearchWithEmailID searches for a user given their email id
 func SearchWithEmailID(email string) (User, error) {
 	var dummy User
-	users, err := RetrieveAllUsers()
+	user, err := RetrieveUserByEmail(email)
 	if err != nil {
-		return dummy, errors.Wrap(err, "error while retrieving all users from database")
+		return dummy, errors.Wrap(err, "could not find user with requested email id, quitting")
 	}
 
-	for _, user := range users {
-		if user.Email == email {
-			return user, nil
-		}
+	return user, nil
+}
+
+// secondaryPayment sends XLM from the secondary wallet to the primary wallet
+func (a *User) secondaryPayment(amount float64, seedpwd string) (string, error) {
+	amountString, err := utils.ToString(amount)
+	if err != nil {
+		return "", errors.Wrap(err, "could not convert amount to string")
 	}
 
-	return dummy, errors.New("could not find user with requested email id, quitting")
+	return signer.SubmitTx(a.SecondaryWallet.PublicKey, seedpwd, "fund transfer to secondary", &build.Payment{
+		Destination: a.StellarWallet.PublicKey,
+		Amount:      amountString,
+		Asset:       build.NativeAsset{},
+	})
 }
 
 // MoveFundsFromSecondaryWallet moves XLM from the secondary wallet to the primary wallet
 func (a *User) MoveFundsFromSecondaryWallet(amount float64, seedpwd string) error {
-	// unlock secondary account
-	secSeed, err := wallet.DecryptSeed(a.SecondaryWallet.EncryptedSeed, seedpwd)
-	if err != nil {
-		return errors.Wrap(err, "could not unlock secondary seed, quitting")
-	}
-
 	secFunds := xlm.GetNativeBalance(a.SecondaryWallet.PublicKey)
 	if amount > secFunds {
 		return errors.New("amount to be transferred is greater than the funds available in the secondary account, quitting")
 	}
 
-	_, txhash, err := xlm.SendXLM(a.StellarWallet.PublicKey, amount, secSeed, "fund transfer to secondary")
+	txhash, err := a.secondaryPayment(amount, seedpwd)
 	if err != nil {
 		return errors.Wrap(err, "error while transferring funds to secondary account, quitting")
 	}
@@ -456,15 +541,8 @@ func (a *User) MoveFundsFromSecondaryWallet(amount float64, seedpwd string) erro
 
 // SweepSecondaryWallet sweeps XLM from the secondary account to the primary account
 func (a *User) SweepSecondaryWallet(seedpwd string) error {
-	// unlock secondary account
-
-	secSeed, err := wallet.DecryptSeed(a.SecondaryWallet.EncryptedSeed, seedpwd)
-	if err != nil {
-		return errors.Wrap(err, "could not unlock primary seed, quitting")
-	}
-
 	secFunds := xlm.GetNativeBalance(a.SecondaryWallet.PublicKey)
-	_, txhash, err := xlm.SendXLM(a.StellarWallet.PublicKey, secFunds-5, secSeed, "fund transfer to secondary")
+	txhash, err := a.secondaryPayment(secFunds-5, seedpwd)
 	if err != nil {
 		return errors.Wrap(err, "error while transferring funds to secondary account, quitting")
 	}
@@ -487,7 +565,11 @@ func (a *User) SetBan(userIndex int) error {
 		return errors.Wrap(err, "couldn't  find user to ban, quitting")
 	}
 
-	if !a.Admin {
+	allowed, err := a.HasPermission(PermBanUsers)
+	if err != nil {
+		return errors.Wrap(err, "could not check permissions")
+	}
+	if !allowed {
 		return errors.New("user not authorized to ban a user")
 	}
 
@@ -500,7 +582,11 @@ func (a *User) SetBan(userIndex int) error {
 	}
 
 	user.Banned = true
-	return user.Save()
+	err = user.Save()
+	if err != nil {
+		return err
+	}
+	return AppendAudit(a.Index, a.Username, AuditBanUser, strconv.Itoa(userIndex), "", nil)
 }
 
 // GiveFeedback is used to rate another user
@@ -534,104 +620,21 @@ func (a *User) GiveFeedback(userIndex int, feedback int) error {
 	return a.Save()
 }
 
-// Generate2FA generates a new 2FA secret for the given user
-func (a *User) Generate2FA() (string, error) {
-	secret := utils.GetRandomString(35)
-	secretBase32 := base32.StdEncoding.EncodeToString([]byte(secret))
-	otpc := &googauth.OTPConfig{
-		Secret:     secretBase32,
-		WindowSize: 1,
-		UTC:        true,
-	}
-	otpString, err := otpc.GenerateURI(a.Name)
-	if err != nil {
-		return otpString, err
-	}
-	if err != nil {
-		return otpString, err
-	}
-	a.TwoFASecret = secret
-	err = a.Save()
-	if err != nil {
-		return otpString, err
-	}
-	return otpString, nil
-}
-
-// Authenticate2FA authenticates the given password against the user's stored 2fA secret
-func (a *User) Authenticate2FA(password string) (bool, error) {
-	secretBase32 := base32.StdEncoding.EncodeToString([]byte(a.TwoFASecret))
-	otpc := &googauth.OTPConfig{
-		Secret:     secretBase32,
-		WindowSize: 1,
-		UTC:        true,
-	}
-
-	return otpc.Authenticate(password)
-}
-
-// ImportSeed can be used to import an ecrypted seed
+// ImportSeed can be used to import an ecrypted seed. The signer checks that seedpwd unlocks
+// the seed of pubkey before it stores it
 func (a *User) ImportSeed(encryptedSeed []byte, pubkey string, seedpwd string) error {
-	seed, err := wallet.DecryptSeed(encryptedSeed, seedpwd)
-	if err != nil {
-		return errors.Wrap(err, "could not decrypt seed")
+	if seedpwd == "" {
+		return errors.New("seedpwd required to import seed")
 	}
-	checkPubkey, err := wallet.ReturnPubkey(seed)
+	err := signer.Import(pubkey, encryptedSeed, seedpwd)
 	if err != nil {
-		return errors.Wrap(err, "could not get pubkey from encrypted seed")
-	}
-	if pubkey != checkPubkey {
-		return errors.New("decrypted pubkey does not match with provided pubkey")
+		return err
 	}
 	a.StellarWallet.EncryptedSeed = encryptedSeed
 	a.StellarWallet.PublicKey = pubkey
 	return a.Save()
 }
 
-// GenAccessToken generates a new access token for the user
-func (a *User) GenAccessToken() (string, error) {
-	timeNow := utils.Unix()
-	if len(a.AccessToken) == 0 {
-		a.AccessToken = make(map[string]int64)
-	} else {
-		// delete expired tokens
-		for token, timeout := range a.AccessToken {
-			if timeNow-timeout >= consts.AccessTokenLife {
-				delete(a.AccessToken, token)
-			}
-		}
-
-		if len(a.AccessToken) == 5 { // all 5 tokens are valid, delete oldest token
-			min := int64(0)
-			minToken := ""
-			for token, timeout := range a.AccessToken {
-				if timeout > min {
-					min = timeout
-					minToken = token
-				}
-			}
-			delete(a.AccessToken, minToken) // delete the oldest token
-		}
-	}
-
-	token := utils.GetRandomString(consts.AccessTokenLength)
-	a.AccessToken[token] = timeNow
-
-	err := a.Save()
-	if err != nil {
-		return "", errors.Wrap(err, "could not save user to database")
-	}
-	return token, nil
-}
-
-// AllLogout invalidates the user access token
-func (a *User) AllLogout() error {
-	for token := range a.AccessToken {
-		delete(a.AccessToken, token)
-	}
-	return a.Save()
-}
-
 // AddtoMailbox adds a message to a user's mailbox
 func (a *User) AddtoMailbox(subject string, message string) error {
 	var x MailboxHelper
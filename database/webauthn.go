@@ -0,0 +1,603 @@
+package database
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+
+	edb "github.com/Varunram/essentials/database"
+	utils "github.com/Varunram/essentials/utils"
+)
+
+// webauthn contains the WebAuthn registration and assertion ceremonies that let users sign
+// in and approve sensitive operations with hardware keys and passkeys as a second factor.
+// Credentials are stored with the user and challenges in their own bucket so that a
+// ceremony can span requests. Assertion challenges are bound to the route they were
+// requested for so that an assertion made to sign in can't approve a withdrawal
+
+// WebAuthnBucket stores pending ceremony challenges keyed by the challenge
+var WebAuthnBucket = []byte("WebAuthn")
+
+// WebAuthnConfig identifies openx as a WebAuthn relying party
+type WebAuthnConfig struct {
+	// RPID is the domain credentials are scoped to
+	RPID string
+	// RPName is the name shown to users by their authenticator
+	RPName string
+	// Origins are the origins ceremonies can be performed from
+	Origins []string
+	// Timeout is the number of seconds a ceremony can take
+	Timeout int64
+}
+
+// WebAuthnRP is the relying party config used by the ceremonies
+var WebAuthnRP = WebAuthnConfig{
+	RPID:    "localhost",
+	RPName:  "openx",
+	Origins: []string{"https://localhost"},
+	Timeout: 300,
+}
+
+// purposeRegister is the purpose of registration challenges. Assertion challenges carry the
+// route they were requested for
+const purposeRegister = "register"
+
+// the COSE algorithms of the supported credential public keys
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// the flags of authenticator data
+const (
+	flagUserPresent = 0x01
+	flagAttested    = 0x40
+)
+
+// WebAuthnCredential is a WebAuthn credential registered by a user
+type WebAuthnCredential struct {
+	// ID is the base64url encoded credential id
+	ID string
+	// Name is a label given to the credential by the user
+	Name string
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte
+	// SignCount is the latest signature counter reported by the authenticator
+	SignCount uint32
+	// Created is the unix time at which the credential was registered
+	Created int64
+	// LastUsed is the unix time at which the credential was last used
+	LastUsed int64
+}
+
+// webAuthnChallenge is a pending ceremony
+type webAuthnChallenge struct {
+	User    int
+	Purpose string
+	Expiry  int64
+}
+
+// credentialDescriptor references a credential in ceremony options
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// credentialParameter is a credential type and algorithm accepted at registration
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialCreationOptions are the options passed to navigator.credentials.create. Binary
+// values are base64url encoded
+type CredentialCreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+}
+
+// CredentialRequestOptions are the options passed to navigator.credentials.get. Binary
+// values are base64url encoded
+type CredentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CredentialResponse is the credential returned by navigator.credentials.create or get with
+// its binary values base64url encoded
+type CredentialResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject,omitempty"`
+		AuthenticatorData string `json:"authenticatorData,omitempty"`
+		Signature         string `json:"signature,omitempty"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// clientData is the client data collected by the browser during a ceremony
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// attestationObject is the CBOR encoded result of a registration ceremony
+type attestationObject struct {
+	Fmt      string                 `cbor:"fmt"`
+	AttStmt  map[string]interface{} `cbor:"attStmt"`
+	AuthData []byte                 `cbor:"authData"`
+}
+
+// authenticatorData is the parsed data signed by an authenticator
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// decodeBase64URL decodes base64url data with or without padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// newChallenge stores a new challenge for the user and returns it
+func newChallenge(userIndex int, purpose string) (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate challenge")
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+
+	encoded, err := json.Marshal(webAuthnChallenge{
+		User:    userIndex,
+		Purpose: purpose,
+		Expiry:  utils.Unix() + WebAuthnRP.Timeout,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(WebAuthnBucket)
+		if err != nil {
+			return err
+		}
+
+		// drop expired challenges of abandoned ceremonies
+		now := utils.Unix()
+		var expired [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			var x webAuthnChallenge
+			if json.Unmarshal(v, &x) != nil || x.Expiry < now {
+				key := make([]byte, len(k))
+				copy(key, k)
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			err = b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.Put([]byte(challenge), encoded)
+	})
+	return challenge, err
+}
+
+// consumeChallenge deletes a challenge and checks that it was issued to the user for purpose
+// and hasn't expired. Challenges are deleted even if the ceremony fails so that they can only
+// be used once
+func consumeChallenge(challenge string, userIndex int, purpose string) error {
+	var x webAuthnChallenge
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.Bucket(WebAuthnBucket)
+		if err == edb.ErrBucketMissing {
+			return errors.New("challenge not found")
+		}
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(challenge))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return errors.New("challenge not found")
+		}
+		err = json.Unmarshal(v, &x)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(challenge))
+	})
+	if err != nil {
+		return err
+	}
+
+	if x.User != userIndex || x.Purpose != purpose {
+		return errors.New("challenge was issued for a different ceremony")
+	}
+	if x.Expiry < utils.Unix() {
+		return errors.New("challenge expired")
+	}
+	return nil
+}
+
+// verifyClientData checks the client data of a ceremony and consumes its challenge
+func verifyClientData(raw []byte, ceremony string, userIndex int, purpose string) error {
+	var cd clientData
+	err := json.Unmarshal(raw, &cd)
+	if err != nil {
+		return errors.Wrap(err, "could not decode client data")
+	}
+	if cd.Type != ceremony {
+		return errors.New("unexpected ceremony type " + cd.Type)
+	}
+
+	allowed := false
+	for _, origin := range WebAuthnRP.Origins {
+		if cd.Origin == origin {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return errors.New("origin " + cd.Origin + " not allowed")
+	}
+
+	return consumeChallenge(cd.Challenge, userIndex, purpose)
+}
+
+// parseAuthenticatorData parses authenticator data and checks that it is scoped to our
+// relying party and that the user was present
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var ad authenticatorData
+	if len(data) < 37 {
+		return ad, errors.New("authenticator data too short")
+	}
+	ad.RPIDHash = data[:32]
+	ad.Flags = data[32]
+	ad.SignCount = binary.BigEndian.Uint32(data[33:37])
+
+	rpIDHash := sha256.Sum256([]byte(WebAuthnRP.RPID))
+	if subtle.ConstantTimeCompare(ad.RPIDHash, rpIDHash[:]) != 1 {
+		return ad, errors.New("credential scoped to a different relying party")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return ad, errors.New("user not present")
+	}
+
+	if ad.Flags&flagAttested == 0 {
+		return ad, nil
+	}
+
+	// attested credential data: aaguid, credential id length and id, public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return ad, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return ad, errors.New("credential id too short")
+	}
+	ad.CredentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	// the public key is followed by extensions, so decode it to find where it ends
+	var key map[int]interface{}
+	dec := cbor.NewDecoder(bytes.NewReader(rest))
+	err := dec.Decode(&key)
+	if err != nil {
+		return ad, errors.Wrap(err, "could not decode credential public key")
+	}
+	ad.PublicKey = rest[:dec.NumBytesRead()]
+	return ad, nil
+}
+
+// coseInt returns the integer stored under label in a COSE key
+func coseInt(key map[int]interface{}, label int) (int64, bool) {
+	switch x := key[label].(type) {
+	case uint64:
+		return int64(x), true
+	case int64:
+		return x, true
+	}
+	return 0, false
+}
+
+// coseBytes returns the byte string stored under label in a COSE key
+func coseBytes(key map[int]interface{}, label int) []byte {
+	x, _ := key[label].([]byte)
+	return x
+}
+
+// verifyCOSESignature verifies sig over data with a COSE encoded public key
+func verifyCOSESignature(coseKey []byte, data []byte, sig []byte) error {
+	var key map[int]interface{}
+	err := cbor.Unmarshal(coseKey, &key)
+	if err != nil {
+		return errors.Wrap(err, "could not decode credential public key")
+	}
+
+	alg, _ := coseInt(key, 3)
+	switch alg {
+	case coseES256:
+		x, y := coseBytes(key, -2), coseBytes(key, -3)
+		if crv, _ := coseInt(key, -1); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return errors.New("invalid P-256 public key")
+		}
+		pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		var esig struct {
+			R, S *big.Int
+		}
+		_, err = asn1.Unmarshal(sig, &esig)
+		if err != nil {
+			return errors.Wrap(err, "invalid signature")
+		}
+		hash := sha256.Sum256(data)
+		if !ecdsa.Verify(&pub, hash[:], esig.R, esig.S) {
+			return errors.New("invalid signature")
+		}
+	case coseEdDSA:
+		x := coseBytes(key, -2)
+		if crv, _ := coseInt(key, -1); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 public key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(x), data, sig) {
+			return errors.New("invalid signature")
+		}
+	case coseRS256:
+		n, e := coseBytes(key, -1), coseBytes(key, -2)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return errors.New("invalid RSA public key")
+		}
+		pub := rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		hash := sha256.Sum256(data)
+		err = rsa.VerifyPKCS1v15(&pub, crypto.SHA256, hash[:], sig)
+		if err != nil {
+			return errors.Wrap(err, "invalid signature")
+		}
+	default:
+		return errors.New("unsupported credential algorithm " + strconv.FormatInt(alg, 10))
+	}
+	return nil
+}
+
+// webAuthnUserID is the user handle of the user's credentials
+func (a User) webAuthnUserID() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(a.Index)))
+}
+
+// credentialDescriptors references the credentials of the user
+func (a User) credentialDescriptors() []credentialDescriptor {
+	arr := make([]credentialDescriptor, len(a.WebAuthnCredentials))
+	for i, cred := range a.WebAuthnCredentials {
+		arr[i] = credentialDescriptor{Type: "public-key", ID: cred.ID}
+	}
+	return arr
+}
+
+// BeginWebAuthnRegistration starts registering a new credential for the user
+func (a User) BeginWebAuthnRegistration() (CredentialCreationOptions, error) {
+	var opts CredentialCreationOptions
+	challenge, err := newChallenge(a.Index, purposeRegister)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Challenge = challenge
+	opts.RP.ID = WebAuthnRP.RPID
+	opts.RP.Name = WebAuthnRP.RPName
+	opts.User.ID = a.webAuthnUserID()
+	opts.User.Name = a.Username
+	opts.User.DisplayName = a.Name
+	for _, alg := range []int{coseES256, coseEdDSA, coseRS256} {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, credentialParameter{Type: "public-key", Alg: alg})
+	}
+	opts.Timeout = WebAuthnRP.Timeout * 1000
+	opts.Attestation = "none"
+	opts.ExcludeCredentials = a.credentialDescriptors()
+	opts.AuthenticatorSelection.UserVerification = "preferred"
+	return opts, nil
+}
+
+// FinishWebAuthnRegistration verifies the response to a registration challenge and stores
+// the new credential under the passed name. Only the none attestation format is accepted
+// since registration doesn't request attestation
+func (a *User) FinishWebAuthnRegistration(name string, response CredentialResponse) (WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+
+	rawClientData, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return cred, errors.Wrap(err, "could not decode client data")
+	}
+	err = verifyClientData(rawClientData, "webauthn.create", a.Index, purposeRegister)
+	if err != nil {
+		return cred, err
+	}
+
+	rawAttestation, err := decodeBase64URL(response.Response.AttestationObject)
+	if err != nil {
+		return cred, errors.Wrap(err, "could not decode attestation object")
+	}
+	var att attestationObject
+	err = cbor.Unmarshal(rawAttestation, &att)
+	if err != nil {
+		return cred, errors.Wrap(err, "could not decode attestation object")
+	}
+	if att.Fmt != "none" || len(att.AttStmt) != 0 {
+		return cred, errors.New("unsupported attestation format " + att.Fmt)
+	}
+
+	ad, err := parseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return cred, err
+	}
+	if ad.CredentialID == nil {
+		return cred, errors.New("no credential in attestation")
+	}
+
+	// check that the key can be used before storing it
+	var key map[int]interface{}
+	err = cbor.Unmarshal(ad.PublicKey, &key)
+	if err != nil {
+		return cred, errors.Wrap(err, "could not decode credential public key")
+	}
+	alg, _ := coseInt(key, 3)
+	if alg != coseES256 && alg != coseEdDSA && alg != coseRS256 {
+		return cred, errors.New("unsupported credential algorithm " + strconv.FormatInt(alg, 10))
+	}
+
+	cred.ID = base64.RawURLEncoding.EncodeToString(ad.CredentialID)
+	for _, x := range a.WebAuthnCredentials {
+		if x.ID == cred.ID {
+			return cred, errors.New("credential already registered")
+		}
+	}
+
+	cred.Name = name
+	cred.PublicKey = ad.PublicKey
+	cred.SignCount = ad.SignCount
+	cred.Created = utils.Unix()
+	a.WebAuthnCredentials = append(a.WebAuthnCredentials, cred)
+	return cred, a.Save()
+}
+
+// BeginWebAuthnAssertion starts an assertion with one of the user's credentials that can
+// only be used to authorize a request to route
+func (a User) BeginWebAuthnAssertion(route string) (CredentialRequestOptions, error) {
+	var opts CredentialRequestOptions
+	if len(a.WebAuthnCredentials) == 0 {
+		return opts, errors.New("user has no webauthn credentials")
+	}
+
+	challenge, err := newChallenge(a.Index, route)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Challenge = challenge
+	opts.RPID = WebAuthnRP.RPID
+	opts.Timeout = WebAuthnRP.Timeout * 1000
+	opts.AllowCredentials = a.credentialDescriptors()
+	opts.UserVerification = "preferred"
+	return opts, nil
+}
+
+// FinishWebAuthnAssertion verifies an assertion made for route with one of the user's
+// credentials. The signature counter must increase to detect cloned authenticators
+func (a *User) FinishWebAuthnAssertion(route string, response CredentialResponse) error {
+	index := -1
+	for i, cred := range a.WebAuthnCredentials {
+		if cred.ID == strings.TrimRight(response.ID, "=") {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return errors.New("unknown credential")
+	}
+	cred := a.WebAuthnCredentials[index]
+
+	if response.Response.UserHandle != "" && strings.TrimRight(response.Response.UserHandle, "=") != a.webAuthnUserID() {
+		return errors.New("credential belongs to a different user")
+	}
+
+	rawClientData, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return errors.Wrap(err, "could not decode client data")
+	}
+	err = verifyClientData(rawClientData, "webauthn.get", a.Index, route)
+	if err != nil {
+		return err
+	}
+
+	rawAuthData, err := decodeBase64URL(response.Response.AuthenticatorData)
+	if err != nil {
+		return errors.Wrap(err, "could not decode authenticator data")
+	}
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return err
+	}
+
+	sig, err := decodeBase64URL(response.Response.Signature)
+	if err != nil {
+		return errors.Wrap(err, "could not decode signature")
+	}
+	// the authenticator signs its data followed by the hash of the client data
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	err = verifyCOSESignature(cred.PublicKey, signed, sig)
+	if err != nil {
+		return err
+	}
+
+	// authenticators that don't implement a counter always report zero
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return errors.New("signature counter did not increase, authenticator may be cloned")
+	}
+
+	a.WebAuthnCredentials[index].SignCount = ad.SignCount
+	a.WebAuthnCredentials[index].LastUsed = utils.Unix()
+	return a.Save()
+}
+
+// RemoveWebAuthnCredential removes the credential with the passed id from the user
+func (a *User) RemoveWebAuthnCredential(id string) error {
+	for i, cred := range a.WebAuthnCredentials {
+		if cred.ID == id {
+			a.WebAuthnCredentials = append(a.WebAuthnCredentials[:i], a.WebAuthnCredentials[i+1:]...)
+			return a.Save()
+		}
+	}
+	return errors.New("credential not found")
+}
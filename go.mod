@@ -7,6 +7,7 @@ require (
 	github.com/bithyve/research v0.0.0-20191102090848-d238806b60bf
 	github.com/boltdb/bolt v1.3.1
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/go-chi/chi v4.1.1+incompatible // indirect
 	github.com/go-errors/errors v1.0.2 // indirect
 	github.com/ipfs/go-cid v0.0.6 // indirect
@@ -14,9 +15,10 @@ require (
 	github.com/jessevdk/go-flags v1.4.0
 	github.com/lib/pq v1.5.2 // indirect
 	github.com/libp2p/go-libp2p-core v0.5.6 // indirect
+	github.com/mattn/go-sqlite3 v1.9.0
 	github.com/mitchellh/mapstructure v1.3.1 // indirect
 	github.com/multiformats/go-multiaddr-net v0.1.5 // indirect
-	github.com/pelletier/go-toml v1.8.0 // indirect
+	github.com/pelletier/go-toml v1.8.0
 	github.com/pkg/errors v0.9.1
 	github.com/pquerna/ffjson v0.0.0-20190930134022-aa0246cd15f7
 	github.com/sirupsen/logrus v1.6.0 // indirect
@@ -28,5 +30,6 @@ require (
 	github.com/stellar/go v0.0.0-20200528062442-f08b35a3f034
 	github.com/stellar/go-xdr v0.0.0-20200331223602-71a1e6d555f2 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
+	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	gopkg.in/ini.v1 v1.57.0 // indirect
 )
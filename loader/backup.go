@@ -0,0 +1,38 @@
+package loader
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// StartSnapshots starts taking scheduled database snapshots if snapshotdir is set in the config
+// file. snapshotinterval is the number of hours between snapshots, snapshotretention the number
+// of snapshots to keep and snapshotpassphrase an optional passphrase to encrypt snapshots with
+func StartSnapshots() {
+	if !viper.IsSet("snapshotdir") {
+		return
+	}
+
+	interval := 24
+	if viper.IsSet("snapshotinterval") {
+		interval = viper.GetInt("snapshotinterval")
+	}
+
+	retain := 7
+	if viper.IsSet("snapshotretention") {
+		retain = viper.GetInt("snapshotretention")
+	}
+
+	if interval <= 0 {
+		log.Println("snapshot interval must be positive, not scheduling snapshots")
+		return
+	}
+
+	dir := viper.GetString("snapshotdir")
+	log.Println("saving database snapshots to ", dir, " every ", interval, " hours")
+	go database.ScheduleSnapshots(dir, time.Duration(interval)*time.Hour, retain, viper.GetString("snapshotpassphrase"))
+}
@@ -0,0 +1,141 @@
+package loader
+
+import (
+	"github.com/spf13/viper"
+
+	anchor "github.com/YaleOpenLab/openx/anchor"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+	rpc "github.com/YaleOpenLab/openx/rpc"
+)
+
+// loadConfig overrides the defaults of openx with the params set in the config file
+func loadConfig() {
+	initPasswordParams()
+	initLockoutParams()
+	initWebAuthn()
+	initOIDC()
+	initHomeDomain()
+	initSigner()
+	initAnchors()
+	initApprovalPolicies()
+	initTwoFARoutes()
+	initTransferPolling()
+	initSessionSweeps()
+}
+
+// initPasswordParams overrides the Argon2id parameters used to hash passwords with the
+// argon2time, argon2memory (in KiB) and argon2threads params in the config file
+func initPasswordParams() {
+	if viper.IsSet("argon2time") {
+		database.Argon2Params.Time = uint32(viper.GetInt("argon2time"))
+	}
+	if viper.IsSet("argon2memory") {
+		database.Argon2Params.Memory = uint32(viper.GetInt("argon2memory"))
+	}
+	if viper.IsSet("argon2threads") {
+		database.Argon2Params.Threads = uint8(viper.GetInt("argon2threads"))
+	}
+}
+
+// initLockoutParams overrides the number of failed attempts after which accounts are locked
+// and the duration in seconds of the first and longest lockouts with the lockoutfailures,
+// lockoutbase and lockoutmax params in the config file
+func initLockoutParams() {
+	if viper.IsSet("lockoutfailures") {
+		database.MaxAuthFailures = viper.GetInt("lockoutfailures")
+	}
+	if viper.IsSet("lockoutbase") {
+		database.LockoutBase = viper.GetInt64("lockoutbase")
+	}
+	if viper.IsSet("lockoutmax") {
+		database.MaxLockout = viper.GetInt64("lockoutmax")
+	}
+}
+
+// initWebAuthn sets the relying party that WebAuthn credentials are scoped to with the
+// webauthnrpid, webauthnrpname and webauthnorigins params in the config file
+func initWebAuthn() {
+	if viper.IsSet("webauthnrpid") {
+		database.WebAuthnRP.RPID = viper.GetString("webauthnrpid")
+	}
+	if viper.IsSet("webauthnrpname") {
+		database.WebAuthnRP.RPName = viper.GetString("webauthnrpname")
+	}
+	if viper.IsSet("webauthnorigins") {
+		database.WebAuthnRP.Origins = viper.GetStringSlice("webauthnorigins")
+	}
+}
+
+// initOIDC sets the issuer of ID tokens with the oidcissuer param in the config file
+func initOIDC() {
+	if viper.IsSet("oidcissuer") {
+		database.OIDCIssuer = viper.GetString("oidcissuer")
+	}
+}
+
+// initHomeDomain sets the domain openx is served at with the homedomain param in the config file
+func initHomeDomain() {
+	if viper.IsSet("homedomain") {
+		consts.HomeDomain = viper.GetString("homedomain")
+	}
+}
+
+// initSigner has transactions signed by the signing daemon listening on the unix socket in the
+// signersocket param in the config file instead of in process
+func initSigner() {
+	if viper.IsSet("signersocket") {
+		consts.SignerSocket = viper.GetString("signersocket")
+	}
+}
+
+// initAnchors registers the anchors users can transfer with. The anchors param in the config
+// file replaces the default anchors of the network
+func initAnchors() {
+	if viper.IsSet("anchors") {
+		consts.Anchors = viper.GetStringSlice("anchors")
+	}
+	for _, domain := range consts.Anchors {
+		anchor.Register(anchor.New(domain))
+	}
+}
+
+// initApprovalPolicies overrides the number of approvals and the window in seconds of actions
+// that require approval with the approvals.<action>.required and approvals.<action>.window
+// params in the config file
+func initApprovalPolicies() {
+	for action, policy := range database.ApprovalPolicies {
+		key := "approvals." + action
+		if viper.IsSet(key + ".required") {
+			policy.Required = viper.GetInt(key + ".required")
+		}
+		if viper.IsSet(key + ".window") {
+			policy.Window = viper.GetInt64(key + ".window")
+		}
+		database.ApprovalPolicies[action] = policy
+	}
+}
+
+// initTwoFARoutes replaces the routes that need an otp from users who enabled 2fa with the
+// twofaroutes param in the config file
+func initTwoFARoutes() {
+	if viper.IsSet("twofaroutes") {
+		rpc.SetTwoFARoutes(viper.GetStringSlice("twofaroutes"))
+	}
+}
+
+// initTransferPolling sets the number of seconds between polls of pending anchor transfers
+// with the transferpollinterval param in the config file
+func initTransferPolling() {
+	if viper.IsSet("transferpollinterval") {
+		rpc.TransferPollInterval = viper.GetInt("transferpollinterval")
+	}
+}
+
+// initSessionSweeps sets the number of seconds between sweeps of expired sessions with the
+// sessionsweepinterval param in the config file
+func initSessionSweeps() {
+	if viper.IsSet("sessionsweepinterval") {
+		database.SessionSweepInterval = viper.GetInt("sessionsweepinterval")
+	}
+}
@@ -23,6 +23,12 @@ func Mainnet() error {
 	var err error
 	consts.SetConsts(true) // set in house  consts
 
+	err = initStore()
+	if err != nil {
+		return errors.Wrap(err, "could not initialize database backend")
+	}
+	loadConfig()
+
 	lim, _ := database.RetrieveAllUsersLim()
 	if lim == 0 {
 		// nothing exists, create dbs and buckets
@@ -30,6 +36,11 @@ func Mainnet() error {
 		database.CreateHomeDir()
 	}
 
+	err = prepareDatabase()
+	if err != nil {
+		return err
+	}
+
 	// Initialize platform stuff like the platform seed
 	err = openx.InitializePlatform()
 	if err != nil {
@@ -0,0 +1,22 @@
+package loader
+
+import (
+	"github.com/pkg/errors"
+
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// AutoMigrate runs pending database migrations while loading openx. It can be turned off so
+// that migrations are run explicitly instead, for example to inspect them with a dry run first
+var AutoMigrate = true
+
+// migrate brings the database schema up to date
+func migrate() error {
+	reports, err := database.RunMigrations(false)
+	if err != nil {
+		return errors.Wrap(err, "could not migrate database")
+	}
+
+	database.LogMigrationReports(reports, false)
+	return nil
+}
@@ -0,0 +1,79 @@
+package loader
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// initStore selects the database backend using the dbbackend and dbpath params in the
+// config file. openx falls back to the bolt file in consts.DbDir if neither is set
+func initStore() error {
+	viper.SetConfigType("yaml")
+	viper.SetConfigName("config")
+	viper.AddConfigPath(".")
+	err := viper.ReadInConfig()
+	if err != nil {
+		log.Println("could not read config file, using the default bolt store")
+		return nil
+	}
+
+	if !viper.IsSet("dbbackend") && !viper.IsSet("dbpath") {
+		return nil
+	}
+
+	store, err := database.NewStore(viper.GetString("dbbackend"), viper.GetString("dbpath"))
+	if err != nil {
+		return err
+	}
+
+	log.Println("using database backend: ", viper.GetString("dbbackend"))
+	database.SetStore(store)
+	return nil
+}
+
+// prepareDatabase loads the master key for sensitive user data, runs pending migrations,
+// creates the default roles, imports the seeds of users into the signer and encrypts users
+// that are stored in plaintext or with a retired data key. Everything after the migrations
+// reads or writes records that have to be on the latest schema version, and saving a user
+// stamps it with that version
+func prepareDatabase() error {
+	err := database.LoadMasterKeyFile(consts.MasterKeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load master key")
+	}
+
+	if !AutoMigrate {
+		// nothing can be seeded or encrypted until the pending migrations have been run
+		log.Println("skipping database migrations, seeding and encryption of users")
+		return nil
+	}
+
+	err = migrate()
+	if err != nil {
+		return err
+	}
+
+	err = database.SeedRoles()
+	if err != nil {
+		return errors.Wrap(err, "could not create default roles")
+	}
+
+	err = database.ImportSeeds()
+	if err != nil {
+		return errors.Wrap(err, "could not import seeds into signer")
+	}
+
+	count, err := database.ReencryptUsers()
+	if err != nil {
+		return errors.Wrap(err, "could not encrypt users")
+	}
+	if count != 0 {
+		log.Println("encrypted sensitive fields of users: ", count)
+	}
+	return nil
+}
@@ -24,8 +24,16 @@ import (
 func Testnet() error {
 	log.Println("initializing openx testnet..")
 	consts.SetConsts(false)
+	err := initStore()
+	if err != nil {
+		return errors.Wrap(err, "could not initialize database backend")
+	}
+	loadConfig()
 	database.CreateHomeDir()
-	var err error
+	err = prepareDatabase()
+	if err != nil {
+		return err
+	}
 	// init stablecoin before platform so we don't have to create a stablecoin in case our dbdir is wiped
 	consts.StablecoinPublicKey, consts.StablecoinSeed, err = stablecoin.InitStableCoin()
 	if err != nil {
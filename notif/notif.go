@@ -51,3 +51,50 @@ func SendUserConfEmail(to string, code string) error {
 
 	return email.SendMail(body, to)
 }
+
+// SendUnlockEmail notifies a user that their account has been locked after repeated failed
+// login attempts and sends them the code that unlocks it
+func SendUnlockEmail(to string, code string) error {
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that your account has been temporarily locked " +
+		"after repeated failed attempts to sign in. If this wasn't you, we recommend changing your password\n\n" +
+		"The account unlocks by itself after a while, or you can input this code to unlock it right away\n\n" +
+		"UNLOCK CODE: " + code + "\n\n\n" + footerString
+
+	return email.SendMail(body, to)
+}
+
+// SendNewDeviceEmail notifies a user that their account was logged in to from a device or
+// ip address they haven't used before
+func SendNewDeviceEmail(to string, ip string, userAgent string, time string) error {
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that your account was just signed in to " +
+		"from a new device\n\n" +
+		"TIME: " + time + "\n" +
+		"IP ADDRESS: " + ip + "\n" +
+		"DEVICE: " + userAgent + "\n\n" +
+		"If this was you, you can ignore this email. If it wasn't, please change your password and log out " +
+		"of all devices right away\n\n\n" + footerString
+
+	return email.SendMail(body, to)
+}
+
+// SendTransferEmail notifies a user that a deposit or withdrawal they made with an anchor has
+// completed or failed
+func SendTransferEmail(to string, kind string, amount string, asset string, anchor string,
+	status string, txhash string) error {
+
+	outcome := "has completed"
+	if status != "completed" {
+		outcome = "has failed with status " + status
+	}
+	if amount == "" {
+		amount = "the chosen amount of"
+	}
+	body := "Greetings from the opensolar platform! \n\nWe're writing to let you know that your " + kind +
+		" of " + amount + " " + asset + " with " + anchor + " " + outcome + "\n\n"
+	if txhash != "" {
+		body += "STELLAR TRANSACTION: " + txhash + "\n\n"
+	}
+	body += "You can see all your transfers on the platform\n\n\n" + footerString
+
+	return email.SendMail(body, to)
+}
@@ -3,11 +3,11 @@ package rpc
 import (
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
-	consts "github.com/YaleOpenLab/openx/consts"
 	database "github.com/YaleOpenLab/openx/database"
 )
 
@@ -21,11 +21,28 @@ var AdminRPC = map[int][]string{
 	3:  {"/admin/gennuke", "POST"},                                        // POST
 	5:  {"/admin/platform/all", "GET"},                                    // GET
 	6:  {"/admin/list"},                                                   // GET
-	7:  {"/admin/platform/new", "POST", "name", "code", "timeout"},        // POST
+	7:  {"/admin/platform/new", "POST", "name", "timeout"},                // POST
 	8:  {"/admin/sendmessage", "POST", "subject", "message", "recipient"}, // POST
 	9:  {"/admin/getallusers", "GET"},                                     // GET
 	10: {"/admin/userverify", "POST", "index"},                            // POST
 	11: {"/admin/userunverify", "POST", "index"},                          // POST
+	12: {"/admin/backup", "POST"},                                         // POST
+	13: {"/admin/rotatekey", "POST"},                                      // POST
+	14: {"/admin/audit", "GET"},                                           // GET
+	15: {"/admin/users", "GET"},                                           // GET
+	16: {"/admin/roles", "GET"},                                           // GET
+	17: {"/admin/roles/grant", "POST", "index", "role"},                   // POST
+	18: {"/admin/roles/revoke", "POST", "index", "role"},                  // POST
+	19: {"/admin/ban", "POST", "index"},                                   // POST
+	20: {"/admin/proposals", "GET"},                                       // GET
+	21: {"/admin/proposals/approve", "POST", "index"},                     // POST
+	22: {"/admin/proposals/cancel", "POST", "index"},                      // POST
+	23: {"/admin/platform/rotatekey", "POST", "index"},                    // POST
+	24: {"/admin/platform/revokekey", "POST", "index", "id"},              // POST
+	25: {"/admin/platform/scopes", "POST", "index"},                       // POST
+	26: {"/admin/platform/redirects", "POST", "index", "redirects"},       // POST
+	27: {"/admin/oidc/rotatekey", "POST"},                                 // POST
+	28: {"/admin/logins", "GET"},                                          // GET
 }
 
 // adminHandlers are a list of all the admin handlers defined by openx
@@ -40,20 +57,44 @@ func adminHandlers() {
 	getallUsersAdmin()
 	verifyUser()
 	unverifyUser()
+	backupDatabase()
+	rotateDataKey()
+	queryAudit()
+	queryUsers()
+	listRoles()
+	grantRole()
+	revokeRole()
+	banUser()
+	listProposals()
+	approveProposal()
+	cancelProposal()
+	rotatePlatformKey()
+	revokePlatformKey()
+	setPlatformScopes()
+	setPlatformRedirects()
+	rotateOIDCKey()
+	queryLogins()
+	registerApprovalExecutors()
 }
 
 // KillCode is a code that can immediately shut down the server in case of hacks / crises
 var KillCode string
 
-// validateAdmin validates whether a given user is an admin and returns a bool
-func validateAdmin(w http.ResponseWriter, r *http.Request, options []string, method string) (database.User, bool) {
+// validatePermission validates a user and checks whether one of their roles grants perm
+func validatePermission(w http.ResponseWriter, r *http.Request, options []string, method string, perm string) (database.User, bool) {
 	prepUser, err := userValidateHelper(w, r, options, method)
 	if err != nil {
 		log.Println(err)
 		return prepUser, false
 	}
 
-	if !prepUser.Admin {
+	allowed, err := prepUser.HasPermission(perm)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return prepUser, false
+	}
+
+	if !allowed {
+		log.Println("user: ", prepUser.Index, " does not have permission: ", perm)
 		erpc.ResponseHandler(w, erpc.StatusUnauthorized)
 		return prepUser, false
 	}
@@ -61,36 +102,33 @@ func validateAdmin(w http.ResponseWriter, r *http.Request, options []string, met
 	return prepUser, true
 }
 
-// killServer instantly kills the server. Recovery possible only with server access
+// killServer proposes killing the server. The server is killed once the proposal has been
+// approved. Recovery possible only with server access
 func killServer() {
 	http.HandleFunc(AdminRPC[1][0], func(w http.ResponseWriter, r *http.Request) {
 		log.Println("kill command received")
 		// need to pass the pwhash param here
-		_, adminBool := validateAdmin(w, r, AdminRPC[1][2:], AdminRPC[1][1])
+		admin, adminBool := validatePermission(w, r, AdminRPC[1][2:], AdminRPC[1][1], database.PermKillServer)
 		if !adminBool {
 			return
 		}
 
-		if r.FormValue("username") == "martin" {
-			// only certain admins can access this endpoint, can be compiled at runtime
-			log.Println("Activating kill switch")
-			os.Exit(1)
-		}
+		log.Println("kill switch proposed by admin: ", admin.Index)
+		propose(w, r, admin, database.AuditKillServer, "")
 	})
 }
 
-// freezeServer freezes the server to make all transactions void. The easiest way to do that
-// is to set the Mainnet const to false.
+// freezeServer proposes freezing the server to make all transactions void. The easiest way to
+// do that is to set the Mainnet const to false.
 func freezeServer() {
 	http.HandleFunc(AdminRPC[2][0], func(w http.ResponseWriter, r *http.Request) {
 		// need to pass the pwhash param here
-		_, adminBool := validateAdmin(w, r, []string{}, AdminRPC[2][1])
+		admin, adminBool := validatePermission(w, r, []string{}, AdminRPC[2][1], database.PermFreezeServer)
 		if !adminBool {
 			return
 		}
 
-		consts.SetConsts(false) // runtime const migration
-		log.Println("Server frozen, state reverted to mainnet. Restart server to unfreeze")
+		propose(w, r, admin, database.AuditFreezeServer, "")
 	})
 }
 
@@ -99,27 +137,22 @@ func freezeServer() {
 func genNuclearCode() {
 	http.HandleFunc(AdminRPC[3][0], func(w http.ResponseWriter, r *http.Request) {
 		// need to pass the pwhash param here
-		_, adminBool := validateAdmin(w, r, AdminRPC[3][2:], AdminRPC[3][1])
+		admin, adminBool := validatePermission(w, r, AdminRPC[3][2:], AdminRPC[3][1], database.PermGenKillCode)
 		if !adminBool {
 			return
 		}
 
-		if r.FormValue("username") == "martin" {
-			// only authorized users, can change at compile time
-			log.Println("generating new nuclear code")
-			KillCode = utils.GetRandomString(64)
-			w.Write([]byte(KillCode))
-		} else {
-			erpc.MarshalSend(w, erpc.StatusUnauthorized)
-			return
-		}
+		log.Println("generating new nuclear code")
+		KillCode = utils.GetRandomString(64)
+		auditLog(r, admin, database.AuditGenKillCode, "", "")
+		w.Write([]byte(KillCode))
 	})
 }
 
 // retrieveAllPlatforms retrieves all platforms from the database
 func retrieveAllPlatforms() {
 	http.HandleFunc(AdminRPC[5][0], func(w http.ResponseWriter, r *http.Request) {
-		_, adminBool := validateAdmin(w, r, []string{}, AdminRPC[5][1])
+		_, adminBool := validatePermission(w, r, []string{}, AdminRPC[5][1], database.PermViewPlatforms)
 		if !adminBool {
 			return
 		}
@@ -129,6 +162,10 @@ func retrieveAllPlatforms() {
 			return
 		}
 
+		for i := range pfs {
+			pfs[i] = pfs[i].Redacted()
+		}
+
 		erpc.MarshalSend(w, pfs)
 	})
 }
@@ -153,39 +190,201 @@ func listAllAdmins() {
 
 func addNewPlatform() {
 	http.HandleFunc(AdminRPC[7][0], func(w http.ResponseWriter, r *http.Request) {
-		_, adminBool := validateAdmin(w, r, AdminRPC[7][2:], AdminRPC[7][1])
+		admin, adminBool := validatePermission(w, r, AdminRPC[7][2:], AdminRPC[7][1], database.PermManagePlatforms)
 		if !adminBool {
 			return
 		}
 
-		var err error
 		name := r.FormValue("name")
-		code := r.FormValue("code")
-		timeout := r.FormValue("timeout")
+		timeout := r.FormValue("timeout") != "false"
 
-		if name == "" || code == "" {
-			log.Println("code or desired name empty")
-			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+		pf, secret, err := database.NewPlatform(name, timeout)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
 		}
 
-		if timeout == "false" {
-			err = database.NewPlatform(name, code, false)
-			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		if r.FormValue("scopes") != "" {
+			err = pf.SetScopes(strings.Split(r.FormValue("scopes"), ","))
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
 				return
 			}
-		} else {
-			err = database.NewPlatform(name, code, true)
-			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		}
+
+		auditLog(r, admin, database.AuditNewPlatform, strconv.Itoa(pf.Index), name+" key "+pf.Keys[0].ID)
+		erpc.MarshalSend(w, PlatformKeyResponse{Platform: pf.Index, KeyID: pf.Keys[0].ID, Secret: secret})
+	})
+}
+
+// PlatformKeyResponse is the response to an admin issuing a platform key. The secret is
+// only ever sent in this response
+type PlatformKeyResponse struct {
+	Platform int
+	KeyID    string
+	Secret   string
+}
+
+// rotatePlatformKey issues a new key to a platform. The old keys of the platform stay valid
+// for the number of seconds passed in the optional overlap param
+func rotatePlatformKey() {
+	http.HandleFunc(AdminRPC[23][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[23][2:], AdminRPC[23][1], database.PermManagePlatforms)
+		if !adminBool {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		overlap := database.KeyOverlap
+		if r.FormValue("overlap") != "" {
+			overlap, err = strconv.ParseInt(r.FormValue("overlap"), 10, 64)
+			if err != nil || overlap < 0 {
+				log.Println("invalid overlap: ", r.FormValue("overlap"))
+				erpc.ResponseHandler(w, erpc.StatusBadRequest)
 				return
 			}
 		}
+
+		pf, err := database.RetrievePlatform(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		key, secret, err := pf.RotateKey(overlap)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		auditLog(r, admin, database.AuditRotatePlatformKey, strconv.Itoa(pf.Index), "key "+key.ID)
+		erpc.MarshalSend(w, PlatformKeyResponse{Platform: pf.Index, KeyID: key.ID, Secret: secret})
+	})
+}
+
+// setPlatformScopes replaces the scopes of a platform with the comma separated list passed
+// in the scopes param. An empty list revokes all scopes
+func setPlatformScopes() {
+	http.HandleFunc(AdminRPC[25][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[25][2:], AdminRPC[25][1], database.PermManagePlatforms)
+		if !adminBool {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		var scopes []string
+		if r.FormValue("scopes") != "" {
+			scopes = strings.Split(r.FormValue("scopes"), ",")
+		}
+
+		pf, err := database.RetrievePlatform(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		err = pf.SetScopes(scopes)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		auditLog(r, admin, database.AuditPlatformScopes, strconv.Itoa(pf.Index), strings.Join(pf.Scopes, ","))
+		erpc.MarshalSend(w, pf.Redacted())
+	})
+}
+
+// setPlatformRedirects replaces the OAuth2 redirect uris of a platform with the comma
+// separated list passed in the redirects param. The optional logout param sets the uri the
+// platform is sent back-channel logout tokens at
+func setPlatformRedirects() {
+	http.HandleFunc(AdminRPC[26][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[26][2:], AdminRPC[26][1], database.PermManagePlatforms)
+		if !adminBool {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		pf, err := database.RetrievePlatform(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		err = pf.SetRedirectURIs(strings.Split(r.FormValue("redirects"), ","))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		if _, exists := r.Form["logout"]; exists {
+			err = pf.SetLogoutURI(r.FormValue("logout"))
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+
+		auditLog(r, admin, database.AuditPlatformRedirects, strconv.Itoa(pf.Index), r.FormValue("redirects"))
+		erpc.MarshalSend(w, pf.Redacted())
+	})
+}
+
+// rotateOIDCKey rotates the key ID tokens are signed with. The old key stays in the JWKS
+// until tokens signed with it have expired
+func rotateOIDCKey() {
+	http.HandleFunc(AdminRPC[27][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[27][2:], AdminRPC[27][1], database.PermRotateKeys)
+		if !adminBool {
+			return
+		}
+
+		key, err := database.RotateOIDCKey()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		auditLog(r, admin, database.AuditRotateOIDCKey, key.ID, "")
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// revokePlatformKey revokes a key of a platform immediately
+func revokePlatformKey() {
+	http.HandleFunc(AdminRPC[24][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[24][2:], AdminRPC[24][1], database.PermManagePlatforms)
+		if !adminBool {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		id := r.FormValue("id")
+
+		pf, err := database.RetrievePlatform(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		err = pf.RevokeKey(id)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		auditLog(r, admin, database.AuditRevokePlatformKey, strconv.Itoa(pf.Index), "key "+id)
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
 
 func sendNewMessage() {
 	http.HandleFunc(AdminRPC[8][0], func(w http.ResponseWriter, r *http.Request) {
-		_, adminBool := validateAdmin(w, r, AdminRPC[8][2:], AdminRPC[8][1])
+		admin, adminBool := validatePermission(w, r, AdminRPC[8][2:], AdminRPC[8][1], database.PermMessageUsers)
 		if !adminBool {
 			return
 		}
@@ -218,6 +417,8 @@ func sendNewMessage() {
 			return
 		}
 
+		auditLog(r, admin, database.AuditSendMessage, strconv.Itoa(user.Index), subject)
+
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -228,7 +429,7 @@ type getUsersAdmin struct {
 
 func getallUsersAdmin() {
 	http.HandleFunc(AdminRPC[9][0], func(w http.ResponseWriter, r *http.Request) {
-		_, adminBool := validateAdmin(w, r, AdminRPC[9][2:], AdminRPC[9][1])
+		_, adminBool := validatePermission(w, r, AdminRPC[9][2:], AdminRPC[9][1], database.PermViewUsers)
 		if !adminBool {
 			return
 		}
@@ -245,9 +446,34 @@ func getallUsersAdmin() {
 	})
 }
 
+// verifyUser proposes marking a user as verified
 func verifyUser() {
 	http.HandleFunc(AdminRPC[10][0], func(w http.ResponseWriter, r *http.Request) {
-		admin, adminBool := validateAdmin(w, r, AdminRPC[10][2:], AdminRPC[10][1])
+		admin, adminBool := validatePermission(w, r, AdminRPC[10][2:], AdminRPC[10][1], database.PermVerifyUsers)
+		if !adminBool {
+			return
+		}
+
+		indexS := r.FormValue("index")
+
+		index, err := utils.ToInt(indexS)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		_, err = database.RetrieveUser(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		propose(w, r, admin, database.AuditVerifyUser, indexS)
+	})
+}
+
+// unverifyUser proposes removing the verified mark of a user
+func unverifyUser() {
+	http.HandleFunc(AdminRPC[11][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[11][2:], AdminRPC[11][1], database.PermVerifyUsers)
 		if !adminBool {
 			return
 		}
@@ -255,56 +481,282 @@ func verifyUser() {
 		indexS := r.FormValue("index")
 
 		index, err := utils.ToInt(indexS)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		_, err = database.RetrieveUser(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		propose(w, r, admin, database.AuditUnverifyUser, indexS)
+	})
+}
+
+// backupDatabase streams a consistent snapshot of the database. The snapshot is encrypted if
+// the optional passphrase param is passed
+func backupDatabase() {
+	http.HandleFunc(AdminRPC[12][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[12][2:], AdminRPC[12][1], database.PermBackup)
+		if !adminBool {
+			return
+		}
+
+		log.Println("database snapshot requested by admin: ", admin.Index)
+		auditLog(r, admin, database.AuditBackup, "", "")
+		filename := "openx-" + strconv.FormatInt(utils.Unix(), 10) + ".snap"
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+
+		// the status has already been sent once we start streaming, so errors can only be logged
+		err := database.WriteSnapshot(w, r.FormValue("passphrase"))
+		if err != nil {
+			log.Println("error while writing database snapshot: ", err)
+		}
+	})
+}
+
+// rotateDataKey creates a new data key for encrypting sensitive user data and reencrypts
+// existing users with it in the background
+func rotateDataKey() {
+	http.HandleFunc(AdminRPC[13][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[13][2:], AdminRPC[13][1], database.PermRotateKeys)
+		if !adminBool {
+			return
+		}
+
+		log.Println("data key rotation requested by admin: ", admin.Index)
+		id, err := database.RotateDataKey()
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
-		user, err := database.RetrieveUser(index)
+		auditLog(r, admin, database.AuditRotateKey, "datakey", strconv.Itoa(id))
+
+		go func() {
+			count, err := database.ReencryptUsers()
+			if err != nil {
+				log.Println("error while reencrypting users: ", err)
+				return
+			}
+			log.Println("reencrypted users with new data key: ", count)
+		}()
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// queryAudit returns entries from the audit log, latest first. The optional actor, action,
+// target, since, until and limit params filter the returned entries
+func queryAudit() {
+	http.HandleFunc(AdminRPC[14][0], func(w http.ResponseWriter, r *http.Request) {
+		_, adminBool := validatePermission(w, r, AdminRPC[14][2:], AdminRPC[14][1], database.PermViewAudit)
+		if !adminBool {
+			return
+		}
+
+		var filter database.AuditFilter
+		var err error
+		query := r.URL.Query()
+
+		filter.Action = query.Get("action")
+		filter.Target = query.Get("target")
+
+		if query.Get("actor") != "" {
+			filter.Actor, err = utils.ToInt(query.Get("actor"))
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+		if query.Get("since") != "" {
+			filter.Since, err = strconv.ParseInt(query.Get("since"), 10, 64)
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+		if query.Get("until") != "" {
+			filter.Until, err = strconv.ParseInt(query.Get("until"), 10, 64)
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+		if query.Get("limit") != "" {
+			filter.Limit, err = utils.ToInt(query.Get("limit"))
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+
+		entries, err := database.QueryAudit(filter)
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
-		user.Verified = true
-		user.VerifiedBy = admin.Index
-		user.VerifiedTime = utils.Timestamp()
+		erpc.MarshalSend(w, entries)
+	})
+}
+
+// parseBoolFilter parses an optional boolean query param
+func parseBoolFilter(r *http.Request, param string) (*bool, error) {
+	x := r.URL.Query().Get(param)
+	if x == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(x)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
 
-		err = user.Save()
+type queryUsersResponse struct {
+	Users []database.UserSummary
+	Next  string
+	Total int
+}
+
+// queryUsers returns a page of sanitized users. The optional kyc, verified, banned, role,
+// country, after, before and search params filter the returned users, sort and order (asc or
+// desc) sort them and cursor and limit paginate through them
+func queryUsers() {
+	http.HandleFunc(AdminRPC[15][0], func(w http.ResponseWriter, r *http.Request) {
+		_, adminBool := validatePermission(w, r, AdminRPC[15][2:], AdminRPC[15][1], database.PermViewUsers)
+		if !adminBool {
+			return
+		}
+
+		var q database.UserQuery
+		var err error
+		query := r.URL.Query()
+
+		q.Kyc, err = parseBoolFilter(r, "kyc")
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+		q.Verified, err = parseBoolFilter(r, "verified")
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+		q.Banned, err = parseBoolFilter(r, "banned")
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+		q.Role = query.Get("role")
+		q.Country = query.Get("country")
+		q.Search = query.Get("search")
+		q.SortBy = query.Get("sort")
+		q.Cursor = query.Get("cursor")
+
+		switch query.Get("order") {
+		case "", "asc":
+		case "desc":
+			q.Descending = true
+		default:
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
+
+		if query.Get("after") != "" {
+			q.SignedUpAfter, err = strconv.ParseInt(query.Get("after"), 10, 64)
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+		if query.Get("before") != "" {
+			q.SignedUpBefore, err = strconv.ParseInt(query.Get("before"), 10, 64)
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+		if query.Get("limit") != "" {
+			q.Limit, err = utils.ToInt(query.Get("limit"))
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+
+		page, err := database.QueryUsers(q)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		var x queryUsersResponse
+		x.Users = database.Summaries(page.Users)
+		x.Next = page.Next
+		x.Total = page.Total
+
+		erpc.MarshalSend(w, x)
+	})
+}
+
+// listRoles lists the roles that can be granted along with their permissions
+func listRoles() {
+	http.HandleFunc(AdminRPC[16][0], func(w http.ResponseWriter, r *http.Request) {
+		_, adminBool := validatePermission(w, r, AdminRPC[16][2:], AdminRPC[16][1], database.PermManageRoles)
+		if !adminBool {
+			return
+		}
+
+		roles, err := database.RetrieveRoles()
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
-		erpc.ResponseHandler(w, erpc.StatusOK)
+		erpc.MarshalSend(w, roles)
 	})
 }
 
-func unverifyUser() {
-	http.HandleFunc(AdminRPC[11][0], func(w http.ResponseWriter, r *http.Request) {
-		admin, adminBool := validateAdmin(w, r, AdminRPC[11][2:], AdminRPC[11][1])
+// grantRole grants a role to the user with the passed index
+func grantRole() {
+	http.HandleFunc(AdminRPC[17][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[17][2:], AdminRPC[17][1], database.PermManageRoles)
 		if !adminBool {
 			return
 		}
 
 		indexS := r.FormValue("index")
+		role := r.FormValue("role")
 
 		index, err := utils.ToInt(indexS)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
-		user, err := database.RetrieveUser(index)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		err = database.GrantRole(index, role)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
-		user.Verified = false
-		user.VerifiedBy = admin.Index
-		user.VerifiedTime = utils.Timestamp()
+		auditLog(r, admin, database.AuditGrantRole, indexS, role)
 
-		err = user.Save()
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// revokeRole revokes a role from the user with the passed index
+func revokeRole() {
+	http.HandleFunc(AdminRPC[18][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[18][2:], AdminRPC[18][1], database.PermManageRoles)
+		if !adminBool {
+			return
+		}
+
+		indexS := r.FormValue("index")
+		role := r.FormValue("role")
+
+		index, err := utils.ToInt(indexS)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		err = database.RevokeRole(index, role)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
+		auditLog(r, admin, database.AuditRevokeRole, indexS, role)
+
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -1,304 +1,367 @@
 package rpc
 
 import (
-	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"strings"
 
+	"github.com/pkg/errors"
+
 	erpc "github.com/Varunram/essentials/rpc"
-	consts "github.com/YaleOpenLab/openx/consts"
+	utils "github.com/Varunram/essentials/utils"
+	anchor "github.com/YaleOpenLab/openx/anchor"
+	database "github.com/YaleOpenLab/openx/database"
 )
 
 // AnchorRPC is a collection of all Anchor RPC endpoints and their required params
 var AnchorRPC = map[int][]string{
-	1: {"/user/anchorusd/deposit/intent", "GET"},  // GET
-	2: {"/user/anchorusd/deposit/kyc", "GET"},     // GET
-	3: {"/user/anchorusd/withdraw/intent", "GET"}, // GET
-	4: {"/user/anchorusd/withdraw/kyc", "GET"},    // GET
-	5: {"/user/anchorusd/kycinfo", "GET"},         // GET
-	6: {"/user/anchorusd/kyc/register", "POST"},   // POST
+	0: {"/user/anchors", "GET"},                                         // GET
+	1: {"/user/anchor/deposit", "POST", "anchor", "asset", "seedpwd"},   // POST
+	2: {"/user/anchor/withdraw", "POST", "anchor", "asset", "seedpwd"},  // POST
+	3: {"/user/anchor/transaction", "POST", "anchor", "id", "protocol"}, // POST
+	4: {"/user/anchor/transfers", "GET"},                                // GET
+	5: {"/user/anchor/transfers/refresh", "POST", "seedpwd"},            // POST
 }
 
-// When a user wants to procure or deal with AnchorUSD, there are a couple things that they need to do:
-// 1. Deposit Funds and get AnchorUSD:
-// 1a. Create a deposit intent - this wouuld be returned with a 403 since the user has not
-// gone through Anchor's KYC process
-// 1b. Verify KYC - need to pass relevant parameters to Anchor so they can verfiy from their
-// end that the user who wants stablecoin is not sanctioned or something
-// 1c. Deposit funds to the relevant bank address sent to the email address of the user.
-// AnchorUSD verifies this and deposits AnchorUSD after 2/3 business days.
-// 1d. After this, the user heads back to the platform and invests in the platform using the
-// AnchorUSD associated with his account
-// 2. Withdraw funds denominated in AnchorUSD
-// 2a. Create Withdraw intent - returns the identifier / an error if the user hasn't gone through KYC
-// 2b. Go through KYC / Withdraw funds - this again takes 2 or 3 business days for AnchorUSD
-// to deposit or withdraw funds.
-// there are a couple problems with automation in between since there's a delay of 2/3 days with
-// each associated fiat operation.
-
-// setupAnchorHandlers sets up all anchorUSD related endpoints
+// Users deposit fiat with an anchor to get tokens on Stellar that they can invest with, and
+// withdraw tokens back to fiat. openx logs users in with the anchor over SEP-10 by signing
+// the anchor's challenge with their seed and then either:
+// 1. starts an interactive SEP-24 transfer, where the user follows the returned url to the
+// anchor's web flow that collects KYC information, the amount and bank details, or
+// 2. requests a programmatic SEP-6 transfer and returns the anchor's instructions. If the
+// anchor needs KYC information, the information users stored with openx (UserRPC 30) is sent
+// to it over SEP-12 and the transfer is retried once.
+// Fiat transfers take a couple business days. Started transfers are recorded and polled until
+// they're done (see transfers.go), users can list them with AnchorRPC 4
+
+// setupAnchorHandlers sets up all anchor related endpoints
 func setupAnchorHandlers() {
-	intentDeposit()
-	kycDeposit()
-	intentWithdraw()
-	kycWithdraw()
+	http.HandleFunc(AnchorRPC[0][0], listAnchors)
+	http.HandleFunc(AnchorRPC[1][0], anchorDeposit)
+	http.HandleFunc(AnchorRPC[2][0], anchorWithdraw)
+	http.HandleFunc(AnchorRPC[3][0], anchorTransaction)
+	http.HandleFunc(AnchorRPC[4][0], listTransfers)
+	http.HandleFunc(AnchorRPC[5][0], refreshTransfers)
 }
 
-// AnchorIntentResponse defines the intent response struct for AnchorUSD
-type AnchorIntentResponse struct {
-	Type       string `json:"type"`
-	URL        string `json:"url"`
-	Identifier string `json:"identifier"`
+// AnchorSummary describes an anchor users can transfer with
+type AnchorSummary struct {
+	HomeDomain string
+	Currencies []anchor.Currency
+	SEP6       bool
+	SEP24      bool
 }
 
-// kycDepositResponse defines the kyc response st ruct for AnchorUSD
-type kycDepositResponse struct {
-	Error  string
-	Result string
-	URL    string
+// AnchorTransferResponse is returned when a deposit or withdrawal has been started. URL is
+// the web flow of SEP-24 transfers, Deposit and Withdraw are the instructions of SEP-6 ones.
+// If the anchor needs more information about the user, CustomerInfo says what and no transfer
+// has been started
+type AnchorTransferResponse struct {
+	Anchor       string
+	Protocol     string
+	ID           string
+	URL          string                       `json:",omitempty"`
+	Deposit      *anchor.DepositInstructions  `json:",omitempty"`
+	Withdraw     *anchor.WithdrawInstructions `json:",omitempty"`
+	CustomerInfo *anchor.CustomerInfoNeeded   `json:",omitempty"`
 }
 
-// GetAndReturnIdentifier is a handler that makes a get request and returns json data
-func GetAndReturnIdentifier(w http.ResponseWriter, r *http.Request, body string) (AnchorIntentResponse, error) {
-	var x AnchorIntentResponse
-	data, err := erpc.GetRequest(body)
+// listAnchors lists the anchors users can transfer with. Anchors whose stellar.toml can't be
+// fetched are left out
+func listAnchors(w http.ResponseWriter, r *http.Request) {
+	_, err := userValidateHelper(w, r, AnchorRPC[0][2:], AnchorRPC[0][1])
 	if err != nil {
-		log.Println("did not get response", err)
-		return x, err
+		return
 	}
-	// now data is in byte, we need the other structure now
-	err = json.Unmarshal(data, &x)
-	if err != nil {
-		log.Println("did not unmarshal json", err)
-		return x, err
+
+	anchors := make([]AnchorSummary, 0)
+	for _, domain := range anchor.List() {
+		client, err := anchor.Get(domain)
+		if err != nil {
+			continue
+		}
+		info, err := client.Info()
+		if err != nil {
+			log.Println("could not fetch stellar.toml of anchor", domain, err)
+			continue
+		}
+		anchors = append(anchors, AnchorSummary{
+			HomeDomain: domain,
+			Currencies: info.Currencies,
+			SEP6:       info.TransferServer != "",
+			SEP24:      info.TransferServerSep24 != "",
+		})
 	}
-	return x, nil
+
+	erpc.MarshalSend(w, anchors)
 }
 
-// PostAndSend is a handler that POSTs data and returns the response
-func PostAndSend(w http.ResponseWriter, r *http.Request, body string, payload io.Reader) {
-	data, err := erpc.PostRequest(body, payload)
-	if erpc.Err(w, err, erpc.StatusBadRequest, "did not receive success response") {
-		return
+// anchorAuth logs the user in with the anchor by signing its SEP-10 challenge with the user's seed
+func anchorAuth(client *anchor.Client, user *database.User, seedpwd string) (anchor.Token, error) {
+	return client.Auth(user.StellarWallet.PublicKey, func(txe string) (string, error) {
+		return user.SignTx(seedpwd, txe)
+	})
+}
+
+// customerFields returns the SEP-9 fields of the KYC information the user stored with openx
+func customerFields(user *database.User) map[string]string {
+	kyc := user.AnchorKYC
+	fields := map[string]string{
+		"email_address":        user.Email,
+		"tax_id":               kyc.Tax.ID,
+		"address":              kyc.Address.Street,
+		"city":                 kyc.Address.City,
+		"postal_code":          kyc.Address.Postal,
+		"state_or_province":    kyc.Address.Region,
+		"address_country_code": kyc.Address.Country,
+		"mobile_number":        kyc.PrimaryPhone,
+		"sex":                  kyc.Gender,
 	}
-	var x kycDepositResponse
-	err = json.Unmarshal(data, &x)
-	if erpc.Err(w, err, erpc.StatusInternalServerError, "did not unmarshal json") {
-		return
+	if names := strings.Fields(kyc.Name); len(names) != 0 {
+		fields["first_name"] = names[0]
+		fields["last_name"] = strings.Join(names[1:], " ")
 	}
-	erpc.MarshalSend(w, x)
+	year, yErr := utils.ToInt(kyc.Birthday.Year)
+	month, mErr := utils.ToInt(kyc.Birthday.Month)
+	day, dErr := utils.ToInt(kyc.Birthday.Day)
+	if yErr == nil && mErr == nil && dErr == nil {
+		fields["birth_date"] = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	}
+	return fields
 }
 
-// intentDeposit creates an intent to deposit funds in order to fetch AnchorUSD
-func intentDeposit() {
-	// curl 'https://sandbox-api.anchorusd.com/transfer/deposit?account=GBP3XOFYC6TWUIRZAB7MB6MTUZBCREAYB4E7XKE3OWDP75VU5JB74ZF6&asset_code=USD&email_address=j%40anchorusd.com
-	http.HandleFunc(AnchorRPC[1][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, AnchorRPC[1][2:], AnchorRPC[1][1])
-		if err != nil {
-			return
-		}
+// sendCustomerInfo sends the fields the anchor asked for over SEP-12. It returns false if the
+// user hasn't stored all of them with openx
+func sendCustomerInfo(client *anchor.Client, token anchor.Token, user *database.User,
+	needed *anchor.CustomerInfoNeeded) (bool, error) {
 
-		body := consts.AnchorAPI + "transfer/deposit?account=" + prepUser.StellarWallet.PublicKey +
-			"&asset_code=USD&email_address=" + prepUser.Email
-		x, err := GetAndReturnIdentifier(w, r, body) // we could return the identifier and save it if we have to. But the user has to click through anyawy and we could call the other endpoint from the frontend, so would need to discuss before we do that here
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
+	if needed.Type != "non_interactive_customer_info_needed" {
+		return false, nil
+	}
+	fields := customerFields(user)
+	for _, field := range needed.Fields {
+		if fields[field] == "" {
+			return false, nil
 		}
+	}
+	err := client.PutCustomer(token.Value, user.StellarWallet.PublicKey, fields)
+	if err != nil {
+		return false, errors.Wrap(err, "could not send customer info to anchor")
+	}
+	return true, nil
+}
 
-		prepUser.AnchorKYC.DepositIdentifier = x.Identifier
-		prepUser.AnchorKYC.URL = x.URL
-		err = prepUser.Save()
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
+// sep6Transfer makes a SEP-6 transfer and retries it once with the KYC information the user
+// stored with openx if the anchor asks for it. It returns false if the transfer wasn't made and
+// a response has been sent
+func sep6Transfer(w http.ResponseWriter, client *anchor.Client, token anchor.Token, user *database.User,
+	x *AnchorTransferResponse, transfer func() error) bool {
+
+	err := transfer()
+	if needed, ok := err.(*anchor.CustomerInfoNeeded); ok {
+		sent, kycErr := sendCustomerInfo(client, token, user, needed)
+		if erpc.Err(w, kycErr, erpc.StatusBadGateway) {
+			return false
 		}
+		if sent {
+			err = transfer()
+		}
+	}
 
+	if needed, ok := err.(*anchor.CustomerInfoNeeded); ok {
+		x.CustomerInfo = needed
 		erpc.MarshalSend(w, x)
-	})
+		return false
+	}
+	return !erpc.Err(w, err, erpc.StatusBadGateway)
 }
 
-// kycDeposit is the kyc workflow involved when a user wants to obtain AnchorUSD
-func kycDeposit() {
-	http.HandleFunc(AnchorRPC[2][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, AnchorRPC[2][2:], AnchorRPC[2][1])
-		if err != nil {
-			return
-		}
+// transferParams validates the params of a transfer and logs the user in with the anchor
+func transferParams(w http.ResponseWriter, r *http.Request, options []string,
+	method string) (database.User, *anchor.Client, anchor.Token, string, anchor.TransferRequest, error) {
 
-		body := consts.AnchorAPI + "api/register"
-		data := url.Values{}
-		data.Set("identifier", prepUser.AnchorKYC.DepositIdentifier)
-		data.Set("name", prepUser.AnchorKYC.Name)
-		data.Set("birthday[month]", prepUser.AnchorKYC.Birthday.Month)
-		data.Set("birthday[day]", prepUser.AnchorKYC.Birthday.Day)
-		data.Set("birthday[year]", prepUser.AnchorKYC.Birthday.Year)
-		data.Set("tax-country", prepUser.AnchorKYC.Tax.Country)
-		data.Set("tax-id-number", prepUser.AnchorKYC.Tax.ID)
-		data.Set("address[street-1]", prepUser.AnchorKYC.Address.Street)
-		data.Set("address[city]", prepUser.AnchorKYC.Address.City)
-		data.Set("address[postal-code]", prepUser.AnchorKYC.Address.Postal)
-		data.Set("address[region]", prepUser.AnchorKYC.Address.Region)
-		data.Set("address[country]", prepUser.AnchorKYC.Address.Country)
-		data.Set("primary-phone-number", prepUser.AnchorKYC.PrimaryPhone)
-		data.Set("gender", prepUser.AnchorKYC.Gender)
-
-		payload := strings.NewReader(data.Encode())
-		PostAndSend(w, r, body, payload)
-	})
-}
-
-// intentWithdraw creates an intent to withdraw funds from AnchorUSD
-func intentWithdraw() {
-	// curl 'https://sandbox-api.anchorusd.com/transfer/withdraw?type=bank_account&asset_code=USD&email_address=j%40anchorusd.com
-	http.HandleFunc(AnchorRPC[3][0], func(w http.ResponseWriter, r *http.Request) {
-		// the withdraw endpoint doesn't return an identifier and we'd have to parse some stuff ourselves. Ugly hack and we shouldn't really have to do this, should be fixed by Anchor
-		prepUser, err := userValidateHelper(w, r, AnchorRPC[3][2:], AnchorRPC[3][1])
-		if err != nil {
-			return
-		}
+	var req anchor.TransferRequest
+	var token anchor.Token
+	user, err := userValidateHelper(w, r, options, method)
+	if err != nil {
+		return user, nil, token, "", req, err
+	}
 
-		// amount can be chosen by the user in the flow on anchor, so no need to handle that here
-		body := consts.AnchorAPI + "transfer/withdraw?type=bank_account&asset_code=USD&account=" + prepUser.StellarWallet.PublicKey +
-			"&email_address=" + prepUser.Email
+	client, err := anchor.Get(r.FormValue("anchor"))
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return user, nil, token, "", req, err
+	}
+	info, err := client.Info()
+	if erpc.Err(w, err, erpc.StatusBadGateway) {
+		return user, nil, token, "", req, err
+	}
 
-		x, err := GetAndReturnIdentifier(w, r, body) // we could return the identifier and save it if we have to. But the user has to click through anyawy and we could call the other endpoint from the frontend, so would need to discuss before we do that here
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
+	// transfers are interactive unless the anchor only supports SEP-6 or SEP-6 is asked for
+	protocol := r.FormValue("protocol")
+	if protocol == "" {
+		protocol = anchor.SEP24
+		if info.TransferServerSep24 == "" {
+			protocol = anchor.SEP6
 		}
+	}
+	if protocol != anchor.SEP6 && protocol != anchor.SEP24 {
+		err = errors.New("unknown protocol " + protocol)
+		erpc.Err(w, err, erpc.StatusBadRequest)
+		return user, nil, token, "", req, err
+	}
 
-		prepUser.AnchorKYC.WithdrawIdentifier = x.Identifier
-		prepUser.AnchorKYC.URL = x.URL
-		err = prepUser.Save()
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
-		}
+	_, err = client.Currency(r.FormValue("asset"))
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return user, nil, token, "", req, err
+	}
 
-		erpc.MarshalSend(w, x)
-	})
+	token, err = anchorAuth(client, &user, r.FormValue("seedpwd"))
+	if erpc.Err(w, err, erpc.StatusUnauthorized, "could not log in with anchor") {
+		return user, nil, token, "", req, err
+	}
+
+	req = anchor.TransferRequest{
+		AssetCode: r.FormValue("asset"),
+		Account:   user.StellarWallet.PublicKey,
+		Amount:    r.FormValue("amount"),
+		Email:     user.Email,
+		Type:      r.FormValue("type"),
+		Dest:      r.FormValue("dest"),
+		DestExtra: r.FormValue("destextra"),
+	}
+	return user, client, token, protocol, req, nil
 }
 
-// kycDeposit is the kyc workflow involved when a user wants to withdraw fiat
-func kycWithdraw() {
-	http.HandleFunc(AnchorRPC[4][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, AnchorRPC[4][2:], AnchorRPC[4][1])
-		if err != nil {
+// anchorDeposit starts a deposit of fiat with an anchor. Optional params are amount and
+// protocol, which is sep24 (interactive) by default if the anchor supports it
+func anchorDeposit(w http.ResponseWriter, r *http.Request) {
+	user, client, token, protocol, req, err := transferParams(w, r, AnchorRPC[1][2:], AnchorRPC[1][1])
+	if err != nil {
+		return
+	}
+
+	x := AnchorTransferResponse{Anchor: client.HomeDomain, Protocol: protocol}
+	if protocol == anchor.SEP24 {
+		flow, err := client.DepositInteractive(token.Value, req)
+		if erpc.Err(w, err, erpc.StatusBadGateway) {
 			return
 		}
-
-		body := consts.AnchorAPI + "api/register"
-		data := url.Values{}
-		if !prepUser.Kyc {
-			// we need to call the register KYC first before heading directly to withdrawals
-			data.Set("identifier", prepUser.AnchorKYC.DepositIdentifier)
-			data.Set("name", prepUser.AnchorKYC.Name)
-			data.Set("birthday[month]", prepUser.AnchorKYC.Birthday.Month)
-			data.Set("birthday[day]", prepUser.AnchorKYC.Birthday.Day)
-			data.Set("birthday[year]", prepUser.AnchorKYC.Birthday.Year)
-			data.Set("tax-country", prepUser.AnchorKYC.Tax.Country)
-			data.Set("tax-id-number", prepUser.AnchorKYC.Tax.ID)
-			data.Set("address[street-1]", prepUser.AnchorKYC.Address.Street)
-			data.Set("address[city]", prepUser.AnchorKYC.Address.City)
-			data.Set("address[postal-code]", prepUser.AnchorKYC.Address.Postal)
-			data.Set("address[region]", prepUser.AnchorKYC.Address.Region)
-			data.Set("address[country]", prepUser.AnchorKYC.Address.Country)
-			data.Set("primary-phone-number", prepUser.AnchorKYC.PrimaryPhone)
-			data.Set("gender", prepUser.AnchorKYC.Gender)
-		} else {
-			// user has already done kyc while depositing or while signing up, no need for us to do anything here
-			data.Set("identifier", prepUser.AnchorKYC.WithdrawIdentifier)
+		x.ID, x.URL = flow.ID, flow.URL
+	} else {
+		var instructions anchor.DepositInstructions
+		if !sep6Transfer(w, client, token, &user, &x, func() (err error) {
+			instructions, err = client.Deposit(token.Value, req)
+			return err
+		}) {
+			return
 		}
-		payload := strings.NewReader(data.Encode())
-		PostAndSend(w, r, body, payload)
-		// after this, the workflow will be handled by Anchor's KYC and withdrawal system
-	})
-}
+		x.ID, x.Deposit = instructions.ID, &instructions
+	}
+
+	err = recordTransfer(user, client, token, protocol, anchor.Deposit, req, x.ID)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return
+	}
 
-type kycReturn struct {
-	AccountID string `json:"account_id"`
-	KycStatus string `json:"kyc_status`
+	erpc.MarshalSend(w, x)
 }
 
-// getKycStatus gets the status of a user's verification in AnchorUSD
-func getKycStatus() {
-	http.HandleFunc(AnchorRPC[5][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, AnchorRPC[5][2:], AnchorRPC[5][1])
-		if err != nil {
+// anchorWithdraw starts a withdrawal of tokens to fiat with an anchor. Optional params are
+// amount and protocol, which is sep24 (interactive) by default if the anchor supports it.
+// SEP-6 withdrawals need type, dest and optionally destextra to say where funds are paid out to
+func anchorWithdraw(w http.ResponseWriter, r *http.Request) {
+	user, client, token, protocol, req, err := transferParams(w, r, AnchorRPC[2][2:], AnchorRPC[2][1])
+	if err != nil {
+		return
+	}
+
+	x := AnchorTransferResponse{Anchor: client.HomeDomain, Protocol: protocol}
+	if protocol == anchor.SEP24 {
+		flow, err := client.WithdrawInteractive(token.Value, req)
+		if erpc.Err(w, err, erpc.StatusBadGateway) {
 			return
 		}
-
-		body := consts.AnchorAPI + "api/accounts/" + prepUser.AnchorKYC.AccountID + "/kyc"
-
-		data, err := erpc.GetRequest(body)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		x.ID, x.URL = flow.ID, flow.URL
+	} else {
+		if req.Type == "" || req.Dest == "" {
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, "type and dest are required for SEP-6 withdrawals")
 			return
 		}
-
-		var ret kycReturn
-		err = json.Unmarshal(data, &ret)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		var instructions anchor.WithdrawInstructions
+		if !sep6Transfer(w, client, token, &user, &x, func() (err error) {
+			instructions, err = client.Withdraw(token.Value, req)
+			return err
+		}) {
 			return
 		}
+		x.ID, x.Withdraw = instructions.ID, &instructions
+	}
 
-		switch ret.KycStatus {
-		case "passed":
-			erpc.ResponseHandler(w, erpc.StatusOK)
-		default:
-			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
-		}
+	err = recordTransfer(user, client, token, protocol, anchor.Withdrawal, req, x.ID)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return
+	}
 
-	})
+	erpc.MarshalSend(w, x)
 }
 
-type kycR struct {
-	URL       string `json:"url"`
-	AccountID string `json:"account_id"`
-}
+// anchorTransaction returns the status of a transfer as reported by the anchor and records it.
+// Recorded transfers are looked up with the token they are polled with while it hasn't expired,
+// the seedpwd is only needed to log in with the anchor again otherwise. The new token then
+// replaces the expired one so that the transfer is polled further
+func anchorTransaction(w http.ResponseWriter, r *http.Request) {
+	user, err := userValidateHelper(w, r, AnchorRPC[3][2:], AnchorRPC[3][1])
+	if err != nil {
+		return
+	}
 
-// kycRegister is used to register for KYC on AnchorUSD's platform
-func kycRegister() {
-	http.HandleFunc(AnchorRPC[6][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, AnchorRPC[6][2:], AnchorRPC[6][1])
-		if err != nil {
+	client, err := anchor.Get(r.FormValue("anchor"))
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return
+	}
+
+	t, err := database.RetrieveTransfer(user.Index, client.HomeDomain, r.FormValue("id"))
+	recorded := err == nil
+
+	var token string
+	if recorded {
+		token, err = t.PollToken()
+		if err != nil || (anchor.Token{Value: token, Expiry: t.TokenExpiry}).Expired(utils.Unix()) {
+			token = ""
+		}
+	}
+	if token == "" {
+		if r.FormValue("seedpwd") == "" {
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, "seedpwd required to log in with anchor")
 			return
 		}
-
-		body := consts.AnchorAPI + "api/register"
-		data := url.Values{}
-		data.Set("identifier", prepUser.AnchorKYC.DepositIdentifier)
-		data.Set("name", prepUser.AnchorKYC.Name)
-		data.Set("birthday[month]", prepUser.AnchorKYC.Birthday.Month)
-		data.Set("birthday[day]", prepUser.AnchorKYC.Birthday.Day)
-		data.Set("birthday[year]", prepUser.AnchorKYC.Birthday.Year)
-		data.Set("tax-country", prepUser.AnchorKYC.Tax.Country)
-		data.Set("tax-id-number", prepUser.AnchorKYC.Tax.ID)
-		data.Set("address[street-1]", prepUser.AnchorKYC.Address.Street)
-		data.Set("address[city]", prepUser.AnchorKYC.Address.City)
-		data.Set("address[postal-code]", prepUser.AnchorKYC.Address.Postal)
-		data.Set("address[region]", prepUser.AnchorKYC.Address.Region)
-		data.Set("address[country]", prepUser.AnchorKYC.Address.Country)
-		data.Set("primary-phone-number", prepUser.AnchorKYC.PrimaryPhone)
-		data.Set("gender", prepUser.AnchorKYC.Gender)
-
-		payload := strings.NewReader(data.Encode())
-		retdata, err := erpc.PostRequest(body, payload)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		x, err := anchorAuth(client, &user, r.FormValue("seedpwd"))
+		if erpc.Err(w, err, erpc.StatusUnauthorized, "could not log in with anchor") {
 			return
 		}
+		token = x.Value
 
-		var ret kycR
-		err = json.Unmarshal(retdata, &ret)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
+		if recorded {
+			err = setTransferToken(&t, x)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
 		}
+	}
 
-		prepUser.AnchorKYC.AccountID = ret.AccountID
-		err = prepUser.Save()
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
+	tx, err := client.Transaction(token, r.FormValue("protocol"), r.FormValue("id"))
+	if erpc.Err(w, err, erpc.StatusBadGateway) {
+		return
+	}
+
+	// keep the recorded transfer up to date
+	if recorded {
+		err = updateTransfer(&t, tx)
+		if err != nil {
+			log.Println("could not update transfer: ", err)
 		}
+	}
 
-		erpc.MarshalSend(w, ret)
-	})
+	erpc.MarshalSend(w, tx)
 }
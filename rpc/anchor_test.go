@@ -1,100 +1,270 @@
-// +build all anchor
+// +build all travis
 
 package rpc
 
 import (
 	"encoding/json"
-	"log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 
-	xlm "github.com/Varunram/essentials/xlm"
+	utils "github.com/Varunram/essentials/utils"
+	anchor "github.com/YaleOpenLab/openx/anchor"
+	anchortest "github.com/YaleOpenLab/openx/anchor/anchortest"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+	signer "github.com/YaleOpenLab/openx/signer"
 )
 
+// postTransfer sends a transfer request to the passed anchor handler
+func postTransfer(handler http.HandlerFunc, route string, form url.Values) (*httptest.ResponseRecorder, AnchorTransferResponse) {
+	r := httptest.NewRequest("POST", route, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	var x AnchorTransferResponse
+	json.Unmarshal(w.Body.Bytes(), &x)
+	return w, x
+}
+
 func TestAnchorEndpoints(t *testing.T) {
-	_, pubkey, err := xlm.GetKeyPair()
+	consts.SetConsts(false)
+	database.SetStore(database.NewMemoryStore())
+	defer database.SetStore(database.NewBoltStore(""))
+	database.CreateHomeDir()
+
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer.Default = signer.NewLocal(signer.NewKeystore(dir))
+	defer func() { signer.Default = nil }()
+
+	s, err := anchortest.NewServer("USD")
 	if err != nil {
 		t.Fatal(err)
 	}
-	email := "random@test.com"
-	body := "https://sandbox-api.anchorusd.com/transfer/deposit?account=" + pubkey +
-		"&asset_code=USD&email_address=" + email
+	defer s.Close()
+	anchor.Register(s.Client())
 
-	var x AnchorIntentResponse
-	dataJson, err := GetRequest(body)
+	user, err := database.NewUser("anchoruser", utils.SHA3hash("pass"), "seedpwd", "anchor@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Conf = true
+	err = user.Save()
 	if err != nil {
 		t.Fatal(err)
 	}
-	// now data is in byte, we need the other structure now
-	err = json.Unmarshal(dataJson, &x)
+	token, err := user.NewSession("test", "127.0.0.1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	depositIdentifier := x.Identifier
 
-	body = "https://sandbox-api.anchorusd.com/api/register"
-	data := url.Values{}
-	data.Set("identifier", depositIdentifier)
-	data.Set("name", "Test User")
-	data.Set("birthday[month]", "6")
-	data.Set("birthday[day]", "8")
-	data.Set("birthday[year]", "1993")
-	data.Set("tax-country", "US")
-	data.Set("tax-id-number", "111111111")
-	data.Set("address[street-1]", "123 4 Street")
-	data.Set("address[city]", "Anytown")
-	data.Set("address[postal-code]", "94107")
-	data.Set("address[region]", "CA")
-	data.Set("address[country]", "US")
-	data.Set("primary-phone-number", "+14151111111")
-	data.Set("gender", "male")
+	form := url.Values{
+		"username": {user.Username}, "token": {token}, "seedpwd": {"seedpwd"},
+		"anchor": {s.HomeDomain()}, "asset": {"USD"}, "amount": {"100"},
+	}
 
-	payload := strings.NewReader(data.Encode())
+	// transfers are interactive by default
+	w, x := postTransfer(anchorDeposit, AnchorRPC[1][0], form)
+	if w.Code != http.StatusOK || x.Protocol != anchor.SEP24 || x.URL == "" || x.ID == "" {
+		t.Fatalf("interactive deposit not started: %d %s", w.Code, w.Body.String())
+	}
+	transfer, err := database.RetrieveTransfer(user.Index, s.HomeDomain(), x.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfer.Kind != anchor.Deposit || transfer.Protocol != anchor.SEP24 || transfer.Status != "incomplete" {
+		t.Fatalf("deposit not recorded: %v", transfer)
+	}
+	interactiveID := x.ID
 
-	dataPost, err := PostRequest(body, payload)
+	// recorded transfers are looked up with their poll token without the seedpwd
+	query := url.Values{
+		"username": {user.Username}, "token": {token},
+		"anchor": {s.HomeDomain()}, "protocol": {anchor.SEP24}, "id": {x.ID},
+	}
+	r := httptest.NewRequest("POST", AnchorRPC[3][0], strings.NewReader(query.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	anchorTransaction(w, r)
+	var tx anchor.Transaction
+	json.Unmarshal(w.Body.Bytes(), &tx)
+	if w.Code != http.StatusOK || tx.ID != x.ID || tx.Status != "incomplete" {
+		t.Fatalf("transfer status not returned: %d %s", w.Code, w.Body.String())
+	}
+
+	// the seedpwd is needed to log in with the anchor again once the poll token expired
+	transfer.TokenExpiry = 1
+	err = transfer.Save()
 	if err != nil {
 		t.Fatal(err)
 	}
-	var xy kycDepositResponse
-	err = json.Unmarshal(dataPost, &xy)
+	r = httptest.NewRequest("POST", AnchorRPC[3][0], strings.NewReader(query.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	anchorTransaction(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("transfer with an expired token looked up without seedpwd: %d", w.Code)
+	}
+	query.Set("seedpwd", "seedpwd")
+	r = httptest.NewRequest("POST", AnchorRPC[3][0], strings.NewReader(query.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	anchorTransaction(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("transfer status not returned after logging in again: %d %s", w.Code, w.Body.String())
+	}
+
+	// SEP-6 transfers send the KYC information stored with openx when the anchor asks for it
+	s.RequiredFields = []string{"first_name", "birth_date"}
+	form.Set("protocol", anchor.SEP6)
+	w, x = postTransfer(anchorDeposit, AnchorRPC[1][0], form)
+	if w.Code != http.StatusOK || x.CustomerInfo == nil || x.ID != "" {
+		t.Fatalf("missing customer info not reported: %d %s", w.Code, w.Body.String())
+	}
+
+	user.AnchorKYC.Name = "John Doe"
+	user.AnchorKYC.Birthday.Year, user.AnchorKYC.Birthday.Month, user.AnchorKYC.Birthday.Day = "1993", "6", "8"
+	err = user.Save()
 	if err != nil {
 		t.Fatal(err)
-		return
+	}
+	w, x = postTransfer(anchorDeposit, AnchorRPC[1][0], form)
+	if w.Code != http.StatusOK || x.Deposit == nil || x.ID == "" {
+		t.Fatalf("programmatic deposit not started: %d %s", w.Code, w.Body.String())
+	}
+	customer := s.Customer(user.StellarWallet.PublicKey)
+	if customer["first_name"] != "John" || customer["last_name"] != "Doe" || customer["birth_date"] != "1993-06-08" {
+		t.Fatalf("wrong customer info sent: %v", customer)
 	}
 
-	log.Println(xy)
-	// if we fall down till here, deposit functions should be fine
+	w, _ = postTransfer(anchorWithdraw, AnchorRPC[2][0], form)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("withdrawal without destination accepted: %d", w.Code)
+	}
+	form.Set("type", "bank_account")
+	form.Set("dest", "123456789")
+	w, x = postTransfer(anchorWithdraw, AnchorRPC[2][0], form)
+	if w.Code != http.StatusOK || x.Withdraw == nil || x.Withdraw.AccountID != s.Key.Address() {
+		t.Fatalf("programmatic withdrawal not started: %d %s", w.Code, w.Body.String())
+	}
+	withdrawalID := x.ID
 
-	body = "https://sandbox-api.anchorusd.com/transfer/withdraw?type=bank_account&asset_code=USD&account=" + pubkey +
-		"&email_address=" + email
+	// pending transfers are polled until they're done and the user is notified once they are
+	var notified []database.Transfer
+	oldNotify := notifyTransfer
+	notifyTransfer = func(t database.Transfer) { notified = append(notified, t) }
+	defer func() { notifyTransfer = oldNotify }()
 
-	dataJson, err = GetRequest(body)
+	err = s.SetStatus(withdrawalID, "completed", "stellartxhash")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// now data is in byte, we need the other structure now
-	err = json.Unmarshal(dataJson, &x)
+	err = s.SetStatus(interactiveID, "pending_user_transfer_start", "")
 	if err != nil {
 		t.Fatal(err)
 	}
+	pollTransfers()
+	pollTransfers()
+	if len(notified) != 1 || notified[0].ID != withdrawalID || notified[0].StellarTxHash != "stellartxhash" {
+		t.Fatalf("user not notified once about the completed transfer: %v", notified)
+	}
+	pending, err := database.RetrievePendingTransfers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("expected 2 pending transfers, got %d", len(pending))
+	}
 
-	withdrawIdentifier := x.Identifier
-
-	body = "https://sandbox-api.anchorusd.com/api/register"
-	data = url.Values{}
-	data.Set("identifier", withdrawIdentifier)
-	payload = strings.NewReader(data.Encode())
+	r = httptest.NewRequest("GET", AnchorRPC[4][0]+"?username="+user.Username+"&token="+token, nil)
+	w = httptest.NewRecorder()
+	listTransfers(w, r)
+	var transfers []database.Transfer
+	err = json.Unmarshal(w.Body.Bytes(), &transfers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 3 {
+		t.Fatalf("expected 3 transfers, got %d", len(transfers))
+	}
+	for _, x := range transfers {
+		if x.Token != "" || x.SealedToken != nil {
+			t.Fatalf("anchor token sent to user")
+		}
+		if x.ID == interactiveID && (x.Status != "pending_user_transfer_start" || len(x.History) != 2) {
+			t.Fatalf("status of interactive transfer not updated: %v", x)
+		}
+		if x.ID == withdrawalID && (!x.Done || x.StellarTxHash != "stellartxhash") {
+			t.Fatalf("completed withdrawal not recorded: %v", x)
+		}
+	}
 
-	dataPost, err = PostRequest(body, payload)
+	// transfers whose token expired are only polled again after the user logs in with the anchor
+	transfer, err = database.RetrieveTransfer(user.Index, s.HomeDomain(), interactiveID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var xz kycDepositResponse
-	err = json.Unmarshal(dataPost, &xz)
+	transfer.TokenExpiry = 1
+	err = transfer.Save()
 	if err != nil {
 		t.Fatal(err)
-		return
 	}
-	log.Println(xz)
+	err = s.SetStatus(interactiveID, "error", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollTransfers()
+	if len(notified) != 1 {
+		t.Fatalf("transfer with an expired token polled")
+	}
+	refresh := url.Values{"username": {user.Username}, "token": {token}, "seedpwd": {"seedpwd"}}
+	r = httptest.NewRequest("POST", AnchorRPC[5][0], strings.NewReader(refresh.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	refreshTransfers(w, r)
+	if w.Code != http.StatusOK || len(notified) != 2 || notified[1].ID != interactiveID || notified[1].Status != "error" {
+		t.Fatalf("failed transfer not seen after refresh: %d %v", w.Code, notified)
+	}
+
+	// refreshes fail if the user can't be logged in with an anchor
+	down, err := anchortest.NewServer("USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor.Register(down.Client())
+	form.Set("anchor", down.HomeDomain())
+	w, x = postTransfer(anchorDeposit, AnchorRPC[1][0], form)
+	if w.Code != http.StatusOK || x.ID == "" {
+		t.Fatalf("deposit not started: %d %s", w.Code, w.Body.String())
+	}
+	down.Close()
+	r = httptest.NewRequest("POST", AnchorRPC[5][0], strings.NewReader(refresh.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	refreshTransfers(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh reported success without logging in with the anchor: %d", w.Code)
+	}
+	form.Set("anchor", s.HomeDomain())
+
+	form.Set("seedpwd", "wrong")
+	w, _ = postTransfer(anchorWithdraw, AnchorRPC[2][0], form)
+	if w.Code == http.StatusOK {
+		t.Fatalf("transfer started with the wrong seed password")
+	}
+	form.Set("seedpwd", "seedpwd")
+	form.Set("anchor", "unknown.example")
+	w, _ = postTransfer(anchorWithdraw, AnchorRPC[2][0], form)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("transfer with an unknown anchor accepted: %d", w.Code)
+	}
 }
@@ -0,0 +1,201 @@
+package rpc
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// approval contains the handlers for dangerous admin operations that go through the multi
+// party approval workflow in the database package
+
+// registerApprovalExecutors sets up the functions that perform approved actions
+func registerApprovalExecutors() {
+	database.RegisterApprovalExecutor(database.AuditKillServer, func(p database.Proposal, approvers []database.User) error {
+		recordApproved(p, approvers)
+		return nil
+	})
+	// the server is only killed once the proposal has been saved as executed
+	database.RegisterApprovalFinalizer(database.AuditKillServer, func(p database.Proposal) {
+		log.Println("Activating kill switch")
+		os.Exit(1)
+	})
+
+	database.RegisterApprovalExecutor(database.AuditFreezeServer, func(p database.Proposal, approvers []database.User) error {
+		consts.SetConsts(false) // runtime const migration
+		recordApproved(p, approvers)
+		log.Println("Server frozen, state reverted to mainnet. Restart server to unfreeze")
+		return nil
+	})
+
+	database.RegisterApprovalExecutor(database.AuditBanUser, func(p database.Proposal, approvers []database.User) error {
+		index, err := utils.ToInt(p.Target)
+		if err != nil {
+			return err
+		}
+		// SetBan records the ban in the audit log
+		return approvers[0].SetBan(index)
+	})
+
+	database.RegisterApprovalExecutor(database.AuditVerifyUser, func(p database.Proposal, approvers []database.User) error {
+		return setVerified(p, approvers, true)
+	})
+
+	database.RegisterApprovalExecutor(database.AuditUnverifyUser, func(p database.Proposal, approvers []database.User) error {
+		return setVerified(p, approvers, false)
+	})
+}
+
+// recordApproved records an approved action in the audit log on behalf of its proposer
+func recordApproved(p database.Proposal, approvers []database.User) {
+	err := database.AppendAudit(approvers[0].Index, approvers[0].Username, p.Action, p.Target,
+		"proposal "+strconv.Itoa(p.Index), nil)
+	if err != nil {
+		log.Println("could not write audit entry for action: ", p.Action, err)
+	}
+}
+
+// setVerified sets the verified flag of the user targeted by the proposal
+func setVerified(p database.Proposal, approvers []database.User, verified bool) error {
+	index, err := utils.ToInt(p.Target)
+	if err != nil {
+		return err
+	}
+
+	user, err := database.RetrieveUser(index)
+	if err != nil {
+		return err
+	}
+
+	user.Verified = verified
+	user.VerifiedBy = approvers[0].Index
+	user.VerifiedTime = utils.Timestamp()
+
+	err = user.Save()
+	if err != nil {
+		return err
+	}
+
+	recordApproved(p, approvers)
+	return nil
+}
+
+// propose proposes action on target and returns the proposal, which has already been executed
+// if the action requires a single approval
+func propose(w http.ResponseWriter, r *http.Request, admin database.User, action string, target string) {
+	p, err := database.ProposeAction(admin, action, target)
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return
+	}
+
+	erpc.MarshalSend(w, p)
+}
+
+// banUser proposes banning the user with the passed index
+func banUser() {
+	http.HandleFunc(AdminRPC[19][0], func(w http.ResponseWriter, r *http.Request) {
+		admin, adminBool := validatePermission(w, r, AdminRPC[19][2:], AdminRPC[19][1], database.PermBanUsers)
+		if !adminBool {
+			return
+		}
+
+		indexS := r.FormValue("index")
+
+		index, err := utils.ToInt(indexS)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		if index == admin.Index {
+			log.Println("can't ban yourself")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
+
+		_, err = database.RetrieveUser(index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		propose(w, r, admin, database.AuditBanUser, indexS)
+	})
+}
+
+// listProposals lists the proposals the user can approve, latest first. The optional status
+// param filters proposals by status
+func listProposals() {
+	http.HandleFunc(AdminRPC[20][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, AdminRPC[20][2:], AdminRPC[20][1])
+		if err != nil {
+			return
+		}
+
+		proposals, err := database.RetrieveProposals(r.URL.Query().Get("status"))
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		var arr []database.Proposal
+		for _, p := range proposals {
+			allowed, err := user.HasPermission(database.ApprovalPolicies[p.Action].Permission)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+			if allowed {
+				arr = append(arr, p)
+			}
+		}
+
+		erpc.MarshalSend(w, arr)
+	})
+}
+
+// approveProposal approves a proposal and executes it if it reaches quorum
+func approveProposal() {
+	http.HandleFunc(AdminRPC[21][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, AdminRPC[21][2:], AdminRPC[21][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		p, err := database.ApproveProposal(user, index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, p)
+	})
+}
+
+// cancelProposal cancels a pending proposal or marks an abandoned executing one as failed
+func cancelProposal() {
+	http.HandleFunc(AdminRPC[22][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, AdminRPC[22][2:], AdminRPC[22][1])
+		if err != nil {
+			return
+		}
+
+		index, err := utils.ToInt(r.FormValue("index"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		p, err := database.CancelProposal(user, index)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, p)
+	})
+}
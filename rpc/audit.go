@@ -0,0 +1,27 @@
+package rpc
+
+import (
+	"log"
+	"net/http"
+
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// auditLog records a security relevant action performed by actor in the audit log along with
+// metadata on the request that triggered it. Failures are logged and don't fail the request
+// since the action has already been performed by the time this is called
+func auditLog(r *http.Request, actor database.User, action string, target string, details string) {
+	metadata := map[string]string{
+		"ip":        r.RemoteAddr,
+		"useragent": r.UserAgent(),
+		"path":      r.URL.Path,
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		metadata["forwardedfor"] = forwarded
+	}
+
+	err := database.AppendAudit(actor.Index, actor.Username, action, target, details, metadata)
+	if err != nil {
+		log.Println("could not write audit entry for action: ", action, err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	erpc "github.com/Varunram/essentials/rpc"
 	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
 )
 
 // CARPC contains a list of all ComplyAdvantage related RPCs
@@ -124,6 +125,13 @@ func PostRequestCA(body string, payload io.Reader) ([]byte, error) {
 	return x, nil
 }
 
+// kycResponse defines the response struct for ComplyAdvantage
+type kycResponse struct {
+	Error  string
+	Result string
+	URL    string
+}
+
 // PostAndSendCA is a handler that POSTs data and returns the response
 func PostAndSendCA(w http.ResponseWriter, r *http.Request, body string, payload io.Reader) {
 	data, err := PostRequestCA(body, payload)
@@ -131,7 +139,7 @@ func PostAndSendCA(w http.ResponseWriter, r *http.Request, body string, payload
 		return
 	}
 	log.Println(string(data))
-	var x kycDepositResponse
+	var x kycResponse
 	err = json.Unmarshal(data, &x)
 	if erpc.Err(w, err, erpc.StatusInternalServerError, "did not unmarshal json") {
 		return
@@ -142,8 +150,8 @@ func PostAndSendCA(w http.ResponseWriter, r *http.Request, body string, payload
 // searchComplyAdvantage searches for a particular entity on ComplyAdvantage's platform
 func searchComplyAdvantage() {
 	http.HandleFunc(CARPC[1][0], func(w http.ResponseWriter, r *http.Request) {
-		_, err := userValidateHelper(w, r, CARPC[1][1:], "GET")
-		if err != nil {
+		_, allowed := validatePermission(w, r, CARPC[1][1:], "GET", database.PermScreenKyc)
+		if !allowed {
 			return
 		}
 
@@ -185,8 +193,8 @@ type caAllUserResponse struct {
 // getAllCAUsers gets a list of all users searched for using ComplyAdvantage
 func getAllCAUsers() {
 	http.HandleFunc(CARPC[2][0], func(w http.ResponseWriter, r *http.Request) {
-		_, err := userValidateHelper(w, r, CARPC[2][1:], "GET")
-		if err != nil {
+		_, allowed := validatePermission(w, r, CARPC[2][1:], "GET", database.PermScreenKyc)
+		if !allowed {
 			return
 		}
 
@@ -0,0 +1,185 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	xlm "github.com/Varunram/essentials/xlm"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// federation contains the discovery endpoints of openx: the stellar.toml (SEP-1) that tells
+// wallets which accounts and assets openx controls and where its endpoints are, and the
+// federation server (SEP-2) that resolves stellar addresses of the form username*homedomain
+// to the public keys of users and back, so that users can receive payments by name
+
+// setupFederationRoutes sets up the SEP-1 and SEP-2 routes
+func setupFederationRoutes() {
+	http.HandleFunc(FederationRPC[0][0], serveStellarToml)
+	http.HandleFunc(FederationRPC[1][0], serveFederation)
+}
+
+// FederationRPC contains the SEP-1 and SEP-2 RPCs
+var FederationRPC = map[int][]string{
+	0: {"/.well-known/stellar.toml", "GET"}, // GET
+	1: {"/federation", "GET", "q", "type"},  // GET
+}
+
+// homeURL returns the url of the passed route on the home domain
+func homeURL(route string) string {
+	return "https://" + consts.HomeDomain + route
+}
+
+// tomlString quotes a string as a TOML basic string
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\u%04x", c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// StellarToml returns the stellar.toml of openx generated from consts
+func StellarToml() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "VERSION = %s\n", tomlString("1.0.0"))
+	fmt.Fprintf(&b, "NETWORK_PASSPHRASE = %s\n", tomlString(xlm.Passphrase))
+	fmt.Fprintf(&b, "FEDERATION_SERVER = %s\n", tomlString(homeURL(FederationRPC[1][0])))
+	fmt.Fprintf(&b, "WEB_AUTH_ENDPOINT = %s\n", tomlString(homeURL(Sep10RPC[0][0])))
+	if consts.PlatformPublicKey != "" {
+		fmt.Fprintf(&b, "SIGNING_KEY = %s\n", tomlString(consts.PlatformPublicKey))
+	}
+
+	var accounts []string
+	for _, account := range []string{consts.PlatformPublicKey, consts.StablecoinPublicKey} {
+		if account != "" {
+			accounts = append(accounts, tomlString(account))
+		}
+	}
+	fmt.Fprintf(&b, "ACCOUNTS = [%s]\n", strings.Join(accounts, ", "))
+
+	fmt.Fprintf(&b, "\n[DOCUMENTATION]\n")
+	fmt.Fprintf(&b, "ORG_NAME = %s\n", tomlString("openx"))
+	fmt.Fprintf(&b, "ORG_URL = %s\n", tomlString(homeURL("")))
+	if consts.PlatformEmail != "" {
+		fmt.Fprintf(&b, "ORG_OFFICIAL_EMAIL = %s\n", tomlString(consts.PlatformEmail))
+	}
+
+	// the in house stablecoin only exists on testnet
+	if consts.StablecoinCode != "" && consts.StablecoinPublicKey != "" {
+		fmt.Fprintf(&b, "\n[[CURRENCIES]]\n")
+		fmt.Fprintf(&b, "code = %s\n", tomlString(consts.StablecoinCode))
+		fmt.Fprintf(&b, "issuer = %s\n", tomlString(consts.StablecoinPublicKey))
+		fmt.Fprintf(&b, "display_decimals = 2\n")
+		fmt.Fprintf(&b, "name = %s\n", tomlString("openx test stablecoin"))
+		fmt.Fprintf(&b, "desc = %s\n", tomlString("USD pegged stablecoin issued by openx in exchange for XLM on testnet"))
+		fmt.Fprintf(&b, "is_asset_anchored = true\n")
+		fmt.Fprintf(&b, "anchor_asset_type = %s\n", tomlString("fiat"))
+		fmt.Fprintf(&b, "anchor_asset = %s\n", tomlString("USD"))
+		fmt.Fprintf(&b, "status = %s\n", tomlString("test"))
+	}
+	return b.String()
+}
+
+// serveStellarToml serves the stellar.toml of openx
+func serveStellarToml(w http.ResponseWriter, r *http.Request) {
+	err := erpc.CheckGet(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// SEP-1 requires the toml to be readable from any origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(StellarToml()))
+}
+
+// FederationResponse is a SEP-2 federation record
+type FederationResponse struct {
+	StellarAddress string `json:"stellar_address"`
+	AccountID      string `json:"account_id"`
+}
+
+// federationError responds with a SEP-2 error
+func federationError(w http.ResponseWriter, status int, detail string) {
+	log.Println("federation error: ", detail)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"detail": detail})
+}
+
+// federationUser returns the user a federation query resolves to. Only confirmed users who
+// haven't been banned and have generated their keys can be looked up
+func federationUser(q string, qtype string) (database.User, error) {
+	var user database.User
+	var err error
+	switch qtype {
+	case "name":
+		i := strings.LastIndex(q, "*")
+		if i <= 0 || !strings.EqualFold(q[i+1:], consts.HomeDomain) {
+			return user, errors.New("not a stellar address of " + consts.HomeDomain)
+		}
+		user, err = database.RetrieveUserByUsername(q[:i])
+	case "id":
+		user, err = database.RetrieveUserByPubkey(q)
+	}
+	if err != nil || !user.Conf || user.Banned || user.StellarWallet.PublicKey == "" {
+		return user, errors.New("no user found")
+	}
+	return user, nil
+}
+
+// serveFederation resolves stellar addresses to accounts and accounts to stellar addresses
+func serveFederation(w http.ResponseWriter, r *http.Request) {
+	// SEP-2 requires lookups to be readable from any origin, errors included
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	err := erpc.CheckGet(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if rateLimited(w, r) {
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	qtype := r.URL.Query().Get("type")
+	if q == "" {
+		federationError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	if qtype != "name" && qtype != "id" {
+		federationError(w, http.StatusNotImplemented, "unsupported federation type")
+		return
+	}
+
+	user, err := federationUser(q, qtype)
+	if err != nil {
+		federationError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	erpc.MarshalSend(w, FederationResponse{
+		StellarAddress: user.Username + "*" + consts.HomeDomain,
+		AccountID:      user.StellarWallet.PublicKey,
+	})
+}
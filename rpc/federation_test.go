@@ -0,0 +1,152 @@
+// +build all travis
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+	toml "github.com/pelletier/go-toml"
+)
+
+// federationQuery sends a federation query to the federation handler
+func federationQuery(q string, qtype string) *httptest.ResponseRecorder {
+	query := url.Values{"q": {q}, "type": {qtype}}
+	r := httptest.NewRequest("GET", FederationRPC[1][0]+"?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	serveFederation(w, r)
+	return w
+}
+
+func TestFederation(t *testing.T) {
+	consts.SetConsts(false)
+	database.SetStore(database.NewMemoryStore())
+	defer database.SetStore(database.NewBoltStore(""))
+	database.CreateHomeDir()
+
+	oldDomain, oldPubkey := consts.HomeDomain, consts.PlatformPublicKey
+	consts.HomeDomain = "openx.example"
+	consts.PlatformPublicKey = "GBESYUIFJ2NKNSLXCDWJJ7YYXD7OTCPWDM57YK6R3U76YEVYS5F5HI37"
+	defer func() { consts.HomeDomain, consts.PlatformPublicKey = oldDomain, oldPubkey }()
+
+	w := httptest.NewRecorder()
+	serveStellarToml(w, httptest.NewRequest("GET", FederationRPC[0][0], nil))
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("stellar.toml not readable from other origins")
+	}
+	tree, err := toml.Load(w.Body.String())
+	if err != nil {
+		t.Fatalf("invalid stellar.toml: %v\n%s", err, w.Body.String())
+	}
+	if tree.Get("NETWORK_PASSPHRASE") != xlm.Passphrase ||
+		tree.Get("SIGNING_KEY") != consts.PlatformPublicKey ||
+		tree.Get("FEDERATION_SERVER") != "https://openx.example/federation" ||
+		tree.Get("WEB_AUTH_ENDPOINT") != "https://openx.example/auth" {
+		t.Fatalf("unexpected stellar.toml: %s", w.Body.String())
+	}
+	currencies, ok := tree.Get("CURRENCIES").([]*toml.Tree)
+	if !ok || len(currencies) != 1 || currencies[0].Get("code") != consts.StablecoinCode ||
+		currencies[0].Get("issuer") != consts.StablecoinPublicKey {
+		t.Fatalf("stablecoin missing from stellar.toml: %s", w.Body.String())
+	}
+
+	user, err := database.NewUser("feduser", utils.SHA3hash("pass"), "x", "fed@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unconfirmed users can't be looked up
+	w = federationQuery("feduser*openx.example", "name")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unconfirmed user resolved: %d", w.Code)
+	}
+
+	user.Conf = true
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var x FederationResponse
+	w = federationQuery("feduser*OPENX.example", "name")
+	if w.Code != http.StatusOK {
+		t.Fatalf("stellar address not resolved: %d %s", w.Code, w.Body.String())
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.AccountID != user.StellarWallet.PublicKey || x.StellarAddress != "feduser*openx.example" {
+		t.Fatalf("stellar address resolved to the wrong account: %v", x)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("federation response not readable from other origins")
+	}
+
+	w = federationQuery(user.StellarWallet.PublicKey, "id")
+	if w.Code != http.StatusOK {
+		t.Fatalf("account not resolved: %d %s", w.Code, w.Body.String())
+	}
+	x = FederationResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.StellarAddress != "feduser*openx.example" {
+		t.Fatalf("account resolved to the wrong address: %v", x)
+	}
+
+	w = federationQuery("feduser*other.example", "name")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("address of another domain resolved: %d", w.Code)
+	}
+	w = federationQuery("nobody*openx.example", "name")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown user resolved: %d", w.Code)
+	}
+
+	// users who haven't generated their keys don't have an account to resolve to
+	keyless, err := database.NewUser("keylessuser", utils.SHA3hash("pass"), "x", "keyless@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyless.Conf = true
+	keyless.StellarWallet = database.StellWallet{}
+	err = keyless.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = federationQuery("keylessuser*openx.example", "name")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("user without keys resolved: %d %s", w.Code, w.Body.String())
+	}
+
+	w = federationQuery("sometx", "txid")
+	if w.Code != http.StatusNotImplemented {
+		t.Fatalf("unsupported type not rejected: %d", w.Code)
+	}
+
+	// lookups of a single address are limited apart from the lookups of the ip
+	limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	for i := 0; i < 10; i++ {
+		w = federationQuery("feduser*openx.example", "name")
+		if w.Code != http.StatusOK {
+			t.Fatalf("lookup within the limit rejected: %d", w.Code)
+		}
+	}
+	w = federationQuery("feduser*openx.example", "name")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("lookups of a single address not limited: %d", w.Code)
+	}
+	w = federationQuery(user.StellarWallet.PublicKey, "id")
+	if w.Code != http.StatusOK {
+		t.Fatalf("lookup of another address limited: %d", w.Code)
+	}
+}
@@ -0,0 +1,142 @@
+package rpc
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	database "github.com/YaleOpenLab/openx/database"
+	notif "github.com/YaleOpenLab/openx/notif"
+)
+
+// logins contains the login history of users and the endpoints users and admins can view
+// it with
+
+// recordLogin records a login attempt of the user and emails the user if a successful login
+// came from a device they haven't used before
+func recordLogin(r *http.Request, user database.User, outcome string) {
+	login, err := database.RecordLogin(user.Index, clientIP(r), r.UserAgent(), r.URL.Path, outcome)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !login.NewDevice {
+		return
+	}
+
+	err = notif.SendNewDeviceEmail(user.Email, login.IP, login.UserAgent,
+		time.Unix(login.Time, 0).UTC().Format(time.RFC1123))
+	if err != nil {
+		log.Println("could not send new device email to user: ", user.Index, err)
+	}
+}
+
+// recordUnknownLogin records a login attempt for a username no user has
+func recordUnknownLogin(r *http.Request, username string) {
+	err := database.RecordUnknownLogin(username, clientIP(r), r.UserAgent(), r.URL.Path)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// loginLimit returns the limit passed in the optional limit param
+func loginLimit(r *http.Request) (int, error) {
+	if r.URL.Query().Get("limit") == "" {
+		return 0, nil
+	}
+	return utils.ToInt(r.URL.Query().Get("limit"))
+}
+
+// listLogins lists the login attempts made for the user's account, latest first
+func listLogins() {
+	http.HandleFunc(UserRPC[54][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[54][2:], UserRPC[54][1])
+		if err != nil {
+			return
+		}
+
+		limit, err := loginLimit(r)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		logins, err := database.QueryLogins(database.LoginQuery{User: user.Index, Limit: limit})
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, logins)
+	})
+}
+
+// LoginInvestigation is the state of an account an admin sees while investigating it
+type LoginInvestigation struct {
+	User     *database.UserSummary `json:",omitempty"`
+	Sessions []database.Session    `json:",omitempty"`
+	Lockout  *database.Lockout     `json:",omitempty"`
+	Logins   []database.Login
+}
+
+// queryLogins lets admins look through login attempts. Attempts can be filtered by the
+// index of the user, the ip they were made from, their outcome and a since unix time. If a
+// user is passed their live sessions and lockout are returned as well
+func queryLogins() {
+	http.HandleFunc(AdminRPC[28][0], func(w http.ResponseWriter, r *http.Request) {
+		_, adminBool := validatePermission(w, r, AdminRPC[28][2:], AdminRPC[28][1], database.PermViewAudit)
+		if !adminBool {
+			return
+		}
+
+		var err error
+		q := database.LoginQuery{
+			IP:      r.URL.Query().Get("ip"),
+			Outcome: r.URL.Query().Get("outcome"),
+		}
+		q.Limit, err = loginLimit(r)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+		if r.URL.Query().Get("since") != "" {
+			q.Since, err = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+		}
+
+		var x LoginInvestigation
+		if r.URL.Query().Get("index") != "" {
+			q.User, err = utils.ToInt(r.URL.Query().Get("index"))
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+
+			user, err := database.RetrieveUser(q.User)
+			if erpc.Err(w, err, erpc.StatusBadRequest) {
+				return
+			}
+			summary := user.Summary()
+			x.User = &summary
+
+			x.Sessions, err = database.RetrieveSessions(q.User)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+
+			lockout, err := database.RetrieveLockout(q.User)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+			x.Lockout = &lockout
+		}
+
+		x.Logins, err = database.QueryLogins(q)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, x)
+	})
+}
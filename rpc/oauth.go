@@ -0,0 +1,325 @@
+package rpc
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// oauth contains the endpoints of the OAuth2 provider. Users authorize platforms through the
+// openx frontend which calls the authorize endpoint with the user's token. Platforms then
+// exchange the authorization code for tokens at the token endpoint and look up who a token
+// belongs to with the introspection endpoint instead of handling user credentials themselves.
+// Platforms authenticate as clients with their index as client id and the secret of one of
+// their live keys as client secret
+
+// setupOAuthRoutes sets up the routes of the OAuth2 provider
+func setupOAuthRoutes() {
+	oauthAuthorize()
+	oauthToken()
+	oauthIntrospect()
+	oauthRevoke()
+	listConsents()
+	revokeConsent()
+}
+
+// OAuthRPC contains a list of all OAuth2 related RPCs
+var OAuthRPC = map[int][]string{
+	0: {"/oauth/authorize", "POST", "response_type", "client_id", "redirect_uri", "scope", "code_challenge", "code_challenge_method"}, // POST
+	1: {"/oauth/token", "POST", "grant_type"},                                                                                         // POST
+	2: {"/oauth/introspect", "POST", "token"},                                                                                         // POST
+	3: {"/oauth/revoke", "POST", "token"},                                                                                             // POST
+	4: {"/oauth/consents", "GET"},                                                                                                     // GET
+	5: {"/oauth/consents/revoke", "POST", "client_id"},                                                                                // POST
+}
+
+// oauthErrorResponse is an error as defined in RFC 6749
+type oauthErrorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// oauthError responds with an OAuth2 error
+func oauthError(w http.ResponseWriter, status int, code string, description string) {
+	log.Println("oauth error: ", code, description)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthErrorResponse{Error: code, Description: description})
+}
+
+// oauthClient authenticates the platform calling the token, introspection or revocation
+// endpoint with HTTP basic auth or the client_id and client_secret params
+func oauthClient(w http.ResponseWriter, r *http.Request) (database.Platform, bool) {
+	var pf database.Platform
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.FormValue("client_id")
+		secret = r.FormValue("client_secret")
+	}
+
+	index, err := utils.ToInt(clientID)
+	if err == nil {
+		pf, err = database.RetrievePlatform(index)
+	}
+	if err != nil || secret == "" || pf.Expired() || !pf.CheckSecret(secret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="openx"`)
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return pf, false
+	}
+	return pf, true
+}
+
+// AuthorizeResponse is the response of the authorize endpoint. If the user hasn't consented
+// to the requested scopes yet, ConsentRequired is set and the frontend should ask the user
+// and call the endpoint again with consent set to true. Otherwise Redirect is the uri the
+// user should be sent to
+type AuthorizeResponse struct {
+	ConsentRequired bool
+	Client          string
+	Scopes          []string
+	Redirect        string
+}
+
+// oauthAuthorize issues an authorization code to a platform on behalf of the user
+func oauthAuthorize() {
+	http.HandleFunc(OAuthRPC[0][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, OAuthRPC[0][2:], OAuthRPC[0][1])
+		if err != nil {
+			return
+		}
+
+		if r.FormValue("response_type") != "code" || r.FormValue("code_challenge_method") != "S256" {
+			log.Println("only the code flow with S256 challenges is supported")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
+
+		client, err := utils.ToInt(r.FormValue("client_id"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		pf, err := database.RetrievePlatform(client)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		redirectURI := r.FormValue("redirect_uri")
+		if pf.Expired() || !pf.ValidRedirect(redirectURI) {
+			log.Println("invalid client or redirect uri: ", client, redirectURI)
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
+
+		scopes, err := database.ParseOAuthScopes(r.FormValue("scope"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		consent, err := database.RetrieveConsent(user.Index, client)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		if !consent.Covers(scopes) {
+			if r.FormValue("consent") != "true" {
+				erpc.MarshalSend(w, AuthorizeResponse{ConsentRequired: true, Client: pf.Name, Scopes: scopes})
+				return
+			}
+
+			_, err = database.GrantConsent(user.Index, client, scopes)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+			auditLog(r, user, database.AuditOAuthConsent, strconv.Itoa(client), strings.Join(scopes, " "))
+		}
+
+		code, err := database.NewAuthorizationCode(user.Index, client, redirectURI, scopes,
+			r.FormValue("code_challenge"), r.FormValue("nonce"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		// redirect uris are validated when they are registered
+		redirect, _ := url.Parse(redirectURI)
+		query := redirect.Query()
+		query.Set("code", code)
+		if state := r.FormValue("state"); state != "" {
+			query.Set("state", state)
+		}
+		redirect.RawQuery = query.Encode()
+
+		erpc.MarshalSend(w, AuthorizeResponse{Client: pf.Name, Scopes: scopes, Redirect: redirect.String()})
+	})
+}
+
+// oauthToken exchanges authorization codes and refresh tokens for tokens
+func oauthToken() {
+	http.HandleFunc(OAuthRPC[1][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckPost(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		pf, ok := oauthClient(w, r)
+		if !ok {
+			return
+		}
+
+		var tokens database.OAuthTokens
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			tokens, err = database.ExchangeAuthorizationCode(r.FormValue("code"), pf.Index,
+				r.FormValue("redirect_uri"), r.FormValue("code_verifier"))
+		case "refresh_token":
+			var scopes []string
+			if r.FormValue("scope") != "" {
+				scopes, err = database.ParseOAuthScopes(r.FormValue("scope"))
+				if err != nil {
+					oauthError(w, http.StatusBadRequest, "invalid_scope", err.Error())
+					return
+				}
+			}
+			tokens, err = database.RefreshOAuthTokens(r.FormValue("refresh_token"), pf.Index, scopes)
+		default:
+			oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+			return
+		}
+		if err != nil {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		erpc.MarshalSend(w, tokens)
+	})
+}
+
+// IntrospectionResponse is the response of the introspection endpoint as defined in RFC 7662
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Expiry    int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// oauthIntrospect tells a platform whether a token issued to it is live and who it belongs to
+func oauthIntrospect() {
+	http.HandleFunc(OAuthRPC[2][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckPost(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		pf, ok := oauthClient(w, r)
+		if !ok {
+			return
+		}
+
+		grant, err := database.IntrospectOAuthToken(r.FormValue("token"))
+		// platforms can only introspect the tokens issued to them
+		if err != nil || grant.Client != pf.Index {
+			erpc.MarshalSend(w, IntrospectionResponse{Active: false})
+			return
+		}
+
+		user, err := database.RetrieveUser(grant.User)
+		if err != nil {
+			erpc.MarshalSend(w, IntrospectionResponse{Active: false})
+			return
+		}
+
+		erpc.MarshalSend(w, IntrospectionResponse{
+			Active:    true,
+			Scope:     strings.Join(grant.Scopes, " "),
+			ClientID:  strconv.Itoa(grant.Client),
+			Username:  user.Username,
+			Subject:   strconv.Itoa(user.Index),
+			TokenType: grant.TokenType(),
+			Expiry:    grant.Expiry,
+			IssuedAt:  grant.Created,
+		})
+	})
+}
+
+// oauthRevoke revokes a token issued to the platform as defined in RFC 7009
+func oauthRevoke() {
+	http.HandleFunc(OAuthRPC[3][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckPost(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		pf, ok := oauthClient(w, r)
+		if !ok {
+			return
+		}
+
+		err = database.RevokeOAuthToken(r.FormValue("token"), pf.Index)
+		if err != nil {
+			oauthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// listConsents lists the platforms the user has authorized
+func listConsents() {
+	http.HandleFunc(OAuthRPC[4][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, OAuthRPC[4][2:], OAuthRPC[4][1])
+		if err != nil {
+			return
+		}
+
+		consents, err := database.RetrieveConsents(user.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, consents)
+	})
+}
+
+// revokeConsent revokes the access of a platform to the user's account along with every
+// token issued to it
+func revokeConsent() {
+	http.HandleFunc(OAuthRPC[5][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, OAuthRPC[5][2:], OAuthRPC[5][1])
+		if err != nil {
+			return
+		}
+
+		client, err := utils.ToInt(r.FormValue("client_id"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		err = database.RevokeConsent(user.Index, client)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		auditLog(r, user, database.AuditOAuthRevoke, strconv.Itoa(client), "")
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
@@ -0,0 +1,195 @@
+package rpc
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// oidc contains the OpenID Connect endpoints that let platforms sign users in with their
+// openx account: the discovery document, the keys ID tokens are signed with and the userinfo
+// endpoint. Logouts are propagated to platforms with back-channel logout tokens
+
+// setupOIDCRoutes sets up the OpenID Connect routes
+func setupOIDCRoutes() {
+	oidcDiscovery()
+	oidcJWKS()
+	oidcUserInfo()
+}
+
+// OIDCRPC contains a list of all OpenID Connect related RPCs
+var OIDCRPC = map[int][]string{
+	0: {"/.well-known/openid-configuration", "GET"}, // GET
+	1: {"/oauth/jwks", "GET"},                       // GET
+	2: {"/oauth/userinfo", "GET"},                   // GET
+}
+
+// logoutClient is the http client logout tokens are sent with
+var logoutClient = &http.Client{Timeout: 10 * time.Second}
+
+// DiscoveryDocument is the OpenID Provider metadata of openx
+type DiscoveryDocument struct {
+	Issuer                     string   `json:"issuer"`
+	AuthorizationEndpoint      string   `json:"authorization_endpoint"`
+	TokenEndpoint              string   `json:"token_endpoint"`
+	UserInfoEndpoint           string   `json:"userinfo_endpoint"`
+	JWKSURI                    string   `json:"jwks_uri"`
+	IntrospectionEndpoint      string   `json:"introspection_endpoint"`
+	RevocationEndpoint         string   `json:"revocation_endpoint"`
+	ScopesSupported            []string `json:"scopes_supported"`
+	ResponseTypesSupported     []string `json:"response_types_supported"`
+	GrantTypesSupported        []string `json:"grant_types_supported"`
+	SubjectTypesSupported      []string `json:"subject_types_supported"`
+	SigningAlgsSupported       []string `json:"id_token_signing_alg_values_supported"`
+	TokenAuthMethodsSupported  []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethods       []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported            []string `json:"claims_supported"`
+	BackchannelLogoutSupported bool     `json:"backchannel_logout_supported"`
+}
+
+// oidcDiscovery serves the discovery document
+func oidcDiscovery() {
+	http.HandleFunc(OIDCRPC[0][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		issuer := strings.TrimSuffix(database.OIDCIssuer, "/")
+		erpc.MarshalSend(w, DiscoveryDocument{
+			Issuer:                    database.OIDCIssuer,
+			AuthorizationEndpoint:     issuer + OAuthRPC[0][0],
+			TokenEndpoint:             issuer + OAuthRPC[1][0],
+			UserInfoEndpoint:          issuer + OIDCRPC[2][0],
+			JWKSURI:                   issuer + OIDCRPC[1][0],
+			IntrospectionEndpoint:     issuer + OAuthRPC[2][0],
+			RevocationEndpoint:        issuer + OAuthRPC[3][0],
+			ScopesSupported:           database.OAuthScopes,
+			ResponseTypesSupported:    []string{"code"},
+			GrantTypesSupported:       []string{"authorization_code", "refresh_token"},
+			SubjectTypesSupported:     []string{"public"},
+			SigningAlgsSupported:      []string{"ES256"},
+			TokenAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+			CodeChallengeMethods:      []string{"S256"},
+			ClaimsSupported: []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name",
+				"preferred_username", "country", "verified", "kyc", "email", "email_verified", "stellar_public_key"},
+			BackchannelLogoutSupported: true,
+		})
+	})
+}
+
+// oidcJWKS serves the public keys ID tokens are signed with
+func oidcJWKS() {
+	http.HandleFunc(OIDCRPC[1][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		jwks, err := database.RetrieveJWKS()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, jwks)
+	})
+}
+
+// bearerToken returns the access token sent in the Authorization header of a request
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+// oidcUserInfo returns the claims about the user an access token was issued for that the
+// user consented to share with the platform
+func oidcUserInfo() {
+	http.HandleFunc(OIDCRPC[2][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		grant, err := database.IntrospectOAuthToken(bearerToken(r))
+		if err != nil || grant.TokenType() != "Bearer" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
+		}
+
+		user, err := database.RetrieveUser(grant.User)
+		if erpc.Err(w, err, erpc.StatusUnauthorized) {
+			return
+		}
+
+		erpc.MarshalSend(w, userClaims(user, grant.Scopes))
+	})
+}
+
+// userClaims returns the claims about a user that the passed scopes grant access to
+func userClaims(user database.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": strconv.Itoa(user.Index)}
+	for _, scope := range scopes {
+		switch scope {
+		case database.OAuthProfile:
+			claims["name"] = user.Name
+			claims["preferred_username"] = user.Username
+			claims["country"] = user.Country
+			claims["verified"] = user.Verified
+			claims["kyc"] = user.Kyc
+		case database.OAuthEmail:
+			claims["email"] = user.Email
+			claims["email_verified"] = user.Conf
+		case database.OAuthWallet:
+			claims["stellar_public_key"] = user.StellarWallet.PublicKey
+		}
+	}
+	return claims
+}
+
+// propagateLogout revokes the tokens issued to platforms on behalf of the user and sends a
+// back-channel logout token to every platform the user has authorized that registered a
+// logout uri. Logout tokens are sent in the background
+func propagateLogout(user database.User) error {
+	clients, err := database.LogoutOAuth(user.Index)
+	if err != nil {
+		return err
+	}
+
+	for _, client := range clients {
+		pf, err := database.RetrievePlatform(client)
+		if err != nil || pf.LogoutURI == "" {
+			continue
+		}
+
+		token, err := database.NewLogoutToken(user.Index, client)
+		if err != nil {
+			return err
+		}
+
+		go func(uri string, token string) {
+			resp, err := logoutClient.PostForm(uri, url.Values{"logout_token": {token}})
+			if err != nil {
+				log.Println("could not send logout token to: ", uri, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Println("platform rejected logout token: ", uri, resp.StatusCode)
+			}
+		}(pf.LogoutURI, token)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// platformauth contains the authentication of requests made by external platforms. Every
+// platform is issued API keys by an admin and signs each request with the secret of one of
+// its keys. The signature covers the method, path, body, a timestamp and a nonce so that a
+// captured request can't be modified or replayed
+
+// headers that carry the signature of a platform request
+const (
+	PlatformKeyHeader       = "X-Openx-Key"
+	PlatformTimestampHeader = "X-Openx-Timestamp"
+	PlatformNonceHeader     = "X-Openx-Nonce"
+	PlatformSignatureHeader = "X-Openx-Signature"
+)
+
+// PlatformClockSkew is the number of seconds the timestamp of a signed request may differ
+// from the time of the server
+var PlatformClockSkew = int64(300)
+
+// maxPlatformBody is the maximum size of the body of a signed request in bytes
+var maxPlatformBody = int64(1 << 20)
+
+// PlatformSignature returns the hex encoded signature of a platform request. uri is the path
+// of the request along with its query string
+func PlatformSignature(secret []byte, method string, uri string, body []byte,
+	timestamp string, nonce string) string {
+	bodyHash := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + hex.EncodeToString(bodyHash[:]) + "\n" +
+		timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignPlatformRequest signs a request on behalf of a platform with the passed key. body
+// must be the body the request is sent with
+func SignPlatformRequest(r *http.Request, keyID string, secret string, body []byte) {
+	timestamp := strconv.FormatInt(utils.Unix(), 10)
+	nonce := utils.GetRandomString(32)
+
+	r.Header.Set(PlatformKeyHeader, keyID)
+	r.Header.Set(PlatformTimestampHeader, timestamp)
+	r.Header.Set(PlatformNonceHeader, nonce)
+	r.Header.Set(PlatformSignatureHeader,
+		PlatformSignature([]byte(secret), r.Method, r.URL.RequestURI(), body, timestamp, nonce))
+}
+
+// authPlatform verifies the signature of a request made by a platform and checks that the
+// platform has been granted scope. It responds with a 401 if either check fails
+func authPlatform(w http.ResponseWriter, r *http.Request, scope string) (database.Platform, error) {
+	platform, err := verifyPlatformRequest(r)
+	if err != nil {
+		log.Println("could not authenticate platform request to: ", r.URL.Path, err)
+		erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+		return platform, err
+	}
+
+	if !platform.HasScope(scope) {
+		erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+		return platform, errors.New("platform " + strconv.Itoa(platform.Index) + " lacks scope: " + scope)
+	}
+	return platform, nil
+}
+
+// sendPlatformUser sends a user to a platform, stripping its secrets unless the platform has
+// been granted ScopeReadUserSecrets
+func sendPlatformUser(w http.ResponseWriter, platform database.Platform, user database.User) {
+	if !platform.HasScope(database.ScopeReadUserSecrets) {
+		user = user.WithoutSecrets()
+	}
+	erpc.MarshalSend(w, user)
+}
+
+// verifyPlatformRequest checks the signature headers of a request against the key they name
+func verifyPlatformRequest(r *http.Request) (database.Platform, error) {
+	var platform database.Platform
+
+	keyID := r.Header.Get(PlatformKeyHeader)
+	timestamp := r.Header.Get(PlatformTimestampHeader)
+	nonce := r.Header.Get(PlatformNonceHeader)
+	signature := r.Header.Get(PlatformSignatureHeader)
+	if keyID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return platform, errors.New("request is not signed")
+	}
+
+	if len(nonce) < 16 || len(nonce) > 64 {
+		return platform, errors.New("nonce must be between 16 and 64 characters long")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return platform, errors.Wrap(err, "invalid timestamp")
+	}
+	now := utils.Unix()
+	if ts < now-PlatformClockSkew || ts > now+PlatformClockSkew {
+		return platform, errors.New("timestamp outside of the allowed window")
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return platform, errors.Wrap(err, "invalid signature")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxPlatformBody))
+		if err != nil {
+			return platform, errors.Wrap(err, "could not read request body")
+		}
+		r.Body.Close()
+		// the handler reads the body again to parse its params
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	platform, err = database.RetrievePlatformByKey(keyID)
+	if err != nil {
+		return platform, err
+	}
+	if platform.Expired() {
+		return platform, errors.New("platform " + strconv.Itoa(platform.Index) + " has expired")
+	}
+
+	secret, err := platform.KeySecret(keyID)
+	if err != nil {
+		return platform, err
+	}
+
+	expected, err := hex.DecodeString(PlatformSignature(secret, r.Method, r.URL.RequestURI(),
+		body, timestamp, nonce))
+	if err != nil {
+		return platform, err
+	}
+	if !hmac.Equal(sig, expected) {
+		return platform, errors.New("signature does not match")
+	}
+
+	// the nonce only needs to be remembered as long as the timestamp is accepted
+	err = database.UsePlatformNonce(keyID, nonce, ts+PlatformClockSkew)
+	if err != nil {
+		return platform, err
+	}
+	return platform, nil
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"crypto/subtle"
 	"log"
 	"net/http"
 
@@ -12,12 +13,11 @@ import (
 	utils "github.com/Varunram/essentials/utils"
 	consts "github.com/YaleOpenLab/openx/consts"
 	database "github.com/YaleOpenLab/openx/database"
-	"github.com/pkg/errors"
 )
 
 // this file has routes that are to be exclusively used by external platforms in order to call
-// data that is exclusive to openx. These platforms can request a code to be generated and they
-// can call openx's endpoints
+// data that is exclusive to openx. These platforms are issued API keys by an admin and sign
+// their requests to openx's endpoints with them (see platformauth.go)
 
 // setupPlatformRoutes sets up routes that are related with external third party platforms
 // which need information from openx to operate
@@ -42,7 +42,7 @@ var PlatformRPC = map[int][]string{
 	4: {"/platform/user/collision", "username"},                         // GET
 	5: {"/platforms/all"},                                               // GET NOAUTH
 	6: {"/platform/email", "body", "to"},                                // POST
-	7: {"/platform/user/confirm", "username", "pwhash", "code"},         // GET
+	7: {"/platform/user/confirm", "username", "pwhash", "confcode"},     // GET
 }
 
 // mainnetRPC is an RPC that reutrns 0 if openx is running on mainnet, 1 if running on testnet
@@ -61,47 +61,6 @@ func mainnetRPC() {
 	})
 }
 
-func authPlatform(w http.ResponseWriter, r *http.Request) error {
-	var code string
-	if r.Method == "GET" {
-		if r.URL.Query()["code"] == nil {
-			erpc.ResponseHandler(w, erpc.StatusBadRequest)
-			return errors.New("required params code and name not found in request")
-		}
-
-		code = r.URL.Query()["code"][0]
-	} else if r.Method == "POST" {
-		log.Println("platform post call")
-		err := r.ParseForm()
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return errors.New("required params code and name not found in request")
-		}
-
-		code = r.FormValue("code")
-		if code == "" {
-			erpc.ResponseHandler(w, erpc.StatusBadRequest)
-			return errors.New("required param code not found in request")
-		}
-	}
-
-	log.Println("Platform's code: ", code)
-
-	platforms, err := database.RetrieveAllPlatforms()
-	if erpc.Err(w, err, erpc.StatusBadRequest) {
-		return err
-	}
-
-	for _, platform := range platforms {
-		log.Println(platform.Code, platform.Name, platform.Code == code, utils.Unix(), platform.Timeout)
-		if platform.Code == code && utils.Unix() < platform.Timeout {
-			return nil
-		}
-	}
-
-	erpc.ResponseHandler(w, erpc.StatusBadRequest)
-	return errors.New("could not authenticate platform, quitting")
-}
-
 // OpensolarConstReturn is a struct that can be used to export consts from openx
 type OpensolarConstReturn struct {
 	PlatformPublicKey   string
@@ -113,7 +72,7 @@ type OpensolarConstReturn struct {
 	AnchorUSDCode       string
 	AnchorUSDAddress    string
 	AnchorUSDTrustLimit float64
-	AnchorAPI           string
+	Anchors             []string
 	Mainnet             bool
 	DbDir               string
 }
@@ -127,7 +86,7 @@ func pfGetConsts() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		pf, err := authPlatform(w, r, database.ScopeReadConsts)
 		if err != nil {
 			log.Println(err)
 			return
@@ -136,15 +95,17 @@ func pfGetConsts() {
 		log.Println("authenticated opensolar platform, sending consts")
 		var x OpensolarConstReturn
 		x.PlatformPublicKey = consts.PlatformPublicKey
-		x.PlatformSeed = consts.PlatformSeed
 		x.PlatformEmail = consts.PlatformEmail
-		x.PlatformEmailPass = consts.PlatformEmailPass
+		if pf.HasScope(database.ScopeReadSecrets) {
+			x.PlatformSeed = consts.PlatformSeed
+			x.PlatformEmailPass = consts.PlatformEmailPass
+		}
 		x.StablecoinCode = consts.StablecoinCode
 		x.StablecoinPublicKey = consts.StablecoinPublicKey
 		x.AnchorUSDCode = consts.AnchorUSDCode
 		x.AnchorUSDAddress = consts.AnchorUSDAddress
 		x.AnchorUSDTrustLimit = consts.AnchorUSDTrustLimit
-		x.AnchorAPI = consts.AnchorAPI
+		x.Anchors = consts.Anchors
 		x.Mainnet = consts.Mainnet
 
 		x.DbDir = consts.DbDir
@@ -162,7 +123,7 @@ func pfGetUser() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		pf, err := authPlatform(w, r, database.ScopeReadUser)
 		if err != nil {
 			return
 		}
@@ -182,11 +143,12 @@ func pfGetUser() {
 			return
 		}
 
-		erpc.MarshalSend(w, user)
+		sendPlatformUser(w, pf, user)
 	})
 }
 
-// pfValidateUser takes in a username and token and returns the user struct
+// pfValidateUser takes in a username and token and returns the user struct. Platforms that
+// shouldn't handle user tokens can use the OAuth2 endpoints in oauth.go instead
 func pfValidateUser() {
 	http.HandleFunc(PlatformRPC[2][0], func(w http.ResponseWriter, r *http.Request) {
 		log.Println("external platform requests validation")
@@ -196,7 +158,7 @@ func pfValidateUser() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		pf, err := authPlatform(w, r, database.ScopeValidateUser)
 		if err != nil {
 			log.Println(err)
 			return
@@ -215,7 +177,7 @@ func pfValidateUser() {
 			return
 		}
 
-		erpc.MarshalSend(w, user)
+		sendPlatformUser(w, pf, user)
 	})
 }
 
@@ -228,7 +190,7 @@ func pfNewUser() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		pf, err := authPlatform(w, r, database.ScopeCreateUser)
 		if err != nil {
 			log.Println(err)
 			return
@@ -255,7 +217,7 @@ func pfNewUser() {
 			return
 		}
 
-		erpc.MarshalSend(w, user)
+		sendPlatformUser(w, pf, user)
 	})
 }
 
@@ -268,7 +230,7 @@ func pfCollisionCheck() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		_, err = authPlatform(w, r, database.ScopeReadUser)
 		if err != nil {
 			return
 		}
@@ -323,7 +285,7 @@ func pfSendEmail() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		_, err = authPlatform(w, r, database.ScopeSendEmail)
 		if err != nil {
 			log.Println(err)
 			return
@@ -358,29 +320,47 @@ func pfConfirmUser() {
 			return
 		}
 
-		err = authPlatform(w, r)
+		pf, err := authPlatform(w, r, database.ScopeCreateUser)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 
-		if r.URL.Query()["username"] == nil || r.URL.Query()["pwhash"] == nil || r.URL.Query()["code"] == nil {
-			log.Println("username / pwhash missing")
+		if r.URL.Query()["username"] == nil || r.URL.Query()["pwhash"] == nil || r.URL.Query()["confcode"] == nil {
+			log.Println("username / pwhash / confcode missing")
 			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
+
+		if rateLimited(w, r) {
+			return
 		}
 
 		name := r.URL.Query()["username"][0]
 		pwhash := r.URL.Query()["pwhash"][0]
 		confcode := r.URL.Query()["confcode"][0]
 
+		// look the user up first so that failed attempts count towards the lockout of the account
+		lUser, lErr := database.RetrieveUserByUsername(name)
+		if lErr == nil && checkLockout(w, lUser) {
+			return
+		}
+
 		user, err := database.ValidatePwhashReg(name, pwhash)
+		if err != nil && lErr == nil {
+			authFailed(r, lUser)
+		}
 		if erpc.Err(w, err, erpc.StatusBadRequest, "error while validating user") {
 			return
 		}
 
-		if confcode != user.ConfToken {
+		if user.ConfToken == "" || subtle.ConstantTimeCompare([]byte(confcode), []byte(user.ConfToken)) != 1 {
 			log.Println("provided code does not match with required code")
+			authFailed(r, user)
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
 		}
+		authSucceeded(user)
 
 		user.Conf = true
 		user.ConfToken = ""
@@ -389,6 +369,6 @@ func pfConfirmUser() {
 			return
 		}
 
-		erpc.MarshalSend(w, user)
+		sendPlatformUser(w, pf, user)
 	})
 }
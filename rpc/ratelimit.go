@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	database "github.com/YaleOpenLab/openx/database"
+	notif "github.com/YaleOpenLab/openx/notif"
+)
+
+// ratelimit contains the rate limiting of authentication endpoints and the helpers that lock
+// accounts out after repeated failed attempts. Requests are limited with token buckets keyed
+// by the ip of the client and by the username the request is made for, so that a single
+// client can't hammer many accounts and many clients can't hammer a single account
+
+// rateLimitPolicy is a token bucket that holds Burst requests and refills Rate per second
+type rateLimitPolicy struct {
+	Rate  float64
+	Burst float64
+}
+
+// routePolicy holds the limits of a route for a single ip and a single username
+type routePolicy struct {
+	IP   rateLimitPolicy
+	User rateLimitPolicy
+	// UserParam is the param the User limit is keyed on, username if empty
+	UserParam string
+}
+
+// rateLimits are the limits of the rate limited routes. The username limits are tighter
+// since an attacker only needs one ip to guess the codes of a user
+var rateLimits = map[string]routePolicy{
+	UserRPC[0][0]: {
+		IP:   rateLimitPolicy{Rate: 1, Burst: 20},
+		User: rateLimitPolicy{Rate: 1.0 / 10, Burst: 10},
+	},
+	UserRPC[20][0]: {
+		IP:   rateLimitPolicy{Rate: 1.0 / 10, Burst: 10},
+		User: rateLimitPolicy{Rate: 1.0 / 60, Burst: 5},
+	},
+	UserRPC[23][0]: {
+		IP:   rateLimitPolicy{Rate: 1.0 / 10, Burst: 10},
+		User: rateLimitPolicy{Rate: 1.0 / 60, Burst: 5},
+	},
+	UserRPC[29][0]: {
+		IP:   rateLimitPolicy{Rate: 1.0 / 5, Burst: 10},
+		User: rateLimitPolicy{Rate: 1.0 / 30, Burst: 5},
+	},
+	UserRPC[51][0]: {
+		IP:   rateLimitPolicy{Rate: 1, Burst: 20},
+		User: rateLimitPolicy{Rate: 1.0 / 10, Burst: 10},
+	},
+	UserRPC[44][0]: {
+		IP:   rateLimitPolicy{Rate: 1.0 / 10, Burst: 10},
+		User: rateLimitPolicy{Rate: 1.0 / 60, Burst: 5},
+	},
+	PlatformRPC[7][0]: {
+		IP:   rateLimitPolicy{Rate: 1, Burst: 20},
+		User: rateLimitPolicy{Rate: 1.0 / 60, Burst: 5},
+	},
+	// SEP-10 requests carry no username, so only the ip limit applies
+	Sep10RPC[0][0]: {
+		IP: rateLimitPolicy{Rate: 1, Burst: 20},
+	},
+	// federation lookups are limited per ip so usernames can't be enumerated quickly and per
+	// queried address so a single address can't be hammered from many ips
+	FederationRPC[1][0]: {
+		IP:        rateLimitPolicy{Rate: 1, Burst: 30},
+		User:      rateLimitPolicy{Rate: 1.0 / 2, Burst: 10},
+		UserParam: "q",
+	},
+}
+
+// maxRateLimitBuckets is the number of buckets above which full buckets are dropped
+var maxRateLimitBuckets = 10000
+
+// tokenBucket is the state of a single rate limited key
+type tokenBucket struct {
+	policy rateLimitPolicy
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets of all rate limited keys
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// refill adds the tokens accumulated since the last request to the bucket
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.policy.Rate
+	if b.tokens > b.policy.Burst {
+		b.tokens = b.policy.Burst
+	}
+	b.last = now
+}
+
+// take takes a token from the bucket of key. If the bucket is empty, the time until the
+// next token is available is returned
+func (l *rateLimiter) take(key string, policy rateLimitPolicy, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.sweep(now)
+		}
+		b = &tokenBucket{policy: policy, tokens: policy.Burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now)
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / b.policy.Rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that have refilled completely since they behave the same as new
+// ones. Caller must hold the lock
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.policy.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the ip address a request was made from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited takes a token for the ip and username (or the route's UserParam) of the request
+// from the buckets of the route. If either bucket is empty it responds with a 429 and returns true
+func rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	route := r.URL.Path
+	policy, ok := rateLimits[route]
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	param := policy.UserParam
+	if param == "" {
+		param = "username"
+	}
+
+	allowed, wait := limiter.take(route+"|ip|"+clientIP(r), policy.IP, now)
+	if allowed {
+		if username := r.FormValue(param); username != "" {
+			allowed, wait = limiter.take(route+"|user|"+username, policy.User, now)
+		}
+	}
+	if allowed {
+		return false
+	}
+
+	log.Println("rate limited request to: ", route, " from: ", clientIP(r))
+	tooManyRequests(w, int64(math.Ceil(wait.Seconds())))
+	return true
+}
+
+// tooManyRequests responds with a 429 telling the client to retry after the passed seconds
+func tooManyRequests(w http.ResponseWriter, retryAfter int64) {
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	erpc.ResponseHandler(w, erpc.StatusTooManyRequests)
+}
+
+// checkLockout responds with a 429 and returns true if the account of the user is locked
+func checkLockout(w http.ResponseWriter, user database.User) bool {
+	lockout, err := database.RetrieveLockout(user.Index)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return true
+	}
+
+	retryAfter := lockout.RetryAfter()
+	if retryAfter == 0 {
+		return false
+	}
+
+	log.Println("user: ", user.Index, " is locked out for: ", retryAfter)
+	tooManyRequests(w, retryAfter)
+	return true
+}
+
+// authFailed records a failed authentication attempt of the user. If the attempt locks the
+// account, the user is sent the code that unlocks it
+func authFailed(r *http.Request, user database.User) {
+	lockout, code, err := database.RecordAuthFailure(user.Index)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if code == "" {
+		return
+	}
+
+	auditLog(r, user, database.AuditLockout, strconv.Itoa(user.Index),
+		"locked until "+strconv.FormatInt(lockout.LockedUntil, 10))
+
+	err = notif.SendUnlockEmail(user.Email, code)
+	if err != nil {
+		log.Println("could not send unlock email to user: ", user.Index, err)
+	}
+}
+
+// authSucceeded clears the failed authentication attempts of the user
+func authSucceeded(user database.User) {
+	err := database.ClearAuthFailures(user.Index)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -26,6 +26,10 @@ func StartServer(portx int, insecure bool) {
 	setupCAHandlers()
 	adminHandlers()
 	setupPlatformRoutes()
+	setupOAuthRoutes()
+	setupOIDCRoutes()
+	setupSep10Routes()
+	setupFederationRoutes()
 
 	port, err := utils.ToString(portx)
 	if err != nil {
@@ -0,0 +1,252 @@
+package rpc
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	xlm "github.com/Varunram/essentials/xlm"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+	horizon "github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// sep10 contains the SEP-10 Stellar Web Authentication endpoint. Wallets prove that they hold
+// the keys of a user's Stellar account by signing a challenge transaction issued and signed
+// with the platform seed, and get an openx session for the user in return without a password.
+// Challenges are verified against the signers and medium threshold of the account so accounts
+// protected by multisig need enough signers to log in
+
+// setupSep10Routes sets up the SEP-10 routes
+func setupSep10Routes() {
+	sep10Auth()
+}
+
+// Sep10RPC contains the SEP-10 RPCs. Both are served at the same endpoint as the SEP requires
+var Sep10RPC = map[int][]string{
+	0: {"/auth", "GET", "account"},      // GET
+	1: {"/auth", "POST", "transaction"}, // POST
+}
+
+// Sep10ChallengeLife is the number of seconds a SEP-10 challenge can be signed and sent back in
+var Sep10ChallengeLife = int64(300)
+
+// ChallengeResponse is a SEP-10 challenge
+type ChallengeResponse struct {
+	Transaction       string `json:"transaction"`
+	NetworkPassphrase string `json:"network_passphrase"`
+}
+
+// Sep10TokenResponse is the session token issued for a signed SEP-10 challenge
+type Sep10TokenResponse struct {
+	Token string `json:"token"`
+}
+
+// sep10ErrorResponse is an error as defined in SEP-10
+type sep10ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// sep10Error responds with a SEP-10 error
+func sep10Error(w http.ResponseWriter, status int, description string) {
+	log.Println("sep10 error: ", description)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(sep10ErrorResponse{Error: description})
+}
+
+// sep10Signers returns the signers of the account and the weight they need to log in. exists
+// is false if the account hasn't been created on Stellar yet
+var sep10Signers = func(account string) (build.SignerSummary, build.Threshold, bool, error) {
+	acc, err := xlm.TestNetClient.AccountDetail(horizon.AccountRequest{AccountID: account})
+	if horizon.IsNotFoundError(err) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, errors.Wrap(err, "could not load account")
+	}
+
+	signers := make(build.SignerSummary)
+	for _, signer := range acc.Signers {
+		// signers without weight, like a disabled master key, can't contribute to logging in
+		if signer.Weight > 0 {
+			signers[signer.Key] = signer.Weight
+		}
+	}
+	threshold := build.Threshold(acc.Thresholds.MedThreshold)
+	if threshold == 0 {
+		threshold = 1
+	}
+	return signers, threshold, true, nil
+}
+
+// newChallenge returns a challenge for the account signed with the platform seed
+func newChallenge(account string) (string, error) {
+	_, err := keypair.ParseAddress(account)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid account")
+	}
+	if consts.PlatformSeed == "" {
+		return "", errors.New("platform seed not loaded")
+	}
+
+	tx, err := build.BuildChallengeTx(consts.PlatformSeed, account, consts.HomeDomain, xlm.Passphrase,
+		time.Duration(Sep10ChallengeLife)*time.Second)
+	if err != nil {
+		return "", errors.Wrap(err, "could not build challenge")
+	}
+	return tx.Base64()
+}
+
+// readChallenge checks that a challenge was issued by the platform and hasn't expired. It
+// returns the account the challenge was issued for along with the hash and expiry of the challenge
+func readChallenge(txe string) (string, string, int64, error) {
+	tx, account, err := build.ReadChallengeTx(txe, consts.PlatformPublicKey, xlm.Passphrase)
+	if err != nil {
+		return "", "", 0, errors.Wrap(err, "invalid challenge")
+	}
+	hash, err := tx.HashHex(xlm.Passphrase)
+	if err != nil {
+		return "", "", 0, errors.Wrap(err, "could not hash challenge")
+	}
+	return account, hash, tx.Timebounds().MaxTime, nil
+}
+
+// verifyChallenge checks that the challenge has been signed by enough signers of the account
+// it was issued for. Accounts that don't exist yet have to sign with their master key
+func verifyChallenge(txe string, account string) error {
+	signers, threshold, exists, err := sep10Signers(account)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = build.VerifyChallengeTxSigners(txe, consts.PlatformPublicKey, xlm.Passphrase, account)
+	} else {
+		_, err = build.VerifyChallengeTxThreshold(txe, consts.PlatformPublicKey, xlm.Passphrase, threshold, signers)
+	}
+	return err
+}
+
+// challengeTx returns the signed challenge sent as JSON or as a form. SEP-10 wallets usually
+// send JSON, so the second factor and device of JSON bodies are copied into the form of the
+// request where missing2FA and sep10Token read them
+func challengeTx(r *http.Request) (string, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return r.FormValue("transaction"), nil
+	}
+
+	var x struct {
+		Transaction string          `json:"transaction"`
+		Otp         string          `json:"otp"`
+		Webauthn    json.RawMessage `json:"webauthn"`
+		Device      string          `json:"device"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&x)
+	if err != nil {
+		return "", err
+	}
+
+	// webauthn assertions can be sent as an object or as a string holding one
+	var webauthn string
+	if len(x.Webauthn) != 0 && json.Unmarshal(x.Webauthn, &webauthn) != nil {
+		webauthn = string(x.Webauthn)
+	}
+	r.Form = url.Values{"otp": {x.Otp}, "webauthn": {webauthn}, "device": {x.Device}}
+	r.PostForm = r.Form
+	return x.Transaction, nil
+}
+
+// sep10Auth issues challenges on GET and exchanges signed challenges for session tokens on POST
+func sep10Auth() {
+	http.HandleFunc(Sep10RPC[0][0], func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(w, r) {
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			txe, err := newChallenge(r.URL.Query().Get("account"))
+			if err != nil {
+				sep10Error(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			erpc.MarshalSend(w, ChallengeResponse{Transaction: txe, NetworkPassphrase: xlm.Passphrase})
+		case "POST":
+			sep10Token(w, r)
+		default:
+			sep10Error(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+// sep10Token verifies a signed challenge and issues a session for the user whose Stellar
+// account it was issued for
+func sep10Token(w http.ResponseWriter, r *http.Request) {
+	txe, err := challengeTx(r)
+	if err != nil || txe == "" {
+		sep10Error(w, http.StatusBadRequest, "signed challenge not found")
+		return
+	}
+
+	account, hash, expiry, err := readChallenge(txe)
+	if err != nil {
+		sep10Error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := database.RetrieveUserByPubkey(account)
+	if err != nil {
+		sep10Error(w, http.StatusUnauthorized, "no user with this account")
+		return
+	}
+
+	if checkLockout(w, user) {
+		recordLogin(r, user, database.LoginLocked)
+		return
+	}
+
+	err = verifyChallenge(txe, account)
+	if err != nil {
+		authFailed(r, user)
+		recordLogin(r, user, database.LoginBadSignature)
+		sep10Error(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// signing a challenge takes the place of the password, so users who enrolled a second
+	// factor always need it to log in regardless of TwoFARoutes. It is checked before the
+	// challenge is used up so a mistyped otp can be retried with the same challenge
+	if missing2FA(w, r, &user) {
+		recordLogin(r, user, database.LoginBad2FA)
+		return
+	}
+
+	// challenges can only be used once
+	err = database.UseChallenge(hash, expiry)
+	if err != nil {
+		sep10Error(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	authSucceeded(user)
+	recordLogin(r, user, database.LoginSuccess)
+
+	device := r.FormValue("device")
+	if device == "" {
+		device = "SEP-10 wallet"
+	}
+	token, err := user.NewSession(device, r.RemoteAddr)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return
+	}
+
+	erpc.MarshalSend(w, Sep10TokenResponse{Token: token})
+}
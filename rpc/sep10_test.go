@@ -0,0 +1,254 @@
+// +build all travis
+
+package rpc
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	googauth "github.com/Varunram/essentials/googauth"
+	utils "github.com/Varunram/essentials/utils"
+	xlm "github.com/Varunram/essentials/xlm"
+	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// signChallenge returns a new challenge for the account signed with the passed keys
+func signChallenge(t *testing.T, account string, kps ...*keypair.Full) string {
+	txe, err := newChallenge(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gtx, err := build.TransactionFromXDR(txe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := gtx.Transaction()
+	tx, err = tx.Sign(xlm.Passphrase, kps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txe, err = tx.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txe
+}
+
+// postChallenge sends a signed challenge to the token handler
+func postChallenge(txe string) *httptest.ResponseRecorder {
+	return postChallengeForm(url.Values{"transaction": {txe}})
+}
+
+// postChallengeForm sends a signed challenge along with other params to the token handler
+func postChallengeForm(form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", Sep10RPC[1][0], strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	sep10Token(w, r)
+	return w
+}
+
+// postChallengeJSON sends a signed challenge along with other params as JSON to the token handler
+func postChallengeJSON(body map[string]string) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest("POST", Sep10RPC[1][0], strings.NewReader(string(data)))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	sep10Token(w, r)
+	return w
+}
+
+func TestSep10(t *testing.T) {
+	consts.SetConsts(false)
+	database.SetStore(database.NewMemoryStore())
+	defer database.SetStore(database.NewBoltStore(""))
+	database.CreateHomeDir()
+
+	platform, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSeed, oldPubkey, oldSigners := consts.PlatformSeed, consts.PlatformPublicKey, sep10Signers
+	consts.PlatformSeed, consts.PlatformPublicKey = platform.Seed(), platform.Address()
+	defer func() {
+		consts.PlatformSeed, consts.PlatformPublicKey, sep10Signers = oldSeed, oldPubkey, oldSigners
+	}()
+
+	client, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosigner, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := database.NewUser("sep10user", utils.SHA3hash("pass"), "x", "sep10@openx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.StellarWallet.PublicKey = client.Address()
+	user.Conf = true
+	err = user.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newChallenge("notanaccount")
+	if err == nil {
+		t.Fatalf("challenge issued for an invalid account")
+	}
+
+	// accounts that don't exist yet log in with their master key
+	sep10Signers = func(account string) (build.SignerSummary, build.Threshold, bool, error) {
+		return nil, 0, false, nil
+	}
+	txe := signChallenge(t, client.Address(), client)
+	w := postChallenge(txe)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed challenge rejected: %d %s", w.Code, w.Body.String())
+	}
+	var x Sep10TokenResponse
+	err = json.Unmarshal(w.Body.Bytes(), &x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = database.ValidateAccessToken(user.Username, x.Token)
+	if err != nil {
+		t.Fatalf("issued token isn't a valid session: %v", err)
+	}
+
+	w = postChallenge(txe)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("replayed challenge accepted: %d", w.Code)
+	}
+
+	w = postChallenge(signChallenge(t, client.Address()))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unsigned challenge accepted: %d", w.Code)
+	}
+	w = postChallenge(signChallenge(t, client.Address(), cosigner))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("challenge signed by another key accepted: %d", w.Code)
+	}
+
+	// challenges not issued by the platform are rejected
+	other, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := build.BuildChallengeTx(other.Seed(), client.Address(), consts.HomeDomain, xlm.Passphrase, 300e9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err = forged.Sign(xlm.Passphrase, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedTxe, err := forged.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = postChallenge(forgedTxe)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("forged challenge accepted: %d", w.Code)
+	}
+
+	// multisig accounts need enough signers to meet the threshold
+	sep10Signers = func(account string) (build.SignerSummary, build.Threshold, bool, error) {
+		return build.SignerSummary{client.Address(): 1, cosigner.Address(): 1}, 2, true, nil
+	}
+	w = postChallenge(signChallenge(t, client.Address(), client))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("challenge below threshold accepted: %d", w.Code)
+	}
+	w = postChallenge(signChallenge(t, client.Address(), client, cosigner))
+	if w.Code != http.StatusOK {
+		t.Fatalf("challenge meeting threshold rejected: %d %s", w.Code, w.Body.String())
+	}
+
+	// a disabled master key can't log in
+	sep10Signers = func(account string) (build.SignerSummary, build.Threshold, bool, error) {
+		return build.SignerSummary{cosigner.Address(): 1}, 1, true, nil
+	}
+	w = postChallenge(signChallenge(t, client.Address(), client))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("challenge signed by a disabled master key accepted: %d", w.Code)
+	}
+
+	logins, err := database.QueryLogins(database.LoginQuery{User: user.Index, Outcome: database.LoginBadSignature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 4 {
+		t.Fatalf("expected 4 failed logins, got %d", len(logins))
+	}
+
+	// users who enrolled a second factor need it to log in with SEP-10 as well
+	sep10Signers = func(account string) (build.SignerSummary, build.Threshold, bool, error) {
+		return nil, 0, false, nil
+	}
+	user, err = database.RetrieveUser(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = user.Generate2FA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Unix()%30 > 27 {
+		time.Sleep(3 * time.Second)
+	}
+	code := googauth.ComputeCode(base32.StdEncoding.EncodeToString([]byte(user.TwoFAPendingSecret)), time.Now().Unix()/30)
+	backupCodes, err := user.Confirm2FA(fmt.Sprintf("%06d", code))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = postChallenge(signChallenge(t, client.Address(), client))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("challenge accepted without a second factor: %d", w.Code)
+	}
+	// a mistyped otp doesn't use up the challenge
+	txe = signChallenge(t, client.Address(), client)
+	w = postChallengeForm(url.Values{"transaction": {txe}, "otp": {"000000"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("challenge accepted with a wrong otp: %d", w.Code)
+	}
+	w = postChallengeForm(url.Values{"transaction": {txe}, "otp": {backupCodes[0]}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("challenge with a second factor rejected: %d %s", w.Code, w.Body.String())
+	}
+
+	// wallets sending JSON pass the second factor in the body as well
+	w = postChallengeJSON(map[string]string{"transaction": signChallenge(t, client.Address(), client)})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("JSON challenge accepted without a second factor: %d", w.Code)
+	}
+	w = postChallengeJSON(map[string]string{"transaction": signChallenge(t, client.Address(), client),
+		"otp": backupCodes[1], "device": "json wallet"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("JSON challenge with a second factor rejected: %d %s", w.Code, w.Body.String())
+	}
+	sessions, err := database.RetrieveSessions(user.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, session := range sessions {
+		found = found || session.Device == "json wallet"
+	}
+	if !found {
+		t.Fatalf("device sent as JSON not stored with the session")
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"log"
 	"net/http"
 
+	tickers "github.com/Varunram/essentials/exchangetickers"
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
-	stablecoin "github.com/Varunram/essentials/xlm/stablecoin"
-	wallet "github.com/Varunram/essentials/xlm/wallet"
+	xlm "github.com/Varunram/essentials/xlm"
 	consts "github.com/YaleOpenLab/openx/consts"
+	database "github.com/YaleOpenLab/openx/database"
+	build "github.com/stellar/go/txnbuild"
 )
 
 // StablecoinRPC is a collection of all stablecoin RPC endpoints and their required params
@@ -43,23 +45,22 @@ func getTestStableCoin() {
 			return
 		}
 
-		receiverSeed, err := wallet.DecryptSeed(user.StellarWallet.EncryptedSeed, r.URL.Query()["seedpwd"][0])
-		if err != nil {
-			return
-		}
 		amount, err := utils.ToFloat(r.URL.Query()["amount"][0])
 		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
-		receiverPubkey, err := wallet.ReturnPubkey(receiverSeed)
-		if erpc.Err(w, err, erpc.StatusBadRequest, "did not return pubkey") {
+		if xlm.GetNativeBalance(user.StellarWallet.PublicKey) < amount {
+			log.Println("balance is less than amount requested")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
 			return
 		}
 
-		err = stablecoin.Exchange(receiverPubkey, receiverSeed, amount)
-		if err != nil {
-			log.Println("did not exchange for xlm", err)
+		// trust the stablecoin and send xlm to the stablecoin account in one transaction, the
+		// stablecoin is sent back once the payment is seen
+		_, err = exchangeXLM(user, r.URL.Query()["seedpwd"][0], consts.StablecoinCode, consts.StablecoinPublicKey,
+			consts.StablecoinTrustLimit, amount, "Exchange XLM for stablecoin")
+		if erpc.Err(w, err, erpc.StatusInternalServerError, "did not exchange for xlm") {
 			return
 		}
 
@@ -67,6 +68,29 @@ func getTestStableCoin() {
 	})
 }
 
+// exchangeXLM trusts a stablecoin from the user's wallet and sends XLM to the stablecoin's
+// account which sends the stablecoin back
+func exchangeXLM(user database.User, seedpwd string, code string, issuer string, limit float64,
+	amount float64, memo string) (string, error) {
+	limitString, err := utils.ToString(limit)
+	if err != nil {
+		return "", err
+	}
+	amountString, err := utils.ToString(amount)
+	if err != nil {
+		return "", err
+	}
+
+	return user.SubmitTx(seedpwd, memo, &build.ChangeTrust{
+		Line:  build.CreditAsset{Code: code, Issuer: issuer},
+		Limit: limitString,
+	}, &build.Payment{
+		Destination: issuer,
+		Amount:      amountString,
+		Asset:       build.NativeAsset{},
+	})
+}
+
 // GetAnchorResponse is a wrapper around the txhash for sent XLM
 type GetAnchorResponse struct {
 	Txhash string // this tx hash is for the sent xlm, not for the received anchorUSD
@@ -88,7 +112,7 @@ func getAnchorUSD() {
 
 		if !user.Kyc || user.Banned {
 			// banned or user without kyc is trying to request stablecoin, don't allow
-			log.Println("user who is not verified under kyc / is sanctioned is requesting stablecoin: ", user.Name, user.Pwhash)
+			log.Println("user who is not verified under kyc / is sanctioned is requesting stablecoin: ", user.Name)
 			erpc.ResponseHandler(w, erpc.StatusNotAcceptable)
 			return
 		}
@@ -113,17 +137,19 @@ func getAnchorUSD() {
 				return
 			}
 
-			seed, err := wallet.DecryptSeed(user.StellarWallet.EncryptedSeed, r.URL.Query()["seedpwd"][0])
+			amount, err := utils.ToFloat(r.URL.Query()["amount"][0]) // amount that the person wants to get. This must be in USD
 			if erpc.Err(w, err, erpc.StatusBadRequest) {
 				return
 			}
 
-			amount, err := utils.ToFloat(r.URL.Query()["amount"][0]) // amount that the person wants to get. This must be in USD
-			if erpc.Err(w, err, erpc.StatusBadRequest) {
+			// the amount is in USD, but we're sending XLM
+			exchangeRate, err := tickers.XLMUSD()
+			if erpc.Err(w, err, erpc.StatusInternalServerError, "error in fetching price from oracle") {
 				return
 			}
 
-			txhash, err := stablecoin.GetAnchorUSD(seed, amount)
+			txhash, err := exchangeXLM(user, r.URL.Query()["seedpwd"][0], consts.AnchorUSDCode, consts.AnchorUSDAddress,
+				consts.AnchorUSDTrustLimit, exchangeRate*amount, "Exchange XLM for anchorUSD")
 			if erpc.Err(w, err, erpc.StatusInternalServerError, "error in fetching stablecoin, quitting") {
 				return
 			}
@@ -0,0 +1,247 @@
+package rpc
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	utils "github.com/Varunram/essentials/utils"
+	anchor "github.com/YaleOpenLab/openx/anchor"
+	database "github.com/YaleOpenLab/openx/database"
+	notif "github.com/YaleOpenLab/openx/notif"
+)
+
+// transfers keeps track of the deposits and withdrawals users start with anchors. Transfers
+// are recorded along with the SEP-10 token they were started with and a background poller
+// asks anchors for their status until they complete or fail, at which point the user is
+// notified. Tokens expire after a while, users can log in with the anchors again to have
+// their pending transfers polled further (AnchorRPC 5)
+
+// TransferPollInterval is the number of seconds between polls of pending transfers
+var TransferPollInterval = 600
+
+// errTokenExpired is returned when a transfer can't be polled until the user logs in with the
+// anchor again
+var errTokenExpired = errors.New("anchor token of transfer expired")
+
+// transferStatus is the status transfers start with
+func transferStatus(protocol string) string {
+	if protocol == anchor.SEP24 {
+		return "incomplete"
+	}
+	return "pending_user_transfer_start"
+}
+
+// recordTransfer records a transfer the user started with the anchor
+func recordTransfer(user database.User, client *anchor.Client, token anchor.Token, protocol string,
+	kind string, req anchor.TransferRequest, id string) error {
+
+	t := database.Transfer{
+		User:     user.Index,
+		Anchor:   client.HomeDomain,
+		Protocol: protocol,
+		ID:       id,
+		Kind:     kind,
+		Asset:    req.AssetCode,
+		Amount:   req.Amount,
+		Status:   transferStatus(protocol),
+	}
+	err := t.SetToken(token.Value, token.Expiry)
+	if err != nil {
+		return err
+	}
+	_, err = database.NewTransfer(t)
+	return err
+}
+
+// setTransferToken replaces the token the transfer is polled with
+func setTransferToken(t *database.Transfer, token anchor.Token) error {
+	var tokenErr error
+	_, updated, err := database.UpdateTransfer(t.User, t.Anchor, t.ID, func(x *database.Transfer) bool {
+		tokenErr = x.SetToken(token.Value, token.Expiry)
+		return tokenErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if tokenErr != nil {
+		return tokenErr
+	}
+	*t = updated
+	return nil
+}
+
+// notifyTransfer tells the user that their transfer has completed or failed
+var notifyTransfer = func(t database.Transfer) {
+	user, err := database.RetrieveUser(t.User)
+	if err != nil {
+		log.Println("could not retrieve user to notify about transfer: ", t.User, err)
+		return
+	}
+
+	subject := fmt.Sprintf("Your %s of %s %s completed", t.Kind, t.Amount, t.Asset)
+	if t.Status != "completed" {
+		subject = fmt.Sprintf("Your %s of %s %s failed", t.Kind, t.Amount, t.Asset)
+	}
+	message := fmt.Sprintf("Your %s with %s ended with status %s", t.Kind, t.Anchor, t.Status)
+	if t.StellarTxHash != "" {
+		message += ", Stellar transaction: " + t.StellarTxHash
+	}
+	err = user.AddtoMailbox(subject, message)
+	if err != nil {
+		log.Println("could not add transfer notification to mailbox of user: ", t.User, err)
+	}
+
+	err = notif.SendTransferEmail(user.Email, t.Kind, t.Amount, t.Asset, t.Anchor, t.Status, t.StellarTxHash)
+	if err != nil {
+		log.Println("could not send transfer email to user: ", t.User, err)
+	}
+}
+
+// updateTransfer records the status the anchor reported for the transfer and notifies the
+// user when the transfer completes or fails. The poller and the user can update a transfer at
+// the same time, so the user is only notified by the update that finished the stored transfer
+func updateTransfer(t *database.Transfer, tx anchor.Transaction) error {
+	old, updated, err := database.UpdateTransfer(t.User, t.Anchor, t.ID, func(x *database.Transfer) bool {
+		changed := false
+		// users choose the amount of interactive transfers in the anchor's flow
+		if x.Amount == "" && tx.AmountIn != "" {
+			x.Amount = tx.AmountIn
+			changed = true
+		}
+		return x.SetStatus(tx.Status, tx.Message, tx.StellarTransactionID, tx.Final()) || changed
+	})
+	if err != nil {
+		return err
+	}
+
+	*t = updated
+	if updated.Done && !old.Done {
+		notifyTransfer(updated)
+	}
+	return nil
+}
+
+// pollTransfer asks the anchor for the status of the transfer and records it
+func pollTransfer(t database.Transfer) error {
+	client, err := anchor.Get(t.Anchor)
+	if err != nil {
+		return err
+	}
+
+	token, err := t.PollToken()
+	if err != nil {
+		return err
+	}
+	if (anchor.Token{Value: token, Expiry: t.TokenExpiry}).Expired(utils.Unix()) {
+		return errTokenExpired
+	}
+
+	tx, err := client.Transaction(token, t.Protocol, t.ID)
+	if err != nil {
+		return err
+	}
+	return updateTransfer(&t, tx)
+}
+
+// pollTransfers polls all pending transfers once
+func pollTransfers() {
+	transfers, err := database.RetrievePendingTransfers()
+	if err != nil {
+		log.Println("could not retrieve pending transfers: ", err)
+		return
+	}
+
+	for _, t := range transfers {
+		err = pollTransfer(t)
+		if err != nil && err != errTokenExpired {
+			log.Println("could not poll transfer ", t.ID, " with anchor ", t.Anchor, ": ", err)
+		}
+	}
+}
+
+// PollTransfers polls pending transfers every TransferPollInterval seconds. This blocks, so it
+// should be run in a goroutine
+func PollTransfers() {
+	ticker := time.NewTicker(time.Duration(TransferPollInterval) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pollTransfers()
+	}
+}
+
+// sendTransfers sends the transfers of the user without their tokens, latest first
+func sendTransfers(w http.ResponseWriter, user database.User) {
+	transfers, err := database.RetrieveUserTransfers(user.Index)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return
+	}
+
+	x := make([]database.Transfer, len(transfers))
+	for i, t := range transfers {
+		x[i] = t.Redacted()
+	}
+	erpc.MarshalSend(w, x)
+}
+
+// listTransfers lists the transfers of the user, latest first
+func listTransfers(w http.ResponseWriter, r *http.Request) {
+	user, err := userValidateHelper(w, r, AnchorRPC[4][2:], AnchorRPC[4][1])
+	if err != nil {
+		return
+	}
+
+	sendTransfers(w, user)
+}
+
+// refreshTransfers logs the user in with the anchors of their pending transfers again and
+// polls the transfers right away, so that transfers whose tokens expired are polled further.
+// Nothing is refreshed if the user can't be logged in with one of the anchors
+func refreshTransfers(w http.ResponseWriter, r *http.Request) {
+	user, err := userValidateHelper(w, r, AnchorRPC[5][2:], AnchorRPC[5][1])
+	if err != nil {
+		return
+	}
+
+	transfers, err := database.RetrieveUserTransfers(user.Index)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return
+	}
+
+	tokens := make(map[string]anchor.Token)
+	for _, t := range transfers {
+		if t.Done {
+			continue
+		}
+
+		token, exists := tokens[t.Anchor]
+		if !exists {
+			client, err := anchor.Get(t.Anchor)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			token, err = anchorAuth(client, &user, r.FormValue("seedpwd"))
+			if erpc.Err(w, err, erpc.StatusUnauthorized, "could not log in with anchor "+t.Anchor) {
+				return
+			}
+			tokens[t.Anchor] = token
+		}
+
+		err = setTransferToken(&t, token)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+		err = pollTransfer(t)
+		if err != nil {
+			log.Println("could not poll transfer ", t.ID, " with anchor ", t.Anchor, ": ", err)
+		}
+	}
+
+	sendTransfers(w, user)
+}
@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"log"
+	"net/http"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// twofa contains the 2FA enrollment of users and the enforcement of a second factor on
+// sensitive routes for users who enabled 2FA or registered a WebAuthn credential
+
+// TwoFARoutes are the routes on which users who enabled 2FA have to pass a second factor.
+// Changing the password or seedpwd through /user/update and logging in with SEP-10 always
+// require one
+var TwoFARoutes = map[string]bool{
+	UserRPC[0][0]:  true, // /token
+	UserRPC[7][0]:  true, // /user/sendxlm
+	UserRPC[24][0]: true, // /user/sweep
+	UserRPC[25][0]: true, // /user/sweepasset
+}
+
+// SetTwoFARoutes replaces the routes that require an otp
+func SetTwoFARoutes(routes []string) {
+	TwoFARoutes = make(map[string]bool)
+	for _, route := range routes {
+		TwoFARoutes[route] = true
+	}
+}
+
+// missing2FA checks the second factor of a request made by a user who enabled 2FA or
+// registered a WebAuthn credential. The second factor is either a WebAuthn assertion made
+// for the route in the webauthn param or an otp in the otp param. The otp can be a backup
+// code, which is used up. If the second factor is missing or invalid it responds with an
+// error and returns true
+func missing2FA(w http.ResponseWriter, r *http.Request, user *database.User) bool {
+	if !user.TwoFAEnabled && len(user.WebAuthnCredentials) == 0 {
+		return false
+	}
+
+	if checkLockout(w, *user) {
+		return true
+	}
+
+	if assertion := r.FormValue("webauthn"); assertion != "" && len(user.WebAuthnCredentials) != 0 {
+		return missingWebAuthn(w, r, user, assertion)
+	}
+
+	otp := r.FormValue("otp")
+	if otp == "" || !user.TwoFAEnabled {
+		log.Println("second factor required for user: ", user.Index)
+		erpc.ResponseHandler(w, erpc.StatusUnauthorized, "second factor required")
+		return true
+	}
+
+	result, err := user.Verify2FA(otp)
+	if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		return true
+	}
+
+	if !result {
+		authFailed(r, *user)
+		erpc.ResponseHandler(w, erpc.StatusUnauthorized, "invalid otp")
+		return true
+	}
+
+	authSucceeded(*user)
+	return false
+}
+
+// TwoFAResponse is a wrapper around the QRCode data
+type TwoFAResponse struct {
+	ImageData string
+}
+
+// new2fa generates a new 2fa secret that has to be confirmed before it is enforced
+func new2fa() {
+	http.HandleFunc(UserRPC[28][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[28][2:], UserRPC[28][1])
+		if err != nil {
+			return
+		}
+
+		// users who enabled 2fa need an otp from their current secret in order to generate a new
+		// one. The new secret replaces the current one once confirmed
+		if missing2FA(w, r, &prepUser) {
+			return
+		}
+
+		otpString, err := prepUser.Generate2FA()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		var x TwoFAResponse
+		x.ImageData = otpString
+
+		erpc.MarshalSend(w, x)
+	})
+}
+
+// auth2fa authenticates the passed 2fa code
+func auth2fa() {
+	http.HandleFunc(UserRPC[29][0], func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(w, r) {
+			return
+		}
+
+		prepUser, err := userValidateHelper(w, r, UserRPC[29][2:], UserRPC[29][1])
+		if err != nil {
+			return
+		}
+
+		if checkLockout(w, prepUser) {
+			return
+		}
+
+		password := r.URL.Query()["password"][0]
+		result, err := prepUser.Authenticate2FA(password)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		if !result {
+			authFailed(r, prepUser)
+			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+			return
+		}
+		authSucceeded(prepUser)
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// BackupCodesResponse contains the single use backup codes of a user
+type BackupCodesResponse struct {
+	BackupCodes []string
+}
+
+// confirm2fa confirms the secret generated by /user/2fa/generate and enables 2fa. Returns
+// the backup codes of the user which are not shown again
+func confirm2fa() {
+	http.HandleFunc(UserRPC[45][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[45][2:], UserRPC[45][1])
+		if err != nil {
+			return
+		}
+
+		codes, err := prepUser.Confirm2FA(r.URL.Query().Get("otp"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		var x BackupCodesResponse
+		x.BackupCodes = codes
+		erpc.MarshalSend(w, x)
+	})
+}
+
+// disable2fa disables 2fa after checking an otp or backup code
+func disable2fa() {
+	http.HandleFunc(UserRPC[46][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[46][2:], UserRPC[46][1])
+		if err != nil {
+			return
+		}
+
+		if checkLockout(w, prepUser) {
+			return
+		}
+
+		err = prepUser.Disable2FA(r.FormValue("otp"))
+		if err != nil {
+			authFailed(r, prepUser)
+		}
+		if erpc.Err(w, err, erpc.StatusUnauthorized) {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// newBackupCodes replaces the backup codes of a user who enabled 2fa
+func newBackupCodes() {
+	http.HandleFunc(UserRPC[47][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[47][2:], UserRPC[47][1])
+		if err != nil {
+			return
+		}
+
+		if !prepUser.TwoFAEnabled {
+			erpc.ResponseHandler(w, erpc.StatusBadRequest, "2fa not enabled")
+			return
+		}
+
+		if missing2FA(w, r, &prepUser) {
+			return
+		}
+
+		codes, err := prepUser.GenerateBackupCodes()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		var x BackupCodesResponse
+		x.BackupCodes = codes
+		erpc.MarshalSend(w, x)
+	})
+}
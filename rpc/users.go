@@ -6,20 +6,19 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/pkg/errors"
 
-	aes "github.com/Varunram/essentials/aes"
 	ipfs "github.com/Varunram/essentials/ipfs"
 	erpc "github.com/Varunram/essentials/rpc"
 	utils "github.com/Varunram/essentials/utils"
 	xlm "github.com/Varunram/essentials/xlm"
-	assets "github.com/Varunram/essentials/xlm/assets"
-	wallet "github.com/Varunram/essentials/xlm/wallet"
 	consts "github.com/YaleOpenLab/openx/consts"
 	database "github.com/YaleOpenLab/openx/database"
 	notif "github.com/YaleOpenLab/openx/notif"
 	recovery "github.com/bithyve/research/sss"
+	build "github.com/stellar/go/txnbuild"
 )
 
 // UserRPC is a collection of all user RPC endpoints and their required params
@@ -61,6 +60,19 @@ var UserRPC = map[int][]string{
 	39: {"/user/logout", "POST"},                                                           // POST
 	40: {"/user/verify", "POST"},                                                           // POST
 	41: {"/user/unverify", "POST"},                                                         // POST
+	42: {"/user/sessions", "GET"},                                                          // GET
+	43: {"/user/sessions/revoke", "POST", "id"},                                            // POST
+	44: {"/user/unlock", "GET", "username", "code"},                                        // GET
+	45: {"/user/2fa/confirm", "GET", "otp"},                                                // GET
+	46: {"/user/2fa/disable", "POST", "otp"},                                               // POST
+	47: {"/user/2fa/backupcodes", "POST", "otp"},                                           // POST
+	48: {"/user/webauthn/register/begin", "POST"},                                          // POST
+	49: {"/user/webauthn/register/finish", "POST", "credential"},                           // POST
+	50: {"/user/webauthn/assert/begin", "POST", "route"},                                   // POST
+	51: {"/user/webauthn/login/begin", "POST", "username", "pwhash"},                       // POST
+	52: {"/user/webauthn/credentials", "GET"},                                              // GET
+	53: {"/user/webauthn/credentials/remove", "POST", "id"},                                // POST
+	54: {"/user/logins", "GET"},                                                            // GET
 
 	30: {"/user/anchorusd/kyc", "GET", "name", "bdaymonth", "bdayday", "bdayyear", "taxcountry", // GET
 		"taxid", "addrstreet", "addrcity", "addrpostal", "addrregion", "addrcountry", "addrphone", "primaryphone", "gender"},
@@ -106,6 +118,19 @@ func setupUserRpcs() {
 	logout()
 	verify()
 	unverify()
+	listSessions()
+	revokeSession()
+	unlockAccount()
+	confirm2fa()
+	disable2fa()
+	newBackupCodes()
+	beginWebAuthnRegistration()
+	finishWebAuthnRegistration()
+	beginWebAuthnAssertion()
+	beginWebAuthnLogin()
+	listWebAuthnCredentials()
+	removeWebAuthnCredential()
+	listLogins()
 
 	// sendTellerShutdownEmail()
 	// sendTellerFailedPaybackEmail()
@@ -208,6 +233,10 @@ func userValidateHelper(w http.ResponseWriter, r *http.Request, options []string
 		return prepUser, err
 	}
 
+	if TwoFARoutes[r.URL.Path] && missing2FA(w, r, &prepUser) {
+		return prepUser, errors.New("otp missing or invalid")
+	}
+
 	log.Println("successfully validated: ", prepUser.Name)
 	return prepUser, nil
 }
@@ -217,29 +246,67 @@ type GenAccessTokenReturn struct {
 	Token string
 }
 
-func genAccessToken() {
-	http.HandleFunc(UserRPC[0][0], func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseForm()
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
+// passwordLogin validates the username and pwhash params of a login request. Failed attempts
+// count towards the lockout of the account. Responds with an error and returns false if the
+// credentials are missing or invalid
+func passwordLogin(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	var user database.User
+	err := r.ParseForm()
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return user, false
+	}
 
-		username := r.FormValue("username")
-		pwhash := r.FormValue("pwhash")
+	username := r.FormValue("username")
+	pwhash := r.FormValue("pwhash")
 
-		if username == "" || pwhash == "" {
-			log.Println("required params username or pwhash not found, quitting")
-			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+	if username == "" || pwhash == "" {
+		log.Println("required params username or pwhash not found, quitting")
+		erpc.ResponseHandler(w, erpc.StatusBadRequest)
+		return user, false
+	}
+
+	if rateLimited(w, r) {
+		return user, false
+	}
+
+	// look the user up first so that failed attempts count towards the lockout of the account
+	lUser, lErr := database.RetrieveUserByUsername(username)
+	if lErr == nil && checkLockout(w, lUser) {
+		recordLogin(r, lUser, database.LoginLocked)
+		return user, false
+	}
+
+	user, err = database.ValidatePwhash(username, pwhash)
+	if err != nil && lErr == nil {
+		authFailed(r, lUser)
+		recordLogin(r, lUser, database.LoginBadPassword)
+	}
+	if err != nil && lErr != nil {
+		recordUnknownLogin(r, username)
+	}
+	if erpc.Err(w, err, erpc.StatusUnauthorized) {
+		return user, false
+	}
+	return user, true
+}
+
+func genAccessToken() {
+	http.HandleFunc(UserRPC[0][0], func(w http.ResponseWriter, r *http.Request) {
+		user, ok := passwordLogin(w, r)
+		if !ok {
 			return
 		}
 
-		log.Println("username: ", username, " requesting a new access token")
-		user, err := database.ValidatePwhash(username, pwhash)
-		if erpc.Err(w, err, erpc.StatusUnauthorized) {
+		log.Println("username: ", user.Username, " requesting a new access token")
+		if TwoFARoutes[r.URL.Path] && missing2FA(w, r, &user) {
+			recordLogin(r, user, database.LoginBad2FA)
 			return
 		}
+		authSucceeded(user)
+		recordLogin(r, user, database.LoginSuccess)
 
-		token, err := user.GenAccessToken()
+		// device is an optional label that helps users tell their sessions apart
+		token, err := user.NewSession(r.FormValue("device"), r.RemoteAddr)
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
@@ -372,6 +439,22 @@ func authKyc() {
 	})
 }
 
+// sendPayment sends an amount of an asset from the user's wallet to the destination. The
+// transaction is signed by the signer so the user's seed is never unlocked here
+func sendPayment(user database.User, seedpwd string, destination string, amount float64,
+	asset build.Asset, memo string) (string, error) {
+	amountString, err := utils.ToString(amount)
+	if err != nil {
+		return "", err
+	}
+
+	return user.SubmitTx(seedpwd, memo, &build.Payment{
+		Destination: destination,
+		Amount:      amountString,
+		Asset:       asset,
+	})
+}
+
 // sendXLM sends a given amount of XLM to the destination address specified.
 func sendXLM() {
 	http.HandleFunc(UserRPC[7][0], func(w http.ResponseWriter, r *http.Request) {
@@ -388,17 +471,12 @@ func sendXLM() {
 			return
 		}
 
-		seed, err := wallet.DecryptSeed(prepUser.StellarWallet.EncryptedSeed, seedpwd)
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
-
 		var memo string
 		if r.URL.Query()["memo"] != nil {
 			memo = r.URL.Query()["memo"][0]
 		}
 
-		_, txhash, err := xlm.SendXLM(destination, amount, seed, memo)
+		txhash, err := sendPayment(prepUser, seedpwd, destination, amount, build.NativeAsset{}, memo)
 		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
@@ -408,16 +486,11 @@ func sendXLM() {
 }
 
 // notKycView returns a list of all the users who have not yet been verified through KYC. Can be
-// called only by KYC Inspectors
+// called only by users with the PermKyc permission
 func notKycView() {
 	http.HandleFunc(UserRPC[8][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, UserRPC[8][2:], UserRPC[8][1])
-		if err != nil {
-			return
-		}
-
-		if !prepUser.Inspector && !prepUser.Admin {
-			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+		_, allowed := validatePermission(w, r, UserRPC[8][2:], UserRPC[8][1], database.PermKyc)
+		if !allowed {
 			return
 		}
 
@@ -426,21 +499,16 @@ func notKycView() {
 			return
 		}
 
-		erpc.MarshalSend(w, users)
+		erpc.MarshalSend(w, database.Summaries(users))
 	})
 }
 
 // kycView returns a list of all the users who have been KYC verified. Can be called
-// only by KYC Inspectors
+// only by users with the PermKyc permission
 func kycView() {
 	http.HandleFunc(UserRPC[9][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, UserRPC[9][2:], UserRPC[9][1])
-		if err != nil {
-			return
-		}
-
-		if !prepUser.Inspector && !prepUser.Admin {
-			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
+		_, allowed := validatePermission(w, r, UserRPC[9][2:], UserRPC[9][1], database.PermKyc)
+		if !allowed {
 			return
 		}
 
@@ -449,7 +517,7 @@ func kycView() {
 			return
 		}
 
-		erpc.MarshalSend(w, users)
+		erpc.MarshalSend(w, database.Summaries(users))
 	})
 }
 
@@ -492,13 +560,16 @@ func trustAsset() {
 			return
 		}
 
-		seedpwd := r.URL.Query()["seedpwd"][0]
-		seed, err := wallet.DecryptSeed(prepUser.StellarWallet.EncryptedSeed, seedpwd)
+		limitString, err := utils.ToString(limit)
 		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
-		txhash, err := assets.TrustAsset(assetCode, assetIssuer, limit, seed)
+		seedpwd := r.URL.Query()["seedpwd"][0]
+		txhash, err := prepUser.SubmitTx(seedpwd, "trust asset", &build.ChangeTrust{
+			Line:  build.CreditAsset{Code: assetCode, Issuer: assetIssuer},
+			Limit: limitString,
+		})
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
@@ -644,20 +715,32 @@ type SeedResponse struct {
 // mergeSecrets takes in two shares in a 2 of 3 Shamir Secret Sharing Scheme and reconstructs the seed
 func mergeSecrets() {
 	http.HandleFunc(UserRPC[20][0], func(w http.ResponseWriter, r *http.Request) {
-		_, err := userValidateHelper(w, r, UserRPC[20][2:], UserRPC[20][1])
+		if rateLimited(w, r) {
+			return
+		}
+
+		prepUser, err := userValidateHelper(w, r, UserRPC[20][2:], UserRPC[20][1])
 		if err != nil {
 			return
 		}
 
+		if checkLockout(w, prepUser) {
+			return
+		}
+
 		var shares []string
 		secret1 := r.URL.Query()["secret1"][0]
 		secret2 := r.URL.Query()["secret2"][0]
 		shares = append(shares, secret1, secret2)
 		// now we have 2 out of the 3 secrets needed to reconstruct. Reconstruct the seed.
 		secret, err := recovery.Combine(shares)
+		if err != nil {
+			authFailed(r, prepUser)
+		}
 		if erpc.Err(w, err, erpc.StatusInternalServerError, "couldn't combine shares") {
 			return
 		}
+		authSucceeded(prepUser)
 
 		var x SeedResponse
 		x.Seed = secret
@@ -678,13 +761,9 @@ func generateNewSecrets() {
 		email2 := r.URL.Query()["email2"][0]
 		email3 := r.URL.Query()["email3"][0]
 
-		seed, err := wallet.DecryptSeed(user.StellarWallet.EncryptedSeed, seedpwd)
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
 		// user has validated his seed and identity. Generate new shares and send them out
-		shares, err := recovery.Create(2, 3, seed)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+		shares, err := user.NewRecoveryShares(seedpwd)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
@@ -700,7 +779,7 @@ func generateNewSecrets() {
 // generateResetPwdCode generates a password reset code
 func generateResetPwdCode() {
 	http.HandleFunc(UserRPC[22][0], func(w http.ResponseWriter, r *http.Request) {
-		_, err := userValidateHelper(w, r, UserRPC[22][2:], UserRPC[22][1])
+		prepUser, err := userValidateHelper(w, r, UserRPC[22][2:], UserRPC[22][1])
 		if err != nil {
 			return
 		}
@@ -712,7 +791,7 @@ func generateResetPwdCode() {
 			return
 		}
 
-		_, err = ValidateSeedPwd(w, r, rUser.StellarWallet.EncryptedSeed, rUser.StellarWallet.PublicKey)
+		_, err = ValidateSeedPwd(w, r, rUser)
 		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
@@ -726,6 +805,8 @@ func generateResetPwdCode() {
 			return
 		}
 
+		auditLog(r, prepUser, database.AuditPwdResetRequest, strconv.Itoa(rUser.Index), "")
+
 		// now send this verification code to the email we have in the database
 		err = notif.SendPasswordResetEmail(rUser.Email, verificationCode)
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
@@ -739,7 +820,11 @@ func generateResetPwdCode() {
 // resetPassword is a reset password route that can be called by the user in case they forget their password
 func resetPassword() {
 	http.HandleFunc(UserRPC[23][0], func(w http.ResponseWriter, r *http.Request) {
-		_, err := userValidateHelper(w, r, UserRPC[23][2:], UserRPC[23][1])
+		if rateLimited(w, r) {
+			return
+		}
+
+		prepUser, err := userValidateHelper(w, r, UserRPC[23][2:], UserRPC[23][1])
 		if err != nil {
 			return
 		}
@@ -753,25 +838,36 @@ func resetPassword() {
 			return
 		}
 
-		_, err = ValidateSeedPwd(w, r, rUser.StellarWallet.EncryptedSeed, rUser.StellarWallet.PublicKey)
+		if checkLockout(w, rUser) {
+			return
+		}
+
+		_, err = ValidateSeedPwd(w, r, rUser)
 		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
 		if vCode != rUser.PwdResetCode || vCode == "INVALID" {
 			log.Println(rUser.PwdResetCode == vCode, vCode == "INVALID")
+			authFailed(r, rUser)
 			erpc.ResponseHandler(w, erpc.StatusBadRequest)
 			return
 		}
+		authSucceeded(rUser)
 
 		// reset the user's password
-		rUser.Pwhash = pwhash
+		err = rUser.SetPassword(pwhash)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
 		rUser.PwdResetCode = "INVALID" // invalidate the pwd reset code to avoid replay attacks
 		err = rUser.Save()
 		if erpc.Err(w, err, erpc.StatusBadRequest) {
 			return
 		}
 
+		auditLog(r, prepUser, database.AuditPwdReset, strconv.Itoa(rUser.Index), "")
+
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -793,17 +889,9 @@ func sweepFunds() {
 			return
 		}
 
-		seedpwd, err := ValidateSeedPwd(w, r, prepUser.StellarWallet.EncryptedSeed, prepUser.StellarWallet.PublicKey)
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
-
-		seed, err := wallet.DecryptSeed(prepUser.StellarWallet.EncryptedSeed, seedpwd)
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
+		seedpwd := r.URL.Query()["seedpwd"][0]
 
-		// validated the user, so now proceed to sweep funds
+		// the signer checks the seedpwd, so proceed to sweep funds
 		xlmBalance := xlm.GetNativeBalance(prepUser.StellarWallet.PublicKey)
 		log.Println(xlmBalance)
 		// reduce 0.05 xlm and then sweep funds
@@ -815,12 +903,13 @@ func sweepFunds() {
 		xlmBalance -= 5
 		// now we have the xlm balance, shift funds to the other account as requested by the user.
 		sweepAmt := math.Round(xlmBalance)
-		_, txhash, err := xlm.SendXLM(transferAddress, sweepAmt, seed, "sweep funds")
+		txhash, err := sendPayment(prepUser, seedpwd, transferAddress, sweepAmt, build.NativeAsset{}, "sweep funds")
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
 		log.Println("sweep funds txhash: ", txhash)
+		auditLog(r, prepUser, database.AuditSweepFunds, transferAddress, txhash)
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -838,17 +927,9 @@ func sweepAsset() {
 		destination := r.URL.Query()["destination"][0]
 		issuerPubkey := r.URL.Query()["issuerPubkey"][0]
 
-		seedpwd, err := ValidateSeedPwd(w, r, prepUser.StellarWallet.EncryptedSeed, prepUser.StellarWallet.PublicKey)
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
-
-		seed, err := wallet.DecryptSeed(prepUser.StellarWallet.EncryptedSeed, seedpwd)
-		if erpc.Err(w, err, erpc.StatusBadRequest) {
-			return
-		}
+		seedpwd := r.URL.Query()["seedpwd"][0]
 
-		// validated the user, so now proceed to sweep funds
+		// the signer checks the seedpwd, so proceed to sweep funds
 		assetBalance := xlm.GetAssetBalance(prepUser.StellarWallet.PublicKey, assetName)
 		assetBalanceF, err := utils.ToFloat(assetBalance)
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
@@ -864,12 +945,14 @@ func sweepAsset() {
 
 		assetBalanceF -= 5
 		sweepAmt := math.Round(assetBalanceF)
-		_, txhash, err := assets.SendAsset(assetName, issuerPubkey, destination, sweepAmt, seed, "sweeping funds")
+		asset := build.CreditAsset{Code: assetName, Issuer: issuerPubkey}
+		txhash, err := sendPayment(prepUser, seedpwd, destination, sweepAmt, asset, "sweeping funds")
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
 		log.Println("txhash: ", txhash)
+		auditLog(r, prepUser, database.AuditSweepAsset, destination, txhash)
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -990,73 +1073,6 @@ func giveStarRating() {
 	})
 }
 
-// TwoFAResponse is a wrapper around the QRCode data
-type TwoFAResponse struct {
-	ImageData string
-}
-
-// new2fa generates a new 2fa code
-func new2fa() {
-	http.HandleFunc(UserRPC[28][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, UserRPC[28][2:], UserRPC[28][1])
-		if err != nil {
-			return
-		}
-
-		if len(prepUser.TwoFASecret) != 0 {
-			// user already has a 2fa secret, we need that in order to generate a new one
-			if r.URL.Query()["password"] == nil {
-				erpc.ResponseHandler(w, erpc.StatusBadRequest)
-				return
-			}
-
-			password := r.URL.Query()["password"][0]
-			result, err := prepUser.Authenticate2FA(password)
-			if erpc.Err(w, err, erpc.StatusInternalServerError) {
-				return
-			}
-
-			if !result {
-				erpc.ResponseHandler(w, erpc.StatusUnauthorized)
-				return
-			}
-			// now the old 2fa account is verified, we can proceed with creating a new 2fa secret
-		}
-
-		otpString, err := prepUser.Generate2FA()
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
-		}
-
-		var x TwoFAResponse
-		x.ImageData = otpString
-
-		erpc.MarshalSend(w, x)
-	})
-}
-
-// auth2fa authenticates the passed 2fa code
-func auth2fa() {
-	http.HandleFunc(UserRPC[29][0], func(w http.ResponseWriter, r *http.Request) {
-		prepUser, err := userValidateHelper(w, r, UserRPC[29][2:], UserRPC[29][1])
-		if err != nil {
-			return
-		}
-
-		password := r.URL.Query()["password"][0]
-		result, err := prepUser.Authenticate2FA(password)
-		if erpc.Err(w, err, erpc.StatusInternalServerError) {
-			return
-		}
-
-		if !result {
-			erpc.ResponseHandler(w, erpc.StatusUnauthorized)
-			return
-		}
-		erpc.ResponseHandler(w, erpc.StatusOK)
-	})
-}
-
 // addAnchorKYCInfo adds anchorKYC info that the user passes to our platform.
 func addAnchorKYCInfo() {
 	http.HandleFunc(UserRPC[30][0], func(w http.ResponseWriter, r *http.Request) {
@@ -1112,24 +1128,13 @@ func changeReputation() {
 }
 
 // ValidateSeedPwd validates only the seedpwd and not the username / pwhash
-func ValidateSeedPwd(w http.ResponseWriter, r *http.Request, encryptedSeed []byte, userPublickey string) (string, error) {
+func ValidateSeedPwd(w http.ResponseWriter, r *http.Request, user database.User) (string, error) {
 	seedpwd := r.URL.Query()["seedpwd"][0]
-	// we've validated the seedpwd, try decrypting the Encrypted Seed.
-	seed, err := wallet.DecryptSeed(encryptedSeed, seedpwd)
+	// the signer holding the user's seed checks the seedpwd
+	err := user.VerifySeedpwd(seedpwd)
 	if err != nil {
-		return seedpwd, errors.New("could not decrypt seed")
+		return seedpwd, err
 	}
-
-	// now get the pubkey from this seed and match with original pubkey
-	pubkey, err := wallet.ReturnPubkey(seed)
-	if err != nil {
-		return seedpwd, errors.New("could not retrieve pubkey")
-	}
-
-	if pubkey != userPublickey {
-		return seedpwd, errors.New("pubkeys don't match, quitting")
-	}
-
 	return seedpwd, nil
 }
 
@@ -1155,6 +1160,8 @@ func importSeed() {
 			return
 		}
 
+		auditLog(r, prepUser, database.AuditSeedImport, strconv.Itoa(prepUser.Index), pubkey)
+
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -1237,6 +1244,15 @@ func updateUser() {
 			return
 		}
 
+		// credential changes need an otp from users who enabled 2fa even if the route doesn't
+		if (r.FormValue("pwhash") != "" || r.FormValue("seedpwd") != "") && !TwoFARoutes[r.URL.Path] &&
+			missing2FA(w, r, &user) {
+			return
+		}
+
+		// security relevant changes that need to go into the audit log once saved
+		var audits []string
+
 		if r.FormValue("name") != "" {
 			user.Name = r.FormValue("name")
 		}
@@ -1249,7 +1265,11 @@ func updateUser() {
 				erpc.ResponseHandler(w, erpc.StatusBadRequest)
 				return
 			}
-			user.Pwhash = r.FormValue("pwhash")
+			err = user.SetPassword(r.FormValue("pwhash"))
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+			audits = append(audits, database.AuditPwdChange)
 		}
 		if r.FormValue("zipcode") != "" {
 			user.ZipCode = r.FormValue("zipcode")
@@ -1268,22 +1288,11 @@ func updateUser() {
 		}
 		if r.FormValue("email") != "" {
 			user.Email = r.FormValue("email")
+			audits = append(audits, database.AuditEmailChange)
 		}
-		if r.FormValue("seedpwd") != "" {
-			if r.FormValue("oldseedpwd") == "" {
-				erpc.ResponseHandler(w, erpc.StatusBadRequest)
-				return
-			}
-			oldseedpwd := r.FormValue("oldseedpwd")
-			seedpwd := r.FormValue("seedpwd")
-			seed, err := wallet.DecryptSeed(user.StellarWallet.EncryptedSeed, oldseedpwd)
-			if erpc.Err(w, err, erpc.StatusInternalServerError) {
-				return
-			}
-			user.StellarWallet.EncryptedSeed, err = aes.Encrypt([]byte(seed), seedpwd)
-			if erpc.Err(w, err, erpc.StatusInternalServerError) {
-				return
-			}
+		if r.FormValue("seedpwd") != "" && r.FormValue("oldseedpwd") == "" {
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
 		}
 
 		if r.FormValue("notification") != "" {
@@ -1294,11 +1303,37 @@ func updateUser() {
 			}
 		}
 
+		// the seed is rekeyed last since the signer stores it right away
+		oldseedpwd, seedpwd := r.FormValue("oldseedpwd"), r.FormValue("seedpwd")
+		if seedpwd != "" {
+			err = user.ChangeSeedpwd(oldseedpwd, seedpwd)
+			if erpc.Err(w, err, erpc.StatusInternalServerError) {
+				return
+			}
+			audits = append(audits, database.AuditSeedChange)
+		}
+
 		err = user.Save()
+		if err != nil && seedpwd != "" {
+			// put the old seedpwd back so the seedpwd the user knows still unlocks their seed
+			rerr := user.ChangeSeedpwd(seedpwd, oldseedpwd)
+			if rerr != nil {
+				log.Println("could not restore seedpwd of user: ", user.Index, rerr)
+			}
+		}
+		if errors.Cause(err) == database.ErrIndexCollision {
+			log.Println(err)
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
 		if erpc.Err(w, err, erpc.StatusInternalServerError) {
 			return
 		}
 
+		for _, action := range audits {
+			auditLog(r, user, action, strconv.Itoa(user.Index), "")
+		}
+
 		erpc.MarshalSend(w, user)
 	})
 }
@@ -1316,7 +1351,7 @@ func downloadTeller() {
 	})
 }
 
-// logout logs out from all devices
+// logout logs out from all devices and the platforms the user signed in to with openx
 func logout() {
 	http.HandleFunc(UserRPC[39][0], func(w http.ResponseWriter, r *http.Request) {
 		//_, err := userValidateHelper(w, r, UserRPC[38][2:], UserRPC[38][1])
@@ -1330,6 +1365,11 @@ func logout() {
 			return
 		}
 
+		err = propagateLogout(user)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
@@ -1369,3 +1409,69 @@ func unverify() {
 		erpc.ResponseHandler(w, erpc.StatusOK)
 	})
 }
+
+// listSessions lists the active sessions of the user
+func listSessions() {
+	http.HandleFunc(UserRPC[42][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[42][2:], UserRPC[42][1])
+		if err != nil {
+			return
+		}
+
+		sessions, err := database.RetrieveSessions(user.Index)
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, sessions)
+	})
+}
+
+// revokeSession revokes one of the user's sessions
+func revokeSession() {
+	http.HandleFunc(UserRPC[43][0], func(w http.ResponseWriter, r *http.Request) {
+		user, err := userValidateHelper(w, r, UserRPC[43][2:], UserRPC[43][1])
+		if err != nil {
+			return
+		}
+
+		err = database.RevokeSession(user.Index, r.FormValue("id"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
+
+// unlockAccount unlocks an account that has been locked after repeated failed attempts using
+// the code emailed to the user. Doesn't require a token since locked users can't get one
+func unlockAccount() {
+	http.HandleFunc(UserRPC[44][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckGet(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if rateLimited(w, r) {
+			return
+		}
+
+		username := r.URL.Query().Get("username")
+		code := r.URL.Query().Get("code")
+		if username == "" || code == "" {
+			log.Println("required params username or code not found, quitting")
+			erpc.ResponseHandler(w, erpc.StatusBadRequest)
+			return
+		}
+
+		user, err := database.UnlockUser(username, code)
+		if erpc.Err(w, err, erpc.StatusUnauthorized) {
+			return
+		}
+
+		auditLog(r, user, database.AuditUnlock, strconv.Itoa(user.Index), "")
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
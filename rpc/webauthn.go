@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	erpc "github.com/Varunram/essentials/rpc"
+	database "github.com/YaleOpenLab/openx/database"
+)
+
+// webauthn contains the endpoints that register WebAuthn credentials and start assertions.
+// Assertions are passed in the webauthn param of the request they authorize and are checked
+// along with otps by missing2FA
+
+// missingWebAuthn checks a WebAuthn assertion made for the route of the request. If it is
+// invalid it responds with an error and returns true
+func missingWebAuthn(w http.ResponseWriter, r *http.Request, user *database.User, assertion string) bool {
+	var response database.CredentialResponse
+	err := json.Unmarshal([]byte(assertion), &response)
+	if erpc.Err(w, err, erpc.StatusBadRequest) {
+		return true
+	}
+
+	err = user.FinishWebAuthnAssertion(r.URL.Path, response)
+	if err != nil {
+		log.Println("webauthn assertion failed for user: ", user.Index, err)
+		authFailed(r, *user)
+		erpc.ResponseHandler(w, erpc.StatusUnauthorized, "invalid webauthn assertion")
+		return true
+	}
+
+	authSucceeded(*user)
+	return false
+}
+
+// beginWebAuthnRegistration returns the options to create a new credential with. Users who
+// already have a second factor need to pass it
+func beginWebAuthnRegistration() {
+	http.HandleFunc(UserRPC[48][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[48][2:], UserRPC[48][1])
+		if err != nil {
+			return
+		}
+
+		if missing2FA(w, r, &prepUser) {
+			return
+		}
+
+		opts, err := prepUser.BeginWebAuthnRegistration()
+		if erpc.Err(w, err, erpc.StatusInternalServerError) {
+			return
+		}
+
+		erpc.MarshalSend(w, opts)
+	})
+}
+
+// finishWebAuthnRegistration stores the credential created with the registration options.
+// The optional name param labels the credential
+func finishWebAuthnRegistration() {
+	http.HandleFunc(UserRPC[49][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[49][2:], UserRPC[49][1])
+		if err != nil {
+			return
+		}
+
+		var response database.CredentialResponse
+		err = json.Unmarshal([]byte(r.FormValue("credential")), &response)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		cred, err := prepUser.FinishWebAuthnRegistration(r.FormValue("name"), response)
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, cred)
+	})
+}
+
+// beginWebAuthnAssertion returns the options to make an assertion with that authorizes a
+// request to the route param
+func beginWebAuthnAssertion() {
+	http.HandleFunc(UserRPC[50][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[50][2:], UserRPC[50][1])
+		if err != nil {
+			return
+		}
+
+		opts, err := prepUser.BeginWebAuthnAssertion(r.FormValue("route"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, opts)
+	})
+}
+
+// beginWebAuthnLogin returns the options to make an assertion with that authorizes a /token
+// request. Takes the username and pwhash since the user doesn't have a token yet
+func beginWebAuthnLogin() {
+	http.HandleFunc(UserRPC[51][0], func(w http.ResponseWriter, r *http.Request) {
+		err := erpc.CheckPost(w, r)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		user, ok := passwordLogin(w, r)
+		if !ok {
+			return
+		}
+
+		opts, err := user.BeginWebAuthnAssertion(UserRPC[0][0])
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.MarshalSend(w, opts)
+	})
+}
+
+// listWebAuthnCredentials lists the credentials registered by the user
+func listWebAuthnCredentials() {
+	http.HandleFunc(UserRPC[52][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[52][2:], UserRPC[52][1])
+		if err != nil {
+			return
+		}
+
+		erpc.MarshalSend(w, prepUser.WebAuthnCredentials)
+	})
+}
+
+// removeWebAuthnCredential removes a credential of the user. Requires a second factor
+func removeWebAuthnCredential() {
+	http.HandleFunc(UserRPC[53][0], func(w http.ResponseWriter, r *http.Request) {
+		prepUser, err := userValidateHelper(w, r, UserRPC[53][2:], UserRPC[53][1])
+		if err != nil {
+			return
+		}
+
+		if missing2FA(w, r, &prepUser) {
+			return
+		}
+
+		err = prepUser.RemoveWebAuthnCredential(r.FormValue("id"))
+		if erpc.Err(w, err, erpc.StatusBadRequest) {
+			return
+		}
+
+		erpc.ResponseHandler(w, erpc.StatusOK)
+	})
+}
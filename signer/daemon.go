@@ -0,0 +1,209 @@
+package signer
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// daemon contains the client openx uses to talk to a signing daemon and the server the daemon
+// runs. Each connection carries one JSON encoded request and its response
+
+// DaemonTimeout is the number of seconds openx waits for the signing daemon to respond
+var DaemonTimeout = 10
+
+// methods of the signing daemon
+const (
+	methodImport = "import"
+	methodVerify = "verify"
+	methodRekey  = "rekey"
+	methodShares = "shares"
+	methodSign   = "sign"
+)
+
+// daemonRequest is a request sent to the signing daemon
+type daemonRequest struct {
+	Method        string
+	Account       string
+	EncryptedSeed []byte `json:",omitempty"`
+	Seedpwd       string `json:",omitempty"`
+	NewSeedpwd    string `json:",omitempty"`
+	Envelope      string `json:",omitempty"`
+}
+
+// daemonResponse is the response of the signing daemon
+type daemonResponse struct {
+	EncryptedSeed []byte   `json:",omitempty"`
+	Shares        []string `json:",omitempty"`
+	Envelope      string   `json:",omitempty"`
+	Error         string   `json:",omitempty"`
+}
+
+// Daemon signs transactions with a signing daemon listening on a unix socket
+type Daemon struct {
+	socket string
+}
+
+// NewDaemon returns a signer that talks to the signing daemon listening on the passed socket
+func NewDaemon(socket string) *Daemon {
+	return &Daemon{socket: socket}
+}
+
+// call sends a request to the signing daemon and returns its response
+func (d *Daemon) call(req daemonRequest) (daemonResponse, error) {
+	var resp daemonResponse
+	timeout := time.Duration(DaemonTimeout) * time.Second
+
+	conn, err := net.DialTimeout("unix", d.socket, timeout)
+	if err != nil {
+		return resp, errors.Wrap(err, "could not reach signing daemon")
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return resp, errors.Wrap(err, "could not set deadline")
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return resp, errors.Wrap(err, "could not send request to signing daemon")
+	}
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return resp, errors.Wrap(err, "could not read response of signing daemon")
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Import stores the encrypted seed of the account with the signing daemon
+func (d *Daemon) Import(account string, encryptedSeed []byte, seedpwd string) error {
+	_, err := d.call(daemonRequest{Method: methodImport, Account: account, EncryptedSeed: encryptedSeed,
+		Seedpwd: seedpwd})
+	return err
+}
+
+// Verify has the signing daemon check that seedpwd unlocks the seed of the account
+func (d *Daemon) Verify(account string, seedpwd string) error {
+	_, err := d.call(daemonRequest{Method: methodVerify, Account: account, Seedpwd: seedpwd})
+	return err
+}
+
+// Rekey has the signing daemon encrypt the seed of the account with newSeedpwd
+func (d *Daemon) Rekey(account string, seedpwd string, newSeedpwd string) ([]byte, error) {
+	resp, err := d.call(daemonRequest{Method: methodRekey, Account: account, Seedpwd: seedpwd,
+		NewSeedpwd: newSeedpwd})
+	if err != nil {
+		return nil, err
+	}
+	return resp.EncryptedSeed, nil
+}
+
+// Shares has the signing daemon split the seed of the account into recovery shares
+func (d *Daemon) Shares(account string, seedpwd string) ([]string, error) {
+	resp, err := d.call(daemonRequest{Method: methodShares, Account: account, Seedpwd: seedpwd})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Shares, nil
+}
+
+// Sign has the signing daemon sign the transaction envelope with the seed of the account
+func (d *Daemon) Sign(account string, seedpwd string, txe string) (string, error) {
+	resp, err := d.call(daemonRequest{Method: methodSign, Account: account, Seedpwd: seedpwd, Envelope: txe})
+	if err != nil {
+		return "", err
+	}
+	return resp.Envelope, nil
+}
+
+// Listen listens on the unix socket at the passed path. The socket gets the passed mode and,
+// unless gid is -1, the passed group so that openx can connect when it runs as a member of the
+// group but not as the user the daemon runs as
+func Listen(socket string, mode os.FileMode, gid int) (net.Listener, error) {
+	// remove the socket left behind by a daemon that didn't shut down cleanly
+	err := os.Remove(socket)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not remove old socket")
+	}
+
+	// create the socket without any permissions so nobody can connect before it has its mode
+	old := umask(0777)
+	l, err := net.Listen("unix", socket)
+	umask(old)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not listen on socket")
+	}
+	if gid != -1 {
+		err = os.Chown(socket, -1, gid)
+		if err != nil {
+			l.Close()
+			return nil, errors.Wrap(err, "could not set group of socket")
+		}
+	}
+	err = os.Chmod(socket, mode)
+	if err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "could not restrict access to socket")
+	}
+	return l, nil
+}
+
+// Serve answers the requests sent to the listener with the passed signer until the listener
+// is closed
+func Serve(l net.Listener, s Signer) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, s)
+	}
+}
+
+// serveConn answers the request sent on a connection
+func serveConn(conn net.Conn, s Signer) {
+	defer conn.Close()
+	timeout := time.Duration(DaemonTimeout) * time.Second
+	err := conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var req daemonRequest
+	var resp daemonResponse
+	err = json.NewDecoder(conn).Decode(&req)
+	if err == nil {
+		switch req.Method {
+		case methodImport:
+			err = s.Import(req.Account, req.EncryptedSeed, req.Seedpwd)
+		case methodVerify:
+			err = s.Verify(req.Account, req.Seedpwd)
+		case methodRekey:
+			resp.EncryptedSeed, err = s.Rekey(req.Account, req.Seedpwd, req.NewSeedpwd)
+		case methodShares:
+			resp.Shares, err = s.Shares(req.Account, req.Seedpwd)
+		case methodSign:
+			resp.Envelope, err = s.Sign(req.Account, req.Seedpwd, req.Envelope)
+		default:
+			err = errors.New("unknown method")
+		}
+	}
+	if err != nil {
+		log.Println("signing request failed: ", req.Method, req.Account, err)
+		resp.Error = err.Error()
+	}
+
+	err = json.NewEncoder(conn).Encode(resp)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,272 @@
+package signer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	aes "github.com/Varunram/essentials/aes"
+	xlm "github.com/Varunram/essentials/xlm"
+	wallet "github.com/Varunram/essentials/xlm/wallet"
+	consts "github.com/YaleOpenLab/openx/consts"
+	recovery "github.com/bithyve/research/sss"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// the signer package keeps the seeds of Stellar accounts away from the RPC handlers. Handlers
+// build unsigned transactions and hand them to a Signer which is the only thing that unlocks
+// seeds. Signers either run in process or in a separate signing daemon that openx talks to
+// over a unix socket
+
+// Signer signs transactions on behalf of the accounts whose seeds it holds
+type Signer interface {
+	// Import stores the encrypted seed of an account with the signer. If seedpwd is passed,
+	// the seed has to unlock with it. A different seed the signer already holds for the account
+	// is only replaced if seedpwd unlocks that seed as well
+	Import(account string, encryptedSeed []byte, seedpwd string) error
+	// Verify checks that seedpwd unlocks the seed of the account
+	Verify(account string, seedpwd string) error
+	// Rekey encrypts the seed of the account with newSeedpwd and returns the new encrypted seed
+	Rekey(account string, seedpwd string, newSeedpwd string) ([]byte, error)
+	// Shares splits the seed of the account into three recovery shares, any two of which
+	// recover the seed
+	Shares(account string, seedpwd string) ([]string, error)
+	// Sign unlocks the seed of the account with seedpwd and signs the base64 encoded
+	// transaction envelope with it
+	Sign(account string, seedpwd string, txe string) (string, error)
+}
+
+// Default is the signer openx signs transactions with. If it isn't set, transactions are
+// signed by the daemon listening on consts.SignerSocket or in process with the seeds in
+// consts.KeystoreDir if no socket is set
+var Default Signer
+
+// current returns the signer transactions should be signed with
+func current() Signer {
+	if Default != nil {
+		return Default
+	}
+	if consts.SignerSocket != "" {
+		return NewDaemon(consts.SignerSocket)
+	}
+	return NewLocal(NewKeystore(consts.KeystoreDir))
+}
+
+// Import stores the encrypted seed of the account with the default signer. Seeds are imported
+// when they are generated or changed, not before every transaction
+func Import(account string, encryptedSeed []byte, seedpwd string) error {
+	err := current().Import(account, encryptedSeed, seedpwd)
+	if err != nil {
+		return errors.Wrap(err, "could not import seed into signer")
+	}
+	return nil
+}
+
+// Verify has the default signer check that seedpwd unlocks the seed of the account
+func Verify(account string, seedpwd string) error {
+	err := current().Verify(account, seedpwd)
+	if err != nil {
+		return errors.Wrap(err, "could not verify seedpwd")
+	}
+	return nil
+}
+
+// Rekey has the default signer encrypt the seed of the account with newSeedpwd
+func Rekey(account string, seedpwd string, newSeedpwd string) ([]byte, error) {
+	encryptedSeed, err := current().Rekey(account, seedpwd, newSeedpwd)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not change seedpwd")
+	}
+	return encryptedSeed, nil
+}
+
+// Shares has the default signer split the seed of the account into recovery shares
+func Shares(account string, seedpwd string) ([]string, error) {
+	shares, err := current().Shares(account, seedpwd)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create recovery shares")
+	}
+	return shares, nil
+}
+
+// Keystore is a directory of encrypted seeds, one file per account. Files are encrypted the
+// same way as the platform seed file so it can be copied into the keystore as is
+type Keystore struct {
+	dir string
+}
+
+// NewKeystore returns the keystore in the passed directory
+func NewKeystore(dir string) *Keystore {
+	return &Keystore{dir: dir}
+}
+
+// path returns the path of the file the seed of the account is stored in
+func (k *Keystore) path(account string) (string, error) {
+	// accounts are validated so they can't be used to escape the keystore directory
+	_, err := keypair.ParseAddress(account)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid account")
+	}
+	return filepath.Join(k.dir, account+".hex"), nil
+}
+
+// Load returns the encrypted seed of the account
+func (k *Keystore) Load(account string) ([]byte, error) {
+	path, err := k.path(account)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSeed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read seed of account")
+	}
+	return encryptedSeed, nil
+}
+
+// Store stores the encrypted seed of the account, replacing the one stored before
+func (k *Keystore) Store(account string, encryptedSeed []byte) error {
+	path, err := k.path(account)
+	if err != nil {
+		return err
+	}
+	if len(encryptedSeed) == 0 {
+		return errors.New("empty seed passed")
+	}
+
+	old, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(old, encryptedSeed) {
+		return nil
+	}
+
+	err = os.MkdirAll(k.dir, 0700)
+	if err != nil {
+		return errors.Wrap(err, "could not create keystore")
+	}
+	err = ioutil.WriteFile(path, encryptedSeed, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not store seed of account")
+	}
+	return nil
+}
+
+// Local signs transactions in process with the seeds in a keystore
+type Local struct {
+	keys *Keystore
+}
+
+// NewLocal returns a signer that signs with the seeds in the passed keystore
+func NewLocal(keys *Keystore) *Local {
+	return &Local{keys: keys}
+}
+
+// unlockSeed decrypts the encrypted seed with seedpwd and checks that it is the seed of the account
+func unlockSeed(account string, encryptedSeed []byte, seedpwd string) (*keypair.Full, error) {
+	seed, err := wallet.DecryptSeed(encryptedSeed, seedpwd)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unlock seed")
+	}
+	kp, err := keypair.ParseFull(seed)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse seed")
+	}
+	if kp.Address() != account {
+		return nil, errors.New("seed does not belong to account")
+	}
+	return kp, nil
+}
+
+// unlock decrypts the seed the keystore holds for the account with seedpwd
+func (l *Local) unlock(account string, seedpwd string) (*keypair.Full, error) {
+	encryptedSeed, err := l.keys.Load(account)
+	if err != nil {
+		return nil, err
+	}
+	return unlockSeed(account, encryptedSeed, seedpwd)
+}
+
+// Import stores the encrypted seed of the account in the keystore
+func (l *Local) Import(account string, encryptedSeed []byte, seedpwd string) error {
+	if seedpwd != "" {
+		_, err := unlockSeed(account, encryptedSeed, seedpwd)
+		if err != nil {
+			return err
+		}
+	}
+
+	// only someone who can unlock the seed held for the account can replace it
+	held, err := l.keys.Load(account)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	if err == nil && !bytes.Equal(held, encryptedSeed) {
+		_, err = unlockSeed(account, held, seedpwd)
+		if err != nil {
+			return errors.Wrap(err, "signer already holds another seed for the account")
+		}
+	}
+
+	return l.keys.Store(account, encryptedSeed)
+}
+
+// Verify checks that seedpwd unlocks the seed of the account
+func (l *Local) Verify(account string, seedpwd string) error {
+	_, err := l.unlock(account, seedpwd)
+	return err
+}
+
+// Rekey encrypts the seed of the account with newSeedpwd and stores it in the keystore
+func (l *Local) Rekey(account string, seedpwd string, newSeedpwd string) ([]byte, error) {
+	kp, err := l.unlock(account, seedpwd)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSeed, err := aes.Encrypt([]byte(kp.Seed()), newSeedpwd)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not encrypt seed")
+	}
+	err = l.keys.Store(account, encryptedSeed)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedSeed, nil
+}
+
+// Shares splits the seed of the account into recovery shares
+func (l *Local) Shares(account string, seedpwd string) ([]string, error) {
+	kp, err := l.unlock(account, seedpwd)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := recovery.Create(2, 3, kp.Seed())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create recovery shares")
+	}
+	return shares, nil
+}
+
+// Sign signs the transaction envelope with the seed of the account
+func (l *Local) Sign(account string, seedpwd string, txe string) (string, error) {
+	kp, err := l.unlock(account, seedpwd)
+	if err != nil {
+		return "", err
+	}
+
+	gtx, err := build.TransactionFromXDR(txe)
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode transaction")
+	}
+	tx, ok := gtx.Transaction()
+	if !ok {
+		return "", errors.New("fee bump transactions can't be signed")
+	}
+
+	tx, err = tx.Sign(xlm.Passphrase, kp)
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign transaction")
+	}
+	return tx.Base64()
+}
@@ -0,0 +1,238 @@
+// +build all travis
+
+package signer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	aes "github.com/Varunram/essentials/aes"
+	xlm "github.com/Varunram/essentials/xlm"
+	"github.com/stellar/go/keypair"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// unsignedTx builds an unsigned payment from the account without going to horizon
+func unsignedTx(t *testing.T, account string) string {
+	tx, err := build.NewTransaction(build.TransactionParams{
+		SourceAccount:        &build.SimpleAccount{AccountID: account, Sequence: 1},
+		IncrementSequenceNum: true,
+		Operations: []build.Operation{&build.Payment{
+			Destination: account,
+			Amount:      "1",
+			Asset:       build.NativeAsset{},
+		}},
+		BaseFee:    build.MinBaseFee,
+		Timebounds: build.NewTimeout(TxTimeout),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txe, err := tx.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txe
+}
+
+// checkSigned checks that the envelope carries a valid signature of the account
+func checkSigned(t *testing.T, txe string, kp *keypair.Full) {
+	gtx, err := build.TransactionFromXDR(txe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := gtx.Transaction()
+	if len(tx.Signatures()) != 1 {
+		t.Fatalf("expected one signature, got %d", len(tx.Signatures()))
+	}
+	hash, err := tx.Hash(xlm.Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kp.Verify(hash[:], tx.Signatures()[0].Signature)
+	if err != nil {
+		t.Fatalf("invalid signature: %v", err)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	xlm.SetConsts(10, false)
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedSeed, err := aes.Encrypt([]byte(kp.Seed()), "seedpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := NewKeystore(filepath.Join(dir, "keys"))
+	local := NewLocal(keys)
+	err = local.Import("../../etc/passwd", encryptedSeed, "")
+	if err == nil {
+		t.Fatalf("invalid account accepted")
+	}
+	_, err = local.Sign(kp.Address(), "seedpwd", unsignedTx(t, kp.Address()))
+	if err == nil {
+		t.Fatalf("signed without a seed")
+	}
+
+	err = local.Import(kp.Address(), encryptedSeed, "wrongpwd")
+	if err == nil {
+		t.Fatalf("seed imported with the wrong seedpwd")
+	}
+	err = local.Import(kp.Address(), encryptedSeed, "seedpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "keys", kp.Address()+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("seed file readable by others: %v", info.Mode())
+	}
+
+	_, err = local.Sign(kp.Address(), "wrongpwd", unsignedTx(t, kp.Address()))
+	if err == nil {
+		t.Fatalf("signed with the wrong seedpwd")
+	}
+	txe, err := local.Sign(kp.Address(), "seedpwd", unsignedTx(t, kp.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, txe, kp)
+
+	err = local.Verify(kp.Address(), "wrongpwd")
+	if err == nil {
+		t.Fatalf("wrong seedpwd verified")
+	}
+	err = local.Verify(kp.Address(), "seedpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := local.Shares(kp.Address(), "seedpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 3 {
+		t.Fatalf("expected 3 recovery shares, got %d", len(shares))
+	}
+
+	// seeds the signer holds are only replaced by someone who can unlock them
+	rekeyed, err := aes.Encrypt([]byte(kp.Seed()), "newpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Import(kp.Address(), rekeyed, "")
+	if err == nil {
+		t.Fatalf("held seed replaced without a seedpwd")
+	}
+	err = local.Import(kp.Address(), encryptedSeed, "")
+	if err != nil {
+		t.Fatalf("reimporting the held seed failed: %v", err)
+	}
+	rekeyed, err = local.Rekey(kp.Address(), "seedpwd", "newpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Verify(kp.Address(), "seedpwd")
+	if err == nil {
+		t.Fatalf("old seedpwd still unlocks the seed")
+	}
+	_, err = local.Sign(kp.Address(), "newpwd", unsignedTx(t, kp.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = local.Import(kp.Address(), encryptedSeed, "seedpwd")
+	if err == nil {
+		t.Fatalf("held seed replaced with the old seedpwd")
+	}
+	err = local.Import(kp.Address(), encryptedSeed, "newpwd")
+	if err == nil {
+		t.Fatalf("seed imported with a seedpwd that doesn't unlock it")
+	}
+
+	// the seed of one account can't sign for another
+	other, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "keys", other.Address()+".hex"), encryptedSeed, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = local.Sign(other.Address(), "seedpwd", unsignedTx(t, other.Address()))
+	if err == nil {
+		t.Fatalf("signed with the seed of another account")
+	}
+
+	// the daemon signs with its own keystore
+	socket := filepath.Join(dir, "signer.sock")
+	l, err := Listen(socket, 0660, os.Getgid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err = os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Fatalf("socket has the wrong permissions: %v", info.Mode())
+	}
+	go Serve(l, NewLocal(NewKeystore(filepath.Join(dir, "daemonkeys"))))
+
+	daemon := NewDaemon(socket)
+	_, err = daemon.Sign(kp.Address(), "seedpwd", unsignedTx(t, kp.Address()))
+	if err == nil {
+		t.Fatalf("daemon signed without a seed")
+	}
+	err = daemon.Import(kp.Address(), encryptedSeed, "seedpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = daemon.Import(kp.Address(), rekeyed, "")
+	if err == nil {
+		t.Fatalf("daemon replaced a held seed without a seedpwd")
+	}
+	err = daemon.Verify(kp.Address(), "wrongpwd")
+	if err == nil {
+		t.Fatalf("daemon verified the wrong seedpwd")
+	}
+	shares, err = daemon.Shares(kp.Address(), "seedpwd")
+	if err != nil || len(shares) != 3 {
+		t.Fatalf("daemon returned no recovery shares: %v", err)
+	}
+	_, err = daemon.Sign(kp.Address(), "wrongpwd", unsignedTx(t, kp.Address()))
+	if err == nil {
+		t.Fatalf("daemon signed with the wrong seedpwd")
+	}
+	txe, err = daemon.Sign(kp.Address(), "seedpwd", unsignedTx(t, kp.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, txe, kp)
+
+	rekeyed, err = daemon.Rekey(kp.Address(), "seedpwd", "newpwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = daemon.Import(kp.Address(), rekeyed, "")
+	if err != nil {
+		t.Fatalf("reimporting the held seed failed: %v", err)
+	}
+	txe, err = daemon.Sign(kp.Address(), "newpwd", unsignedTx(t, kp.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSigned(t, txe, kp)
+}
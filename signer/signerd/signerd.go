@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	consts "github.com/YaleOpenLab/openx/consts"
+	signer "github.com/YaleOpenLab/openx/signer"
+	flags "github.com/jessevdk/go-flags"
+)
+
+// signerd is the signing daemon. It holds the keystore of encrypted seeds and signs the
+// transactions openx sends it over a unix socket so the openx process never unlocks seeds.
+// Run it as a separate user that openx can't read the keystore of and pass a group openx runs
+// as a member of with -g. Only the daemon user and that group can connect to the socket
+
+var opts struct {
+	Mainnet  bool   `short:"m" description:"Sign transactions for Stellar mainnet"`
+	Socket   string `short:"s" description:"The unix socket to listen on" default:"/tmp/openx-signer.sock"`
+	Keystore string `short:"k" description:"The directory encrypted seeds are stored in, defaults to the openx keystore"`
+	Group    string `short:"g" description:"The group allowed to connect to the socket, defaults to the group of the daemon"`
+	Mode     string `long:"mode" description:"The permissions of the socket" default:"0660"`
+}
+
+func main() {
+	_, err := flags.ParseArgs(&opts, os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	consts.SetConsts(opts.Mainnet)
+	if opts.Keystore == "" {
+		opts.Keystore = consts.KeystoreDir
+	}
+
+	mode, err := strconv.ParseUint(opts.Mode, 8, 32)
+	if err != nil {
+		log.Fatal("invalid socket mode: ", err)
+	}
+	gid := -1
+	if opts.Group != "" {
+		group, err := user.LookupGroup(opts.Group)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gid, err = strconv.Atoi(group.Gid)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	l, err := signer.Listen(opts.Socket, os.FileMode(mode), gid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// remove the socket on shutdown
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	log.Println("signing daemon listening on: ", opts.Socket)
+	err = signer.Serve(l, signer.NewLocal(signer.NewKeystore(opts.Keystore)))
+	log.Println("signing daemon shut down: ", err)
+}
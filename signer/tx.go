@@ -0,0 +1,75 @@
+package signer
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+
+	xlm "github.com/Varunram/essentials/xlm"
+	build "github.com/stellar/go/txnbuild"
+)
+
+// TxTimeout is the number of seconds after which transactions built by openx can't be
+// included in a ledger anymore
+var TxTimeout = int64(300)
+
+// BuildTx builds an unsigned transaction from the account with the passed ops and returns
+// its base64 encoded envelope
+func BuildTx(account string, memo string, ops ...build.Operation) (string, error) {
+	source, err := xlm.ReturnSourceAccountPubkey(account)
+	if err != nil {
+		return "", errors.Wrap(err, "could not load source account")
+	}
+
+	params := build.TransactionParams{
+		SourceAccount:        &source,
+		IncrementSequenceNum: true,
+		Operations:           ops,
+		BaseFee:              build.MinBaseFee,
+		Timebounds:           build.NewTimeout(TxTimeout),
+	}
+	if memo != "" {
+		params.Memo = build.MemoText(memo)
+	}
+
+	tx, err := build.NewTransaction(params)
+	if err != nil {
+		return "", errors.Wrap(err, "could not build transaction")
+	}
+	return tx.Base64()
+}
+
+// Submit broadcasts a signed transaction envelope and returns the hash of the transaction
+func Submit(txe string) (string, error) {
+	resp, err := xlm.TestNetClient.SubmitTransactionXDR(txe)
+	if err != nil {
+		return "", errors.Wrap(err, "could not submit transaction to horizon")
+	}
+	log.Printf("Propagated Transaction: %s, sequence: %d\n", resp.Hash, resp.Ledger)
+	return resp.Hash, nil
+}
+
+// SignTx has the default signer sign the transaction envelope with the seed of the account
+func SignTx(account string, seedpwd string, txe string) (string, error) {
+	txe, err := current().Sign(account, seedpwd, txe)
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign transaction")
+	}
+	return txe, nil
+}
+
+// SubmitTx builds a transaction from the account with the passed ops, has the default signer
+// sign it and broadcasts it
+func SubmitTx(account string, seedpwd string, memo string, ops ...build.Operation) (string, error) {
+	txe, err := BuildTx(account, memo, ops...)
+	if err != nil {
+		return "", err
+	}
+
+	txe, err = SignTx(account, seedpwd, txe)
+	if err != nil {
+		return "", err
+	}
+
+	return Submit(txe)
+}
@@ -0,0 +1,10 @@
+// +build !windows
+
+package signer
+
+import "syscall"
+
+// umask sets the file mode creation mask of the process and returns the previous one
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,6 @@
+package signer
+
+// umask is a no-op on windows which has no file mode creation mask
+func umask(mask int) int {
+	return 0
+}
@@ -7,6 +7,7 @@ import (
 
 	"log"
 	"os"
+	"strconv"
 
 	consts "github.com/YaleOpenLab/openx/consts"
 	database "github.com/YaleOpenLab/openx/database"
@@ -33,13 +34,22 @@ import (
 // the backend server powering the openx platform of platforms
 
 var opts struct {
-	Insecure  bool `short:"i" description:"Start the API using http. Not recommended"`
-	Port      int  `short:"p" description:"The port on which the server runs on" default:"0"`
-	Simulate  bool `short:"t" description:"Simulate the test database with demo values (last updated: April 2019)"`
-	Mainnet   bool `short:"m" description:"Switch mainnet mode on"`
-	Trustline bool `short:"x" description:"create trustlines from platform seed to anchorUSD"`
-	Rescue    bool `short:"r" description:"start rescue mode"`
-	EnvRead   bool `short:"e" description:"read values from env files"`
+	Insecure     bool   `short:"i" description:"Start the API using http. Not recommended"`
+	Port         int    `short:"p" description:"The port on which the server runs on" default:"0"`
+	Simulate     bool   `short:"t" description:"Simulate the test database with demo values (last updated: April 2019)"`
+	Mainnet      bool   `short:"m" description:"Switch mainnet mode on"`
+	Trustline    bool   `short:"x" description:"create trustlines from platform seed to anchorUSD"`
+	Rescue       bool   `short:"r" description:"start rescue mode"`
+	EnvRead      bool   `short:"e" description:"read values from env files"`
+	Reindex      bool   `long:"reindex" description:"rebuild the username, email and public key indexes and exit"`
+	Migrate      bool   `long:"migrate" description:"run pending database migrations and exit"`
+	DryRun       bool   `long:"dry-run" description:"report what pending migrations would change without applying them, used with --migrate"`
+	Backup       string `long:"backup" description:"save a snapshot of the database to the given file and exit"`
+	Restore      string `long:"restore" description:"validate the snapshot in the given file, restore the database from it and exit"`
+	Passphrase   string `long:"passphrase" description:"passphrase to encrypt or decrypt snapshots with, used with --backup and --restore"`
+	RotateData   bool   `long:"rotate-datakey" description:"encrypt sensitive user data with a new data key and exit"`
+	RotateMaster bool   `long:"rotate-masterkey" description:"generate a new master key, rewrap the data keys with it and exit"`
+	VerifyAudit  bool   `long:"verify-audit" description:"verify that the audit log hasn't been tampered with and exit"`
 }
 
 // ParseConfFile parses stuff from the config file provided
@@ -109,6 +119,10 @@ func main() {
 		}
 	}
 
+	// run migrations explicitly below instead of while loading. Restored snapshots are
+	// migrated the next time openx starts
+	loader.AutoMigrate = !opts.Migrate && opts.Restore == ""
+
 	if consts.Mainnet {
 		err = loader.Mainnet()
 		if err != nil {
@@ -126,15 +140,20 @@ func main() {
 		var admin database.User
 		admin.Index = 1
 		admin.Username = "admin"
-		admin.Pwhash = utils.SHA3hash("password")
-		admin.AccessToken = make(map[string]int64)
-		admin.AccessToken["pmkjMEnyeUpdTyhdHElkBExEKeLIlYft"] = utils.Unix() + 10000000000
-		admin.Admin = true
+		err = admin.SetPassword(utils.SHA3hash("password"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		admin.Roles = []string{database.RoleSuperAdmin}
 		admin.Conf = true
 		err = admin.Save()
 		if err != nil {
 			log.Fatal(err)
 		}
+		err = admin.ImportSession("pmkjMEnyeUpdTyhdHElkBExEKeLIlYft", "testnet", 10000000000)
+		if err != nil {
+			log.Fatal(err)
+		}
 		err = admin.GenKeys("x")
 		if err != nil {
 			log.Fatal(err)
@@ -142,6 +161,85 @@ func main() {
 		go xlm.GetXLM(admin.StellarWallet.PublicKey)
 	}
 
+	if opts.Reindex {
+		count, err := database.RebuildUserIndexes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("rebuilt indexes for users: ", count)
+		os.Exit(0)
+	}
+
+	if opts.Backup != "" {
+		err = database.SaveSnapshot(opts.Backup, opts.Passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("saved database snapshot to: ", opts.Backup)
+		os.Exit(0)
+	}
+
+	if opts.Restore != "" {
+		err = database.RestoreSnapshotFile(opts.Restore, opts.Passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("restored database from snapshot: ", opts.Restore)
+		err = database.AppendAudit(0, "cli", database.AuditRestore, opts.Restore, "", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if opts.RotateData {
+		id, err := database.RotateDataKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = database.AppendAudit(0, "cli", database.AuditRotateKey, "datakey", strconv.Itoa(id), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		count, err := database.ReencryptUsers()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("reencrypted users with new data key: ", count)
+		os.Exit(0)
+	}
+
+	if opts.RotateMaster {
+		err = database.RotateMasterKeyFile(consts.MasterKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = database.AppendAudit(0, "cli", database.AuditRotateKey, "masterkey", "", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("rotated master key, back up the new key file: ", consts.MasterKeyFile)
+		os.Exit(0)
+	}
+
+	if opts.VerifyAudit {
+		count, err := database.VerifyAudit()
+		if err != nil {
+			log.Fatal("audit log verification failed after ", count, " entries: ", err)
+		}
+		log.Println("verified audit log entries: ", count)
+		os.Exit(0)
+	}
+
+	if opts.Migrate {
+		reports, err := database.RunMigrations(opts.DryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		database.LogMigrationReports(reports, opts.DryRun)
+		os.Exit(0)
+	}
+
 	if opts.Rescue {
 		RescueMode()
 		os.Exit(1)
@@ -159,5 +257,8 @@ func main() {
 	  ╚═════╝ ╚═╝     ╚══════╝╚═╝  ╚═══╝╚═╝  ╚═╝
 		`)
 
+	loader.StartSnapshots()
+	go rpc.PollTransfers()
+	go database.ScheduleSessionSweeps()
 	rpc.StartServer(port, insecure)
 }